@@ -0,0 +1,89 @@
+package app
+
+import (
+  "github.com/gin-gonic/gin"
+  "github.com/gin-contrib/sessions"
+)
+
+// Account is a human that logged in on this device, offered by the account chooser.
+type Account struct {
+  Id string
+  Email string
+  Name string
+}
+
+// AccountChooser decides which accounts are remembered on the device, see login.accounts in the configuration.
+type AccountChooser struct {
+  Enabled bool
+  Max int // Most recently used accounts kept
+  For int // Seconds the device remembers the accounts
+}
+
+const sessionAccountsKey = "accounts"
+
+// ReadAccounts returns the accounts remembered on the device, most recently used first. The cookie is signed, so the list is only what this ui wrote.
+func ReadAccounts(env *Environment, c *gin.Context) []Account {
+  if env.AccountChooser.Enabled == false {
+    return nil
+  }
+
+  session := sessions.DefaultMany(c, env.Constants.SessionAccountsStoreKey)
+  accounts, ok := session.Get(sessionAccountsKey).([]Account)
+  if ok == false {
+    return nil
+  }
+  return accounts
+}
+
+// FindAccount returns the remembered account with the id.
+func FindAccount(env *Environment, c *gin.Context, id string) (Account, bool) {
+  for _, account := range ReadAccounts(env, c) {
+    if account.Id == id {
+      return account, true
+    }
+  }
+  return Account{}, false
+}
+
+// RememberAccount puts the account first in the list remembered on the device, dropping the least recently used beyond the max.
+func RememberAccount(env *Environment, c *gin.Context, account Account) error {
+  if env.AccountChooser.Enabled == false {
+    return nil
+  }
+
+  accounts := []Account{ account }
+  for _, a := range ReadAccounts(env, c) {
+    if a.Id != account.Id && len(accounts) < env.AccountChooser.Max {
+      accounts = append(accounts, a)
+    }
+  }
+  return saveAccounts(env, c, accounts)
+}
+
+// ForgetAccounts removes every account remembered on the device.
+func ForgetAccounts(env *Environment, c *gin.Context) error {
+  return saveAccounts(env, c, nil)
+}
+
+func saveAccounts(env *Environment, c *gin.Context, accounts []Account) error {
+  session := sessions.DefaultMany(c, env.Constants.SessionAccountsStoreKey)
+
+  // Outlives the other sessions, the device remembers the accounts until they are forgotten or expire.
+  maxAge := env.AccountChooser.For
+  if len(accounts) == 0 {
+    maxAge = -1
+  }
+  session.Options(sessions.Options{
+    MaxAge: maxAge,
+    Path: "/",
+    Secure: !env.Development,
+    HttpOnly: true,
+  })
+
+  if len(accounts) == 0 {
+    session.Delete(sessionAccountsKey)
+  } else {
+    session.Set(sessionAccountsKey, accounts)
+  }
+  return session.Save()
+}
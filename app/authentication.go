@@ -9,7 +9,7 @@ import (
   "github.com/gin-gonic/gin"
   "golang.org/x/oauth2"
 
-  "github.com/opensentry/idpui/config"
+  "github.com/opensentry/idpui/utils"
 )
 
 // # Authentication and Authorization
@@ -20,8 +20,14 @@ import (
 // 4. Is the user or client giving the grants in the access token authorized to operate the scopes granted?
 // 5. Is the access token revoked?
 
-func createAuthorizationCodeExchangeUrl(req *http.Request) (exchangeUrl string, err error) {
-  baseUrl := config.GetString("idpui.public.url")
+func createAuthorizationCodeExchangeUrl(env *Environment, req *http.Request) (exchangeUrl string, err error) {
+  var baseUrl string
+  if env.Endpoints.Idpui.Public != nil {
+    baseUrl = env.Endpoints.Idpui.Public.String()
+  } else {
+    // Not configured, use what the client used to reach us. Forwarded headers are only trusted from serve.proxy.trusted
+    baseUrl = utils.GetRequestBaseUrl(req, env.TrustedProxies).String()
+  }
 
   // allowedRedirectUris := []string{
   //   baseUrl + config.GetString("idpui.public.endpoints.login"),
@@ -47,7 +53,7 @@ func createAuthorizationCodeExchangeUrl(req *http.Request) (exchangeUrl string,
   return exchangeUrl, nil
 }
 
-func createPostRedirectUri(requestedUrl string) (redirectTo string, err error) {
+func createPostRedirectUri(env *Environment, requestedUrl string) (redirectTo string, err error) {
 
   // Do not allowed landing on any urls that start the authentication process as it can create infinite loops.
   /*
@@ -62,10 +68,8 @@ func createPostRedirectUri(requestedUrl string) (redirectTo string, err error) {
   */
 
 
-  loginUrl, err := url.Parse(config.GetString("idpui.public.endpoints.login"))
-  if err != nil {
-    return "", err
-  }
+  // The request reached the ui on the route, without the path prefix of idpui.public.url
+  loginUrl := &url.URL{ Path:env.Endpoints.Idpui.RoutePath(env.Endpoints.Idpui.Login) }
 
   // Redirect to after successful authentication
   wantUrl, err := url.Parse(requestedUrl)
@@ -80,9 +84,9 @@ func createPostRedirectUri(requestedUrl string) (redirectTo string, err error) {
   wantUrl.RawQuery = q.Encode()
 
   if strings.EqualFold(wantUrl.String(), loginUrl.String()) {
-    redirectTo = config.GetString("idpui.public.endpoints.root") // Do not allow landing login controller after authentication as it will create an inf. loop.
+    redirectTo = env.Endpoints.Idpui.Root.RequestURI() // Do not allow landing login controller after authentication as it will create an inf. loop.
   } else {
-    redirectTo = requestedUrl
+    redirectTo = env.Endpoints.Idpui.PublicPath(requestedUrl)
   }
 
   return redirectTo, nil
@@ -90,7 +94,7 @@ func createPostRedirectUri(requestedUrl string) (redirectTo string, err error) {
 
 func StartAuthenticationSession(env *Environment, c *gin.Context, oauth2Config *oauth2.Config, idTokenHint string, state string) (authorizationCodeUrl *url.URL, err error) {
 
-  redirectTo, err := createPostRedirectUri(c.Request.RequestURI)
+  redirectTo, err := createPostRedirectUri(env, c.Request.RequestURI)
   if err != nil {
     return nil, err
   }
@@ -130,8 +134,13 @@ func StartAuthenticationSession(env *Environment, c *gin.Context, oauth2Config *
     q.Add("id_token_hint", idTokenHint)
     authorizationCodeUrl.RawQuery = q.Encode()
   }
-  // q.Add("prompt", "login") // options are none, login
-  // q.Add("max_age", ?)
+
+  // Hydra asks for credentials again when the login is older than the page allows, see RequireAuthentication.
+  if age := maxAge(FetchAuthenticationRequirement(env, c)); age != "" {
+    q := authorizationCodeUrl.Query()
+    q.Set("max_age", age)
+    authorizationCodeUrl.RawQuery = q.Encode()
+  }
 
   return authorizationCodeUrl, err
 }
\ No newline at end of file
@@ -0,0 +1,244 @@
+package app
+
+import (
+  "fmt"
+  "time"
+  "errors"
+  "net/http"
+  "crypto/rand"
+  "encoding/base64"
+  "github.com/gin-gonic/gin"
+  "github.com/gofrs/uuid"
+  "gopkg.in/go-playground/validator.v9"
+  idp "github.com/opensentry/idp/client"
+
+  bulky "github.com/charmixer/bulky/client"
+
+  "github.com/opensentry/idpui/directory"
+)
+
+// # Authenticators
+// The credentials posted to the login form are verified by the authenticators of login.authenticators, in order. The first to authenticate the human wins, so a human with a password in the idp and an account in the directory can log in with either.
+//  - IdpAuthenticator: the password of the human in the idp. The idp continues the login with email confirmation or the second factor when the human requires it.
+//  - LdapAuthenticator: a bind to the directory, see directory.Ldap. The ui accepts the login itself for the human matched or provisioned in the idp.
+
+var (
+  ErrNotSignedInHuman = errors.New("Not the signed in user") // Hydra asks to confirm the human already signed in, see HydraLoginRequest.Skip
+  ErrSecondFactorUnavailable = errors.New("Second factor required") // The idp only asks for the second factor after its own password check
+)
+
+// Authentication is the human the credentials are for, with the response of the idp as it would authenticate them. RedirectTo is empty when the ui accepts the login itself.
+type Authentication struct {
+  Human idp.Human
+  Response idp.CreateHumansAuthenticateResponse
+}
+
+type Authenticator interface {
+  // Authenticate returns nil when the credentials are not valid for the authenticator.
+  Authenticate(env *Environment, c *gin.Context, loginRequest *HydraLoginRequest, identifier string, password string) (*Authentication, error)
+}
+
+// Authenticators tries each authenticator in order. Errors stop the chain, so a broken authenticator is never mistaken for a wrong password.
+type Authenticators []Authenticator
+
+func (as Authenticators) Authenticate(env *Environment, c *gin.Context, loginRequest *HydraLoginRequest, identifier string, password string) (*Authentication, error) {
+  for _, a := range as {
+    auth, err := a.Authenticate(env, c, loginRequest, identifier, password)
+    if err != nil || auth != nil {
+      return auth, err
+    }
+  }
+  return nil, nil
+}
+
+// IdpAuthenticator looks the human up by the identifier, see ReadHumanByIdentifier, and has the idp verify the password.
+type IdpAuthenticator struct {}
+
+func (IdpAuthenticator) Authenticate(env *Environment, c *gin.Context, loginRequest *HydraLoginRequest, identifier string, password string) (*Authentication, error) {
+  idpClient := IdpClientUsingClientCredentials(env, c)
+
+  human, err := ReadHumanByIdentifier(env, idpClient, identifier)
+  if err != nil || human == nil {
+    return nil, err
+  }
+
+  // Hydra only accepts the human already signed in. The password of another human is checked without the challenge, so the idp accepts nothing, and only a correct password tells who is not signed in.
+  challenge := loginRequest.Challenge
+  notSignedIn := loginRequest.Skip && human.Id != loginRequest.Subject
+  if notSignedIn {
+    challenge = ""
+  }
+
+  authenticateRequest := []idp.CreateHumansAuthenticateRequest{{
+    Id: human.Id,
+    Password: password,
+    Challenge: challenge,
+  }}
+  _, responses, err := env.IdpApi.CreateHumansAuthenticate(idpClient, env.Endpoints.Idp.HumansAuthenticate.String(), authenticateRequest)
+  if err != nil {
+    return nil, err
+  }
+  if responses == nil {
+    return nil, nil
+  }
+
+  var auth idp.CreateHumansAuthenticateResponse
+  status, _ := bulky.Unmarshal(0, responses, &auth)
+  if status != http.StatusOK || auth.Authenticated == false {
+    return nil, nil
+  }
+  if notSignedIn {
+    return nil, ErrNotSignedInHuman
+  }
+  return &Authentication{ Human:*human, Response:auth }, nil
+}
+
+// LdapAuthenticator verifies the password with the directory. The entry is matched to the human in the idp by username, so configuring a directory trusts it with every account whose username it has an entry for. Matching by email as well trusts it with those accounts too, see ldap.matchEmail.
+type LdapAuthenticator struct {
+  Directory *directory.Ldap
+  Provision bool // Create humans for entries that match none, see ldap.provision
+  MatchEmail bool // Match entries to humans with the same confirmed email, see ldap.matchEmail
+}
+
+func (a LdapAuthenticator) Authenticate(env *Environment, c *gin.Context, loginRequest *HydraLoginRequest, identifier string, password string) (*Authentication, error) {
+  entry, err := a.Directory.Authenticate(identifier, password)
+  if err != nil || entry == nil {
+    return nil, err
+  }
+
+  idpClient := IdpClientUsingClientCredentials(env, c)
+
+  human, err := a.matchHuman(env, idpClient, entry)
+  if err != nil {
+    return nil, err
+  }
+
+  if human == nil {
+    if a.Provision == false {
+      return nil, nil
+    }
+
+    // The email belongs to a human the entry did not match, another human with it would take over the email
+    if entry.Email != "" {
+      owner, err := ReadHuman(env, idpClient, idp.ReadHumansRequest{ Email:entry.Email })
+      if err != nil || owner != nil {
+        return nil, err
+      }
+    }
+
+    human, err = a.provisionHuman(env, idpClient, entry)
+    if err != nil {
+      return nil, err
+    }
+  }
+
+  if loginRequest.Skip && human.Id != loginRequest.Subject {
+    return nil, ErrNotSignedInHuman
+  }
+
+  if human.AllowLogin == false {
+    return nil, nil
+  }
+
+  if human.TotpRequired {
+    return nil, ErrSecondFactorUnavailable
+  }
+
+  return &Authentication{
+    Human: *human,
+    Response: idp.CreateHumansAuthenticateResponse{
+      Id: human.Id,
+      Authenticated: true,
+      IdentityExists: true,
+    },
+  }, nil
+}
+
+// matchHuman returns the human of the entry, nil when none matches. An email the human never confirmed proves nothing, so it does not match even when MatchEmail is set.
+func (a LdapAuthenticator) matchHuman(env *Environment, idpClient *idp.IdpClient, entry *directory.Entry) (*idp.Human, error) {
+  if entry.Username != "" {
+    human, err := ReadHuman(env, idpClient, idp.ReadHumansRequest{ Username:entry.Username })
+    if err != nil || human != nil {
+      return human, err
+    }
+  }
+
+  if a.MatchEmail == false || entry.Email == "" {
+    return nil, nil
+  }
+
+  human, err := ReadHuman(env, idpClient, idp.ReadHumansRequest{ Email:entry.Email })
+  if err != nil || human == nil || human.EmailConfirmedAt == 0 {
+    return nil, err
+  }
+  return human, nil
+}
+
+// provisionHuman creates the human of the entry. The directory vouches for the email, and the random password is only known by the idp, so the human logs in with the directory until they recover a password of their own.
+func (a LdapAuthenticator) provisionHuman(env *Environment, idpClient *idp.IdpClient, entry *directory.Entry) (*idp.Human, error) {
+  id, err := uuid.NewV4()
+  if err != nil {
+    return nil, err
+  }
+
+  secret := make([]byte, 32)
+  _, err = rand.Read(secret)
+  if err != nil {
+    return nil, err
+  }
+
+  var emailConfirmedAt int64
+  if entry.Email != "" {
+    emailConfirmedAt = time.Now().Unix()
+  }
+
+  request := []idp.CreateHumansRequest{{
+    Id: id.String(),
+    Password: base64.RawURLEncoding.EncodeToString(secret),
+    Username: entry.Username,
+    Email: entry.Email,
+    Name: entry.Name,
+    AllowLogin: true,
+    EmailConfirmedAt: emailConfirmedAt,
+  }}
+  _, responses, err := env.IdpApi.CreateHumans(idpClient, env.Endpoints.Idp.HumansCollection.String(), request)
+  if err != nil {
+    return nil, err
+  }
+
+  var human idp.CreateHumansResponse
+  status, _ := bulky.Unmarshal(0, responses, &human)
+  if status != http.StatusOK {
+    return nil, fmt.Errorf("Provisioning %s failed with status %d", entry.Dn, status)
+  }
+
+  h := idp.Human(human)
+  return &h, nil
+}
+
+// ReadHumanByIdentifier reads the human by the email, or by the username when it is not an email and login.username is enabled.
+func ReadHumanByIdentifier(env *Environment, idpClient *idp.IdpClient, identifier string) (*idp.Human, error) {
+  request := idp.ReadHumansRequest{ Email:identifier }
+  if env.LoginPolicy.Username && validator.New().Var(identifier, "email") != nil {
+    request = idp.ReadHumansRequest{ Username:identifier }
+  }
+  return ReadHuman(env, idpClient, request)
+}
+
+// ReadHuman returns the first human matching the request, nil when none does.
+func ReadHuman(env *Environment, idpClient *idp.IdpClient, request idp.ReadHumansRequest) (*idp.Human, error) {
+  _, responses, err := env.IdpApi.ReadHumans(idpClient, env.Endpoints.Idp.HumansCollection.String(), []idp.ReadHumansRequest{ request })
+  if err != nil {
+    return nil, err
+  }
+  if responses == nil {
+    return nil, nil
+  }
+
+  var humans idp.ReadHumansResponse
+  status, _ := bulky.Unmarshal(0, responses, &humans)
+  if status != http.StatusOK || len(humans) == 0 {
+    return nil, nil
+  }
+  return &humans[0], nil
+}
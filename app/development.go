@@ -0,0 +1,134 @@
+package app
+
+import (
+  "bytes"
+  "fmt"
+  "html/template"
+  "net/http"
+  "runtime/debug"
+  "github.com/gin-gonic/gin"
+  "github.com/gin-gonic/gin/render"
+  "github.com/sirupsen/logrus"
+)
+
+// # Development mode
+// Everything in here is only used when the application is started with --dev. It must never be enabled in production as it exposes internals of the application to the browser.
+
+// DevelopmentHTMLRender re-parses the templates matching Glob on every render, so changes to views/* are visible on the next request without a restart.
+type DevelopmentHTMLRender struct {
+  Glob string
+  FuncMap template.FuncMap
+}
+
+func (r DevelopmentHTMLRender) Instance(name string, data interface{}) render.Render {
+  return developmentHTML{ Glob:r.Glob, FuncMap:r.FuncMap, Name:name, Data:data }
+}
+
+type developmentHTML struct {
+  Glob string
+  FuncMap template.FuncMap
+  Name string
+  Data interface{}
+}
+
+// Render parses and executes the template into a buffer before anything is written, so a failing template does not leave a half written page behind the error page.
+func (r developmentHTML) Render(w http.ResponseWriter) error {
+  funcMap := r.FuncMap
+  if funcMap == nil {
+    funcMap = template.FuncMap{}
+  }
+
+  t, err := template.New("").Funcs(funcMap).ParseGlob(r.Glob)
+  if err != nil {
+    return err
+  }
+
+  var buf bytes.Buffer
+  err = t.ExecuteTemplate(&buf, r.Name, r.Data)
+  if err != nil {
+    return err
+  }
+
+  r.WriteContentType(w)
+  _, err = w.Write(buf.Bytes())
+  return err
+}
+
+func (r developmentHTML) WriteContentType(w http.ResponseWriter) {
+  header := w.Header()
+  if val := header["Content-Type"]; len(val) == 0 {
+    header["Content-Type"] = []string{"text/html; charset=utf-8"}
+  }
+}
+
+var developmentErrorTemplate = template.Must(template.New("error").Parse(`<html>
+<head>
+  <meta charset="utf-8">
+  <title>{{ .status }} {{ .method }} {{ .path }}</title>
+  <style>
+    body { font-family: monospace; margin: 2em; }
+    h1 { color: #db2828; }
+    pre { background: #f8f8f8; border: 1px solid #ddd; padding: 1em; overflow: auto; }
+  </style>
+</head>
+<body>
+  <h1>{{ .status }} {{ .method }} {{ .path }}</h1>
+  <p>Handler: <strong>{{ .handler }}</strong></p>
+  <p>Request id: {{ .requestId }}</p>
+  {{ range .errors }}<pre>{{ . }}</pre>{{ end }}
+  {{ if .stack }}<h2>Stack</h2><pre>{{ .stack }}</pre>{{ end }}
+</body>
+</html>
+`))
+
+// DevelopmentErrorPages replaces gin.Recovery in development mode. Panics (this includes template parse and execution errors) and errors registered on the context are rendered as a detailed error page naming the failing handler.
+func DevelopmentErrorPages(env *Environment) gin.HandlerFunc {
+  fn := func(c *gin.Context) {
+
+    defer func() {
+      if r := recover(); r != nil {
+        stack := string(debug.Stack())
+
+        env.Logger.WithFields(logrus.Fields{
+          "func": "DevelopmentErrorPages",
+          "handler": c.HandlerName(),
+        }).Error(fmt.Sprintf("%v", r))
+
+        renderDevelopmentError(c, http.StatusInternalServerError, []string{ fmt.Sprintf("%v", r) }, stack)
+        c.Abort()
+      }
+    }()
+
+    c.Next()
+
+    if len(c.Errors) > 0 && c.Writer.Written() == false {
+      errors := []string{}
+      for _, e := range c.Errors {
+        errors = append(errors, e.Error())
+      }
+      renderDevelopmentError(c, c.Writer.Status(), errors, "")
+    }
+  }
+  return gin.HandlerFunc(fn)
+}
+
+func renderDevelopmentError(c *gin.Context, status int, errors []string, stack string) {
+  requestId, _ := c.Get("RequestId")
+
+  var buf bytes.Buffer
+  err := developmentErrorTemplate.Execute(&buf, gin.H{
+    "status": status,
+    "method": c.Request.Method,
+    "path": c.Request.URL.RequestURI(),
+    "handler": c.HandlerName(),
+    "requestId": requestId,
+    "errors": errors,
+    "stack": stack,
+  })
+  if err != nil {
+    buf.Reset()
+    buf.WriteString(err.Error())
+  }
+
+  c.Data(status, "text/html; charset=utf-8", buf.Bytes())
+}
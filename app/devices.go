@@ -0,0 +1,85 @@
+package app
+
+import (
+  "time"
+  "github.com/gin-gonic/gin"
+  "github.com/gin-contrib/sessions"
+  "github.com/gofrs/uuid"
+
+  "github.com/opensentry/idpui/devices"
+  "github.com/opensentry/idpui/utils"
+)
+
+const sessionDevicesKey = "devices"
+
+// TrustDevice trusts the device of the request for the human, see login.trustedDevices. The device is remembered by id, per human, in a signed cookie.
+func TrustDevice(env *Environment, c *gin.Context, humanId string) error {
+  id, err := uuid.NewV4()
+  if err != nil {
+    return err
+  }
+
+  ip, err := utils.GetForwardedForIpData(c.Request, env.TrustedProxies)
+  if err != nil {
+    return err
+  }
+
+  now := time.Now()
+  err = env.TrustedDevices.CreateDevice(devices.Device{
+    Id: id.String(),
+    HumanId: humanId,
+    UserAgent: c.Request.UserAgent(),
+    Ip: ip.Ip,
+    CreatedAt: now.Unix(),
+    ExpiresAt: now.Unix() + int64(env.LoginPolicy.TrustDevicesFor),
+  })
+  if err != nil {
+    return err
+  }
+
+  trusted := map[string]string{ humanId:id.String() }
+  for h, d := range readDeviceIds(env, c) {
+    if h != humanId {
+      trusted[h] = d
+    }
+  }
+
+  session := sessions.DefaultMany(c, env.Constants.SessionDevicesStoreKey)
+
+  // Outlives the other sessions, as long as the device stays trusted.
+  session.Options(sessions.Options{
+    MaxAge: env.LoginPolicy.TrustDevicesFor,
+    Path: "/",
+    Secure: !env.Development,
+    HttpOnly: true,
+  })
+  session.Set(sessionDevicesKey, trusted)
+  return session.Save()
+}
+
+// FindTrustedDevice returns the device of the request when the human trusts it, nil when the human does not, or the trust expired or was revoked.
+func FindTrustedDevice(env *Environment, c *gin.Context, humanId string) (*devices.Device, error) {
+  if env.LoginPolicy.TrustDevices == false {
+    return nil, nil
+  }
+
+  id, exists := readDeviceIds(env, c)[humanId]
+  if exists == false {
+    return nil, nil
+  }
+
+  device, err := env.TrustedDevices.FindDevice(id)
+  if err != nil || device == nil {
+    return nil, err
+  }
+  if device.HumanId != humanId || device.ExpiresAt <= time.Now().Unix() {
+    return nil, nil
+  }
+  return device, nil
+}
+
+func readDeviceIds(env *Environment, c *gin.Context) map[string]string {
+  session := sessions.DefaultMany(c, env.Constants.SessionDevicesStoreKey)
+  trusted, _ := session.Get(sessionDevicesKey).(map[string]string)
+  return trusted
+}
@@ -0,0 +1,225 @@
+package app
+
+import (
+  "fmt"
+  "strings"
+  "net/url"
+
+  "github.com/opensentry/idpui/config"
+)
+
+// # Endpoints
+// Every url the application talks to or links to is built once on startup from the configuration, verified and stored here. Handlers and templates use these instead of concatenating config strings per request.
+
+type Endpoints struct {
+  Hydra HydraEndpoints
+  Idp IdpEndpoints
+  Idpui IdpuiEndpoints
+  Meui MeuiEndpoints
+}
+
+type HydraEndpoints struct {
+  Public *url.URL
+  Admin *url.URL
+}
+
+type IdpEndpoints struct {
+  Public *url.URL
+
+  HumansCollection *url.URL
+  HumansAuthenticate *url.URL
+  HumansPassword *url.URL
+  HumansTotp *url.URL
+  HumansEmailChange *url.URL
+  HumansLogout *url.URL
+  HumansRecover *url.URL
+  HumansRecoverVerification *url.URL
+  HumansDeleteVerification *url.URL
+
+  ChallengesCollection *url.URL
+  ChallengesVerify *url.URL
+
+  InvitesCollection *url.URL
+  InvitesClaim *url.URL
+}
+
+// IdpuiEndpoints are absolute when idpui.public.url is configured, otherwise relative to the host the request came in on.
+type IdpuiEndpoints struct {
+  Public *url.URL
+
+  Root *url.URL
+  Login *url.URL
+  AccountsForget *url.URL
+  LoginLink *url.URL
+  LoginLinkOpen *url.URL
+  VerifyEmail *url.URL
+  VerifyEmailSend *url.URL
+  FederatedLogin *url.URL
+  FederatedCallback *url.URL
+  Logout *url.URL
+  Claim *url.URL
+  Register *url.URL
+  Recover *url.URL
+  RecoverPassword *url.URL
+  Password *url.URL
+  PasswordStrength *url.URL
+  Totp *url.URL
+  Identities *url.URL
+  IdentitiesLink *url.URL
+  IdentitiesUnlink *url.URL
+  TrustedDevices *url.URL
+  TrustedDevicesRevoke *url.URL
+  Sessions *url.URL
+  SessionsRevoke *url.URL
+  Device *url.URL
+  DeviceConfirm *url.URL
+  DeviceDone *url.URL
+  Delete *url.URL
+  EmailChange *url.URL
+  EmailChangeConfirm *url.URL
+  SeeYouLater *url.URL
+}
+
+type MeuiEndpoints struct {
+  Public *url.URL
+
+  Profile *url.URL
+}
+
+// AbsoluteUrl returns the endpoint for links that leave the ui, mailed links and the redirect_uri of upstream providers. These are never derived from the Host header of the request, so idpui.public.url is required for the features that use them.
+func AbsoluteUrl(u *url.URL) (string, error) {
+  if u.IsAbs() == false {
+    return "", fmt.Errorf("%s is not absolute, configure idpui.public.url", u)
+  }
+  return u.String(), nil
+}
+
+type endpointsBuilder struct {
+  errors config.ValidationErrors
+}
+
+func (b *endpointsBuilder) absolute(key string, base string) *url.URL {
+  u, err := url.Parse(base)
+  if err != nil {
+    b.errors = append(b.errors, fmt.Sprintf("%s: %s", key, err.Error()))
+    return &url.URL{}
+  }
+  if u.IsAbs() == false || u.Host == "" {
+    b.errors = append(b.errors, fmt.Sprintf("%s: Not an absolute url", key))
+  }
+  return u
+}
+
+// join keeps the semantics of base + endpoint string concatenation, so a base with a path prefix is retained.
+func (b *endpointsBuilder) join(key string, base string, endpoint string) *url.URL {
+  if endpoint == "" {
+    b.errors = append(b.errors, fmt.Sprintf("%s: Required", key))
+    return &url.URL{}
+  }
+  u, err := url.Parse(base + endpoint)
+  if err != nil {
+    b.errors = append(b.errors, fmt.Sprintf("%s: %s", key, err.Error()))
+    return &url.URL{}
+  }
+  return u
+}
+
+// NewEndpoints builds and verifies the registry from configuration. All problems are reported at once.
+func NewEndpoints(cfg *config.Configuration) (*Endpoints, error) {
+  b := &endpointsBuilder{}
+
+  idp := cfg.Idp.Public.Url
+  idpe := cfg.Idp.Public.Endpoints
+
+  idpui := cfg.Idpui.Public.Url
+  idpuie := cfg.Idpui.Public.Endpoints
+
+  meui := cfg.Meui.Public.Url
+
+  var idpuiPublic *url.URL
+  if idpui != "" {
+    idpuiPublic = b.absolute("idpui.public.url", idpui)
+  }
+
+  e := &Endpoints{
+    Hydra: HydraEndpoints{
+      Public: b.absolute("hydra.public.url", cfg.Hydra.Public.Url),
+      Admin: b.absolute("hydra.admin.url", cfg.Hydra.Admin.Url),
+    },
+    Idp: IdpEndpoints{
+      Public: b.absolute("idp.public.url", idp),
+      HumansCollection: b.join("idp.public.endpoints.humans.collection", idp, idpe.Humans.Collection),
+      HumansAuthenticate: b.join("idp.public.endpoints.humans.authenticate", idp, idpe.Humans.Authenticate),
+      HumansPassword: b.join("idp.public.endpoints.humans.password", idp, idpe.Humans.Password),
+      HumansTotp: b.join("idp.public.endpoints.humans.totp", idp, idpe.Humans.Totp),
+      HumansEmailChange: b.join("idp.public.endpoints.humans.emailchange", idp, idpe.Humans.Emailchange),
+      HumansLogout: b.join("idp.public.endpoints.humans.logout", idp, idpe.Humans.Logout),
+      HumansRecover: b.join("idp.public.endpoints.humans.recover", idp, idpe.Humans.Recover),
+      HumansRecoverVerification: b.join("idp.public.endpoints.humans.recoververification", idp, idpe.Humans.Recoververification),
+      HumansDeleteVerification: b.join("idp.public.endpoints.humans.deleteverification", idp, idpe.Humans.Deleteverification),
+      ChallengesCollection: b.join("idp.public.endpoints.challenges.collection", idp, idpe.Challenges.Collection),
+      ChallengesVerify: b.join("idp.public.endpoints.challenges.verify", idp, idpe.Challenges.Verify),
+      InvitesCollection: b.join("idp.public.endpoints.invites.collection", idp, idpe.Invites.Collection),
+      InvitesClaim: b.join("idp.public.endpoints.invites.claim", idp, idpe.Invites.Claim),
+    },
+    Idpui: IdpuiEndpoints{
+      Public: idpuiPublic,
+      Root: b.join("idpui.public.endpoints.root", idpui, idpuie.Root),
+      Login: b.join("idpui.public.endpoints.login", idpui, idpuie.Login),
+      AccountsForget: b.join("idpui.public.endpoints.accountsforget", idpui, idpuie.Accountsforget),
+      LoginLink: b.join("idpui.public.endpoints.loginlink", idpui, idpuie.Loginlink),
+      LoginLinkOpen: b.join("idpui.public.endpoints.loginlinkopen", idpui, idpuie.Loginlinkopen),
+      VerifyEmail: b.join("idpui.public.endpoints.verifyemail", idpui, idpuie.Verifyemail),
+      VerifyEmailSend: b.join("idpui.public.endpoints.verifyemailsend", idpui, idpuie.Verifyemailsend),
+      FederatedLogin: b.join("idpui.public.endpoints.federatedlogin", idpui, idpuie.Federatedlogin),
+      FederatedCallback: b.join("idpui.public.endpoints.federatedcallback", idpui, idpuie.Federatedcallback),
+      Logout: b.join("idpui.public.endpoints.logout", idpui, idpuie.Logout),
+      Claim: b.join("idpui.public.endpoints.claim", idpui, idpuie.Claim),
+      Register: b.join("idpui.public.endpoints.register", idpui, idpuie.Register),
+      Recover: b.join("idpui.public.endpoints.recover", idpui, idpuie.Recover),
+      RecoverPassword: b.join("idpui.public.endpoints.recoverpassword", idpui, idpuie.Recoverpassword),
+      Password: b.join("idpui.public.endpoints.password", idpui, idpuie.Password),
+      PasswordStrength: b.join("idpui.public.endpoints.passwordstrength", idpui, idpuie.Passwordstrength),
+      Totp: b.join("idpui.public.endpoints.totp", idpui, idpuie.Totp),
+      Identities: b.join("idpui.public.endpoints.identities", idpui, idpuie.Identities),
+      IdentitiesLink: b.join("idpui.public.endpoints.identitieslink", idpui, idpuie.Identitieslink),
+      IdentitiesUnlink: b.join("idpui.public.endpoints.identitiesunlink", idpui, idpuie.Identitiesunlink),
+      TrustedDevices: b.join("idpui.public.endpoints.trusteddevices", idpui, idpuie.Trusteddevices),
+      TrustedDevicesRevoke: b.join("idpui.public.endpoints.trusteddevicesrevoke", idpui, idpuie.Trusteddevicesrevoke),
+      Sessions: b.join("idpui.public.endpoints.sessions", idpui, idpuie.Sessions),
+      SessionsRevoke: b.join("idpui.public.endpoints.sessionsrevoke", idpui, idpuie.Sessionsrevoke),
+      Device: b.join("idpui.public.endpoints.device", idpui, idpuie.Device),
+      DeviceConfirm: b.join("idpui.public.endpoints.deviceconfirm", idpui, idpuie.Deviceconfirm),
+      DeviceDone: b.join("idpui.public.endpoints.devicedone", idpui, idpuie.Devicedone),
+      Delete: b.join("idpui.public.endpoints.delete", idpui, idpuie.Delete),
+      EmailChange: b.join("idpui.public.endpoints.emailchange", idpui, idpuie.Emailchange),
+      EmailChangeConfirm: b.join("idpui.public.endpoints.emailchangeconfirm", idpui, idpuie.Emailchangeconfirm),
+      SeeYouLater: b.join("idpui.public.endpoints.seeyoulater", idpui, idpuie.Seeyoulater),
+    },
+    Meui: MeuiEndpoints{
+      Public: b.absolute("meui.public.url", meui),
+      Profile: b.join("meui.public.endpoints.profile", meui, cfg.Meui.Public.Endpoints.Profile),
+    },
+  }
+
+  if len(b.errors) > 0 {
+    return nil, b.errors
+  }
+  return e, nil
+}
+
+// RoutePath is the path the endpoint is served on, relative to idpui.public.url as the endpoints are configured. A path prefix of idpui.public.url is left to the proxy in front of the ui.
+func (e IdpuiEndpoints) RoutePath(endpoint *url.URL) string {
+  if e.Public == nil {
+    return endpoint.Path
+  }
+  return "/" + strings.TrimLeft(strings.TrimPrefix(endpoint.Path, strings.TrimSuffix(e.Public.Path, "/")), "/")
+}
+
+// PublicPath is where the browser finds the route, with the path prefix of idpui.public.url the proxy removed.
+func (e IdpuiEndpoints) PublicPath(route string) string {
+  if e.Public == nil {
+    return route
+  }
+  return strings.TrimSuffix(e.Public.Path, "/") + route
+}
@@ -0,0 +1,140 @@
+package app
+
+import (
+  "reflect"
+  "net/url"
+  "strings"
+  "testing"
+
+  "github.com/opensentry/idpui/config"
+)
+
+// testConfiguration has every endpoint set to its lower case field names, ex. /humans/collection.
+func testConfiguration(idpui string) *config.Configuration {
+  cfg := &config.Configuration{}
+  cfg.Hydra.Public.Url = "https://hydra.example"
+  cfg.Hydra.Admin.Url = "https://hydra.internal:4445"
+  cfg.Idp.Public.Url = "https://idp.example/api"
+  cfg.Idpui.Public.Url = idpui
+  cfg.Meui.Public.Url = "https://me.example"
+  setEndpoints(reflect.ValueOf(&cfg.Idp.Public.Endpoints).Elem(), "")
+  setEndpoints(reflect.ValueOf(&cfg.Idpui.Public.Endpoints).Elem(), "")
+  setEndpoints(reflect.ValueOf(&cfg.Meui.Public.Endpoints).Elem(), "")
+  return cfg
+}
+
+func setEndpoints(v reflect.Value, path string) {
+  for i := 0; i < v.NumField(); i++ {
+    name := path + "/" + strings.ToLower(v.Type().Field(i).Name)
+    switch v.Field(i).Kind() {
+    case reflect.Struct:
+      setEndpoints(v.Field(i), name)
+    case reflect.String:
+      v.Field(i).SetString(name)
+    }
+  }
+}
+
+func TestNewEndpoints(t *testing.T) {
+  for _, test := range []struct{
+    name string
+    idpui string
+    endpoint func(e *Endpoints) string
+    expected string
+  }{
+    { "absolute", "https://ui.example", func(e *Endpoints) string { return e.Idpui.Login.String() }, "https://ui.example/login" },
+    { "relative without public url", "", func(e *Endpoints) string { return e.Idpui.Login.String() }, "/login" },
+    { "public url", "https://ui.example", func(e *Endpoints) string { return e.Idpui.Public.String() }, "https://ui.example" },
+    { "path prefix kept", "https://example.com/idpui", func(e *Endpoints) string { return e.Idpui.FederatedCallback.String() }, "https://example.com/idpui/federatedcallback" },
+    { "idp path prefix kept", "", func(e *Endpoints) string { return e.Idp.HumansCollection.String() }, "https://idp.example/api/humans/collection" },
+    { "hydra", "", func(e *Endpoints) string { return e.Hydra.Admin.String() }, "https://hydra.internal:4445" },
+    { "meui", "", func(e *Endpoints) string { return e.Meui.Profile.String() }, "https://me.example/profile" },
+  } {
+    e, err := NewEndpoints(testConfiguration(test.idpui))
+    if err != nil {
+      t.Fatalf("%s: %v", test.name, err)
+    }
+    if endpoint := test.endpoint(e); endpoint != test.expected {
+      t.Errorf("%s: expected %s, got %s", test.name, test.expected, endpoint)
+    }
+  }
+
+  e, err := NewEndpoints(testConfiguration(""))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if e.Idpui.Public != nil {
+    t.Errorf("Expected no public url, got %s", e.Idpui.Public)
+  }
+}
+
+func TestNewEndpointsErrors(t *testing.T) {
+  cfg := testConfiguration("ui.example")
+  cfg.Hydra.Admin.Url = "/admin"
+  cfg.Idpui.Public.Endpoints.Login = ""
+  cfg.Meui.Public.Endpoints.Profile = ""
+
+  _, err := NewEndpoints(cfg)
+  errors, ok := err.(config.ValidationErrors)
+  if ok == false {
+    t.Fatalf("Expected ValidationErrors, got %v", err)
+  }
+
+  // Every problem is reported at once
+  for _, expected := range []string{
+    "hydra.admin.url: Not an absolute url",
+    "idpui.public.url: Not an absolute url",
+    "idpui.public.endpoints.login: Required",
+    "meui.public.endpoints.profile: Required",
+  } {
+    found := false
+    for _, e := range errors {
+      found = found || e == expected
+    }
+    if found == false {
+      t.Errorf("Expected %q, got %v", expected, errors)
+    }
+  }
+  if len(errors) != 4 {
+    t.Errorf("Expected 4 problems, got %v", errors)
+  }
+}
+
+func TestRoutePath(t *testing.T) {
+  for _, test := range []struct{ public string; endpoint string; route string }{
+    { "", "/login", "/login" },
+    { "https://ui.example", "https://ui.example/login", "/login" },
+    { "https://ui.example/", "https://ui.example//login", "/login" },
+    { "https://example.com/idpui", "https://example.com/idpui/login/link", "/login/link" },
+  } {
+    var e IdpuiEndpoints
+    if test.public != "" {
+      e.Public, _ = url.Parse(test.public)
+    }
+    endpoint, _ := url.Parse(test.endpoint)
+    if route := e.RoutePath(endpoint); route != test.route {
+      t.Errorf("Expected %s for %s on %s, got %s", test.route, test.endpoint, test.public, route)
+    }
+  }
+}
+
+func TestCreatePostRedirectUri(t *testing.T) {
+  e, err := NewEndpoints(testConfiguration("https://example.com/idpui"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  env := &Environment{ Endpoints:e }
+
+  for _, test := range []struct{ requested string; expected string }{
+    { "/login?login_challenge=x", "/idpui/root" }, // Landing on the login again would loop
+    { "/password", "/idpui/password" }, // The browser returns through the proxy
+  } {
+    redirectTo, err := createPostRedirectUri(env, test.requested)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if redirectTo != test.expected {
+      t.Errorf("Expected %s for %s, got %s", test.expected, test.requested, redirectTo)
+    }
+  }
+}
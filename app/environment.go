@@ -10,7 +10,11 @@ import (
   "github.com/gin-gonic/gin"
   "github.com/gofrs/uuid"
 
+  "github.com/opensentry/idpui/breach"
+  "github.com/opensentry/idpui/devices"
+  "github.com/opensentry/idpui/federation"
   "github.com/opensentry/idpui/utils"
+  "github.com/opensentry/idpui/validators"
 )
 
 type EnvironmentConstants struct {
@@ -22,7 +26,13 @@ type EnvironmentConstants struct {
   SessionStoreKey             string // This holds the controller data
   SessionRedirectCsrfStoreKey string // This holds the data that is shared between controllers (redirects and state for CSRF over redirects)
   SessionChallengeStoreKey    string // This holds the data from challenges
+  SessionAccountsStoreKey     string // This holds the accounts remembered on the device, see AccountChooser
+  SessionDevicesStoreKey      string // This holds the trusted devices of the humans using the device, see TrustDevice
   SessionLogoutStateKey       string
+  SessionRecoverChallengeKey  string // The recover challenge verified by this browser, see /recover/password
+  SessionStepUpStateKey       string // The state of the last step-up authentication, see RequireAuthentication
+  SessionEmailOtpChallengeKey string // The email challenge sent by this browser instead of TOTP, see /verify/email
+  SessionAuthenticationKey    string // The login the last page with a step-up requirement accepted, see VerifyRecentAuthentication
 
   ContextAccessTokenKey string
   ContextIdTokenKey string
@@ -31,6 +41,7 @@ type EnvironmentConstants struct {
   ContextIdentityKey string
   ContextOAuth2ConfigKey string
   ContextRequiredScopesKey string
+  ContextAuthenticationRequirementKey string
   ContextPrecalculatedStateKey string
 }
 
@@ -46,6 +57,33 @@ type Environment struct {
 
   IdpConfig *clientcredentials.Config
   AapConfig *clientcredentials.Config
+
+  Endpoints *Endpoints
+
+  IdpApi IdpApi // IdpClientApi in production
+  HydraApi HydraApi // HydraAdminApi in production
+  HydraClient *http.Client // See hydra.timeout
+
+  LoginPolicy *LoginPolicy // See login
+  Authenticators Authenticators // See login.authenticators
+  AccountChooser *AccountChooser // See login.accounts
+  FederationProviders federation.Providers // See federation.providers
+  FederationLinks federation.Links // See federation.links
+  StepUp StepUpRequirements // See stepup
+  TrustedDevices devices.Devices // See login.trustedDevices
+  DeviceUserCodeAlphabet string // See hydra.device.userCode.alphabet
+  DeviceUserCodeLength int // See hydra.device.userCode.length
+
+  PasswordPolicy *validators.PasswordPolicy // See password.policy
+  PasswordMeter bool // See password.meter
+  RecoverResetTotp bool // See password.recover.resetTotp
+  PasswordBreaches breach.Checker // nil when password.breached.policy is off
+  PasswordBreachPolicy string // warn or block
+  PasswordBreachFailOpen bool // See password.breached.failOpen
+
+  TrustedProxies utils.TrustedProxies // Only these may set X-Forwarded-* headers, see serve.proxy.trusted
+
+  Development bool // Set by --dev. Reloads templates, renders detailed error pages and relaxes cookie security for local development.
 }
 
 
@@ -76,7 +114,7 @@ func RequestLogger(env *Environment, appFields logrus.Fields) gin.HandlerFunc {
       }).Debug(err.Error())
     }
 
-    forwardedForIpData, err := utils.GetForwardedForIpData(c.Request)
+    forwardedForIpData, err := utils.GetForwardedForIpData(c.Request, env.TrustedProxies)
     if err != nil {
       env.Logger.WithFields(appFields).WithFields(logrus.Fields{
         "func": "RequestLogger",
@@ -0,0 +1,270 @@
+package app
+
+import (
+  "fmt"
+  "time"
+  "bytes"
+  "net/url"
+  "net/http"
+  "encoding/json"
+)
+
+// HydraApi is every operation on the Hydra admin api used by the ui. Handlers call it through env.HydraApi, so Hydra can be replaced with the local fake in hydrafake when testing.
+type HydraApi interface {
+  // RevokeLoginSessions ends every authenticated session of the subject with Hydra, so the subject must log in again.
+  RevokeLoginSessions(subject string) error
+
+  // ReadConsentSessions returns the consents the subject granted to clients, one for every authorization the subject consented to. Hydra has no such list of login sessions.
+  ReadConsentSessions(subject string) ([]HydraConsentSession, error)
+
+  // RevokeConsentSessions revokes the consents of the subject and every token issued with them. Only for the client when clientId is given, otherwise for all clients.
+  RevokeConsentSessions(subject string, clientId string) error
+
+  // ReadLoginRequest returns what Hydra knows about the login_challenge, nil when it does not exist.
+  ReadLoginRequest(challenge string) (*HydraLoginRequest, error)
+
+  // AcceptLoginRequest accepts the login_challenge and returns where the browser continues. Accepting again replaces the previous accept, as long as the browser has not continued.
+  AcceptLoginRequest(challenge string, accept HydraLoginAccept) (redirectTo string, err error)
+
+  // RejectLoginRequest denies the login_challenge and returns where the browser continues, the client is told the error. A device waiting for the login is denied with it.
+  RejectLoginRequest(challenge string, reject HydraLoginReject) (redirectTo string, err error)
+
+  // AcceptDeviceRequest hands Hydra the user code entered for the device_challenge and returns where the browser continues, which is the login of the human authorizing the device. Empty when Hydra does not know the code, or it expired or was used. Hydra has no way to look up a code before accepting it, nor to reject one, the device is denied by rejecting the login that follows.
+  AcceptDeviceRequest(challenge string, userCode string) (redirectTo string, err error)
+}
+
+type HydraLoginRequest struct {
+  Challenge string `json:"challenge"`
+  Skip bool `json:"skip"` // The browser has a remembered session with Hydra for Subject
+  Subject string `json:"subject"`
+  RequestedScope []string `json:"requested_scope"`
+  RequestUrl string `json:"request_url"` // The authorization request of the client, ex. with prompt and max_age
+  SessionId string `json:"session_id"`
+  Client struct {
+    ClientId string `json:"client_id"`
+    ClientName string `json:"client_name"`
+  } `json:"client"`
+  OidcContext struct {
+    LoginHint string `json:"login_hint"` // The client suggests who logs in, ex. an email
+    AcrValues []string `json:"acr_values"` // How the client asks the human to log in, see stepUpAuthentication
+  } `json:"oidc_context"`
+}
+
+type HydraLoginAccept struct {
+  Subject string `json:"subject"`
+  Remember bool `json:"remember"` // Keep the human signed in with Hydra, ignored when the login request was skipped
+  RememberFor int `json:"remember_for"` // Seconds, 0 is until the Hydra session cookie expires
+  Acr string `json:"acr,omitempty"` // As the idp sets it: empty for password, otp or otp.email
+  Amr []string `json:"amr,omitempty"` // RFC 8176 methods, see AuthenticationMethods
+}
+
+// HydraLoginReject is the error the client is told, RFC 6749 section 4.1.2.1.
+type HydraLoginReject struct {
+  Error string `json:"error"`
+  ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// HydraConsentSession is a consent the subject granted to a client.
+type HydraConsentSession struct {
+  GrantScope []string `json:"grant_scope"`
+  HandledAt time.Time `json:"handled_at"` // When the subject consented, which is when the client last asked for authorization
+  ConsentRequest struct {
+    Client struct {
+      ClientId string `json:"client_id"`
+      ClientName string `json:"client_name"`
+    } `json:"client"`
+  } `json:"consent_request"`
+}
+
+// HydraAdminApi is the production HydraApi, it calls the Hydra admin api over http. It uses the /admin paths of Hydra 2, the first version with the device authorization grant. The admin api must never be exposed publicly.
+type HydraAdminApi struct {
+  Url *url.URL // hydra.admin.url
+  Client *http.Client // See hydra.timeout, a call never waits for Hydra longer
+}
+
+func (h HydraAdminApi) RevokeLoginSessions(subject string) error {
+  q := url.Values{}
+  q.Set("subject", subject)
+  return h.delete("/admin/oauth2/auth/sessions/login", q)
+}
+
+func (h HydraAdminApi) ReadConsentSessions(subject string) ([]HydraConsentSession, error) {
+  q := url.Values{}
+  q.Set("subject", subject)
+
+  res, err := h.do("GET", "/admin/oauth2/auth/sessions/consent", q, nil)
+  if err != nil {
+    return nil, err
+  }
+  defer res.Body.Close()
+
+  if res.StatusCode != http.StatusOK {
+    return nil, fmt.Errorf("GET /admin/oauth2/auth/sessions/consent: %s", res.Status)
+  }
+
+  var consentSessions []HydraConsentSession
+  err = json.NewDecoder(res.Body).Decode(&consentSessions)
+  if err != nil {
+    return nil, err
+  }
+  return consentSessions, nil
+}
+
+func (h HydraAdminApi) RevokeConsentSessions(subject string, clientId string) error {
+  q := url.Values{}
+  q.Set("subject", subject)
+  if clientId == "" {
+    q.Set("all", "true")
+  } else {
+    q.Set("client", clientId)
+  }
+  return h.delete("/admin/oauth2/auth/sessions/consent", q)
+}
+
+func (h HydraAdminApi) ReadLoginRequest(challenge string) (*HydraLoginRequest, error) {
+  q := url.Values{}
+  q.Set("login_challenge", challenge)
+
+  res, err := h.do("GET", "/admin/oauth2/auth/requests/login", q, nil)
+  if err != nil {
+    return nil, err
+  }
+  defer res.Body.Close()
+
+  // Hydra answers 410 when the login request was already used.
+  if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone {
+    return nil, nil
+  }
+  if res.StatusCode != http.StatusOK {
+    return nil, fmt.Errorf("GET /admin/oauth2/auth/requests/login: %s", res.Status)
+  }
+
+  var loginRequest HydraLoginRequest
+  err = json.NewDecoder(res.Body).Decode(&loginRequest)
+  if err != nil {
+    return nil, err
+  }
+  return &loginRequest, nil
+}
+
+func (h HydraAdminApi) AcceptLoginRequest(challenge string, accept HydraLoginAccept) (string, error) {
+  q := url.Values{}
+  q.Set("login_challenge", challenge)
+
+  body, err := json.Marshal(accept)
+  if err != nil {
+    return "", err
+  }
+
+  res, err := h.do("PUT", "/admin/oauth2/auth/requests/login/accept", q, body)
+  if err != nil {
+    return "", err
+  }
+  defer res.Body.Close()
+
+  if res.StatusCode != http.StatusOK {
+    return "", fmt.Errorf("PUT /admin/oauth2/auth/requests/login/accept: %s", res.Status)
+  }
+
+  var completed struct {
+    RedirectTo string `json:"redirect_to"`
+  }
+  err = json.NewDecoder(res.Body).Decode(&completed)
+  if err != nil {
+    return "", err
+  }
+  return completed.RedirectTo, nil
+}
+
+func (h HydraAdminApi) RejectLoginRequest(challenge string, reject HydraLoginReject) (string, error) {
+  q := url.Values{}
+  q.Set("login_challenge", challenge)
+
+  body, err := json.Marshal(reject)
+  if err != nil {
+    return "", err
+  }
+
+  res, err := h.do("PUT", "/admin/oauth2/auth/requests/login/reject", q, body)
+  if err != nil {
+    return "", err
+  }
+  defer res.Body.Close()
+
+  if res.StatusCode != http.StatusOK {
+    return "", fmt.Errorf("PUT /admin/oauth2/auth/requests/login/reject: %s", res.Status)
+  }
+
+  var completed struct {
+    RedirectTo string `json:"redirect_to"`
+  }
+  err = json.NewDecoder(res.Body).Decode(&completed)
+  if err != nil {
+    return "", err
+  }
+  return completed.RedirectTo, nil
+}
+
+// AcceptDeviceRequest requires a Hydra with the device authorization grant enabled and urls.device.verification set to the device page of the ui.
+func (h HydraAdminApi) AcceptDeviceRequest(challenge string, userCode string) (string, error) {
+  q := url.Values{}
+  q.Set("device_challenge", challenge)
+
+  body, err := json.Marshal(map[string]string{ "user_code":userCode })
+  if err != nil {
+    return "", err
+  }
+
+  res, err := h.do("PUT", "/admin/oauth2/auth/requests/device/accept", q, body)
+  if err != nil {
+    return "", err
+  }
+  defer res.Body.Close()
+
+  // Unknown, expired and used codes. The human may have mistyped the code, which is not an error.
+  if res.StatusCode == http.StatusBadRequest || res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone {
+    return "", nil
+  }
+  if res.StatusCode != http.StatusOK {
+    return "", fmt.Errorf("PUT /admin/oauth2/auth/requests/device/accept: %s", res.Status)
+  }
+
+  var completed struct {
+    RedirectTo string `json:"redirect_to"`
+  }
+  err = json.NewDecoder(res.Body).Decode(&completed)
+  if err != nil {
+    return "", err
+  }
+  return completed.RedirectTo, nil
+}
+
+func (h HydraAdminApi) delete(path string, q url.Values) error {
+  res, err := h.do("DELETE", path, q, nil)
+  if err != nil {
+    return err
+  }
+  defer res.Body.Close()
+
+  // Hydra answers 404 when there is nothing to revoke.
+  if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+    return fmt.Errorf("DELETE %s: %s", path, res.Status)
+  }
+  return nil
+}
+
+func (h HydraAdminApi) do(method string, path string, q url.Values, body []byte) (*http.Response, error) {
+  u := *h.Url
+  u.Path = u.Path + path
+  u.RawQuery = q.Encode()
+
+  req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+  if err != nil {
+    return nil, err
+  }
+  if body != nil {
+    req.Header.Set("Content-Type", "application/json")
+  }
+
+  return h.Client.Do(req)
+}
@@ -0,0 +1,38 @@
+package app
+
+import (
+  "time"
+  "testing"
+  "net/url"
+  "net/http"
+  "net/http/httptest"
+)
+
+func TestHydraAdminApiTimeout(t *testing.T) {
+  done := make(chan struct{})
+
+  slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    select {
+    case <-done:
+    case <-time.After(5 * time.Second):
+    }
+  }))
+  defer slow.Close()
+  defer close(done) // Before the server closes, it waits for the handler
+
+  u, err := url.Parse(slow.URL)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  h := HydraAdminApi{ Url:u, Client:&http.Client{ Timeout:100 * time.Millisecond } }
+
+  start := time.Now()
+  _, err = h.ReadLoginRequest("challenge")
+  if err == nil {
+    t.Fatal("Expected the call to time out")
+  }
+  if time.Since(start) > 2 * time.Second {
+    t.Fatalf("Expected the call to give up after the timeout, took %s", time.Since(start))
+  }
+}
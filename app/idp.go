@@ -0,0 +1,116 @@
+package app
+
+import (
+  idp "github.com/opensentry/idp/client"
+
+  bulky "github.com/charmixer/bulky/client"
+)
+
+// IdpApi is every operation on the idp used by the ui. Handlers call it through env.IdpApi instead of the package functions of the idp client, so the idp can be replaced with the in-memory fake in idpfake when testing.
+type IdpApi interface {
+  CreateHumans(client *idp.IdpClient, url string, requests []idp.CreateHumansRequest) (status int, responses bulky.Responses, err error)
+  ReadHumans(client *idp.IdpClient, url string, requests []idp.ReadHumansRequest) (status int, responses bulky.Responses, err error)
+  DeleteHumans(client *idp.IdpClient, url string, requests []idp.DeleteHumansRequest) (status int, responses bulky.Responses, err error)
+  DeleteHumansVerify(client *idp.IdpClient, url string, requests []idp.UpdateHumansDeleteVerifyRequest) (status int, responses bulky.Responses, err error)
+  UpdateHumansPassword(client *idp.IdpClient, url string, requests []idp.UpdateHumansPasswordRequest) (status int, responses bulky.Responses, err error)
+  UpdateHumansTotp(client *idp.IdpClient, url string, requests []idp.UpdateHumansTotpRequest) (status int, responses bulky.Responses, err error)
+  CreateHumansAuthenticate(client *idp.IdpClient, url string, requests []idp.CreateHumansAuthenticateRequest) (status int, responses bulky.Responses, err error)
+  RecoverHumans(client *idp.IdpClient, url string, requests []idp.CreateHumansRecoverRequest) (status int, responses bulky.Responses, err error)
+  RecoverHumansVerify(client *idp.IdpClient, url string, requests []idp.UpdateHumansRecoverVerifyRequest) (status int, responses bulky.Responses, err error)
+  CreateHumansEmailChange(client *idp.IdpClient, url string, requests []idp.CreateHumansEmailChangeRequest) (status int, responses bulky.Responses, err error)
+  UpdateHumansEmailConfirm(client *idp.IdpClient, url string, requests []idp.UpdateHumansEmailConfirmRequest) (status int, responses bulky.Responses, err error)
+  CreateHumansLogout(client *idp.IdpClient, url string, requests []idp.CreateHumansLogoutRequest) (status int, responses bulky.Responses, err error)
+  ReadHumansLogout(client *idp.IdpClient, url string, requests []idp.ReadHumansLogoutRequest) (status int, responses bulky.Responses, err error)
+  UpdateHumansLogoutAccept(client *idp.IdpClient, url string, requests []idp.UpdateHumansLogoutAcceptRequest) (status int, responses bulky.Responses, err error)
+
+  CreateChallenges(client *idp.IdpClient, url string, requests []idp.CreateChallengesRequest) (status int, responses bulky.Responses, err error)
+  ReadChallenges(client *idp.IdpClient, url string, requests []idp.ReadChallengesRequest) (status int, responses bulky.Responses, err error)
+  VerifyChallenges(client *idp.IdpClient, url string, requests []idp.UpdateChallengesVerifyRequest) (status int, responses bulky.Responses, err error)
+
+  CreateInvites(client *idp.IdpClient, url string, requests []idp.CreateInvitesRequest) (status int, responses bulky.Responses, err error)
+  ReadInvites(client *idp.IdpClient, url string, requests []idp.ReadInvitesRequest) (status int, responses bulky.Responses, err error)
+  CreateInvitesClaim(client *idp.IdpClient, url string, requests []idp.CreateInvitesClaimRequest) (status int, responses bulky.Responses, err error)
+}
+
+// IdpClientApi is the production IdpApi, it calls the idp over http using the idp client.
+type IdpClientApi struct {}
+
+func (IdpClientApi) CreateHumans(client *idp.IdpClient, url string, requests []idp.CreateHumansRequest) (int, bulky.Responses, error) {
+  return idp.CreateHumans(client, url, requests)
+}
+
+func (IdpClientApi) ReadHumans(client *idp.IdpClient, url string, requests []idp.ReadHumansRequest) (int, bulky.Responses, error) {
+  return idp.ReadHumans(client, url, requests)
+}
+
+func (IdpClientApi) DeleteHumans(client *idp.IdpClient, url string, requests []idp.DeleteHumansRequest) (int, bulky.Responses, error) {
+  return idp.DeleteHumans(client, url, requests)
+}
+
+func (IdpClientApi) DeleteHumansVerify(client *idp.IdpClient, url string, requests []idp.UpdateHumansDeleteVerifyRequest) (int, bulky.Responses, error) {
+  return idp.DeleteHumansVerify(client, url, requests)
+}
+
+func (IdpClientApi) UpdateHumansPassword(client *idp.IdpClient, url string, requests []idp.UpdateHumansPasswordRequest) (int, bulky.Responses, error) {
+  return idp.UpdateHumansPassword(client, url, requests)
+}
+
+func (IdpClientApi) UpdateHumansTotp(client *idp.IdpClient, url string, requests []idp.UpdateHumansTotpRequest) (int, bulky.Responses, error) {
+  return idp.UpdateHumansTotp(client, url, requests)
+}
+
+func (IdpClientApi) CreateHumansAuthenticate(client *idp.IdpClient, url string, requests []idp.CreateHumansAuthenticateRequest) (int, bulky.Responses, error) {
+  return idp.CreateHumansAuthenticate(client, url, requests)
+}
+
+func (IdpClientApi) RecoverHumans(client *idp.IdpClient, url string, requests []idp.CreateHumansRecoverRequest) (int, bulky.Responses, error) {
+  return idp.RecoverHumans(client, url, requests)
+}
+
+func (IdpClientApi) RecoverHumansVerify(client *idp.IdpClient, url string, requests []idp.UpdateHumansRecoverVerifyRequest) (int, bulky.Responses, error) {
+  return idp.RecoverHumansVerify(client, url, requests)
+}
+
+func (IdpClientApi) CreateHumansEmailChange(client *idp.IdpClient, url string, requests []idp.CreateHumansEmailChangeRequest) (int, bulky.Responses, error) {
+  return idp.CreateHumansEmailChange(client, url, requests)
+}
+
+func (IdpClientApi) UpdateHumansEmailConfirm(client *idp.IdpClient, url string, requests []idp.UpdateHumansEmailConfirmRequest) (int, bulky.Responses, error) {
+  return idp.UpdateHumansEmailConfirm(client, url, requests)
+}
+
+func (IdpClientApi) CreateHumansLogout(client *idp.IdpClient, url string, requests []idp.CreateHumansLogoutRequest) (int, bulky.Responses, error) {
+  return idp.CreateHumansLogout(client, url, requests)
+}
+
+func (IdpClientApi) ReadHumansLogout(client *idp.IdpClient, url string, requests []idp.ReadHumansLogoutRequest) (int, bulky.Responses, error) {
+  return idp.ReadHumansLogout(client, url, requests)
+}
+
+func (IdpClientApi) UpdateHumansLogoutAccept(client *idp.IdpClient, url string, requests []idp.UpdateHumansLogoutAcceptRequest) (int, bulky.Responses, error) {
+  return idp.UpdateHumansLogoutAccept(client, url, requests)
+}
+
+func (IdpClientApi) CreateChallenges(client *idp.IdpClient, url string, requests []idp.CreateChallengesRequest) (int, bulky.Responses, error) {
+  return idp.CreateChallenges(client, url, requests)
+}
+
+func (IdpClientApi) ReadChallenges(client *idp.IdpClient, url string, requests []idp.ReadChallengesRequest) (int, bulky.Responses, error) {
+  return idp.ReadChallenges(client, url, requests)
+}
+
+func (IdpClientApi) VerifyChallenges(client *idp.IdpClient, url string, requests []idp.UpdateChallengesVerifyRequest) (int, bulky.Responses, error) {
+  return idp.VerifyChallenges(client, url, requests)
+}
+
+func (IdpClientApi) CreateInvites(client *idp.IdpClient, url string, requests []idp.CreateInvitesRequest) (int, bulky.Responses, error) {
+  return idp.CreateInvites(client, url, requests)
+}
+
+func (IdpClientApi) ReadInvites(client *idp.IdpClient, url string, requests []idp.ReadInvitesRequest) (int, bulky.Responses, error) {
+  return idp.ReadInvites(client, url, requests)
+}
+
+func (IdpClientApi) CreateInvitesClaim(client *idp.IdpClient, url string, requests []idp.CreateInvitesClaimRequest) (int, bulky.Responses, error) {
+  return idp.CreateInvitesClaim(client, url, requests)
+}
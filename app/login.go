@@ -0,0 +1,54 @@
+package app
+
+import (
+  "net/url"
+  "strings"
+)
+
+// LoginPolicy decides how login requests from Hydra are handled, see login in the configuration.
+type LoginPolicy struct {
+  Username bool // Accept the username as well as the email
+  Remember bool // Offer to keep the human signed in
+  RememberFor int // Seconds Hydra remembers the login, 0 until its session cookie expires
+
+  Skip bool // Accept login requests Hydra marks as skip, ie. single sign-on
+  ReauthenticateScopes []string // Requesting any of these always asks for credentials
+
+  Link bool // Offer to email a sign-in link
+  LinkTTL int64 // Seconds the link can be opened
+
+  EmailOtp bool // Offer a code sent by email instead of TOTP
+  EmailOtpTTL int64 // Seconds the code can be entered
+
+  TrustDevices bool // Offer to skip the second factor on devices the human trusts
+  TrustDevicesFor int // Seconds a device stays trusted
+}
+
+// RequiresAuthentication reports whether the human must enter credentials even though Hydra would skip the login. The client can force it with prompt=login or max_age=0, and the policy for sensitive scopes.
+func (p *LoginPolicy) RequiresAuthentication(lr *HydraLoginRequest) bool {
+  if p.Skip == false {
+    return true
+  }
+
+  u, err := url.Parse(lr.RequestUrl)
+  if err == nil {
+    q := u.Query()
+    for _, prompt := range strings.Fields(q.Get("prompt")) {
+      if prompt == "login" {
+        return true
+      }
+    }
+    if q.Get("max_age") == "0" {
+      return true
+    }
+  }
+
+  for _, scope := range lr.RequestedScope {
+    for _, sensitive := range p.ReauthenticateScopes {
+      if scope == sensitive {
+        return true
+      }
+    }
+  }
+  return false
+}
@@ -2,6 +2,7 @@ package app
 
 import (
   //"fmt"
+  "time"
   "net/http"
   "net/url"
   "github.com/gin-gonic/gin"
@@ -10,7 +11,6 @@ import (
   "golang.org/x/oauth2"
   "golang.org/x/net/context"
 
-  "github.com/opensentry/idpui/config"
   idp "github.com/opensentry/idp/client"
 
   bulky "github.com/charmixer/bulky/client"
@@ -100,7 +100,7 @@ func ConfigureOauth2(env *Environment) gin.HandlerFunc {
     endpoint := env.Provider.Endpoint()
     endpoint.AuthStyle = 2 // Force basic secret, so token exchange does not auto to post which we did not allow.
 
-    exchangeRedirectUrl, err := createAuthorizationCodeExchangeUrl(c.Request)
+    exchangeRedirectUrl, err := createAuthorizationCodeExchangeUrl(env, c.Request)
     if err != nil {
       log.Debug(err.Error())
       c.AbortWithStatus(http.StatusInternalServerError)
@@ -166,6 +166,9 @@ func RequestTokenUsingAuthorizationCode(env *Environment) gin.HandlerFunc {
 
       // Use precalculated state iff present
       state := FetchPrecalculatedState(env, c)
+      if state != "" {
+        ClearSessionRedirect(env, c, state) // The page is opened again, ex. to log in again when the login got too old
+      }
 
       initUrl, err := StartAuthenticationSession(env, c, oauth2Config, idTokenHint, state)
       if err != nil {
@@ -333,13 +336,12 @@ func RequireIdentity(env *Environment) gin.HandlerFunc {
       return
     }
 
-    // FIXME: This should be defined on application start up and verified and stored in a map to use here.
-    idpHumansUrl := config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.humans.collection")
+    idpHumansUrl := env.Endpoints.Idp.HumansCollection.String()
 
     // Id token found lookup identity.
     idpClient := idp.NewIdpClientWithUserAccessToken(oauth2Config, token)
     humanRequest := idp.ReadHumansRequest{ Id:idToken.Subject }
-    status, responses, err := idp.ReadHumans(idpClient, idpHumansUrl, []idp.ReadHumansRequest{ humanRequest })
+    status, responses, err := env.IdpApi.ReadHumans(idpClient, idpHumansUrl, []idp.ReadHumansRequest{ humanRequest })
     if err != nil {
       log.Debug(err.Error())
       c.AbortWithStatus(http.StatusInternalServerError)
@@ -368,6 +370,30 @@ func RequireIdentity(env *Environment) gin.HandlerFunc {
         c.AbortWithStatus(http.StatusInternalServerError)
         return
       }
+
+      requirement := FetchAuthenticationRequirement(env, c)
+      if requirement != nil {
+        unmet, err := requirement.Unmet(idToken, human, time.Now())
+        if err != nil {
+          log.Debug(err.Error())
+          c.AbortWithStatus(http.StatusInternalServerError)
+          return
+        }
+
+        if unmet != "" {
+          log.WithFields(logrus.Fields{ "id":human.Id, "unmet":unmet }).Debug("Step-up authentication required")
+          stepUpAuthentication(env, c, oauth2Config, log)
+          return
+        }
+
+        err = rememberAuthentication(env, c, idToken, human)
+        if err != nil {
+          log.Debug(err.Error())
+          c.AbortWithStatus(http.StatusInternalServerError)
+          return
+        }
+      }
+
       c.Set(env.Constants.ContextIdentityKey, resp[0])
       c.Next()
       return
@@ -0,0 +1,234 @@
+package app
+
+import (
+  "fmt"
+  "time"
+  "strconv"
+  "strings"
+  "net/http"
+  "github.com/gin-gonic/gin"
+  "github.com/gin-contrib/sessions"
+  "github.com/sirupsen/logrus"
+  oidc "github.com/coreos/go-oidc"
+  "golang.org/x/oauth2"
+
+  idp "github.com/opensentry/idp/client"
+)
+
+// # Step-up authentication
+// Sensitive pages require a recent login, and the second factor of humans that have one. RequireIdentity checks the id token against the requirement of the route, and sends a login that falls short back through Hydra with prompt=login and max_age.
+
+type AuthenticationRequirement struct {
+  MaxAge int // Seconds since the human entered credentials, 0 for any age
+  Acr []string // The login must have one of these acr values, empty for any
+  Amr []string // The login must have used all of these methods
+  SecondFactor bool // Humans with TOTP must have used it
+  EmailOtp bool // A code sent by email instead of TOTP counts as the second factor
+  TrustedDevice bool // A login on a device trusted to skip the second factor counts as it
+}
+
+// StepUpRequirements are the requirements of the sensitive pages, see stepup in the configuration.
+type StepUpRequirements struct {
+  Password *AuthenticationRequirement
+  Totp *AuthenticationRequirement
+  Delete *AuthenticationRequirement
+  EmailChange *AuthenticationRequirement
+  Identities *AuthenticationRequirement
+  Devices *AuthenticationRequirement
+  Sessions *AuthenticationRequirement
+}
+
+// AuthenticationMethods returns the RFC 8176 amr values for the acr the idp uses.
+func AuthenticationMethods(acr string) []string {
+  switch acr {
+  case "":
+    return []string{"pwd"}
+  case "otp":
+    return []string{"pwd", "otp", "mfa"}
+  case "otp.email":
+    return []string{"pwd", "otp"} // Confirms the email after the password, not a factor the human chose
+  case "link":
+    return []string{"otp"} // A sign-in link sent by email instead of the password, see login.link
+  case "otp.device":
+    return []string{"pwd", "mfa"} // The password on a device trusted after the second factor, see TrustDevice. Only a second factor for pages that allow it, see AuthenticationRequirement.TrustedDevice
+  case "otp.email.mfa":
+    return []string{"pwd", "otp", "mfa"} // The password, then a code sent by email instead of TOTP
+  }
+  return nil
+}
+
+type authenticationClaims struct {
+  AuthTime int64 `json:"auth_time"`
+  Acr string `json:"acr"`
+  Amr []string `json:"amr"`
+}
+
+// Unmet returns why the login does not meet the requirement, empty when it does.
+func (r *AuthenticationRequirement) Unmet(idToken *oidc.IDToken, human idp.Human, now time.Time) (string, error) {
+  var claims authenticationClaims
+  err := idToken.Claims(&claims)
+  if err != nil {
+    return "", err
+  }
+  return r.unmet(claims, human.TotpRequired, now), nil
+}
+
+func (r *AuthenticationRequirement) unmet(claims authenticationClaims, totpRequired bool, now time.Time) string {
+  if r.MaxAge > 0 {
+    if claims.AuthTime == 0 {
+      return "Missing auth_time"
+    }
+    if now.Unix() - claims.AuthTime > int64(r.MaxAge) {
+      return fmt.Sprintf("Authenticated %d seconds ago, at most %d allowed", now.Unix() - claims.AuthTime, r.MaxAge)
+    }
+  }
+
+  if len(r.Acr) > 0 && contains(r.Acr, claims.Acr) == false {
+    return fmt.Sprintf("acr %q not allowed", claims.Acr)
+  }
+
+  for _, method := range r.Amr {
+    if contains(claims.Amr, method) == false {
+      return fmt.Sprintf("amr %q missing", method)
+    }
+  }
+
+  if r.SecondFactor && totpRequired {
+    if contains(claims.Amr, "mfa") == false {
+      return "Second factor missing"
+    }
+    if claims.Acr == "otp.email.mfa" && r.EmailOtp == false {
+      return "Second factor by email not allowed"
+    }
+    if claims.Acr == "otp.device" && r.TrustedDevice == false {
+      return "Trusted device not allowed"
+    }
+  }
+
+  return ""
+}
+
+func contains(values []string, value string) bool {
+  for _, v := range values {
+    if v == value {
+      return true
+    }
+  }
+  return false
+}
+
+// RequireAuthentication sets the requirement RequireIdentity checks the login against. Call it before RequestTokenUsingAuthorizationCode, so max_age is asked of Hydra right away.
+func RequireAuthentication(env *Environment, requirement *AuthenticationRequirement) gin.HandlerFunc {
+  fn := func(c *gin.Context) {
+    if requirement != nil {
+      c.Set(env.Constants.ContextAuthenticationRequirementKey, requirement)
+    }
+    c.Next()
+  }
+  return gin.HandlerFunc(fn)
+}
+
+func FetchAuthenticationRequirement(env *Environment, c *gin.Context) *AuthenticationRequirement {
+  t, exists := c.Get(env.Constants.ContextAuthenticationRequirementKey)
+  if exists == true {
+    return t.(*AuthenticationRequirement)
+  }
+  return nil
+}
+
+// stepUpAuthentication sends the browser through Hydra to log in again. A login that still falls short when it returns is refused, the human cannot meet the requirement.
+func stepUpAuthentication(env *Environment, c *gin.Context, oauth2Config *oauth2.Config, log *logrus.Entry) {
+  session := sessions.DefaultMany(c, env.Constants.SessionStoreKey)
+
+  requestState := c.Query("state")
+  if requestState != "" && session.Get(env.Constants.SessionStepUpStateKey) == requestState {
+    log.Debug("Step-up authentication failed")
+    c.AbortWithStatus(http.StatusForbidden)
+    return
+  }
+
+  state, err := CreateRandomStringWithNumberOfBytes(32)
+  if err != nil {
+    log.Debug(err.Error())
+    c.AbortWithStatus(http.StatusInternalServerError)
+    return
+  }
+
+  session.Set(env.Constants.SessionStepUpStateKey, state)
+  err = session.Save()
+  if err != nil {
+    log.Debug(err.Error())
+    c.AbortWithStatus(http.StatusInternalServerError)
+    return
+  }
+
+  authorizationCodeUrl, err := StartAuthenticationSession(env, c, oauth2Config, IdTokenHint(env, c), state)
+  if err != nil {
+    log.Debug(err.Error())
+    c.AbortWithStatus(http.StatusInternalServerError)
+    return
+  }
+
+  q := authorizationCodeUrl.Query()
+  q.Set("prompt", "login")
+  requirement := FetchAuthenticationRequirement(env, c)
+  if requirement != nil && requirement.SecondFactor && requirement.TrustedDevice == false {
+    q.Set("acr_values", "otp") // The login asks for the second factor on trusted devices too, see TrustedDeviceAllowed
+  }
+  authorizationCodeUrl.RawQuery = q.Encode()
+
+  log.WithFields(logrus.Fields{ "redirect_to":authorizationCodeUrl.String() }).Debug("Redirecting")
+  c.Redirect(http.StatusFound, authorizationCodeUrl.String())
+  c.Abort()
+}
+
+// TrustedDeviceAllowed tells if the login may skip the second factor on a trusted device. Not when a page asked for the second factor itself, see stepUpAuthentication.
+func TrustedDeviceAllowed(loginRequest *HydraLoginRequest) bool {
+  acrValues := loginRequest.OidcContext.AcrValues
+  return len(acrValues) == 0 || contains(acrValues, "otp.device")
+}
+
+// maxAge is the max_age parameter for the requirement, empty for any age.
+func maxAge(requirement *AuthenticationRequirement) string {
+  if requirement == nil || requirement.MaxAge <= 0 {
+    return ""
+  }
+  return strconv.Itoa(requirement.MaxAge)
+}
+
+// rememberAuthentication keeps the login RequireIdentity accepted in the session of the ui, so the forms of the page are verified against the session instead of a token they post, see VerifyRecentAuthentication.
+func rememberAuthentication(env *Environment, c *gin.Context, idToken *oidc.IDToken, human idp.Human) error {
+  var claims authenticationClaims
+  err := idToken.Claims(&claims)
+  if err != nil {
+    return err
+  }
+
+  session := sessions.DefaultMany(c, env.Constants.SessionStoreKey)
+  session.Set(env.Constants.SessionAuthenticationKey, map[string]string{
+    "sub": idToken.Subject,
+    "auth_time": strconv.FormatInt(claims.AuthTime, 10),
+    "acr": claims.Acr,
+    "amr": strings.Join(claims.Amr, " "),
+    "totp_required": strconv.FormatBool(human.TotpRequired),
+  })
+  return session.Save()
+}
+
+// VerifyRecentAuthentication verifies the login remembered in the session is of the subject and still meets the requirement. Forms that act on a page checked by RequireIdentity use it, the page may have been open for a while.
+func VerifyRecentAuthentication(env *Environment, c *gin.Context, subject string, requirement *AuthenticationRequirement) (bool, error) {
+  session := sessions.DefaultMany(c, env.Constants.SessionStoreKey)
+
+  remembered, _ := session.Get(env.Constants.SessionAuthenticationKey).(map[string]string)
+  if remembered == nil || remembered["sub"] != subject {
+    return false, nil
+  }
+
+  authTime, err := strconv.ParseInt(remembered["auth_time"], 10, 64)
+  if err != nil {
+    return false, err
+  }
+
+  claims := authenticationClaims{ AuthTime:authTime, Acr:remembered["acr"], Amr:strings.Fields(remembered["amr"]) }
+  return requirement.unmet(claims, remembered["totp_required"] == "true", time.Now()) == "", nil
+}
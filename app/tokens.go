@@ -0,0 +1,54 @@
+package app
+
+import (
+  "fmt"
+  "strings"
+  "net/url"
+  "net/http"
+  "github.com/sirupsen/logrus"
+  "github.com/gin-gonic/gin"
+)
+
+// RevokeToken revokes an access or refresh token issued to the ui, RFC 7009. Hydra answers 200 for tokens it does not know, so revoking twice is not an error.
+func RevokeToken(env *Environment, token string) error {
+  form := url.Values{}
+  form.Set("token", token)
+
+  req, err := http.NewRequest("POST", env.Endpoints.Hydra.Public.String() + "/oauth2/revoke", strings.NewReader(form.Encode()))
+  if err != nil {
+    return err
+  }
+  req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+  req.SetBasicAuth(url.QueryEscape(env.ClientId), url.QueryEscape(env.ClientSecret)) // As the token exchange authenticates, RFC 6749 section 2.3.1
+
+  res, err := env.HydraClient.Do(req)
+  if err != nil {
+    return err
+  }
+  defer res.Body.Close()
+
+  if res.StatusCode != http.StatusOK {
+    return fmt.Errorf("POST /oauth2/revoke: %s", res.Status)
+  }
+  return nil
+}
+
+// RevokeAccessToken revokes the access token of RequestTokenUsingAuthorizationCode once the page is rendered. Only for pages that do not pass the token on to their forms.
+func RevokeAccessToken(env *Environment) gin.HandlerFunc {
+  fn := func(c *gin.Context) {
+    c.Next()
+
+    token := AccessToken(env, c)
+    if token == nil {
+      return
+    }
+
+    // The token expires anyway, a failed revoke does not fail the page.
+    err := RevokeToken(env, token.AccessToken)
+    if err != nil {
+      log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+      log.WithFields(logrus.Fields{ "func":"RevokeAccessToken" }).Debug(err.Error())
+    }
+  }
+  return gin.HandlerFunc(fn)
+}
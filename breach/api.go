@@ -0,0 +1,44 @@
+package breach
+
+import (
+  "fmt"
+  "bufio"
+  "net/url"
+  "net/http"
+)
+
+// RangeApi looks up hashes with a k-anonymity range api. Only the first 5 characters of the hash are sent, and the response is padded so its size does not reveal the prefix.
+type RangeApi struct {
+  Url *url.URL // Ex. https://api.pwnedpasswords.com, the prefix is requested at /range/{prefix}
+  Client *http.Client
+}
+
+func (a RangeApi) Breached(password string) (bool, error) {
+  hash := Hash(password)
+
+  u := *a.Url
+  u.Path = u.Path + "/range/" + hash[:5]
+
+  req, err := http.NewRequest("GET", u.String(), nil)
+  if err != nil {
+    return false, err
+  }
+  req.Header.Set("Add-Padding", "true")
+
+  client := a.Client
+  if client == nil {
+    client = http.DefaultClient
+  }
+
+  res, err := client.Do(req)
+  if err != nil {
+    return false, err
+  }
+  defer res.Body.Close()
+
+  if res.StatusCode != http.StatusOK {
+    return false, fmt.Errorf("%s responded with status %d", u.String(), res.StatusCode)
+  }
+
+  return scanRange(bufio.NewScanner(res.Body), hash[5:])
+}
@@ -0,0 +1,39 @@
+package breach
+
+import (
+  "crypto/sha1"
+  "encoding/hex"
+  "strings"
+)
+
+// # Breached passwords
+// Passwords are looked up by their SHA-1 hash, the format of the Have I Been Pwned (HIBP) Pwned Passwords corpus. Sources are checked fully offline, except RangeApi which only sends the first 5 characters of the hash (k-anonymity).
+//  - Filter: a compact bloom filter file built with idpui --build-breach-filter from the HIBP hashes ordered by hash.
+//  - RangeDir: the HIBP range dataset as downloaded, one file per hash prefix.
+//  - RangeApi: a k-anonymity range api like https://api.pwnedpasswords.com for deployments with network access.
+
+type Checker interface {
+  Breached(password string) (bool, error)
+}
+
+// Checkers checks each source in order and reports the password breached if any source knows it.
+type Checkers []Checker
+
+func (cs Checkers) Breached(password string) (bool, error) {
+  for _, c := range cs {
+    breached, err := c.Breached(password)
+    if err != nil {
+      return false, err
+    }
+    if breached {
+      return true, nil
+    }
+  }
+  return false, nil
+}
+
+// Hash returns the upper case hex SHA-1 of the password, as used by the HIBP corpus.
+func Hash(password string) string {
+  sum := sha1.Sum([]byte(password))
+  return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
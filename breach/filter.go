@@ -0,0 +1,187 @@
+package breach
+
+import (
+  "io"
+  "os"
+  "fmt"
+  "math"
+  "bufio"
+  "bytes"
+  "strings"
+  "strconv"
+  "crypto/sha1"
+  "encoding/hex"
+  "encoding/binary"
+)
+
+// # Filter file
+// A bloom filter over the SHA-1 hashes of breached passwords. Lookups read only the bits they need from the file, so large corpora are not loaded into memory.
+// Layout, big endian: the magic "idpuibf1", the number of bits m (uint64), the number of probes k (uint32), 4 reserved bytes, then m bits.
+// The probes are derived from the hash itself by double hashing: bit i = (h1 + i*h2) mod m, with h1 and h2 the first and second 8 bytes of the SHA-1.
+
+var filterMagic = []byte("idpuibf1")
+
+const filterHeaderSize = 24
+
+type Filter struct {
+  r io.ReaderAt
+  closer io.Closer
+  m uint64
+  k uint32
+}
+
+// OpenFilter opens a filter file built by BuildFilter.
+func OpenFilter(path string) (*Filter, error) {
+  f, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+
+  filter, err := NewFilter(f)
+  if err != nil {
+    f.Close()
+    return nil, fmt.Errorf("%s: %s", path, err.Error())
+  }
+  filter.closer = f
+  return filter, nil
+}
+
+// NewFilter reads the filter header and looks up hashes from r.
+func NewFilter(r io.ReaderAt) (*Filter, error) {
+  header := make([]byte, filterHeaderSize)
+  _, err := r.ReadAt(header, 0)
+  if err != nil {
+    return nil, fmt.Errorf("Invalid breach filter header: %s", err.Error())
+  }
+  if bytes.Equal(header[:8], filterMagic) == false {
+    return nil, fmt.Errorf("Not a breach filter")
+  }
+
+  filter := &Filter{
+    r: r,
+    m: binary.BigEndian.Uint64(header[8:16]),
+    k: binary.BigEndian.Uint32(header[16:20]),
+  }
+  if filter.m == 0 || filter.k == 0 {
+    return nil, fmt.Errorf("Invalid breach filter size")
+  }
+  return filter, nil
+}
+
+func (f *Filter) Close() error {
+  if f.closer == nil {
+    return nil
+  }
+  return f.closer.Close()
+}
+
+// Breached reports whether the password is in the filter. False positives happen at the rate the filter was built for, false negatives never.
+func (f *Filter) Breached(password string) (bool, error) {
+  sum := sha1.Sum([]byte(password))
+
+  b := make([]byte, 1)
+  for _, bit := range probes(sum[:], f.m, f.k) {
+    _, err := f.r.ReadAt(b, filterHeaderSize + int64(bit / 8))
+    if err != nil {
+      return false, err
+    }
+    if b[0] & (1 << (bit % 8)) == 0 {
+      return false, nil
+    }
+  }
+  return true, nil
+}
+
+func probes(sum []byte, m uint64, k uint32) []uint64 {
+  h1 := binary.BigEndian.Uint64(sum[0:8])
+  h2 := binary.BigEndian.Uint64(sum[8:16]) | 1
+
+  bits := make([]uint64, k)
+  for i := uint32(0); i < k; i++ {
+    bits[i] = (h1 + uint64(i) * h2) % m
+  }
+  return bits
+}
+
+// BuildFilter writes a filter of the hashes in the corpus with the given false positive rate, ex. 0.001. The corpus is read twice, first to size the filter. Each line is a hex SHA-1 optionally followed by :count, as in the HIBP hashes ordered by hash. Hashes seen fewer than minCount times are skipped, which shrinks the filter.
+func BuildFilter(corpus io.ReadSeeker, out io.Writer, falsePositive float64, minCount int) (hashes uint64, err error) {
+  if falsePositive <= 0 || falsePositive >= 1 {
+    return 0, fmt.Errorf("False positive rate must be between 0 and 1")
+  }
+
+  err = scanCorpus(corpus, minCount, func(sum []byte) {
+    hashes++
+  })
+  if err != nil {
+    return 0, err
+  }
+
+  _, err = corpus.Seek(0, io.SeekStart)
+  if err != nil {
+    return 0, err
+  }
+
+  n := math.Max(float64(hashes), 1)
+  m := uint64(math.Ceil(-n * math.Log(falsePositive) / (math.Ln2 * math.Ln2)))
+  if m < 64 {
+    m = 64
+  }
+  k := uint32(math.Max(math.Round(float64(m) / n * math.Ln2), 1))
+
+  bits := make([]byte, (m + 7) / 8)
+  err = scanCorpus(corpus, minCount, func(sum []byte) {
+    for _, bit := range probes(sum, m, k) {
+      bits[bit / 8] |= 1 << (bit % 8)
+    }
+  })
+  if err != nil {
+    return 0, err
+  }
+
+  header := make([]byte, filterHeaderSize)
+  copy(header, filterMagic)
+  binary.BigEndian.PutUint64(header[8:16], m)
+  binary.BigEndian.PutUint32(header[16:20], k)
+
+  w := bufio.NewWriter(out)
+  _, err = w.Write(header)
+  if err != nil {
+    return 0, err
+  }
+  _, err = w.Write(bits)
+  if err != nil {
+    return 0, err
+  }
+  return hashes, w.Flush()
+}
+
+func scanCorpus(corpus io.Reader, minCount int, fn func(sum []byte)) error {
+  scanner := bufio.NewScanner(corpus)
+  line := 0
+  for scanner.Scan() {
+    line++
+
+    text := strings.TrimSpace(scanner.Text())
+    if text == "" {
+      continue
+    }
+
+    parts := strings.SplitN(text, ":", 2)
+    if len(parts) == 2 && minCount > 0 {
+      count, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+      if err != nil {
+        return fmt.Errorf("Line %d: Invalid count", line)
+      }
+      if count < minCount {
+        continue
+      }
+    }
+
+    sum, err := hex.DecodeString(parts[0])
+    if err != nil || len(sum) != sha1.Size {
+      return fmt.Errorf("Line %d: Not a SHA-1 hash", line)
+    }
+    fn(sum)
+  }
+  return scanner.Err()
+}
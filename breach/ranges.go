@@ -0,0 +1,44 @@
+package breach
+
+import (
+  "os"
+  "bufio"
+  "strings"
+  "path/filepath"
+)
+
+// RangeDir looks up hashes in the HIBP range dataset, a directory with one file per 5 character hash prefix. Each line of a file is the remaining 35 characters of a hash and the number of times it was seen, as in 0018A45C4D1DEF81644B54AB7F969B88D65:10
+type RangeDir struct {
+  Path string
+}
+
+func (d RangeDir) Breached(password string) (bool, error) {
+  hash := Hash(password)
+  prefix, suffix := hash[:5], hash[5:]
+
+  f, err := os.Open(filepath.Join(d.Path, prefix + ".txt"))
+  if os.IsNotExist(err) {
+    f, err = os.Open(filepath.Join(d.Path, prefix))
+  }
+  if os.IsNotExist(err) {
+    return false, nil // No breached hashes with this prefix
+  }
+  if err != nil {
+    return false, err
+  }
+  defer f.Close()
+
+  return scanRange(bufio.NewScanner(f), suffix)
+}
+
+// scanRange reports whether the suffix is in a range listing with a count above zero. Padding entries have count zero.
+func scanRange(scanner *bufio.Scanner, suffix string) (bool, error) {
+  for scanner.Scan() {
+    line := strings.TrimSpace(scanner.Text())
+    parts := strings.SplitN(line, ":", 2)
+    if strings.EqualFold(parts[0], suffix) {
+      return len(parts) < 2 || strings.TrimSpace(parts[1]) != "0", nil
+    }
+  }
+  return false, scanner.Err()
+}
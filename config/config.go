@@ -1,29 +1,112 @@
 package config
 
 import (
+  "fmt"
+  "os"
+  "io/ioutil"
   "github.com/spf13/viper"
   "strings"
 )
 
+// sources records where the configuration was read from, in the order it was merged. Shown by --check-config.
+var sources []string
+
 func setDefaults() {
   viper.SetDefault("config.app.path", "./app.yml")
   viper.SetDefault("config.discovery.path", "./discovery.yml")
+  viper.SetDefault("config.overlays", []string{}) // Ordered list of files merged on top of app.yml, ex. CONFIG_OVERLAYS="app.production.yml app.local.yml?". A ? marks an optional file
+  viper.SetDefault("serve.listener", "tls") // tls or http. Use http only behind a TLS terminating proxy
+  viper.SetDefault("serve.shutdown.timeout", 30) // seconds to drain in-flight requests on SIGTERM
+  viper.SetDefault("serve.tls.reload.interval", 10) // seconds between checks for renewed certificate files
+  viper.SetDefault("idpui.public.endpoints.recoverpassword", "/recover/password")
+  viper.SetDefault("idpui.public.endpoints.passwordstrength", "/password/strength")
+  viper.SetDefault("idpui.public.endpoints.accountsforget", "/login/accounts/forget")
+  viper.SetDefault("idpui.public.endpoints.loginlink", "/login/link")
+  viper.SetDefault("idpui.public.endpoints.loginlinkopen", "/login/link/open")
+  viper.SetDefault("idpui.public.endpoints.verifyemail", "/verify/email")
+  viper.SetDefault("idpui.public.endpoints.verifyemailsend", "/verify/email/send")
+  viper.SetDefault("idpui.public.endpoints.federatedlogin", "/login/federated")
+  viper.SetDefault("idpui.public.endpoints.federatedcallback", "/login/federated/callback")
+  viper.SetDefault("idpui.public.endpoints.identities", "/identities")
+  viper.SetDefault("idpui.public.endpoints.identitieslink", "/identities/link")
+  viper.SetDefault("idpui.public.endpoints.identitiesunlink", "/identities/unlink")
+  viper.SetDefault("idpui.public.endpoints.trusteddevices", "/devices/trusted")
+  viper.SetDefault("idpui.public.endpoints.trusteddevicesrevoke", "/devices/trusted/revoke")
+  viper.SetDefault("idpui.public.endpoints.sessions", "/sessions")
+  viper.SetDefault("idpui.public.endpoints.sessionsrevoke", "/sessions/revoke")
+  viper.SetDefault("idpui.public.endpoints.device", "/device") // Hydra urls.device.verification
+  viper.SetDefault("idpui.public.endpoints.deviceconfirm", "/device/confirm")
+  viper.SetDefault("idpui.public.endpoints.devicedone", "/device/done") // Hydra urls.device.success
+  viper.SetDefault("login.username", false)
+  viper.SetDefault("login.authenticators", []string{"idp"})
+  viper.SetDefault("login.remember.enabled", true)
+  viper.SetDefault("login.remember.for", 2592000) // 30 days
+  viper.SetDefault("login.skip", true)
+  viper.SetDefault("login.accounts.enabled", true)
+  viper.SetDefault("login.accounts.max", 5)
+  viper.SetDefault("login.accounts.for", 31536000) // 1 year
+  viper.SetDefault("login.link.enabled", false)
+  viper.SetDefault("login.link.ttl", 300)
+  viper.SetDefault("login.emailOtp.enabled", false)
+  viper.SetDefault("login.emailOtp.ttl", 600)
+  viper.SetDefault("login.trustedDevices.enabled", false)
+  viper.SetDefault("login.trustedDevices.for", 2592000) // 30 days
+  viper.SetDefault("stepup.password.maxAge", 900)
+  viper.SetDefault("stepup.password.secondFactor", true)
+  viper.SetDefault("stepup.totp.maxAge", 900)
+  viper.SetDefault("stepup.totp.secondFactor", true)
+  viper.SetDefault("stepup.delete.maxAge", 300)
+  viper.SetDefault("stepup.delete.secondFactor", true)
+  viper.SetDefault("stepup.emailchange.maxAge", 900)
+  viper.SetDefault("stepup.emailchange.secondFactor", true)
+  viper.SetDefault("stepup.identities.maxAge", 900)
+  viper.SetDefault("stepup.identities.secondFactor", true)
+  viper.SetDefault("stepup.devices.maxAge", 900)
+  viper.SetDefault("stepup.devices.secondFactor", true)
+  viper.SetDefault("stepup.sessions.maxAge", 900)
+  viper.SetDefault("stepup.sessions.secondFactor", true)
+  viper.SetDefault("ldap.search.filter", "(&(objectClass=person)(uid=%s))")
+  viper.SetDefault("ldap.attributes.username", "uid")
+  viper.SetDefault("ldap.attributes.email", "mail")
+  viper.SetDefault("ldap.attributes.name", "cn")
+  viper.SetDefault("ldap.provision", true)
+  viper.SetDefault("ldap.matchEmail", false)
+  viper.SetDefault("ldap.timeout", 10) // seconds
+  viper.SetDefault("hydra.timeout", 10) // seconds
+  viper.SetDefault("hydra.device.userCode.alphabet", "BCDFGHJKLMNPQRSTVWXZ") // As Hydra by default, no vowels so no words are spelled
+  viper.SetDefault("hydra.device.userCode.length", 8)
+  viper.SetDefault("password.policy.minLength", 8)
+  viper.SetDefault("password.policy.maxLength", 55)
+  viper.SetDefault("password.policy.minScore", 2) // zxcvbn score, 0 guessable to 4 very unguessable
+  viper.SetDefault("password.meter", true)
+  viper.SetDefault("password.recover.resetTotp", false)
+  viper.SetDefault("password.breached.policy", "off")
+  viper.SetDefault("password.breached.failOpen", false)
 }
 
 func GetInt(key string) int {
   return viper.GetInt(key)
 }
 
-func GetIntStrict(key string) int {
-  return viper.GetInt(key)
+// GetIntStrict fails if the key is not set in any config source.
+func GetIntStrict(key string) (int, error) {
+  if viper.IsSet(key) == false {
+    return 0, fmt.Errorf("Missing config %s", key)
+  }
+  return viper.GetInt(key), nil
 }
 
 func GetString(key string) string {
   return viper.GetString(key)
 }
 
-func GetStringStrict(key string) string {
-  return viper.GetString(key)
+// GetStringStrict fails if the key is not set or is empty.
+func GetStringStrict(key string) (string, error) {
+  v := viper.GetString(key)
+  if v == "" {
+    return "", fmt.Errorf("Missing config %s", key)
+  }
+  return v, nil
 }
 
 func GetStringSlice(key string) []string {
@@ -33,12 +116,19 @@ func GetStringSlice(key string) []string {
 func InitConfigurations() (error) {
   var err error
 
+  sources = nil // Loaded again, ex. by tests
+
   // lets environment variable override config file
   viper.AutomaticEnv()
   viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 
   setDefaults()
 
+  // AutomaticEnv only overrides keys that viper already knows about, bind the schema so every key can be set from the environment alone.
+  for _, key := range Keys() {
+    viper.BindEnv(key)
+  }
+
   // Load discovery configurations
 
   viper.SetConfigFile(viper.GetString("config.discovery.path"))
@@ -47,6 +137,8 @@ func InitConfigurations() (error) {
     return err
   }
 
+  sources = append(sources, "file " + viper.ConfigFileUsed())
+
   // Load app specific configurations
 
   viper.SetConfigFile(viper.GetString("config.app.path"))
@@ -54,6 +146,62 @@ func InitConfigurations() (error) {
   if err != nil { // Handle errors reading the config file
     return err
   }
+  sources = append(sources, "file " + viper.ConfigFileUsed())
+
+  // Load overlays in order, ex. base, environment and local. Later files override earlier ones. A missing overlay fails, unless it ends with ? so a local overlay can be optional.
+  for _, overlay := range viper.GetStringSlice("config.overlays") {
+    path := strings.TrimSuffix(overlay, "?")
+    if _, err := os.Stat(path); os.IsNotExist(err) {
+      if path == overlay {
+        return fmt.Errorf("Missing config overlay %s, end it with ? if it is optional", path)
+      }
+      sources = append(sources, "overlay " + path + " (optional, not found, skipped)")
+      continue
+    }
+
+    viper.SetConfigFile(path)
+    err = viper.MergeInConfig()
+    if err != nil {
+      return err
+    }
+    sources = append(sources, "overlay " + path)
+  }
+
+  sources = append(sources, "environment")
 
+  err = loadSecretFiles()
+  if err != nil {
+    return err
+  }
+
+  return nil
+}
+
+// loadSecretFiles implements <KEY>_FILE indirection for every schema key, ex. OAUTH2_CLIENT_SECRET_FILE=/run/secrets/idpui_client_secret. This is how Docker and Kubernetes mount secrets.
+func loadSecretFiles() error {
+  for _, key := range Keys() {
+    envKey := strings.ToUpper(strings.Replace(key, ".", "_", -1))
+    path := os.Getenv(envKey + "_FILE")
+    if path == "" {
+      continue
+    }
+
+    if os.Getenv(envKey) != "" {
+      return fmt.Errorf("Both %s and %s_FILE are set, use only one", envKey, envKey)
+    }
+
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+      return fmt.Errorf("%s_FILE: %s", envKey, err.Error())
+    }
+
+    viper.Set(key, strings.TrimRight(string(data), "\r\n")) // Files written by editors or echo end with a newline which is not part of the secret
+    sources = append(sources, "file " + path + " for " + key)
+  }
   return nil
 }
+
+// Sources returns the config files, overlays and secret files in the order they were merged.
+func Sources() []string {
+  return sources
+}
@@ -0,0 +1,180 @@
+package config
+
+import (
+  "os"
+  "strings"
+  "testing"
+  "io/ioutil"
+  "path/filepath"
+  "github.com/spf13/viper"
+)
+
+func TestStrictGetters(t *testing.T) {
+  viper.Reset()
+  defer viper.Reset()
+
+  viper.Set("test.int", 5)
+  viper.Set("test.zero", 0)
+  viper.Set("test.string", "value")
+  viper.Set("test.empty", "")
+
+  for _, test := range []struct{ key string; value int; fails bool }{
+    { "test.int", 5, false },
+    { "test.zero", 0, false }, // Set to zero is set
+    { "test.missing", 0, true },
+  } {
+    value, err := GetIntStrict(test.key)
+    if (err != nil) != test.fails || value != test.value {
+      t.Errorf("GetIntStrict(%s): expected %d failing %v, got %d, %v", test.key, test.value, test.fails, value, err)
+    }
+  }
+
+  for _, test := range []struct{ key string; value string; fails bool }{
+    { "test.string", "value", false },
+    { "test.empty", "", true }, // Empty is missing
+    { "test.missing", "", true },
+  } {
+    value, err := GetStringStrict(test.key)
+    if (err != nil) != test.fails || value != test.value {
+      t.Errorf("GetStringStrict(%s): expected %q failing %v, got %q, %v", test.key, test.value, test.fails, value, err)
+    }
+  }
+}
+
+func TestSecretFiles(t *testing.T) {
+  dir := t.TempDir()
+
+  for _, test := range []struct{
+    name string
+    content string // Not written when empty
+    env string // OAUTH2_CLIENT_SECRET, set next to the file
+    value string
+    err string
+  }{
+    { name:"read", content:"s3cret", value:"s3cret" },
+    { name:"trailing newline", content:"s3cret\r\n", value:"s3cret" },
+    { name:"missing file", err:"OAUTH2_CLIENT_SECRET_FILE" },
+    { name:"both set", content:"s3cret", env:"other", err:"use only one" },
+  } {
+    t.Run(test.name, func(t *testing.T) {
+      viper.Reset()
+      defer viper.Reset()
+      sources = nil
+
+      path := filepath.Join(dir, strings.Replace(test.name, " ", "_", -1))
+      if test.content != "" {
+        err := ioutil.WriteFile(path, []byte(test.content), 0600)
+        if err != nil {
+          t.Fatal(err)
+        }
+      }
+      setenv(t, "OAUTH2_CLIENT_SECRET_FILE", path)
+      setenv(t, "OAUTH2_CLIENT_SECRET", test.env)
+
+      err := loadSecretFiles()
+      if test.err != "" {
+        if err == nil || strings.Contains(err.Error(), test.err) == false {
+          t.Fatalf("Expected an error with %q, got %v", test.err, err)
+        }
+        return
+      }
+      if err != nil {
+        t.Fatal(err)
+      }
+      if value := viper.GetString("oauth2.client.secret"); value != test.value {
+        t.Fatalf("Expected %q, got %q", test.value, value)
+      }
+      if s := Sources(); len(s) != 1 || s[0] != "file " + path + " for oauth2.client.secret" {
+        t.Fatalf("Expected the file as source, got %v", s)
+      }
+    })
+  }
+}
+
+func TestOverlayOrder(t *testing.T) {
+  dir := t.TempDir()
+
+  files := map[string]string{
+    "discovery.yml": "provider:\n  name: discovery\nhydra:\n  public:\n    url: https://hydra.discovery\n",
+    "app.yml": "provider:\n  name: app\nlog:\n  format: default\nserve:\n  listener: tls\n",
+    "base.yml": "log:\n  format: json\nserve:\n  listener: http\n",
+    "local.yml": "serve:\n  listener: tls\n",
+  }
+  for name, content := range files {
+    err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  viper.Reset()
+  defer viper.Reset()
+  sources = nil
+
+  setenv(t, "CONFIG_DISCOVERY_PATH", filepath.Join(dir, "discovery.yml"))
+  setenv(t, "CONFIG_APP_PATH", filepath.Join(dir, "app.yml"))
+  setenv(t, "CONFIG_OVERLAYS", filepath.Join(dir, "base.yml") + " " + filepath.Join(dir, "missing.yml?") + " " + filepath.Join(dir, "local.yml?"))
+  setenv(t, "PROVIDER_NAME", "environment")
+
+  err := InitConfigurations()
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  for _, test := range []struct{ key string; value string }{
+    { "hydra.public.url", "https://hydra.discovery" }, // Only in discovery
+    { "log.format", "json" }, // The overlay overrides app
+    { "serve.listener", "tls" }, // Later overlays override earlier ones
+    { "provider.name", "environment" }, // The environment overrides every file
+  } {
+    if value := viper.GetString(test.key); value != test.value {
+      t.Errorf("%s: expected %q, got %q", test.key, test.value, value)
+    }
+  }
+
+  expected := []string{
+    "file " + filepath.Join(dir, "discovery.yml"),
+    "file " + filepath.Join(dir, "app.yml"),
+    "overlay " + filepath.Join(dir, "base.yml"),
+    "overlay " + filepath.Join(dir, "missing.yml") + " (optional, not found, skipped)",
+    "overlay " + filepath.Join(dir, "local.yml"),
+    "environment",
+  }
+  if strings.Join(Sources(), "\n") != strings.Join(expected, "\n") {
+    t.Errorf("Expected sources\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(Sources(), "\n"))
+  }
+
+  // Loading again lists every source once
+  err = InitConfigurations()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if strings.Join(Sources(), "\n") != strings.Join(expected, "\n") {
+    t.Errorf("Expected sources\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(Sources(), "\n"))
+  }
+
+  // An overlay not marked optional must exist, ex. a mistyped path
+  setenv(t, "CONFIG_OVERLAYS", filepath.Join(dir, "base.yml") + " " + filepath.Join(dir, "missing.yml"))
+  err = InitConfigurations()
+  if err == nil || strings.Contains(err.Error(), filepath.Join(dir, "missing.yml")) == false {
+    t.Errorf("Expected the missing overlay to fail, got %v", err)
+  }
+}
+
+// setenv sets the environment variable for the test, empty unsets it.
+func setenv(t *testing.T, key string, value string) {
+  previous, exists := os.LookupEnv(key)
+  t.Cleanup(func() {
+    if exists {
+      os.Setenv(key, previous)
+    } else {
+      os.Unsetenv(key)
+    }
+  })
+
+  if value == "" {
+    os.Unsetenv(key)
+    return
+  }
+  os.Setenv(key, value)
+}
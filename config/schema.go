@@ -0,0 +1,486 @@
+package config
+
+import (
+  "fmt"
+  "io"
+  "sort"
+  "strings"
+  "reflect"
+  "github.com/spf13/viper"
+  "gopkg.in/go-playground/validator.v9"
+
+  "github.com/opensentry/idpui/validators"
+)
+
+// # Configuration schema
+// The typed configuration is unmarshalled from viper (files and environment) and validated on startup, so a missing key fails the boot instead of producing a broken url at request time.
+// The mapstructure tags are the config keys, the validate tags the rules. Fields tagged secret are redacted when printed.
+
+type Configuration struct {
+  Log      LogConfiguration      `mapstructure:"log"`
+  Provider ProviderConfiguration `mapstructure:"provider"`
+  Serve    ServeConfiguration    `mapstructure:"serve"`
+  Session  KeyConfiguration      `mapstructure:"session"`
+  Csrf     KeyConfiguration      `mapstructure:"csrf"`
+  Oauth2   Oauth2Configuration   `mapstructure:"oauth2"`
+  Login LoginConfiguration `mapstructure:"login"`
+  StepUp StepUpConfiguration `mapstructure:"stepup"`
+  Password PasswordConfiguration `mapstructure:"password"`
+  Federation FederationConfiguration `mapstructure:"federation"`
+  Ldap LdapConfiguration `mapstructure:"ldap"`
+  Hydra    HydraConfiguration    `mapstructure:"hydra"`
+  Idp      IdpConfiguration      `mapstructure:"idp"`
+  Idpui    IdpuiConfiguration    `mapstructure:"idpui"`
+  Meui     MeuiConfiguration     `mapstructure:"meui"`
+}
+
+type LogConfiguration struct {
+  Debug  int    `mapstructure:"debug"  validate:"min=0,max=1"`
+  Format string `mapstructure:"format" validate:"omitempty,oneof=default json"`
+}
+
+type ProviderConfiguration struct {
+  Name string `mapstructure:"name" validate:"required,notblank"`
+}
+
+type ServeConfiguration struct {
+  Listener string `mapstructure:"listener" validate:"required,oneof=tls http"`
+  Public struct {
+    Port string `mapstructure:"port" validate:"required,numeric"`
+  } `mapstructure:"public"`
+  Tls struct {
+    Cert struct {
+      Path string `mapstructure:"path"`
+    } `mapstructure:"cert"`
+    Key struct {
+      Path string `mapstructure:"path"`
+    } `mapstructure:"key"`
+    Reload struct {
+      Interval int `mapstructure:"interval" validate:"min=1"`
+    } `mapstructure:"reload"`
+  } `mapstructure:"tls"`
+  Proxy struct {
+    Trusted []string `mapstructure:"trusted" validate:"dive,cidr|ip"`
+  } `mapstructure:"proxy"`
+  Shutdown struct {
+    Timeout int `mapstructure:"timeout" validate:"min=0"`
+  } `mapstructure:"shutdown"`
+}
+
+type KeyConfiguration struct {
+  AuthKey string `mapstructure:"authKey" validate:"required,min=32" secret:"true"`
+}
+
+type Oauth2Configuration struct {
+  Client struct {
+    Id     string `mapstructure:"id"     validate:"required,notblank"`
+    Secret string `mapstructure:"secret" validate:"required,notblank" secret:"true"`
+  } `mapstructure:"client"`
+  Scopes struct {
+    Required []string `mapstructure:"required" validate:"min=1,dive,notblank"`
+  } `mapstructure:"scopes"`
+}
+
+type LoginConfiguration struct {
+  Username bool `mapstructure:"username"` // Accept the username as well as the email
+  Authenticators []string `mapstructure:"authenticators" validate:"min=1,dive,oneof=idp ldap"` // Verify credentials with each in order until one accepts them
+  Remember struct {
+    Enabled bool `mapstructure:"enabled"` // Show keep me signed in
+    For     int  `mapstructure:"for"     validate:"min=0"` // Seconds, 0 until the Hydra session cookie expires
+  } `mapstructure:"remember"`
+  Skip bool `mapstructure:"skip"` // Single sign-on, accept logins Hydra already has a session for
+  Reauthenticate struct {
+    Scopes []string `mapstructure:"scopes"` // Always ask for credentials when a client requests any of these
+  } `mapstructure:"reauthenticate"`
+  Accounts struct {
+    Enabled bool `mapstructure:"enabled"` // Offer the accounts recently used on the device
+    Max     int  `mapstructure:"max"     validate:"min=1"`
+    For     int  `mapstructure:"for"     validate:"min=0"` // Seconds the device remembers them, 0 until the browser closes
+  } `mapstructure:"accounts"`
+  Link struct {
+    Enabled bool `mapstructure:"enabled"` // Offer to email a sign-in link instead of entering the password
+    Ttl     int  `mapstructure:"ttl"     validate:"min=60,max=3600"` // Seconds the link can be opened
+  } `mapstructure:"link"`
+  EmailOtp struct {
+    Enabled bool `mapstructure:"enabled"` // Offer a code sent by email instead of TOTP
+    Ttl     int  `mapstructure:"ttl"     validate:"min=60,max=3600"` // Seconds the code can be entered
+  } `mapstructure:"emailOtp"`
+  TrustedDevices struct {
+    Enabled bool   `mapstructure:"enabled"` // Offer to skip the second factor on devices the human trusts
+    For     int    `mapstructure:"for"     validate:"min=60"` // Seconds a device stays trusted
+    Path    string `mapstructure:"path"` // JSON file of the trusted devices, on a volume shared by every ui instance
+  } `mapstructure:"trustedDevices"`
+}
+
+type FederationConfiguration struct {
+  Links struct {
+    Path string `mapstructure:"path"` // JSON file of the upstream identities linked to humans, on a volume shared by every ui instance
+  } `mapstructure:"links"`
+  Providers []FederationProviderConfiguration `mapstructure:"providers" validate:"dive" secret:"true"` // Redacted as a whole, it holds client secrets
+}
+
+type FederationProviderConfiguration struct {
+  Id     string `mapstructure:"id"     validate:"required,alphanum"` // Used in urls and links, never change it once humans have linked
+  Name   string `mapstructure:"name"   validate:"required,notblank"`
+  Issuer string `mapstructure:"issuer" validate:"required,url"`
+  Client struct {
+    Id     string `mapstructure:"id"     validate:"required,notblank"`
+    Secret string `mapstructure:"secret" validate:"required,notblank"`
+  } `mapstructure:"client"`
+  Scopes     []string `mapstructure:"scopes"` // openid, email and profile when empty
+  TrustEmail bool     `mapstructure:"trustEmail"` // Link by verified email without asking the human to log in once
+  TrustMfa   bool     `mapstructure:"trustMfa"`   // Count amr mfa of the upstream as the second factor, ex. for humans with TOTP required
+}
+
+type LdapConfiguration struct {
+  Url      string `mapstructure:"url"      validate:"omitempty,url"` // ldap:// or ldaps://
+  StartTls bool   `mapstructure:"startTls"` // Upgrade ldap:// before sending credentials
+  Bind struct {
+    Dn       string `mapstructure:"dn"` // Service account used to search, anonymous when empty
+    Password string `mapstructure:"password" secret:"true"`
+  } `mapstructure:"bind"`
+  Search struct {
+    Base   string `mapstructure:"base"`
+    Filter string `mapstructure:"filter"` // %s is the escaped identifier entered on the login form
+  } `mapstructure:"search"`
+  Attributes struct {
+    Username string `mapstructure:"username"`
+    Email    string `mapstructure:"email"`
+    Name     string `mapstructure:"name"`
+  } `mapstructure:"attributes"`
+  Provision bool `mapstructure:"provision"` // Create humans in the idp for entries matching none, unless another human has the email
+  MatchEmail bool `mapstructure:"matchEmail"` // Entries log in as the human with the same confirmed email when no username matches, trusting the directory with those accounts
+  Timeout   int  `mapstructure:"timeout" validate:"min=1"` // Seconds
+}
+
+type StepUpConfiguration struct {
+  Password    AuthenticationRequirementConfiguration `mapstructure:"password"`
+  Totp        AuthenticationRequirementConfiguration `mapstructure:"totp"`
+  Delete      AuthenticationRequirementConfiguration `mapstructure:"delete"`
+  Emailchange AuthenticationRequirementConfiguration `mapstructure:"emailchange"`
+  Identities  AuthenticationRequirementConfiguration `mapstructure:"identities"`
+  Devices     AuthenticationRequirementConfiguration `mapstructure:"devices"`
+  Sessions    AuthenticationRequirementConfiguration `mapstructure:"sessions"`
+}
+
+type AuthenticationRequirementConfiguration struct {
+  MaxAge       int      `mapstructure:"maxAge"       validate:"min=0"` // Seconds since the human entered credentials, 0 for any age
+  Acr          []string `mapstructure:"acr"` // One of these is required, empty for any
+  Amr          []string `mapstructure:"amr"` // All of these are required
+  SecondFactor bool     `mapstructure:"secondFactor"` // Humans with TOTP must have used it
+  EmailOtp     bool     `mapstructure:"emailOtp"` // A code sent by email counts as the second factor, see login.emailOtp
+  TrustedDevice bool    `mapstructure:"trustedDevice"` // A login on a device trusted to skip the second factor counts as it, see login.trustedDevices
+}
+
+type PasswordConfiguration struct {
+  Policy struct {
+    MinLength int  `mapstructure:"minLength" validate:"min=1"`
+    MaxLength int  `mapstructure:"maxLength" validate:"min=1,max=55"` // The idp does not accept longer passwords
+    Lowercase bool `mapstructure:"lowercase"`
+    Uppercase bool `mapstructure:"uppercase"`
+    Digits    bool `mapstructure:"digits"`
+    Symbols   bool `mapstructure:"symbols"`
+    MinScore  int  `mapstructure:"minScore"  validate:"min=0,max=4"`
+  } `mapstructure:"policy"`
+  Meter bool `mapstructure:"meter"` // Show a live strength meter while typing
+  Recover struct {
+    ResetTotp bool `mapstructure:"resetTotp"` // Offer to turn TOTP off when recovering the password, so control of the email alone removes the second factor
+  } `mapstructure:"recover"`
+  Breached struct {
+    Policy string `mapstructure:"policy" validate:"oneof=off warn block"` // warn lets the human accept the risk
+    Filter string `mapstructure:"filter"` // Built with --build-breach-filter
+    Ranges string `mapstructure:"ranges"` // Directory of the HIBP range dataset
+    Api    string `mapstructure:"api"    validate:"omitempty,url"` // k-anonymity range api, only when network access is allowed
+    FailOpen bool  `mapstructure:"failOpen"` // Accept passwords unchecked when a source fails, ex. the api is unreachable, instead of refusing every new password
+  } `mapstructure:"breached"`
+}
+
+type HydraConfiguration struct {
+  Public struct {
+    Url string `mapstructure:"url" validate:"required,url"`
+  } `mapstructure:"public"`
+  Admin struct {
+    Url string `mapstructure:"url" validate:"required,url"` // Hydra 2 or later, used for login requests, devices and sessions. Never expose it publicly
+  } `mapstructure:"admin"`
+  Timeout int `mapstructure:"timeout" validate:"min=1"` // Seconds, for every call to the public and admin api
+  Device struct {
+    UserCode struct {
+      Alphabet string `mapstructure:"alphabet" validate:"required"` // The characters of the user codes Hydra issues, dashes and spaces typed by humans are dropped unless part of it
+      Length   int    `mapstructure:"length"   validate:"min=1"`
+    } `mapstructure:"userCode"`
+  } `mapstructure:"device"`
+}
+
+type IdpConfiguration struct {
+  Public struct {
+    Url string `mapstructure:"url" validate:"required,url"`
+    Endpoints struct {
+      Humans struct {
+        Collection          string `mapstructure:"collection"          validate:"required,endpoint"`
+        Authenticate        string `mapstructure:"authenticate"        validate:"required,endpoint"`
+        Password            string `mapstructure:"password"            validate:"required,endpoint"`
+        Totp                string `mapstructure:"totp"                validate:"required,endpoint"`
+        Emailchange         string `mapstructure:"emailchange"         validate:"required,endpoint"`
+        Logout              string `mapstructure:"logout"              validate:"required,endpoint"`
+        Recover             string `mapstructure:"recover"             validate:"required,endpoint"`
+        Recoververification string `mapstructure:"recoververification" validate:"required,endpoint"`
+        Deleteverification  string `mapstructure:"deleteverification"  validate:"required,endpoint"`
+      } `mapstructure:"humans"`
+      Challenges struct {
+        Collection string `mapstructure:"collection" validate:"required,endpoint"`
+        Verify     string `mapstructure:"verify"     validate:"required,endpoint"`
+      } `mapstructure:"challenges"`
+      Invites struct {
+        Collection string `mapstructure:"collection" validate:"required,endpoint"`
+        Claim      string `mapstructure:"claim"      validate:"required,endpoint"`
+      } `mapstructure:"invites"`
+    } `mapstructure:"endpoints"`
+  } `mapstructure:"public"`
+}
+
+type IdpuiConfiguration struct {
+  Public struct {
+    Url string `mapstructure:"url" validate:"omitempty,url"` // Derived from the request when empty, see serve.proxy.trusted. Required for mailed links and federation
+    Endpoints struct {
+      Root                 string `mapstructure:"root"                 validate:"required,endpoint"`
+      Login                string `mapstructure:"login"                validate:"required,endpoint"`
+      Federatedlogin       string `mapstructure:"federatedlogin"       validate:"required,endpoint"`
+      Federatedcallback    string `mapstructure:"federatedcallback"    validate:"required,endpoint"`
+      Accountsforget       string `mapstructure:"accountsforget"       validate:"required,endpoint"`
+      Loginlink            string `mapstructure:"loginlink"            validate:"required,endpoint"`
+      Loginlinkopen        string `mapstructure:"loginlinkopen"        validate:"required,endpoint"`
+      Verifyemail          string `mapstructure:"verifyemail"          validate:"required,endpoint"`
+      Verifyemailsend      string `mapstructure:"verifyemailsend"      validate:"required,endpoint"`
+      Logout               string `mapstructure:"logout"               validate:"required,endpoint"`
+      Claim                string `mapstructure:"claim"                validate:"required,endpoint"`
+      Register             string `mapstructure:"register"             validate:"required,endpoint"`
+      Recover              string `mapstructure:"recover"              validate:"required,endpoint"`
+      Recoverpassword      string `mapstructure:"recoverpassword"      validate:"required,endpoint"`
+      Password             string `mapstructure:"password"             validate:"required,endpoint"`
+      Passwordstrength     string `mapstructure:"passwordstrength"     validate:"required,endpoint"`
+      Totp                 string `mapstructure:"totp"                 validate:"required,endpoint"`
+      Identities           string `mapstructure:"identities"           validate:"required,endpoint"`
+      Identitieslink       string `mapstructure:"identitieslink"       validate:"required,endpoint"`
+      Identitiesunlink     string `mapstructure:"identitiesunlink"     validate:"required,endpoint"`
+      Trusteddevices       string `mapstructure:"trusteddevices"       validate:"required,endpoint"`
+      Trusteddevicesrevoke string `mapstructure:"trusteddevicesrevoke" validate:"required,endpoint"`
+      Sessions             string `mapstructure:"sessions"             validate:"required,endpoint"`
+      Sessionsrevoke       string `mapstructure:"sessionsrevoke"       validate:"required,endpoint"`
+      Device               string `mapstructure:"device"               validate:"required,endpoint"`
+      Deviceconfirm        string `mapstructure:"deviceconfirm"        validate:"required,endpoint"`
+      Devicedone           string `mapstructure:"devicedone"           validate:"required,endpoint"`
+      Delete               string `mapstructure:"delete"               validate:"required,endpoint"`
+      Emailchange          string `mapstructure:"emailchange"          validate:"required,endpoint"`
+      Emailchangeconfirm   string `mapstructure:"emailchangeconfirm"   validate:"required,endpoint"`
+      Seeyoulater          string `mapstructure:"seeyoulater"          validate:"required,endpoint"`
+    } `mapstructure:"endpoints"`
+  } `mapstructure:"public"`
+}
+
+type MeuiConfiguration struct {
+  Public struct {
+    Url string `mapstructure:"url" validate:"required,url"`
+    Endpoints struct {
+      Profile              string `mapstructure:"profile"              validate:"required,endpoint"`
+    } `mapstructure:"endpoints"`
+  } `mapstructure:"public"`
+}
+
+// ValidationErrors aggregates every problem found in the configuration, so all of them can be fixed in one go.
+type ValidationErrors []string
+
+func (e ValidationErrors) Error() string {
+  return "Invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// Load unmarshals the current configuration into the typed schema without validating it.
+func Load() (*Configuration, error) {
+  var c Configuration
+  err := viper.Unmarshal(&c)
+  if err != nil {
+    return nil, err
+  }
+  return &c, nil
+}
+
+// LoadAndValidate is Load followed by Validate.
+func LoadAndValidate(development bool) (*Configuration, error) {
+  c, err := Load()
+  if err != nil {
+    return nil, err
+  }
+  err = c.Validate(development)
+  if err != nil {
+    return nil, err
+  }
+  return c, nil
+}
+
+// Validate checks the configuration against the schema. In development mode TLS certificates are optional, as a self-signed one is generated.
+func (c *Configuration) Validate(development bool) error {
+  var errors ValidationErrors
+
+  validate := validator.New()
+  validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+    return field.Tag.Get("mapstructure")
+  })
+  validate.RegisterValidation("notblank", validators.NotBlank)
+  validate.RegisterValidation("endpoint", func(fl validator.FieldLevel) bool {
+    return strings.HasPrefix(fl.Field().String(), "/")
+  })
+
+  err := validate.Struct(c)
+  if err != nil {
+    if _, ok := err.(*validator.InvalidValidationError); ok {
+      return err
+    }
+
+    for _, e := range err.(validator.ValidationErrors) {
+      key := e.Namespace()
+      key = key[strings.Index(key, ".")+1:] // Strip the struct name
+
+      switch e.Tag() {
+      case "required":
+        errors = append(errors, fmt.Sprintf("%s: Required", key))
+      case "notblank":
+        errors = append(errors, fmt.Sprintf("%s: Not Blank", key))
+      case "url":
+        errors = append(errors, fmt.Sprintf("%s: Not an absolute url", key))
+      case "endpoint":
+        errors = append(errors, fmt.Sprintf("%s: Must be a path starting with /", key))
+      case "min", "max":
+        errors = append(errors, fmt.Sprintf("%s: Must be %s %s", key, e.Tag(), e.Param()))
+      case "oneof":
+        errors = append(errors, fmt.Sprintf("%s: Must be one of %s", key, e.Param()))
+      default:
+        errors = append(errors, fmt.Sprintf("%s: Invalid (%s)", key, e.Tag()))
+      }
+    }
+  }
+
+  if c.Serve.Listener == "tls" && development == false {
+    if c.Serve.Tls.Cert.Path == "" {
+      errors = append(errors, "serve.tls.cert.path: Required when serve.listener is tls")
+    }
+    if c.Serve.Tls.Key.Path == "" {
+      errors = append(errors, "serve.tls.key.path: Required when serve.listener is tls")
+    }
+  }
+
+  if c.Password.Policy.MaxLength < c.Password.Policy.MinLength {
+    errors = append(errors, "password.policy.maxLength: Must be at least password.policy.minLength")
+  }
+
+  if c.StepUp.Delete.MaxAge == 0 {
+    errors = append(errors, "stepup.delete.maxAge: Must be at least 1, deleting requires a recent login")
+  }
+
+  if len(c.Federation.Providers) > 0 && c.Federation.Links.Path == "" {
+    errors = append(errors, "federation.links.path: Required when federation.providers are configured")
+  }
+  // Mailed links and the redirect_uri of upstream providers must not depend on the Host header of the request
+  if c.Idpui.Public.Url == "" && (c.Login.Link.Enabled || c.Login.EmailOtp.Enabled || len(c.Federation.Providers) > 0) {
+    errors = append(errors, "idpui.public.url: Required when login.link, login.emailOtp or federation.providers are configured")
+  }
+  if c.Login.TrustedDevices.Enabled && c.Login.TrustedDevices.Path == "" {
+    errors = append(errors, "login.trustedDevices.path: Required when login.trustedDevices.enabled")
+  }
+
+  ids := make(map[string]bool)
+  for _, p := range c.Federation.Providers {
+    if ids[p.Id] {
+      errors = append(errors, fmt.Sprintf("federation.providers: Duplicate id %s", p.Id))
+    }
+    ids[p.Id] = true
+  }
+
+  authenticators := make(map[string]bool)
+  for _, a := range c.Login.Authenticators {
+    if authenticators[a] {
+      errors = append(errors, fmt.Sprintf("login.authenticators: Duplicate %s", a))
+    }
+    authenticators[a] = true
+  }
+  if authenticators["ldap"] {
+    if c.Ldap.Url == "" {
+      errors = append(errors, "ldap.url: Required when login.authenticators has ldap")
+    }
+    if c.Ldap.Search.Base == "" {
+      errors = append(errors, "ldap.search.base: Required when login.authenticators has ldap")
+    }
+    if strings.Contains(c.Ldap.Search.Filter, "%s") == false {
+      errors = append(errors, "ldap.search.filter: Must contain %s, the identifier entered on the login form")
+    }
+  }
+
+  breached := c.Password.Breached
+  if breached.Policy != "off" && breached.Filter == "" && breached.Ranges == "" && breached.Api == "" {
+    errors = append(errors, "password.breached: One of filter, ranges or api is required when policy is " + breached.Policy)
+  }
+
+  if len(errors) > 0 {
+    sort.Strings(errors)
+    return errors
+  }
+  return nil
+}
+
+// WriteEffective prints every schema key with the value in effect after merging files and environment. Secrets are redacted.
+func WriteEffective(w io.Writer) {
+  for _, key := range Keys() {
+    var value string = fmt.Sprintf("%v", viper.Get(key))
+    if viper.IsSet(key) == false {
+      value = "<unset>"
+    } else if IsSecret(key) {
+      value = "<redacted>"
+    }
+    fmt.Fprintf(w, "%s = %s\n", key, value)
+  }
+}
+
+// Keys returns every config key of the schema in declaration order.
+func Keys() []string {
+  return schemaKeys(reflect.TypeOf(Configuration{}), "")
+}
+
+// IsSecret reports if the value of the key must be redacted when printed.
+func IsSecret(key string) bool {
+  t := reflect.TypeOf(Configuration{})
+  for _, part := range strings.Split(key, ".") {
+    if t.Kind() != reflect.Struct {
+      return false
+    }
+    found := false
+    for i := 0; i < t.NumField(); i++ {
+      f := t.Field(i)
+      if strings.EqualFold(f.Tag.Get("mapstructure"), part) {
+        if f.Tag.Get("secret") == "true" {
+          return true
+        }
+        t = f.Type
+        found = true
+        break
+      }
+    }
+    if found == false {
+      return false
+    }
+  }
+  return false
+}
+
+func schemaKeys(t reflect.Type, prefix string) (keys []string) {
+  for i := 0; i < t.NumField(); i++ {
+    f := t.Field(i)
+    name := f.Tag.Get("mapstructure")
+    if prefix != "" {
+      name = prefix + "." + name
+    }
+    if f.Type.Kind() == reflect.Struct {
+      keys = append(keys, schemaKeys(f.Type, name)...)
+      continue
+    }
+    keys = append(keys, name)
+  }
+  return keys
+}
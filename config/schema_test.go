@@ -0,0 +1,110 @@
+package config
+
+import (
+  "bytes"
+  "sort"
+  "strings"
+  "testing"
+  "github.com/spf13/viper"
+)
+
+func TestValidationErrors(t *testing.T) {
+  for _, test := range []struct{
+    name string
+    development bool
+    change func(c *Configuration)
+    reported string
+    expected bool
+  }{
+    { "required", false, func(c *Configuration) {}, "provider.name: Required", true },
+    { "endpoint", false, func(c *Configuration) { c.Idpui.Public.Endpoints.Login = "login" }, "idpui.public.endpoints.login: Must be a path starting with /", true },
+    { "oneof", false, func(c *Configuration) { c.Serve.Listener = "udp" }, "serve.listener: Must be one of tls http", true },
+    { "tls certificate", false, func(c *Configuration) { c.Serve.Listener = "tls" }, "serve.tls.cert.path: Required when serve.listener is tls", true },
+    { "tls certificate in development", true, func(c *Configuration) { c.Serve.Listener = "tls" }, "serve.tls.cert.path: Required when serve.listener is tls", false },
+    { "password lengths", false, func(c *Configuration) { c.Password.Policy.MinLength = 10; c.Password.Policy.MaxLength = 8 }, "password.policy.maxLength: Must be at least password.policy.minLength", true },
+    { "public url for mailed links", false, func(c *Configuration) { c.Login.Link.Enabled = true }, "idpui.public.url: Required when login.link, login.emailOtp or federation.providers are configured", true },
+    { "public url configured", false, func(c *Configuration) { c.Login.Link.Enabled = true; c.Idpui.Public.Url = "https://ui.example" }, "idpui.public.url: Required", false },
+    { "duplicate provider", false, func(c *Configuration) { c.Federation.Providers = []FederationProviderConfiguration{ {Id:"partner"}, {Id:"partner"} } }, "federation.providers: Duplicate id partner", true },
+    { "ldap filter", false, func(c *Configuration) { c.Login.Authenticators = []string{"ldap"}; c.Ldap.Search.Filter = "(uid=bob)" }, "ldap.search.filter: Must contain %s, the identifier entered on the login form", true },
+    { "breach source", false, func(c *Configuration) { c.Password.Breached.Policy = "block" }, "password.breached: One of filter, ranges or api is required when policy is block", true },
+  } {
+    t.Run(test.name, func(t *testing.T) {
+      c := &Configuration{}
+      c.Password.Breached.Policy = "off"
+      test.change(c)
+
+      err := c.Validate(test.development)
+      errors, ok := err.(ValidationErrors)
+      if ok == false {
+        t.Fatalf("Expected ValidationErrors, got %v", err)
+      }
+
+      // Every problem is reported at once, in order
+      if len(errors) < 2 || sort.StringsAreSorted(errors) == false {
+        t.Fatalf("Expected every problem sorted, got %v", errors)
+      }
+      if strings.HasPrefix(err.Error(), "Invalid configuration:\n  ") == false || strings.Count(err.Error(), "\n  ") != len(errors) {
+        t.Fatalf("Expected one line for each problem, got %s", err.Error())
+      }
+
+      reported := false
+      for _, e := range errors {
+        if strings.HasPrefix(e, test.reported) {
+          reported = true
+        }
+      }
+      if reported != test.expected {
+        t.Fatalf("Expected %q reported %v, got %v", test.reported, test.expected, errors)
+      }
+    })
+  }
+}
+
+func TestWriteEffectiveRedactsSecrets(t *testing.T) {
+  viper.Reset()
+  defer viper.Reset()
+
+  viper.Set("oauth2.client.id", "idpui")
+  viper.Set("oauth2.client.secret", "client secret")
+  viper.Set("session.authKey", "session key")
+  viper.Set("ldap.bind.password", "bind password")
+  viper.Set("federation.providers", []map[string]string{ {"id":"partner", "clientSecret":"partner secret"} })
+
+  var out bytes.Buffer
+  WriteEffective(&out)
+
+  for _, line := range []string{
+    "oauth2.client.id = idpui",
+    "oauth2.client.secret = <redacted>",
+    "session.authKey = <redacted>",
+    "ldap.bind.password = <redacted>",
+    "federation.providers = <redacted>", // Redacted as a whole
+    "csrf.authKey = <unset>",
+  } {
+    if strings.Contains(out.String(), line + "\n") == false {
+      t.Errorf("Expected %q\n%s", line, out.String())
+    }
+  }
+
+  for _, secret := range []string{ "client secret", "session key", "bind password", "partner secret" } {
+    if strings.Contains(out.String(), secret) {
+      t.Errorf("Expected %q to be redacted\n%s", secret, out.String())
+    }
+  }
+}
+
+func TestIsSecret(t *testing.T) {
+  for key, secret := range map[string]bool{
+    "oauth2.client.secret": true,
+    "oauth2.client.id": false,
+    "csrf.authKey": true,
+    "federation.providers": true,
+    "ldap.bind.password": true,
+    "ldap.bind.dn": false,
+    "unknown.key": false,
+  } {
+    if IsSecret(key) != secret {
+      t.Errorf("IsSecret(%s): expected %v", key, secret)
+    }
+  }
+}
@@ -12,4 +12,7 @@ const RECOVERCONFIRM_ERRORS = "recoverconfirm.errors"
 const RECOVER_CHALLENGE_KEY = "recover_challenge"
 
 const VERIFY_ERRORS = "verify.errors"
-const OTP_CHALLENGE_KEY = "otp_challenge"
\ No newline at end of file
+const OTP_CHALLENGE_KEY = "otp_challenge"
+const VERIFY_EMAIL_ERRORS = "verifyemail.errors"
+const VERIFY_EMAIL_REDIRECT_KEY = "verifyemail.redirect" // Where the otp_challenge continued, the login the code is sent for
+const VERIFY_EMAIL_CODE_KEY = "code"
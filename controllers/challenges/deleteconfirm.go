@@ -13,7 +13,6 @@ import (
   idp "github.com/opensentry/idp/client"
 
   "github.com/opensentry/idpui/app"
-  "github.com/opensentry/idpui/config"
   "github.com/opensentry/idpui/utils"
   "github.com/opensentry/idpui/validators"
 
@@ -179,7 +178,7 @@ func SubmitDeleteConfirm(env *app.Environment) gin.HandlerFunc {
 
     idpClient := app.IdpClientUsingClientCredentials(env, c)
 
-    status, responses, err := idp.VerifyChallenges(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.challenges.verify"), []idp.UpdateChallengesVerifyRequest{ {OtpChallenge: form.Challenge, Code: form.Code} })
+    status, responses, err := env.IdpApi.VerifyChallenges(idpClient, env.Endpoints.Idp.ChallengesVerify.String(), []idp.UpdateChallengesVerifyRequest{ {OtpChallenge: form.Challenge, Code: form.Code} })
     if err != nil {
       log.WithFields( logrus.Fields{ DELETE_CHALLENGE_KEY: form.Challenge }).Debug(err.Error()) // Security Warning: Do not log the code is like logging a password!
       c.AbortWithStatus(http.StatusInternalServerError)
@@ -230,7 +229,7 @@ func SubmitDeleteConfirm(env *app.Environment) gin.HandlerFunc {
       // FIXME: Maybe this should use an access token instead of client credentials.
 
       deleteRequests := []idp.UpdateHumansDeleteVerifyRequest{ {DeleteChallenge: challengeVerification.OtpChallenge} }
-      status, responses, err := idp.DeleteHumansVerify(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.humans.deleteverification"), deleteRequests)
+      status, responses, err := env.IdpApi.DeleteHumansVerify(idpClient, env.Endpoints.Idp.HumansDeleteVerification.String(), deleteRequests)
       if err != nil {
         log.Debug(err.Error())
         c.AbortWithStatus(http.StatusInternalServerError)
@@ -272,6 +271,21 @@ func SubmitDeleteConfirm(env *app.Environment) gin.HandlerFunc {
 
       if verification.Verified == true && verification.RedirectTo != "" {
 
+        // Nothing of the deleted human may stay signed in. End every session and revoke every token.
+        err = env.HydraApi.RevokeLoginSessions(verification.Id)
+        if err != nil {
+          log.WithFields(logrus.Fields{ "id":verification.Id }).Debug(err.Error())
+          c.AbortWithStatus(http.StatusInternalServerError)
+          return
+        }
+
+        err = env.HydraApi.RevokeConsentSessions(verification.Id, "")
+        if err != nil {
+          log.WithFields(logrus.Fields{ "id":verification.Id }).Debug(err.Error())
+          c.AbortWithStatus(http.StatusInternalServerError)
+          return
+        }
+
         // Destroy user session
         session.Clear()
         err = session.Save()
@@ -14,7 +14,6 @@ import (
   "golang.org/x/oauth2"
 
   "github.com/opensentry/idpui/app"
-  "github.com/opensentry/idpui/config"
   "github.com/opensentry/idpui/utils"
   "github.com/opensentry/idpui/validators"
 
@@ -65,7 +64,7 @@ func ShowEmailChangeConfirm(env *app.Environment) gin.HandlerFunc {
 
     // Read challenges
     idpClient := app.IdpClientUsingClientCredentials(env, c)
-    status, responses, err := idp.ReadChallenges(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.challenges.collection"), []idp.ReadChallengesRequest{ {OtpChallenge: emailChallenge} })
+    status, responses, err := env.IdpApi.ReadChallenges(idpClient, env.Endpoints.Idp.ChallengesCollection.String(), []idp.ReadChallengesRequest{ {OtpChallenge: emailChallenge} })
     if err != nil {
       log.WithFields( logrus.Fields{ EMAIL_CHALLENGE_KEY: emailChallenge }).Debug(err.Error()) // Security Warning: Do not log the code is like logging a password!
       c.AbortWithStatus(http.StatusInternalServerError)
@@ -202,6 +201,21 @@ func SubmitEmailChangeConfirm(env *app.Environment) gin.HandlerFunc {
       return
     }
 
+    // Confirming the new email requires a recent login, log in again when the page was open too long.
+    recent, err := app.VerifyRecentAuthentication(env, c, form.Id, env.StepUp.EmailChange)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusForbidden)
+      return
+    }
+
+    if recent == false {
+      log.WithFields(logrus.Fields{"redirect_to": submitUrl}).Debug("Login too old, redirecting")
+      c.Redirect(http.StatusFound, submitUrl)
+      c.Abort()
+      return
+    }
+
     session := sessions.DefaultMany(c, env.Constants.SessionStoreKey)
 
     errors := make(map[string][]string)
@@ -261,7 +275,7 @@ func SubmitEmailChangeConfirm(env *app.Environment) gin.HandlerFunc {
     }
 
     idpClient := app.IdpClientUsingClientCredentials(env, c) // TODO: Maybe this should be using user access token instead.
-    status, responses, err := idp.VerifyChallenges(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.challenges.verify"), []idp.UpdateChallengesVerifyRequest{ {OtpChallenge: form.Challenge, Code: form.Code} })
+    status, responses, err := env.IdpApi.VerifyChallenges(idpClient, env.Endpoints.Idp.ChallengesVerify.String(), []idp.UpdateChallengesVerifyRequest{ {OtpChallenge: form.Challenge, Code: form.Code} })
     if err != nil {
       log.WithFields( logrus.Fields{ EMAIL_CHALLENGE_KEY: form.Challenge }).Debug(err.Error()) // Security Warning: Do not log the code is like logging a password!
       c.AbortWithStatus(http.StatusInternalServerError)
@@ -327,7 +341,7 @@ func SubmitEmailChangeConfirm(env *app.Environment) gin.HandlerFunc {
 
       // Read challenges
       idpClient := app.IdpClientUsingClientCredentials(env, c)
-      status, responses, err := idp.ReadChallenges(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.challenges.collection"), []idp.ReadChallengesRequest{ {OtpChallenge: form.Challenge} })
+      status, responses, err := env.IdpApi.ReadChallenges(idpClient, env.Endpoints.Idp.ChallengesCollection.String(), []idp.ReadChallengesRequest{ {OtpChallenge: form.Challenge} })
       if err != nil {
         log.WithFields( logrus.Fields{ EMAIL_CHALLENGE_KEY: form.Challenge }).Debug(err.Error()) // Security Warning: Do not log the code is like logging a password!
         c.AbortWithStatus(http.StatusInternalServerError)
@@ -402,7 +416,7 @@ func SubmitEmailChangeConfirm(env *app.Environment) gin.HandlerFunc {
         AccessToken: form.AccessToken,
       })
       recoverRequests := []idp.UpdateHumansEmailConfirmRequest{ {EmailChallenge: challengeVerification.OtpChallenge, Email: challenge.Data} } // FIXME: Need a way to save data in a challenge that can be used by the confirmation endpoint to execeute.
-      status, responses, err = idp.UpdateHumansEmailConfirm(idpClientUser, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.humans.emailchange"), recoverRequests)
+      status, responses, err = env.IdpApi.UpdateHumansEmailConfirm(idpClientUser, env.Endpoints.Idp.HumansEmailChange.String(), recoverRequests)
       if err != nil {
         log.Debug(err.Error())
         c.AbortWithStatus(http.StatusInternalServerError)
@@ -442,6 +456,12 @@ func SubmitEmailChangeConfirm(env *app.Environment) gin.HandlerFunc {
         return
       }
 
+      // The access token was only for this change
+      err = app.RevokeToken(env, form.AccessToken)
+      if err != nil {
+        log.Debug(err.Error())
+      }
+
       if verification.Verified == true && verification.RedirectTo != "" {
 
         // Destroy user session
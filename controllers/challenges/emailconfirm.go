@@ -13,7 +13,6 @@ import (
   idp "github.com/opensentry/idp/client"
 
   "github.com/opensentry/idpui/app"
-  "github.com/opensentry/idpui/config"
   "github.com/opensentry/idpui/utils"
   "github.com/opensentry/idpui/validators"
 
@@ -175,7 +174,7 @@ func SubmitEmailConfirm(env *app.Environment) gin.HandlerFunc {
 
     idpClient := app.IdpClientUsingClientCredentials(env, c)
 
-    status, responses, err := idp.VerifyChallenges(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.challenges.verify"), []idp.UpdateChallengesVerifyRequest{ {
+    status, responses, err := env.IdpApi.VerifyChallenges(idpClient, env.Endpoints.Idp.ChallengesVerify.String(), []idp.UpdateChallengesVerifyRequest{ {
       OtpChallenge: form.Challenge,
       Code: form.Code,
     } })
@@ -13,7 +13,6 @@ import (
   idp "github.com/opensentry/idp/client"
 
   "github.com/opensentry/idpui/app"
-  "github.com/opensentry/idpui/config"
   "github.com/opensentry/idpui/utils"
   "github.com/opensentry/idpui/validators"
 
@@ -23,8 +22,6 @@ import (
 type recoverConfirmForm struct {
   Challenge        string `form:"challenge"        binding:"required" validate:"required,notblank"`
   Code             string `form:"code"             binding:"required" validate:"required,notblank"`
-  Password         string `form:"password"         binding:"required" validate:"required,notblank"`
-  PasswordRetyped  string `form:"password_retyped" binding:"required" validate:"required,notblank"`
 }
 
 func ShowRecoverConfirm(env *app.Environment) gin.HandlerFunc {
@@ -61,8 +58,6 @@ func ShowRecoverConfirm(env *app.Environment) gin.HandlerFunc {
     }
 
     var errorCode string
-    var errorPassword string
-    var errorPasswordRetyped string
 
     if len(errors) > 0 {
       errorsMap := errors[0].(map[string][]string)
@@ -71,12 +66,6 @@ func ShowRecoverConfirm(env *app.Environment) gin.HandlerFunc {
         if k == "code" && len(v) > 0 {
           errorCode = strings.Join(v, ", ")
         }
-        if k == "password" && len(v) > 0 {
-          errorPassword = strings.Join(v, ", ")
-        }
-        if k == "password_retyped" && len(v) > 0 {
-          errorPasswordRetyped = strings.Join(v, ", ")
-        }
 
       }
     }
@@ -91,8 +80,6 @@ func ShowRecoverConfirm(env *app.Environment) gin.HandlerFunc {
       "provideraction": "Recover your profile",
       "challenge": recoverChallenge,
       "errorCode": errorCode,
-      "errorPassword": errorPassword,
-      "errorPasswordRetyped": errorPasswordRetyped,
       "submitUrl": submitUrl,
     })
   }
@@ -185,7 +172,7 @@ func SubmitRecoverConfirm(env *app.Environment) gin.HandlerFunc {
 
     idpClient := app.IdpClientUsingClientCredentials(env, c)
 
-    status, responses, err := idp.VerifyChallenges(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.challenges.verify"), []idp.UpdateChallengesVerifyRequest{ {OtpChallenge: form.Challenge, Code: form.Code} })
+    status, responses, err := env.IdpApi.VerifyChallenges(idpClient, env.Endpoints.Idp.ChallengesVerify.String(), []idp.UpdateChallengesVerifyRequest{ {OtpChallenge: form.Challenge, Code: form.Code} })
     if err != nil {
       log.WithFields( logrus.Fields{ RECOVER_CHALLENGE_KEY: form.Challenge }).Debug(err.Error()) // Security Warning: Do not log the code is like logging a password!
       c.AbortWithStatus(http.StatusInternalServerError)
@@ -233,66 +220,26 @@ func SubmitRecoverConfirm(env *app.Environment) gin.HandlerFunc {
 
     if challengeVerification.Verified == true {
 
-      // FIXME: Call recover endpoint and redirect to success redirect.
-      // FIXME: Maybe this should use an access token instead of client credentials.
-
-      recoverRequests := []idp.UpdateHumansRecoverVerifyRequest{ {RecoverChallenge: challengeVerification.OtpChallenge, NewPassword: form.Password} }
-      status, responses, err := idp.RecoverHumansVerify(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.humans.recoververification"), recoverRequests)
+      // Destroy user session, but remember that this browser verified the recover challenge. Only this browser may choose the new password.
+      session.Clear()
+      session.Set(env.Constants.SessionRecoverChallengeKey, challengeVerification.OtpChallenge)
+      err = session.Save()
       if err != nil {
         log.Debug(err.Error())
         c.AbortWithStatus(http.StatusInternalServerError)
         return
       }
 
-      if status == http.StatusForbidden {
-        c.AbortWithStatus(http.StatusForbidden)
-        return
-      }
-
-      if status != http.StatusOK {
-        log.WithFields(logrus.Fields{ "status":status }).Debug("Recover human verify failed")
-        c.AbortWithStatus(http.StatusInternalServerError)
-        return
-      }
-
-      var verification idp.UpdateHumansRecoverVerifyResponse
-      reqStatus, reqErrors := bulky.Unmarshal(0, responses, &verification)
-
-      if reqStatus == http.StatusForbidden {
-        c.AbortWithStatus(http.StatusForbidden)
-        return
-      }
-
-      if reqStatus != http.StatusOK {
-
-        errors := []string{}
-        if len(reqErrors) > 0 {
-          for _,e := range reqErrors {
-            errors = append(errors, e.Error)
-          }
-        }
-
-        log.WithFields(logrus.Fields{ "status":reqStatus, "errors":strings.Join(errors, ", ") }).Debug("Unmarshal UpdateHumansRecoverVerifyResponse failed")
-        c.AbortWithStatus(http.StatusInternalServerError)
-        return
-      }
-
-      if verification.Verified == true && verification.RedirectTo != "" {
-
-        // Destroy user session
-        session.Clear()
-        err = session.Save()
-        if err != nil {
-          log.Debug(err.Error())
-        }
-
-        // Success, call success url redirect_to
-        log.WithFields(logrus.Fields{ "redirect_to": verification.RedirectTo }).Debug("Redirecting");
-        c.Redirect(http.StatusFound, verification.RedirectTo)
-        c.Abort()
-        return
-      }
+      u := *env.Endpoints.Idpui.RecoverPassword
+      q := u.Query()
+      q.Set(RECOVER_CHALLENGE_KEY, challengeVerification.OtpChallenge)
+      u.RawQuery = q.Encode()
 
+      redirectTo := u.String()
+      log.WithFields(logrus.Fields{ "redirect_to": redirectTo }).Debug("Redirecting");
+      c.Redirect(http.StatusFound, redirectTo)
+      c.Abort()
+      return
     }
 
     // Deny by default
@@ -13,7 +13,6 @@ import (
   idp "github.com/opensentry/idp/client"
 
   "github.com/opensentry/idpui/app"
-  "github.com/opensentry/idpui/config"
   "github.com/opensentry/idpui/utils"
   "github.com/opensentry/idpui/validators"
 
@@ -23,6 +22,7 @@ import (
 type verifyForm struct {
   Challenge string `form:"challenge" binding:"required" validate:"required,notblank"`
   Code string `form:"code" binding:"required" validate:"required,notblank"`
+  TrustDevice string `form:"trust_device"` // Skip the second factor on this device from now on, see login.trustedDevices
 }
 
 func ShowVerify(env *app.Environment) gin.HandlerFunc {
@@ -64,6 +64,11 @@ func ShowVerify(env *app.Environment) gin.HandlerFunc {
       }
     }
 
+    var verifyEmailSendUrl string
+    if env.LoginPolicy.EmailOtp {
+      verifyEmailSendUrl = env.Endpoints.Idpui.VerifyEmailSend.RequestURI()
+    }
+
     c.HTML(200, "verify.html", gin.H{
       "title": "OTP Verification",
       "links": []map[string]string{
@@ -74,6 +79,9 @@ func ShowVerify(env *app.Environment) gin.HandlerFunc {
       "provideraction": "Verify one time password",
       "challenge": otpChallenge,
       "errorCode": errorCode,
+      "verifyEmailSendUrl": verifyEmailSendUrl,
+      "trustDevices": env.LoginPolicy.TrustDevices,
+      "trustDevicesDays": env.LoginPolicy.TrustDevicesFor / 86400,
     })
   }
   return gin.HandlerFunc(fn)
@@ -165,7 +173,18 @@ func SubmitVerify(env *app.Environment) gin.HandlerFunc {
 
     idpClient := app.IdpClientUsingClientCredentials(env, c)
 
-    status, verifiedChallenges, err := idp.VerifyChallenges(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.challenges.verify"), []idp.UpdateChallengesVerifyRequest{ {
+    // The human of the challenge trusts the device once the code is verified
+    var trusting *idp.Challenge
+    if env.LoginPolicy.TrustDevices && form.TrustDevice != "" {
+      trusting, err = readPendingOtpChallenge(env, idpClient, form.Challenge)
+      if err != nil {
+        log.WithFields(logrus.Fields{ OTP_CHALLENGE_KEY: form.Challenge }).Debug(err.Error())
+        c.AbortWithStatus(http.StatusInternalServerError)
+        return
+      }
+    }
+
+    status, verifiedChallenges, err := env.IdpApi.VerifyChallenges(idpClient, env.Endpoints.Idp.ChallengesVerify.String(), []idp.UpdateChallengesVerifyRequest{ {
       OtpChallenge: form.Challenge,
       Code: form.Code,
     } })
@@ -199,6 +218,15 @@ func SubmitVerify(env *app.Environment) gin.HandlerFunc {
 
       if challengeVerification.Verified == true {
 
+        if trusting != nil {
+          err = app.TrustDevice(env, c, trusting.Subject)
+          if err != nil {
+            log.WithFields(logrus.Fields{ OTP_CHALLENGE_KEY: challengeVerification.OtpChallenge }).Debug(err.Error())
+            c.AbortWithStatus(http.StatusInternalServerError)
+            return
+          }
+        }
+
         // Append otp_challenge to redirect_to
         u, err := url.Parse(challengeVerification.RedirectTo)
         if err != nil {
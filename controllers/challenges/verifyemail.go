@@ -0,0 +1,349 @@
+package challenges
+
+import (
+  "fmt"
+  "time"
+  "strings"
+  "math/big"
+  "net/url"
+  "net/http"
+  "crypto/rand"
+  "github.com/sirupsen/logrus"
+  "github.com/gin-gonic/gin"
+  "github.com/gorilla/csrf"
+  "github.com/gin-contrib/sessions"
+  idp "github.com/opensentry/idp/client"
+
+  "github.com/opensentry/idpui/app"
+
+  bulky "github.com/charmixer/bulky/client"
+)
+
+// # Email OTP
+// Humans without their authenticator app at hand can have a code sent to their confirmed email instead, see login.emailOtp. The code is only sent for an otp_challenge the idp issued after the password, and the login it continues is accepted with acr otp.email.mfa. Whether that is strong enough for the sensitive pages is decided per page by stepup.*.emailOtp.
+
+type verifyEmailSendForm struct {
+  Challenge string `form:"challenge" binding:"required"` // The otp_challenge the code is sent instead of
+}
+
+type verifyEmailForm struct {
+  Challenge string `form:"challenge" binding:"required"`
+  Code string `form:"code" binding:"required"`
+}
+
+// SubmitVerifyEmailSend has the idp send a code to the email of the human of the otp_challenge, and asks for it.
+func SubmitVerifyEmailSend(env *app.Environment) gin.HandlerFunc {
+  fn := func(c *gin.Context) {
+
+    log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+    log = log.WithFields(logrus.Fields{
+      "func": "SubmitVerifyEmailSend",
+    })
+
+    if env.LoginPolicy.EmailOtp == false {
+      c.AbortWithStatus(http.StatusNotFound)
+      return
+    }
+
+    var form verifyEmailSendForm
+    err := c.Bind(&form)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusBadRequest)
+      return
+    }
+    log = log.WithFields(logrus.Fields{ OTP_CHALLENGE_KEY:form.Challenge })
+
+    session := sessions.DefaultMany(c, env.Constants.SessionStoreKey)
+
+    idpClient := app.IdpClientUsingClientCredentials(env, c)
+
+    otpChallenge, err := readPendingOtpChallenge(env, idpClient, form.Challenge)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+    if otpChallenge == nil {
+      redirectToVerifyWithError(env, c, session, form.Challenge, "The code has expired, log in again")
+      return
+    }
+
+    human, err := app.ReadHuman(env, idpClient, idp.ReadHumansRequest{ Id:otpChallenge.Subject })
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+    if human == nil || human.Email == "" || human.EmailConfirmedAt == 0 {
+      redirectToVerifyWithError(env, c, session, form.Challenge, "No confirmed email to send a code to")
+      return
+    }
+
+    verifyUrl, err := app.AbsoluteUrl(env.Endpoints.Idpui.VerifyEmail)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    code, err := createNumericCode(6)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    status, responses, err := env.IdpApi.CreateChallenges(idpClient, env.Endpoints.Idp.ChallengesCollection.String(), []idp.CreateChallengesRequest{ {
+      ConfirmationType: int(idp.ConfirmIdentityControlOfEmail),
+      Subject: human.Id,
+      Audience: "idp",
+      TTL: env.LoginPolicy.EmailOtpTTL,
+      RedirectTo: verifyUrl,
+      CodeType: int64(idp.OTP),
+      Code: code,
+      Email: human.Email,
+    } })
+    if err != nil {
+      log.Debug(err.Error()) // Security Warning: Do not log the code is like logging a password!
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    var emailChallenge idp.CreateChallengesResponse
+    if status == http.StatusOK && responses != nil {
+      status, _ = bulky.Unmarshal(0, responses, &emailChallenge)
+    }
+    if status != http.StatusOK {
+      log.WithFields(logrus.Fields{ "status":status }).Debug("CreateChallenges failed")
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    // Only this browser can use the code, and only to continue the login of the otp_challenge
+    session.Set(env.Constants.SessionEmailOtpChallengeKey, emailChallenge.OtpChallenge)
+    session.Set(VERIFY_EMAIL_REDIRECT_KEY, otpChallenge.RedirectTo)
+    err = session.Save()
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    redirectTo := verifyUrl + "?" + url.Values{ EMAIL_CHALLENGE_KEY:{emailChallenge.OtpChallenge} }.Encode()
+    log.WithFields(logrus.Fields{"redirect_to": redirectTo}).Debug("Code sent, redirecting")
+    c.Redirect(http.StatusFound, redirectTo)
+    c.Abort()
+  }
+  return gin.HandlerFunc(fn)
+}
+
+// ShowVerifyEmail asks for the code sent by email. The mailed link carries the code, so opening it verifies right away.
+func ShowVerifyEmail(env *app.Environment) gin.HandlerFunc {
+  fn := func(c *gin.Context) {
+
+    log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+    log = log.WithFields(logrus.Fields{
+      "func": "ShowVerifyEmail",
+    })
+
+    emailChallenge := c.Query(EMAIL_CHALLENGE_KEY)
+    if emailChallenge == "" {
+      log.Debug("Missing " + EMAIL_CHALLENGE_KEY)
+      c.AbortWithStatus(http.StatusNotFound)
+      return
+    }
+
+    session := sessions.DefaultMany(c, env.Constants.SessionStoreKey)
+
+    if session.Get(env.Constants.SessionEmailOtpChallengeKey) != emailChallenge {
+      log.WithFields(logrus.Fields{ EMAIL_CHALLENGE_KEY:emailChallenge }).Debug("Code not sent for this browser")
+      c.HTML(http.StatusForbidden, "verifyemail.html", gin.H{
+        "title": "OTP Verification",
+        "links": []map[string]string{
+          {"href": "/public/css/credentials.css"},
+        },
+        "provider": "Identity Provider",
+        "provideraction": "Verify one time password",
+        "errorCode": "Enter the code in the browser you asked for it in",
+      })
+      return
+    }
+
+    if code := c.Query(VERIFY_EMAIL_CODE_KEY); code != "" {
+      verifyEmailOtp(env, c, session, emailChallenge, code)
+      return
+    }
+
+    errors := session.Flashes(VERIFY_EMAIL_ERRORS)
+    err := session.Save() // Remove flashes read
+    if err != nil {
+      log.Debug(err.Error())
+    }
+
+    var errorCode string
+
+    if len(errors) > 0 {
+      errorsMap := errors[0].(map[string][]string)
+      for k, v := range errorsMap {
+
+        if k == "code" && len(v) > 0 {
+          errorCode = strings.Join(v, ", ")
+        }
+
+      }
+    }
+
+    c.HTML(http.StatusOK, "verifyemail.html", gin.H{
+      "title": "OTP Verification",
+      "links": []map[string]string{
+        {"href": "/public/css/credentials.css"},
+      },
+      csrf.TemplateTag: csrf.TemplateField(c.Request),
+      "provider": "Identity Provider",
+      "provideraction": "Verify one time password",
+      "challenge": emailChallenge,
+      "errorCode": errorCode,
+      "verifyEmailUrl": env.Endpoints.Idpui.VerifyEmail.RequestURI(),
+    })
+  }
+  return gin.HandlerFunc(fn)
+}
+
+func SubmitVerifyEmail(env *app.Environment) gin.HandlerFunc {
+  fn := func(c *gin.Context) {
+
+    log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+    log = log.WithFields(logrus.Fields{
+      "func": "SubmitVerifyEmail",
+    })
+
+    var form verifyEmailForm
+    err := c.Bind(&form)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusBadRequest)
+      return
+    }
+
+    session := sessions.DefaultMany(c, env.Constants.SessionStoreKey)
+
+    if session.Get(env.Constants.SessionEmailOtpChallengeKey) != form.Challenge {
+      log.WithFields(logrus.Fields{ EMAIL_CHALLENGE_KEY:form.Challenge }).Debug("Code not sent for this browser")
+      c.AbortWithStatus(http.StatusForbidden)
+      return
+    }
+
+    verifyEmailOtp(env, c, session, form.Challenge, form.Code)
+  }
+  return gin.HandlerFunc(fn)
+}
+
+// verifyEmailOtp verifies the code and continues the login it was sent for with the email_challenge, see ShowLogin.
+func verifyEmailOtp(env *app.Environment, c *gin.Context, session sessions.Session, emailChallenge string, code string) {
+  log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+  log = log.WithFields(logrus.Fields{ EMAIL_CHALLENGE_KEY:emailChallenge })
+
+  idpClient := app.IdpClientUsingClientCredentials(env, c)
+
+  status, responses, err := env.IdpApi.VerifyChallenges(idpClient, env.Endpoints.Idp.ChallengesVerify.String(), []idp.UpdateChallengesVerifyRequest{ {
+    OtpChallenge: emailChallenge,
+    Code: code,
+  } })
+  if err != nil {
+    log.Debug(err.Error()) // Security Warning: Do not log the code is like logging a password!
+    c.AbortWithStatus(http.StatusInternalServerError)
+    return
+  }
+
+  var verification idp.UpdateChallengesVerifyResponse
+  if status == http.StatusOK && responses != nil {
+    status, _ = bulky.Unmarshal(0, responses, &verification)
+  }
+  if status != http.StatusOK || verification.Verified == false {
+    errors := map[string][]string{ "code":{"Invalid"} }
+    session.AddFlash(errors, VERIFY_EMAIL_ERRORS)
+    err = session.Save()
+    if err != nil {
+      log.Debug(err.Error())
+    }
+
+    redirectTo := env.Endpoints.Idpui.VerifyEmail.RequestURI() + "?" + url.Values{ EMAIL_CHALLENGE_KEY:{emailChallenge} }.Encode()
+    log.WithFields(logrus.Fields{"redirect_to": redirectTo}).Debug("Redirecting")
+    c.Redirect(http.StatusFound, redirectTo)
+    c.Abort()
+    return
+  }
+
+  loginUrl, _ := session.Get(VERIFY_EMAIL_REDIRECT_KEY).(string)
+  u, err := url.Parse(loginUrl)
+  if err != nil || loginUrl == "" {
+    log.WithFields(logrus.Fields{ "redirect_to":loginUrl }).Debug("Missing login to continue")
+    c.AbortWithStatus(http.StatusInternalServerError)
+    return
+  }
+
+  session.Delete(VERIFY_EMAIL_REDIRECT_KEY)
+  err = session.Save()
+  if err != nil {
+    log.Debug(err.Error())
+  }
+
+  q := u.Query()
+  q.Set(EMAIL_CHALLENGE_KEY, emailChallenge)
+  u.RawQuery = q.Encode()
+  redirectTo := u.String()
+
+  log.WithFields(logrus.Fields{"redirect_to": redirectTo}).Debug("Redirecting")
+  c.Redirect(http.StatusFound, redirectTo)
+  c.Abort()
+}
+
+// readPendingOtpChallenge returns the TOTP challenge of a login when it can still be verified, nil otherwise.
+func readPendingOtpChallenge(env *app.Environment, idpClient *idp.IdpClient, otpChallenge string) (*idp.Challenge, error) {
+  status, responses, err := env.IdpApi.ReadChallenges(idpClient, env.Endpoints.Idp.ChallengesCollection.String(), []idp.ReadChallengesRequest{ {OtpChallenge: otpChallenge} })
+  if err != nil {
+    return nil, err
+  }
+  if status != http.StatusOK || responses == nil {
+    return nil, nil
+  }
+
+  var challenges idp.ReadChallengesResponse
+  status, _ = bulky.Unmarshal(0, responses, &challenges)
+  if status != http.StatusOK || len(challenges) == 0 {
+    return nil, nil
+  }
+
+  challenge := challenges[0]
+  if challenge.ConfirmationType != int(idp.ConfirmIdentity) || challenge.CodeType != int64(idp.TOTP) || challenge.VerifiedAt > 0 || challenge.ExpiresAt < time.Now().Unix() {
+    return nil, nil
+  }
+  return &challenge, nil
+}
+
+// createNumericCode returns a random code of digits, as humans type it from an email.
+func createNumericCode(digits int) (string, error) {
+  max := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(digits)), nil)
+  n, err := rand.Int(rand.Reader, max)
+  if err != nil {
+    return "", err
+  }
+  return fmt.Sprintf("%0*d", digits, n), nil
+}
+
+func redirectToVerifyWithError(env *app.Environment, c *gin.Context, session sessions.Session, otpChallenge string, message string) {
+  log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+
+  errors := map[string][]string{ "code":{message} }
+  session.AddFlash(errors, VERIFY_ERRORS)
+  err := session.Save()
+  if err != nil {
+    log.Debug(err.Error())
+  }
+
+  redirectTo := "/verify?" + url.Values{ OTP_CHALLENGE_KEY:{otpChallenge} }.Encode()
+  log.WithFields(logrus.Fields{"redirect_to": redirectTo}).Debug("Redirecting")
+  c.Redirect(http.StatusFound, redirectTo)
+  c.Abort()
+}
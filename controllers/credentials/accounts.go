@@ -0,0 +1,84 @@
+package credentials
+
+import (
+  "net/url"
+  "net/http"
+  "github.com/sirupsen/logrus"
+  "github.com/gin-gonic/gin"
+  "github.com/gorilla/csrf"
+
+  "github.com/opensentry/idpui/app"
+  "github.com/opensentry/idpui/config"
+)
+
+type accountsForgetForm struct {
+  Challenge string `form:"challenge" binding:"required"`
+}
+
+// showAccountChooser lists the accounts used on this device, so the human picks one instead of typing the email.
+func showAccountChooser(env *app.Environment, c *gin.Context, loginRequest *app.HydraLoginRequest, accounts []app.Account) {
+  var choices []map[string]string
+  for _, account := range accounts {
+    choices = append(choices, map[string]string{
+      "name": account.Name,
+      "email": account.Email,
+      "url": accountUrl(env, loginRequest, account.Id),
+    })
+  }
+
+  c.HTML(200, "accounts.html", gin.H{
+    "links": []map[string]string{
+      {"href": "/public/css/credentials.css"},
+    },
+    "title": "Choose an account",
+    csrf.TemplateTag: csrf.TemplateField(c.Request),
+    "provider": config.GetString("provider.name"),
+    "provideraction": "Choose an account to continue",
+    "challenge": loginRequest.Challenge,
+    "accounts": choices,
+    "otherUrl": accountUrl(env, loginRequest, ACCOUNT_OTHER),
+    "forgetUrl": env.Endpoints.Idpui.AccountsForget.RequestURI(),
+  })
+}
+
+// accountUrl is the login page for the challenge with the account chosen, the account chooser when empty.
+func accountUrl(env *app.Environment, loginRequest *app.HydraLoginRequest, account string) string {
+  q := url.Values{}
+  q.Set(LOGIN_CHALLENGE_KEY, loginRequest.Challenge)
+  if account != "" {
+    q.Set(LOGIN_ACCOUNT_KEY, account)
+  }
+  return env.Endpoints.Idpui.Login.RequestURI() + "?" + q.Encode()
+}
+
+// SubmitAccountsForget removes the accounts remembered on this device and continues the login.
+func SubmitAccountsForget(env *app.Environment) gin.HandlerFunc {
+  fn := func(c *gin.Context) {
+
+    log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+    log = log.WithFields(logrus.Fields{
+      "func": "SubmitAccountsForget",
+    })
+
+    var form accountsForgetForm
+    err := c.Bind(&form)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusBadRequest)
+      return
+    }
+
+    err = app.ForgetAccounts(env, c)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    redirectTo := env.Endpoints.Idpui.Login.RequestURI() + "?" + url.Values{ LOGIN_CHALLENGE_KEY:{form.Challenge} }.Encode()
+    log.WithFields(logrus.Fields{"redirect_to": redirectTo}).Debug("Redirecting")
+    c.Redirect(http.StatusFound, redirectTo)
+    c.Abort()
+  }
+  return gin.HandlerFunc(fn)
+}
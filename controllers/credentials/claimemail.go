@@ -41,7 +41,7 @@ func ShowClaimEmail(env *app.Environment) gin.HandlerFunc {
       idpClient := app.IdpClientUsingClientCredentials(env, c)
 
       newChallengeSession := app.ChallengeSession{
-        RedirectToOnSuccess: config.GetString("idpui.public.url") + config.GetString("idpui.public.endpoints.register"),
+        RedirectToOnSuccess: env.Endpoints.Idpui.Register.String(),
       }
       challengeSession, err := app.StartChallengeSession(env, c, newChallengeSession)
       if err != nil {
@@ -51,7 +51,7 @@ func ShowClaimEmail(env *app.Environment) gin.HandlerFunc {
       }
 
       claimRequest := []idp.CreateInvitesClaimRequest{ {Id:id, RedirectTo:challengeSession.RedirectToOnSuccess, TTL: 86400} }
-      status, responses, err := idp.CreateInvitesClaim(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.invites.claim"), claimRequest)
+      status, responses, err := env.IdpApi.CreateInvitesClaim(idpClient, env.Endpoints.Idp.InvitesClaim.String(), claimRequest)
       if err != nil {
         log.Debug(err.Error())
         c.AbortWithStatus(http.StatusInternalServerError)
@@ -129,8 +129,8 @@ func ShowClaimEmail(env *app.Environment) gin.HandlerFunc {
       csrf.TemplateTag: csrf.TemplateField(c.Request),
       "provider": config.GetString("provider.name"),
       "provideraction": "Claim an identity in the system with an email",
-      "claimUrl": config.GetString("idpui.public.endpoints.claim"),
-      "loginUrl": config.GetString("idpui.public.endpoints.login"),
+      "claimUrl": env.Endpoints.Idpui.Claim.RequestURI(),
+      "loginUrl": env.Endpoints.Idpui.Login.RequestURI(),
       "invite": invite,
       "email": email,
       "errorEmail": errorEmail,
@@ -236,7 +236,7 @@ func SubmitClaimEmail(env *app.Environment) gin.HandlerFunc {
       var inviteId string
 
       inviteRequest := []idp.ReadInvitesRequest{ {Email: form.Email} }
-      status, responses, err := idp.ReadInvites(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.invites.collection"), inviteRequest)
+      status, responses, err := env.IdpApi.ReadInvites(idpClient, env.Endpoints.Idp.InvitesCollection.String(), inviteRequest)
       if err != nil {
         log.Debug(err.Error())
         c.AbortWithStatus(http.StatusInternalServerError)
@@ -260,7 +260,7 @@ func SubmitClaimEmail(env *app.Environment) gin.HandlerFunc {
       if inviteId == "" {
 
         inviteRequest := []idp.CreateInvitesRequest{ {Email: form.Email} }
-        status, responses, err := idp.CreateInvites(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.invites.collection"), inviteRequest)
+        status, responses, err := env.IdpApi.CreateInvites(idpClient, env.Endpoints.Idp.InvitesCollection.String(), inviteRequest)
         if err != nil {
           log.Debug(err.Error())
           c.AbortWithStatus(http.StatusInternalServerError)
@@ -286,7 +286,7 @@ func SubmitClaimEmail(env *app.Environment) gin.HandlerFunc {
       if inviteId != "" {
 
         newChallengeSession := app.ChallengeSession{
-          RedirectToOnSuccess: config.GetString("idpui.public.url") + config.GetString("idpui.public.endpoints.register"),
+          RedirectToOnSuccess: env.Endpoints.Idpui.Register.String(),
         }
         challengeSession, err := app.StartChallengeSession(env, c, newChallengeSession)
         if err != nil {
@@ -296,7 +296,7 @@ func SubmitClaimEmail(env *app.Environment) gin.HandlerFunc {
         }
 
         claimRequest := []idp.CreateInvitesClaimRequest{ {Id:inviteId, RedirectTo:challengeSession.RedirectToOnSuccess, TTL: 86400} }
-        status, responses, err := idp.CreateInvitesClaim(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.invites.claim"), claimRequest)
+        status, responses, err := env.IdpApi.CreateInvitesClaim(idpClient, env.Endpoints.Idp.InvitesClaim.String(), claimRequest)
         if err != nil {
           log.Debug(err.Error())
           c.AbortWithStatus(http.StatusInternalServerError)
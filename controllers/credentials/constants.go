@@ -6,6 +6,37 @@ const LOGOUT_CHALLENGE_KEY = "logout_challenge"
 
 const EMAIL_CHALLENGE_KEY = "email_challenge"
 
+const LOGIN_ACCOUNT_KEY = "account" // The account chosen on the device, ACCOUNT_OTHER to log in with another
+
+const LOGIN_REMEMBER_KEY = "authenticate.remember" // The login challenge the human chose to stay signed in for
+
+const ACCOUNT_OTHER = "other"
+
+const LOGIN_LINK_CHALLENGE_KEY = "login.link.challenge" // The email challenge of the sign-in link sent, only this browser can open it
+const LOGIN_LINK_LOGIN_KEY = "login.link.login" // The login challenge the link accepts
+const LOGIN_LINK_OPENED_KEY = "login.link.opened" // The email challenge of the link opened, the login it continues is accepted with acr link
+const LOGIN_LINK_CODE_KEY = "code"
+const LOGIN_LINK_ERRORS = "login.link.errors"
+const LOGIN_LINK_SENT = "login.link.sent"
+
+const DEVICE_CHALLENGE_KEY = "device_challenge"
+const DEVICE_USER_CODE_KEY = "user_code"
+const DEVICE_ACCEPTED_KEY = "device.accepted" // The user code Hydra accepted in this browser, the human confirms the device before logging in
+const DEVICE_LOGIN_KEY = "device.login" // The login challenge that authorizes the device of the accepted user code
+
+const FEDERATION_PROVIDER_KEY = "provider"
+const FEDERATION_STATE_KEY = "federation.state" // The authorization request sent to the upstream, checked when it returns
+const FEDERATION_NONCE_KEY = "federation.nonce"
+const FEDERATION_VERIFIER_KEY = "federation.verifier"
+const FEDERATION_UPSTREAM_KEY = "federation.provider"
+const FEDERATION_CHALLENGE_KEY = "federation.challenge"
+const FEDERATION_LINKING_KEY = "federation.linking" // The human linking another upstream identity from the identities page, instead of a login challenge
+const FEDERATION_PENDING_KEY = "federation.pending" // The login challenge an upstream identity is linked on, once the human logs in
+const FEDERATION_PENDING_PROVIDER_KEY = "federation.pending.provider"
+const FEDERATION_PENDING_SUBJECT_KEY = "federation.pending.subject"
+const FEDERATION_PENDING_EMAIL_KEY = "federation.pending.email"
+const FEDERATION_PENDING_HUMAN_KEY = "federation.pending.human" // The human whose password was checked, linked once the second factor or email confirmation accepts the login
+
 // Form constants
 const PROFILEDELETE_ERRORS = "profiledelete.errors"
 
@@ -16,6 +47,13 @@ const PASSWORD_ERRORS = "password.errors"
 
 const TOTP_ERRORS = "totp.errors"
 
+const IDENTITIES_ERRORS = "identities.errors"
+
+const DEVICE_ERRORS = "device.errors"
+
 const RECOVER_ERRORS = "recover.errors"
 
-const EMAILCHANGE_ERRORS = "emailchange.errors"
\ No newline at end of file
+const EMAILCHANGE_ERRORS = "emailchange.errors"
+const RECOVERPASSWORD_ERRORS = "recoverpassword.errors"
+const RECOVER_CHALLENGE_KEY = "recover_challenge"
+const RECOVER_CHALLENGE_MAX_AGE = 600 // seconds from verifying the code until the new password must be chosen
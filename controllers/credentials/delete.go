@@ -35,7 +35,7 @@ func ShowProfileDelete(env *app.Environment) gin.HandlerFunc {
 
     redirectTo := c.Request.Referer() // FIXME: This does not work, when force to login the refrer will be login uri. This should be a param in the /totp?redirect_uri=... param and should be forced to only be allowed to be specified redirect uris for the client.
     if redirectTo == "" {
-      redirectTo = config.GetString("meui.public.url") + config.GetString("meui.public.endpoints.profile") // FIXME should be a config default.
+      redirectTo = env.Endpoints.Meui.Profile.String() // FIXME should be a config default.
     }
 
     identity := app.GetIdentity(env, c)
@@ -83,7 +83,7 @@ func ShowProfileDelete(env *app.Environment) gin.HandlerFunc {
       "id": identity.Id,
       "name": identity.Name,
       "email": identity.Email,
-      "profileDeleteUrl": config.GetString("idpui.public.url") + config.GetString("idpui.public.endpoints.delete"),
+      "profileDeleteUrl": env.Endpoints.Idpui.Delete.String(),
       "RiskAccepted": riskAccepted,
       "errorRiskAccepted": errorRiskAccepted,
     })
@@ -115,6 +115,21 @@ func SubmitProfileDelete(env *app.Environment) gin.HandlerFunc {
       return
     }
 
+    // Deleting requires a recent login, log in again when the page was open too long.
+    recent, err := app.VerifyRecentAuthentication(env, c, form.Id, env.StepUp.Delete)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusForbidden)
+      return
+    }
+
+    if recent == false {
+      log.WithFields(logrus.Fields{"redirect_to": submitUrl}).Debug("Login too old, redirecting")
+      c.Redirect(http.StatusFound, submitUrl)
+      c.Abort()
+      return
+    }
+
     session := sessions.DefaultMany(c, env.Constants.SessionStoreKey)
     errors := make(map[string][]string)
 
@@ -146,8 +161,8 @@ func SubmitProfileDelete(env *app.Environment) gin.HandlerFunc {
       idpClient := idp.NewIdpClientWithUserAccessToken(oauth2Config, &oauth2.Token{
         AccessToken: form.AccessToken,
       })
-      deleteRequests := []idp.DeleteHumansRequest{ {Id:form.Id, RedirectTo:config.GetString("idpui.public.url") + config.GetString("idpui.public.endpoints.seeyoulater")} }
-      status, responses, err := idp.DeleteHumans(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.humans.collection"), deleteRequests)
+      deleteRequests := []idp.DeleteHumansRequest{ {Id:form.Id, RedirectTo:env.Endpoints.Idpui.SeeYouLater.String()} }
+      status, responses, err := env.IdpApi.DeleteHumans(idpClient, env.Endpoints.Idp.HumansCollection.String(), deleteRequests)
       if err != nil {
         log.Debug(err.Error())
         c.AbortWithStatus(http.StatusInternalServerError)
@@ -187,6 +202,12 @@ func SubmitProfileDelete(env *app.Environment) gin.HandlerFunc {
         return
       }
 
+      // The access token was only for asking to delete, the deletion is confirmed by code
+      err = app.RevokeToken(env, form.AccessToken)
+      if err != nil {
+        log.Debug(err.Error())
+      }
+
       // Success
       log.WithFields(logrus.Fields{"redirect_to": resp.RedirectTo}).Debug("Redirecting")
       c.Redirect(http.StatusFound, resp.RedirectTo)
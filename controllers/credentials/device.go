@@ -0,0 +1,359 @@
+package credentials
+
+import (
+  "strings"
+  "unicode/utf8"
+  "net/url"
+  "net/http"
+  "github.com/sirupsen/logrus"
+  "github.com/gin-gonic/gin"
+  "github.com/gin-contrib/sessions"
+  "github.com/gorilla/csrf"
+
+  "github.com/opensentry/idpui/app"
+  "github.com/opensentry/idpui/config"
+)
+
+// # Device authorization
+// Devices without a browser, ex. a TV, show a user code and ask the human to enter it on the device page, RFC 8628. Hydra sends the browser to the page with a device_challenge. Once Hydra accepts the code, it continues with the login challenge of the login page, which names the client. Before logging in the human confirms the client and scopes, or denies the device by rejecting the login, so a code read out by someone else does not connect their device unseen. Once logged in Hydra authorizes the device, which polls Hydra for its tokens.
+
+type deviceForm struct {
+  Challenge string `form:"device_challenge" binding:"required"`
+  UserCode string `form:"user_code"`
+}
+
+type deviceConfirmForm struct {
+  Challenge string `form:"login_challenge" binding:"required"`
+  Confirm bool `form:"confirm"` // False denies the device
+}
+
+// ShowDevice asks for the user code.
+func ShowDevice(env *app.Environment) gin.HandlerFunc {
+  fn := func(c *gin.Context) {
+
+    log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+    log = log.WithFields(logrus.Fields{
+      "func": "ShowDevice",
+    })
+
+    deviceChallenge := c.Query(DEVICE_CHALLENGE_KEY)
+
+    // Visited directly, ex. from the url shown on the device. Hydra issues the device_challenge and sends the browser back.
+    if deviceChallenge == "" {
+      redirectTo := env.Endpoints.Hydra.Public.String() + "/oauth2/device/verify"
+      if userCode := c.Query(DEVICE_USER_CODE_KEY); userCode != "" {
+        redirectTo = redirectTo + "?" + url.Values{ DEVICE_USER_CODE_KEY:{userCode} }.Encode()
+      }
+      log.WithFields(logrus.Fields{"redirect_to": redirectTo}).Debug("Missing device challenge, redirecting")
+      c.Redirect(http.StatusFound, redirectTo)
+      c.Abort()
+      return
+    }
+
+    session := sessions.DefaultMany(c, env.Constants.SessionStoreKey)
+
+    errors := session.Flashes(DEVICE_ERRORS)
+    err := session.Save() // Remove flashes read
+    if err != nil {
+      log.Debug(err.Error())
+    }
+
+    var errorUserCode string
+
+    if len(errors) > 0 {
+      errorsMap := errors[0].(map[string][]string)
+      for k, v := range errorsMap {
+
+        if k == "user_code" && len(v) > 0 {
+          errorUserCode = strings.Join(v, ", ")
+        }
+
+      }
+    }
+
+    c.HTML(http.StatusOK, "device.html", gin.H{
+      "title": "Connect Device",
+      "links": []map[string]string{
+        {"href": "/public/css/credentials.css"},
+      },
+      csrf.TemplateTag: csrf.TemplateField(c.Request),
+      "provider": config.GetString("provider.name"),
+      "provideraction": "Connect a device to your account",
+      "device_challenge": deviceChallenge,
+      "user_code": c.Query(DEVICE_USER_CODE_KEY),
+      "errorUserCode": errorUserCode,
+      "deviceUrl": env.Endpoints.Idpui.Device.RequestURI(),
+    })
+  }
+  return gin.HandlerFunc(fn)
+}
+
+// SubmitDevice hands the user code to Hydra, which continues with the login of the human authorizing the device.
+func SubmitDevice(env *app.Environment) gin.HandlerFunc {
+  fn := func(c *gin.Context) {
+
+    log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+    log = log.WithFields(logrus.Fields{
+      "func": "SubmitDevice",
+    })
+
+    var form deviceForm
+    err := c.Bind(&form)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusBadRequest)
+      return
+    }
+
+    session := sessions.DefaultMany(c, env.Constants.SessionStoreKey)
+
+    userCode, valid := normalizeUserCode(env, form.UserCode)
+    if valid == false {
+      redirectToDeviceWithError(env, c, session, form.Challenge, "Invalid code")
+      return
+    }
+
+    redirectTo, err := env.HydraApi.AcceptDeviceRequest(form.Challenge, userCode)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    if redirectTo == "" {
+      redirectToDeviceWithError(env, c, session, form.Challenge, "Unknown or expired code")
+      return
+    }
+
+    // The login Hydra continues with is confirmed first, see deviceConfirmPending
+    session.Set(DEVICE_ACCEPTED_KEY, userCode)
+    session.Delete(DEVICE_LOGIN_KEY)
+    err = session.Save()
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    log.WithFields(logrus.Fields{"redirect_to": redirectTo}).Debug("User code accepted, redirecting")
+    c.Redirect(http.StatusFound, redirectTo)
+    c.Abort()
+  }
+  return gin.HandlerFunc(fn)
+}
+
+// ShowDeviceConfirm shows the client and scopes of the device before the human logs in to authorize it.
+func ShowDeviceConfirm(env *app.Environment) gin.HandlerFunc {
+  fn := func(c *gin.Context) {
+
+    log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+    log = log.WithFields(logrus.Fields{
+      "func": "ShowDeviceConfirm",
+    })
+
+    loginChallenge := c.Query(LOGIN_CHALLENGE_KEY)
+    if loginChallenge == "" {
+      log.Debug("Missing " + LOGIN_CHALLENGE_KEY)
+      c.AbortWithStatus(http.StatusBadRequest)
+      return
+    }
+
+    session := sessions.DefaultMany(c, env.Constants.SessionStoreKey)
+
+    userCode, _ := session.Get(DEVICE_ACCEPTED_KEY).(string)
+    deviceLogin, _ := session.Get(DEVICE_LOGIN_KEY).(string)
+    if userCode == "" || deviceLogin != loginChallenge {
+      redirectTo := loginUrl(env, loginChallenge)
+      log.WithFields(logrus.Fields{"redirect_to": redirectTo}).Debug("No device to confirm, redirecting")
+      c.Redirect(http.StatusFound, redirectTo)
+      c.Abort()
+      return
+    }
+
+    loginRequest, err := env.HydraApi.ReadLoginRequest(loginChallenge)
+    if err != nil {
+      log.WithFields(logrus.Fields{ "challenge":loginChallenge }).Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    if loginRequest == nil {
+      log.WithFields(logrus.Fields{ "challenge":loginChallenge }).Debug("Login request not found")
+      c.AbortWithStatus(http.StatusNotFound)
+      return
+    }
+
+    clientName := loginRequest.Client.ClientName
+    if clientName == "" {
+      clientName = loginRequest.Client.ClientId
+    }
+
+    c.HTML(http.StatusOK, "deviceconfirm.html", gin.H{
+      "title": "Connect Device",
+      "links": []map[string]string{
+        {"href": "/public/css/credentials.css"},
+      },
+      csrf.TemplateTag: csrf.TemplateField(c.Request),
+      "provider": config.GetString("provider.name"),
+      "provideraction": "Connect a device to your account",
+      "login_challenge": loginChallenge,
+      "user_code": formatUserCode(userCode),
+      "client": clientName,
+      "scopes": loginRequest.RequestedScope,
+      "deviceConfirmUrl": env.Endpoints.Idpui.DeviceConfirm.RequestURI(),
+    })
+  }
+  return gin.HandlerFunc(fn)
+}
+
+// SubmitDeviceConfirm continues with the login of the human authorizing the device, or denies the device by rejecting the login.
+func SubmitDeviceConfirm(env *app.Environment) gin.HandlerFunc {
+  fn := func(c *gin.Context) {
+
+    log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+    log = log.WithFields(logrus.Fields{
+      "func": "SubmitDeviceConfirm",
+    })
+
+    var form deviceConfirmForm
+    err := c.Bind(&form)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusBadRequest)
+      return
+    }
+
+    session := sessions.DefaultMany(c, env.Constants.SessionStoreKey)
+
+    // Only the device of the code entered in this browser can be confirmed
+    deviceLogin, _ := session.Get(DEVICE_LOGIN_KEY).(string)
+    if deviceLogin != form.Challenge {
+      log.WithFields(logrus.Fields{ "challenge":form.Challenge }).Debug("No device to confirm")
+      c.AbortWithStatus(http.StatusBadRequest)
+      return
+    }
+
+    session.Delete(DEVICE_ACCEPTED_KEY)
+    session.Delete(DEVICE_LOGIN_KEY)
+    err = session.Save()
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    redirectTo := loginUrl(env, form.Challenge)
+    if form.Confirm == false {
+      redirectTo, err = env.HydraApi.RejectLoginRequest(form.Challenge, app.HydraLoginReject{
+        Error: "access_denied",
+        ErrorDescription: "The device was denied access",
+      })
+      if err != nil {
+        log.Debug(err.Error())
+        c.AbortWithStatus(http.StatusInternalServerError)
+        return
+      }
+    }
+
+    log.WithFields(logrus.Fields{"confirm": form.Confirm, "redirect_to": redirectTo}).Debug("Device confirmed, redirecting")
+    c.Redirect(http.StatusFound, redirectTo)
+    c.Abort()
+  }
+  return gin.HandlerFunc(fn)
+}
+
+// ShowDeviceDone is where Hydra sends the browser once the device is authorized, or with an error when it was denied.
+func ShowDeviceDone(env *app.Environment) gin.HandlerFunc {
+  fn := func(c *gin.Context) {
+
+    c.HTML(http.StatusOK, "devicedone.html", gin.H{
+      "title": "Connect Device",
+      "links": []map[string]string{
+        {"href": "/public/css/credentials.css"},
+      },
+      "provider": config.GetString("provider.name"),
+      "provideraction": "Connect a device to your account",
+      "denied": c.Query("error") != "",
+    })
+  }
+  return gin.HandlerFunc(fn)
+}
+
+// deviceConfirmPending tells if the login challenge authorizes the device of the user code accepted in this browser, and the human has not confirmed the device yet. Hydra continues with the login right after accepting the code, so the next login challenge is taken as the device's. The session must be saved.
+func deviceConfirmPending(session sessions.Session, loginChallenge string) bool {
+  userCode, _ := session.Get(DEVICE_ACCEPTED_KEY).(string)
+  if userCode == "" {
+    return false
+  }
+
+  deviceLogin, _ := session.Get(DEVICE_LOGIN_KEY).(string)
+  if deviceLogin == "" {
+    session.Set(DEVICE_LOGIN_KEY, loginChallenge)
+    return true
+  }
+  return deviceLogin == loginChallenge
+}
+
+// normalizeUserCode removes what humans add when typing the code, ex. dashes, spaces and lower case letters, and reports if what is left can be a user code of hydra.device.userCode.
+func normalizeUserCode(env *app.Environment, userCode string) (string, bool) {
+  alphabet := env.DeviceUserCodeAlphabet
+
+  // Codes of an upper case alphabet are typed in any case
+  if alphabet == strings.ToUpper(alphabet) {
+    userCode = strings.ToUpper(userCode)
+  }
+
+  normalized := strings.Map(func(r rune) rune {
+    if (r == '-' || r == ' ') && strings.ContainsRune(alphabet, r) == false {
+      return -1
+    }
+    return r
+  }, userCode)
+
+  if utf8.RuneCountInString(normalized) != env.DeviceUserCodeLength {
+    return normalized, false
+  }
+  for _, r := range normalized {
+    if strings.ContainsRune(alphabet, r) == false {
+      return normalized, false
+    }
+  }
+  return normalized, true
+}
+
+// formatUserCode splits the code in two halves, as devices usually show it.
+func formatUserCode(userCode string) string {
+  runes := []rune(userCode)
+  if len(runes) < 4 || len(runes) % 2 != 0 {
+    return userCode
+  }
+  return string(runes[:len(runes)/2]) + "-" + string(runes[len(runes)/2:])
+}
+
+func deviceUrl(env *app.Environment, deviceChallenge string) string {
+  return env.Endpoints.Idpui.Device.RequestURI() + "?" + url.Values{ DEVICE_CHALLENGE_KEY:{deviceChallenge} }.Encode()
+}
+
+func deviceConfirmUrl(env *app.Environment, loginChallenge string) string {
+  return env.Endpoints.Idpui.DeviceConfirm.RequestURI() + "?" + url.Values{ LOGIN_CHALLENGE_KEY:{loginChallenge} }.Encode()
+}
+
+func loginUrl(env *app.Environment, loginChallenge string) string {
+  return env.Endpoints.Idpui.Login.RequestURI() + "?" + url.Values{ LOGIN_CHALLENGE_KEY:{loginChallenge} }.Encode()
+}
+
+func redirectToDeviceWithError(env *app.Environment, c *gin.Context, session sessions.Session, deviceChallenge string, message string) {
+  log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+
+  errors := map[string][]string{ "user_code":{message} }
+  session.AddFlash(errors, DEVICE_ERRORS)
+  err := session.Save()
+  if err != nil {
+    log.Debug(err.Error())
+  }
+
+  redirectTo := deviceUrl(env, deviceChallenge)
+  log.WithFields(logrus.Fields{"redirect_to": redirectTo}).Debug("Redirecting")
+  c.Redirect(http.StatusFound, redirectTo)
+  c.Abort()
+}
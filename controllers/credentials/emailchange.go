@@ -80,7 +80,7 @@ func ShowEmailChange(env *app.Environment) gin.HandlerFunc {
       "id": identity.Id,
       "name": identity.Name,
       "email": identity.Email,
-      "emailChangeUrl": config.GetString("idpui.public.url") + config.GetString("idpui.public.endpoints.emailchange"),
+      "emailChangeUrl": env.Endpoints.Idpui.EmailChange.String(),
       "errorEmail": errorEmail,
     })
   }
@@ -111,6 +111,21 @@ func SubmitEmailChange(env *app.Environment) gin.HandlerFunc {
       return
     }
 
+    // Changing the email requires a recent login, log in again when the page was open too long.
+    recent, err := app.VerifyRecentAuthentication(env, c, form.Id, env.StepUp.EmailChange)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusForbidden)
+      return
+    }
+
+    if recent == false {
+      log.WithFields(logrus.Fields{"redirect_to": submitUrl}).Debug("Login too old, redirecting")
+      c.Redirect(http.StatusFound, submitUrl)
+      c.Abort()
+      return
+    }
+
     session := sessions.DefaultMany(c, env.Constants.SessionStoreKey)
 
     errors := make(map[string][]string)
@@ -189,8 +204,8 @@ func SubmitEmailChange(env *app.Environment) gin.HandlerFunc {
       idpClient := idp.NewIdpClientWithUserAccessToken(oauth2Config, &oauth2.Token{
         AccessToken: form.AccessToken,
       })
-      emailChangeRequests := []idp.CreateHumansEmailChangeRequest{ {Id: form.Id, RedirectTo: config.GetString("meui.public.url") + config.GetString("meui.public.endpoints.profile") , Email:form.Email} }
-      status, responses, err := idp.CreateHumansEmailChange(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.humans.emailchange"), emailChangeRequests)
+      emailChangeRequests := []idp.CreateHumansEmailChangeRequest{ {Id: form.Id, RedirectTo: env.Endpoints.Meui.Profile.String() , Email:form.Email} }
+      status, responses, err := env.IdpApi.CreateHumansEmailChange(idpClient, env.Endpoints.Idp.HumansEmailChange.String(), emailChangeRequests)
       if err != nil {
         log.Debug(err.Error())
         c.AbortWithStatus(http.StatusInternalServerError)
@@ -230,6 +245,12 @@ func SubmitEmailChange(env *app.Environment) gin.HandlerFunc {
         return
       }
 
+      // The access token was only for asking to change, the confirmation gets its own
+      err = app.RevokeToken(env, form.AccessToken)
+      if err != nil {
+        log.Debug(err.Error())
+      }
+
       // Success
       redirectTo := challengeResponse.RedirectTo
       log.WithFields(logrus.Fields{"redirect_to": redirectTo}).Debug("Redirecting")
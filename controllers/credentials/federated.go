@@ -0,0 +1,403 @@
+package credentials
+
+import (
+  "time"
+  "net/url"
+  "net/http"
+  "github.com/sirupsen/logrus"
+  "github.com/gin-gonic/gin"
+  "github.com/gin-contrib/sessions"
+
+  idp "github.com/opensentry/idp/client"
+
+  "github.com/opensentry/idpui/app"
+  "github.com/opensentry/idpui/federation"
+)
+
+// ShowFederatedLogin sends the browser to the upstream provider to log in for the login challenge.
+func ShowFederatedLogin(env *app.Environment) gin.HandlerFunc {
+  fn := func(c *gin.Context) {
+
+    log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+    log = log.WithFields(logrus.Fields{
+      "func": "ShowFederatedLogin",
+    })
+
+    loginChallenge := c.Query(LOGIN_CHALLENGE_KEY)
+    if loginChallenge == "" {
+      log.Debug("Missing " + LOGIN_CHALLENGE_KEY)
+      c.AbortWithStatus(http.StatusBadRequest)
+      return
+    }
+
+    provider := env.FederationProviders.Find(c.Query(FEDERATION_PROVIDER_KEY))
+    if provider == nil {
+      log.WithFields(logrus.Fields{ "provider":c.Query(FEDERATION_PROVIDER_KEY) }).Debug("Provider not found")
+      c.AbortWithStatus(http.StatusNotFound)
+      return
+    }
+
+    redirectToUpstream(env, c, provider, FEDERATION_CHALLENGE_KEY, loginChallenge)
+  }
+  return gin.HandlerFunc(fn)
+}
+
+// redirectToUpstream sends the browser to log in with the upstream provider. The key tells the callback what the login is for, the login challenge or the human linking it.
+func redirectToUpstream(env *app.Environment, c *gin.Context, provider *federation.Provider, key string, value string) {
+  log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+  log = log.WithFields(logrus.Fields{ "provider":provider.Id })
+
+  state, err := app.CreateRandomStringWithNumberOfBytes(32)
+  if err != nil {
+    log.Debug(err.Error())
+    c.AbortWithStatus(http.StatusInternalServerError)
+    return
+  }
+  nonce, err := app.CreateRandomStringWithNumberOfBytes(32)
+  if err != nil {
+    log.Debug(err.Error())
+    c.AbortWithStatus(http.StatusInternalServerError)
+    return
+  }
+  verifier, err := federation.NewCodeVerifier()
+  if err != nil {
+    log.Debug(err.Error())
+    c.AbortWithStatus(http.StatusInternalServerError)
+    return
+  }
+
+  // The redirect_uri registered with the upstream providers
+  callbackUrl, err := app.AbsoluteUrl(env.Endpoints.Idpui.FederatedCallback)
+  if err != nil {
+    log.Debug(err.Error())
+    c.AbortWithStatus(http.StatusInternalServerError)
+    return
+  }
+
+  redirectTo, err := provider.AuthCodeURL(callbackUrl, state, nonce, verifier)
+  if err != nil {
+    log.Debug(err.Error())
+    c.AbortWithStatus(http.StatusBadGateway)
+    return
+  }
+
+  session := sessions.DefaultMany(c, env.Constants.SessionStoreKey)
+  session.Set(FEDERATION_STATE_KEY, state)
+  session.Set(FEDERATION_NONCE_KEY, nonce)
+  session.Set(FEDERATION_VERIFIER_KEY, verifier)
+  session.Set(FEDERATION_UPSTREAM_KEY, provider.Id)
+  session.Delete(FEDERATION_CHALLENGE_KEY) // Left by an upstream login that never returned
+  session.Delete(FEDERATION_LINKING_KEY)
+  session.Set(key, value)
+  err = session.Save()
+  if err != nil {
+    log.Debug(err.Error())
+    c.AbortWithStatus(http.StatusInternalServerError)
+    return
+  }
+
+  log.WithFields(logrus.Fields{ "redirect_to":redirectTo }).Debug("Redirecting")
+  c.Redirect(http.StatusFound, redirectTo)
+  c.Abort()
+}
+
+// ShowFederatedCallback is where the upstream returns the browser. The login is accepted for the human the upstream identity is linked to, otherwise the human logs in once with the password to link it. When linking from the identities page, the upstream identity is linked to the human instead.
+func ShowFederatedCallback(env *app.Environment) gin.HandlerFunc {
+  fn := func(c *gin.Context) {
+
+    log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+    log = log.WithFields(logrus.Fields{
+      "func": "ShowFederatedCallback",
+    })
+
+    session := sessions.DefaultMany(c, env.Constants.SessionStoreKey)
+
+    // The authorization request can only be answered once
+    state, _ := session.Get(FEDERATION_STATE_KEY).(string)
+    nonce, _ := session.Get(FEDERATION_NONCE_KEY).(string)
+    verifier, _ := session.Get(FEDERATION_VERIFIER_KEY).(string)
+    providerId, _ := session.Get(FEDERATION_UPSTREAM_KEY).(string)
+    loginChallenge, _ := session.Get(FEDERATION_CHALLENGE_KEY).(string)
+    linking, _ := session.Get(FEDERATION_LINKING_KEY).(string)
+    for _, key := range []string{ FEDERATION_STATE_KEY, FEDERATION_NONCE_KEY, FEDERATION_VERIFIER_KEY, FEDERATION_UPSTREAM_KEY, FEDERATION_CHALLENGE_KEY, FEDERATION_LINKING_KEY } {
+      session.Delete(key)
+    }
+    err := session.Save()
+    if err != nil {
+      log.Debug(err.Error())
+    }
+
+    if state == "" || c.Query("state") != state {
+      log.Debug("Request did not originate from app. Hint: session cookie or state mismatch")
+      c.AbortWithStatus(http.StatusBadRequest)
+      return
+    }
+
+    provider := env.FederationProviders.Find(providerId)
+    if provider == nil {
+      log.WithFields(logrus.Fields{ "provider":providerId }).Debug("Provider not found")
+      c.AbortWithStatus(http.StatusNotFound)
+      return
+    }
+    log = log.WithFields(logrus.Fields{ "provider":provider.Id, "challenge":loginChallenge })
+
+    if upstreamError := c.Query("error"); upstreamError != "" {
+      log.WithFields(logrus.Fields{ "error":upstreamError, "error_description":c.Query("error_description") }).Debug("Upstream login failed")
+      federatedLoginFailed(env, c, session, loginChallenge, linking, "Login with " + provider.Name + " failed")
+      return
+    }
+
+    callbackUrl, err := app.AbsoluteUrl(env.Endpoints.Idpui.FederatedCallback)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    identity, err := provider.Exchange(c.Request.Context(), callbackUrl, c.Query("code"), verifier, nonce)
+    if err != nil {
+      log.Debug(err.Error())
+      federatedLoginFailed(env, c, session, loginChallenge, linking, "Login with " + provider.Name + " failed")
+      return
+    }
+    log = log.WithFields(logrus.Fields{ "subject":identity.Subject })
+
+    if linking != "" {
+      linkUpstreamIdentity(env, c, session, provider, identity, linking)
+      return
+    }
+
+    loginRequest, err := env.HydraApi.ReadLoginRequest(loginChallenge)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    if loginRequest == nil {
+      log.Debug("Login request not found")
+      c.AbortWithStatus(http.StatusNotFound)
+      return
+    }
+
+    idpClient := app.IdpClientUsingClientCredentials(env, c)
+
+    human, err := linkedHuman(env, idpClient, provider, identity)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    // Not linked yet, the human proves the account is theirs by logging in once
+    if human == nil {
+      session.Set(FEDERATION_PENDING_KEY, loginChallenge)
+      session.Set(FEDERATION_PENDING_PROVIDER_KEY, provider.Id)
+      session.Set(FEDERATION_PENDING_SUBJECT_KEY, identity.Subject)
+      session.Set(FEDERATION_PENDING_EMAIL_KEY, identity.Email)
+      err = session.Save()
+      if err != nil {
+        log.Debug(err.Error())
+        c.AbortWithStatus(http.StatusInternalServerError)
+        return
+      }
+
+      redirectTo := accountUrl(env, loginRequest, ACCOUNT_OTHER)
+      log.WithFields(logrus.Fields{"redirect_to": redirectTo}).Debug("Not linked, redirecting")
+      c.Redirect(http.StatusFound, redirectTo)
+      c.Abort()
+      return
+    }
+
+    if human.AllowLogin == false {
+      redirectToLoginWithError(env, c, session, loginChallenge, "Login not allowed")
+      return
+    }
+
+    // The upstream must have verified a second factor for humans that require one, the ui cannot ask for the TOTP code without the password.
+    amr := federatedMethods(provider, identity)
+    if human.TotpRequired && contains(amr, "mfa") == false {
+      message := provider.Name + " did not verify a second factor, log in with your password"
+      if provider.TrustMfa == false {
+        message = provider.Name + " is not trusted to verify a second factor, log in with your password"
+      }
+      redirectToLoginWithError(env, c, session, loginChallenge, message)
+      return
+    }
+
+    if loginRequest.Skip && human.Id != loginRequest.Subject {
+      redirectToLoginWithError(env, c, session, loginChallenge, "Not the signed in user")
+      return
+    }
+
+    redirectTo, err := env.HydraApi.AcceptLoginRequest(loginChallenge, app.HydraLoginAccept{
+      Subject: human.Id,
+      Acr: "federated",
+      Amr: amr,
+    })
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    err = app.RememberAccount(env, c, app.Account{ Id:human.Id, Email:human.Email, Name:human.Name })
+    if err != nil {
+      log.Debug(err.Error())
+    }
+
+    log.WithFields(logrus.Fields{ "id":human.Id, "redirect_to":redirectTo }).Debug("Redirecting")
+    c.Redirect(http.StatusFound, redirectTo)
+    c.Abort()
+  }
+  return gin.HandlerFunc(fn)
+}
+
+// federatedMethods returns the amr values of the upstream login. Its mfa counts as the second factor only when the upstream is trusted to verify one, see TrustMfa.
+func federatedMethods(provider *federation.Provider, identity *federation.Identity) (amr []string) {
+  for _, method := range identity.Amr {
+    if method != "mfa" || provider.TrustMfa {
+      amr = append(amr, method)
+    }
+  }
+  return amr
+}
+
+// linkedHuman returns the human the upstream identity logs in as, nil when it is not linked. Upstreams trusted for emails link by verified email on first use, to a human that confirmed the same email. Anyone can register an email they do not own.
+func linkedHuman(env *app.Environment, idpClient *idp.IdpClient, provider *federation.Provider, identity *federation.Identity) (*idp.Human, error) {
+  link, err := env.FederationLinks.FindLink(provider.Id, identity.Subject)
+  if err != nil {
+    return nil, err
+  }
+
+  if link != nil {
+    human, err := app.ReadHuman(env, idpClient, idp.ReadHumansRequest{ Id:link.HumanId })
+    if err != nil || human != nil {
+      return human, err
+    }
+    // The human was deleted, link again
+  }
+
+  if provider.TrustEmail == false || identity.EmailVerified == false || identity.Email == "" {
+    return nil, nil
+  }
+
+  human, err := app.ReadHuman(env, idpClient, idp.ReadHumansRequest{ Email:identity.Email })
+  if err != nil || human == nil || human.EmailConfirmedAt == 0 {
+    return nil, err
+  }
+
+  err = env.FederationLinks.CreateLink(federation.Link{
+    Provider: provider.Id,
+    Subject: identity.Subject,
+    HumanId: human.Id,
+    Email: identity.Email,
+    LinkedAt: time.Now().Unix(),
+  })
+  if err != nil {
+    return nil, err
+  }
+  return human, nil
+}
+
+// linkPendingIdentity links the upstream identity waiting on the login challenge to the human that just logged in. Only once the login is accepted, see verifyPendingIdentity.
+func linkPendingIdentity(env *app.Environment, session sessions.Session, loginChallenge string, humanId string) error {
+  if session.Get(FEDERATION_PENDING_KEY) != loginChallenge {
+    return nil
+  }
+
+  provider, _ := session.Get(FEDERATION_PENDING_PROVIDER_KEY).(string)
+  subject, _ := session.Get(FEDERATION_PENDING_SUBJECT_KEY).(string)
+  email, _ := session.Get(FEDERATION_PENDING_EMAIL_KEY).(string)
+
+  for _, key := range []string{ FEDERATION_PENDING_KEY, FEDERATION_PENDING_PROVIDER_KEY, FEDERATION_PENDING_SUBJECT_KEY, FEDERATION_PENDING_EMAIL_KEY, FEDERATION_PENDING_HUMAN_KEY } {
+    session.Delete(key)
+  }
+  err := session.Save()
+  if err != nil {
+    return err
+  }
+
+  return env.FederationLinks.CreateLink(federation.Link{
+    Provider: provider,
+    Subject: subject,
+    HumanId: humanId,
+    Email: email,
+    LinkedAt: time.Now().Unix(),
+  })
+}
+
+// verifyPendingIdentity remembers the human whose password was checked for the upstream identity waiting on the login challenge, when the second factor or email confirmation follows. The link is made when that accepts the login, see linkVerifiedPendingIdentity.
+func verifyPendingIdentity(session sessions.Session, loginChallenge string, humanId string) error {
+  if session.Get(FEDERATION_PENDING_KEY) != loginChallenge {
+    return nil
+  }
+  session.Set(FEDERATION_PENDING_HUMAN_KEY, humanId)
+  return session.Save()
+}
+
+// linkVerifiedPendingIdentity links the upstream identity waiting on the login challenge, if the password of the human was checked for it before the second factor or email confirmation.
+func linkVerifiedPendingIdentity(env *app.Environment, session sessions.Session, loginChallenge string, humanId string) error {
+  if session.Get(FEDERATION_PENDING_HUMAN_KEY) != humanId {
+    return nil
+  }
+  return linkPendingIdentity(env, session, loginChallenge, humanId)
+}
+
+// pendingProvider returns the upstream provider waiting to be linked on the login challenge, nil when none is.
+func pendingProvider(env *app.Environment, session sessions.Session, loginChallenge string) (*federation.Provider, string) {
+  if session.Get(FEDERATION_PENDING_KEY) != loginChallenge {
+    return nil, ""
+  }
+  provider, _ := session.Get(FEDERATION_PENDING_PROVIDER_KEY).(string)
+  email, _ := session.Get(FEDERATION_PENDING_EMAIL_KEY).(string)
+  return env.FederationProviders.Find(provider), email
+}
+
+// federatedLogins are the buttons of the login page, one per upstream provider.
+func federatedLogins(env *app.Environment, loginRequest *app.HydraLoginRequest) (logins []map[string]string) {
+  for _, p := range env.FederationProviders {
+    q := url.Values{}
+    q.Set(FEDERATION_PROVIDER_KEY, p.Id)
+    q.Set(LOGIN_CHALLENGE_KEY, loginRequest.Challenge)
+    logins = append(logins, map[string]string{
+      "name": p.Name,
+      "url": env.Endpoints.Idpui.FederatedLogin.RequestURI() + "?" + q.Encode(),
+    })
+  }
+  return logins
+}
+
+// federatedLoginFailed returns the browser to where the upstream login started with the error.
+func federatedLoginFailed(env *app.Environment, c *gin.Context, session sessions.Session, loginChallenge string, linking string, message string) {
+  if linking != "" {
+    redirectToIdentitiesWithError(env, c, session, message)
+    return
+  }
+  redirectToLoginWithError(env, c, session, loginChallenge, message)
+}
+
+func redirectToLoginWithError(env *app.Environment, c *gin.Context, session sessions.Session, loginChallenge string, message string) {
+  log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+
+  errors := map[string][]string{ "federation":{message} }
+  session.AddFlash(errors, "authenticate.errors")
+  err := session.Save()
+  if err != nil {
+    log.Debug(err.Error())
+  }
+
+  redirectTo := env.Endpoints.Idpui.Login.RequestURI() + "?" + url.Values{ LOGIN_CHALLENGE_KEY:{loginChallenge} }.Encode()
+  log.WithFields(logrus.Fields{"redirect_to": redirectTo}).Debug("Redirecting")
+  c.Redirect(http.StatusFound, redirectTo)
+  c.Abort()
+}
+
+func contains(values []string, value string) bool {
+  for _, v := range values {
+    if v == value {
+      return true
+    }
+  }
+  return false
+}
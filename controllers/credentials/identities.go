@@ -0,0 +1,321 @@
+package credentials
+
+import (
+  "time"
+  "strings"
+  "net/http"
+  "github.com/sirupsen/logrus"
+  "github.com/gin-gonic/gin"
+  "github.com/gin-contrib/sessions"
+  "github.com/gorilla/csrf"
+
+  idp "github.com/opensentry/idp/client"
+
+  "github.com/opensentry/idpui/app"
+  "github.com/opensentry/idpui/config"
+  "github.com/opensentry/idpui/federation"
+)
+
+type identitiesLinkForm struct {
+  Id string `form:"id" binding:"required"`
+  Provider string `form:"provider" binding:"required"`
+}
+
+type identitiesUnlinkForm struct {
+  Id string `form:"id" binding:"required"`
+  Provider string `form:"provider" binding:"required"`
+  Subject string `form:"subject" binding:"required"`
+}
+
+// ShowIdentities lists the upstream identities linked to the human, with the providers that can still be linked.
+func ShowIdentities(env *app.Environment) gin.HandlerFunc {
+  fn := func(c *gin.Context) {
+
+    log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+    log = log.WithFields(logrus.Fields{
+      "func": "ShowIdentities",
+    })
+
+    identity := app.GetIdentity(env, c)
+    if identity == nil {
+      log.Debug("Missing Identity")
+      c.AbortWithStatus(http.StatusForbidden)
+      return
+    }
+
+    session := sessions.DefaultMany(c, env.Constants.SessionStoreKey)
+
+    errors := session.Flashes(IDENTITIES_ERRORS)
+    err := session.Save() // Remove flashes read, and save submit fields
+    if err != nil {
+      log.Debug(err.Error())
+    }
+
+    var errorIdentities string
+
+    if len(errors) > 0 {
+      errorsMap := errors[0].(map[string][]string)
+      for k, v := range errorsMap {
+
+        if k == "identities" && len(v) > 0 {
+          errorIdentities = strings.Join(v, ", ")
+        }
+
+      }
+    }
+
+    links, err := env.FederationLinks.ReadLinks(identity.Id)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    var linked []map[string]string
+    isLinked := make(map[string]bool)
+    for _, l := range links {
+      isLinked[l.Provider] = true
+      name := l.Provider // The provider may no longer be configured, it can still be unlinked
+      if p := env.FederationProviders.Find(l.Provider); p != nil {
+        name = p.Name
+      }
+      linked = append(linked, map[string]string{
+        "provider": l.Provider,
+        "name": name,
+        "subject": l.Subject,
+        "email": l.Email,
+        "linkedAt": time.Unix(l.LinkedAt, 0).UTC().Format("2006-01-02"),
+      })
+    }
+
+    var linkable []map[string]string
+    for _, p := range env.FederationProviders {
+      if isLinked[p.Id] {
+        continue
+      }
+      linkable = append(linkable, map[string]string{
+        "provider": p.Id,
+        "name": p.Name,
+      })
+    }
+
+    c.HTML(http.StatusOK, "identities.html", gin.H{
+      "title": "Linked Identities",
+      "links": []map[string]string{
+        {"href": "/public/css/credentials.css"},
+      },
+      csrf.TemplateTag: csrf.TemplateField(c.Request),
+      "provider": config.GetString("provider.name"),
+      "provideraction": "Manage the accounts you log in with",
+      "id": identity.Id,
+      "name": identity.Name,
+      "email": identity.Email,
+      "linked": linked,
+      "linkable": linkable,
+      "errorIdentities": errorIdentities,
+      "identitiesLinkUrl": env.Endpoints.Idpui.IdentitiesLink.String(),
+      "identitiesUnlinkUrl": env.Endpoints.Idpui.IdentitiesUnlink.String(),
+    })
+  }
+  return gin.HandlerFunc(fn)
+}
+
+// SubmitIdentitiesLink starts the upstream login, the upstream identity is linked to the human when it returns, see ShowFederatedCallback.
+func SubmitIdentitiesLink(env *app.Environment) gin.HandlerFunc {
+  fn := func(c *gin.Context) {
+
+    log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+    log = log.WithFields(logrus.Fields{
+      "func": "SubmitIdentitiesLink",
+    })
+
+    var form identitiesLinkForm
+    err := c.Bind(&form)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusBadRequest)
+      return
+    }
+
+    if verifyIdentitiesForm(env, c, form.Id) == false {
+      return
+    }
+
+    provider := env.FederationProviders.Find(form.Provider)
+    if provider == nil {
+      log.WithFields(logrus.Fields{ "provider":form.Provider }).Debug("Provider not found")
+      c.AbortWithStatus(http.StatusNotFound)
+      return
+    }
+
+    redirectToUpstream(env, c, provider, FEDERATION_LINKING_KEY, form.Id)
+  }
+  return gin.HandlerFunc(fn)
+}
+
+// SubmitIdentitiesUnlink unlinks the upstream identity, as long as the human can still log in without it.
+func SubmitIdentitiesUnlink(env *app.Environment) gin.HandlerFunc {
+  fn := func(c *gin.Context) {
+
+    log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+    log = log.WithFields(logrus.Fields{
+      "func": "SubmitIdentitiesUnlink",
+    })
+
+    var form identitiesUnlinkForm
+    err := c.Bind(&form)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusBadRequest)
+      return
+    }
+
+    if verifyIdentitiesForm(env, c, form.Id) == false {
+      return
+    }
+
+    links, err := env.FederationLinks.ReadLinks(form.Id)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    var unlinking *federation.Link
+    for i, l := range links {
+      if l.Provider == form.Provider && l.Subject == form.Subject {
+        unlinking = &links[i]
+      }
+    }
+
+    // Only the identities of the human itself
+    if unlinking == nil {
+      log.WithFields(logrus.Fields{ "provider":form.Provider, "subject":form.Subject }).Debug("Link not found")
+      c.AbortWithStatus(http.StatusNotFound)
+      return
+    }
+
+    idpClient := app.IdpClientUsingClientCredentials(env, c)
+    human, err := app.ReadHuman(env, idpClient, idp.ReadHumansRequest{ Id:form.Id })
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+    if human == nil {
+      log.WithFields(logrus.Fields{ "id":form.Id }).Debug("Human not found")
+      c.AbortWithStatus(http.StatusNotFound)
+      return
+    }
+
+    session := sessions.DefaultMany(c, env.Constants.SessionStoreKey)
+
+    if remainingCredentials(human, links, unlinking) < 1 {
+      redirectToIdentitiesWithError(env, c, session, "Unlinking would leave no way to log in, confirm your email first")
+      return
+    }
+
+    err = env.FederationLinks.DeleteLink(unlinking.Provider, unlinking.Subject)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    redirectTo := env.Endpoints.Idpui.Identities.String()
+    log.WithFields(logrus.Fields{ "provider":unlinking.Provider, "redirect_to":redirectTo }).Debug("Unlinked, redirecting")
+    c.Redirect(http.StatusFound, redirectTo)
+    c.Abort()
+  }
+  return gin.HandlerFunc(fn)
+}
+
+// verifyIdentitiesForm checks that the form was posted by the human it is for, logged in recently enough. Aborts otherwise.
+func verifyIdentitiesForm(env *app.Environment, c *gin.Context, id string) bool {
+  log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+
+  recent, err := app.VerifyRecentAuthentication(env, c, id, env.StepUp.Identities)
+  if err != nil {
+    log.Debug(err.Error())
+    c.AbortWithStatus(http.StatusForbidden)
+    return false
+  }
+
+  // The page was open too long, log in again
+  if recent == false {
+    redirectTo := env.Endpoints.Idpui.Identities.String()
+    log.WithFields(logrus.Fields{"redirect_to": redirectTo}).Debug("Login too old, redirecting")
+    c.Redirect(http.StatusFound, redirectTo)
+    c.Abort()
+    return false
+  }
+  return true
+}
+
+// remainingCredentials counts the ways the human can log in once the identity is unlinked. The idp cannot tell if the human knows the password, humans provisioned from the directory or an upstream have a random one, so the password only counts once the email is confirmed and a password of their own can be recovered.
+func remainingCredentials(human *idp.Human, links []federation.Link, unlinking *federation.Link) int {
+  remaining := 0
+  if human.EmailConfirmedAt != 0 {
+    remaining++
+  }
+  for _, l := range links {
+    if l.Provider != unlinking.Provider || l.Subject != unlinking.Subject {
+      remaining++
+    }
+  }
+  return remaining
+}
+
+// linkUpstreamIdentity links the identity the upstream returned with to the human linking it from the identities page.
+func linkUpstreamIdentity(env *app.Environment, c *gin.Context, session sessions.Session, provider *federation.Provider, identity *federation.Identity, humanId string) {
+  log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+  log = log.WithFields(logrus.Fields{ "provider":provider.Id, "subject":identity.Subject, "id":humanId })
+
+  link, err := env.FederationLinks.FindLink(provider.Id, identity.Subject)
+  if err != nil {
+    log.Debug(err.Error())
+    c.AbortWithStatus(http.StatusInternalServerError)
+    return
+  }
+
+  if link != nil && link.HumanId != humanId {
+    redirectToIdentitiesWithError(env, c, session, "This " + provider.Name + " account is linked to another account")
+    return
+  }
+
+  if link == nil {
+    err = env.FederationLinks.CreateLink(federation.Link{
+      Provider: provider.Id,
+      Subject: identity.Subject,
+      HumanId: humanId,
+      Email: identity.Email,
+      LinkedAt: time.Now().Unix(),
+    })
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+  }
+
+  redirectTo := env.Endpoints.Idpui.Identities.String()
+  log.WithFields(logrus.Fields{"redirect_to": redirectTo}).Debug("Linked, redirecting")
+  c.Redirect(http.StatusFound, redirectTo)
+  c.Abort()
+}
+
+func redirectToIdentitiesWithError(env *app.Environment, c *gin.Context, session sessions.Session, message string) {
+  log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+
+  errors := map[string][]string{ "identities":{message} }
+  session.AddFlash(errors, IDENTITIES_ERRORS)
+  err := session.Save()
+  if err != nil {
+    log.Debug(err.Error())
+  }
+
+  redirectTo := env.Endpoints.Idpui.Identities.String()
+  log.WithFields(logrus.Fields{"redirect_to": redirectTo}).Debug("Redirecting")
+  c.Redirect(http.StatusFound, redirectTo)
+  c.Abort()
+}
@@ -24,8 +24,9 @@ import (
 
 type authenticationForm struct {
   Challenge string `form:"challenge" binding:"required" validate:"required,notblank"`
-  Email string `form:"email" binding:"required" validate:"required,notblank"`
+  Email string `form:"email" binding:"required" validate:"required,notblank"` // Or the username, see login.username
   Password string `form:"password" binding:"required" validate:"required,notblank"`
+  Remember string `form:"remember"`
 }
 
 func ShowLogin(env *app.Environment) gin.HandlerFunc {
@@ -44,6 +45,37 @@ func ShowLogin(env *app.Environment) gin.HandlerFunc {
       return
     }
 
+    loginRequest, err := env.HydraApi.ReadLoginRequest(loginChallenge)
+    if err != nil {
+      log.WithFields(logrus.Fields{ "challenge":loginChallenge }).Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    if loginRequest == nil {
+      log.WithFields(logrus.Fields{ "challenge":loginChallenge }).Debug("Login request not found")
+      c.AbortWithStatus(http.StatusNotFound)
+      return
+    }
+
+    session := sessions.DefaultMany(c, env.Constants.SessionStoreKey)
+
+    // The login after a user code was entered authorizes the device, the human sees the client and scopes before logging in
+    if deviceConfirmPending(session, loginChallenge) {
+      err = session.Save()
+      if err != nil {
+        log.Debug(err.Error())
+        c.AbortWithStatus(http.StatusInternalServerError)
+        return
+      }
+
+      redirectTo := deviceConfirmUrl(env, loginChallenge)
+      log.WithFields(logrus.Fields{"redirect_to": redirectTo}).Debug("Device not confirmed, redirecting")
+      c.Redirect(http.StatusFound, redirectTo)
+      c.Abort()
+      return
+    }
+
     idpClient := app.IdpClientUsingClientCredentials(env, c)
 
     var authenticateRequests []idp.CreateHumansAuthenticateRequest
@@ -58,9 +90,16 @@ func ShowLogin(env *app.Environment) gin.HandlerFunc {
       authenticateRequest.EmailChallenge = emailChallenge
     }
 
+    // The idp accepts skipped logins without credentials, so do not ask it when credentials are required anyway.
+    reauthenticate := loginRequest.Skip && env.LoginPolicy.RequiresAuthentication(loginRequest)
+    if reauthenticate && otpChallenge == "" && emailChallenge == "" {
+      showLoginForm(env, c, session, loginRequest)
+      return
+    }
+
     authenticateRequests = append(authenticateRequests, authenticateRequest)
 
-    status, authenticateResponse, err := idp.CreateHumansAuthenticate(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.humans.authenticate"), authenticateRequests)
+    status, authenticateResponse, err := env.IdpApi.CreateHumansAuthenticate(idpClient, env.Endpoints.Idp.HumansAuthenticate.String(), authenticateRequests)
     if err != nil {
       log.WithFields(logrus.Fields{ "challenge":loginChallenge }).Debug(err.Error())
       c.AbortWithStatus(http.StatusInternalServerError)
@@ -91,60 +130,49 @@ func ShowLogin(env *app.Environment) gin.HandlerFunc {
       auth := resp
 
       if auth.Authenticated {
-        log.WithFields(logrus.Fields{"authenticated":auth.Authenticated, "redirect_to":auth.RedirectTo}).Debug("Redirecting")
-        c.Redirect(http.StatusFound, auth.RedirectTo)
-        c.Abort()
-        return
-      }
-
-      session := sessions.DefaultMany(c, env.Constants.SessionStoreKey)
-
-      // Retain the values that was submittet, except passwords!
-      var email string
-      fau := session.Flashes("authenticate.email")
-      if fau != nil {
-        email = fmt.Sprintf("%s", fau[0])
-      }
-
-      errors := session.Flashes("authenticate.errors")
-      err = session.Save() // Remove flashes read, and save submit fields
-      if err != nil {
-        log.Debug(err.Error())
-      }
+        acr := "skip"
+        if otpChallenge != "" {
+          acr = "otp"
+        } else if emailChallenge != "" {
+          acr = "otp.email"
+
+          // Sent by this browser instead of TOTP, after the password
+          if session.Get(env.Constants.SessionEmailOtpChallengeKey) == emailChallenge {
+            acr = "otp.email.mfa"
+            session.Delete(env.Constants.SessionEmailOtpChallengeKey)
+          }
 
-      var errorEmail string
-      var errorPassword string
+          // A sign-in link opened in this browser, instead of the password
+          if session.Get(LOGIN_LINK_OPENED_KEY) == emailChallenge {
+            acr = "link"
+            session.Delete(LOGIN_LINK_OPENED_KEY)
+          }
+        }
 
-      if len(errors) > 0 {
-        errorsMap := errors[0].(map[string][]string)
-        for k, v := range errorsMap {
+        // The otp and email challenges are the last step, and skipped logins have none
+        redirectTo, _, err := acceptLogin(env, session, loginRequest, auth, false, acr)
+        if err != nil {
+          log.WithFields(logrus.Fields{ "challenge":loginChallenge }).Debug(err.Error())
+          c.AbortWithStatus(http.StatusInternalServerError)
+          return
+        }
 
-          if k == "email" && len(v) > 0 {
-            errorEmail = strings.Join(v, ", ")
-          }
-          if k == "password" && len(v) > 0 {
-            errorPassword = strings.Join(v, ", ")
+        if acr != "skip" {
+          err = linkVerifiedPendingIdentity(env, session, loginChallenge, auth.Id)
+          if err != nil {
+            log.WithFields(logrus.Fields{ "id":auth.Id, "challenge":loginChallenge }).Debug(err.Error())
+            c.AbortWithStatus(http.StatusInternalServerError)
+            return
           }
-
         }
+
+        log.WithFields(logrus.Fields{"authenticated":auth.Authenticated, "redirect_to":redirectTo}).Debug("Redirecting")
+        c.Redirect(http.StatusFound, redirectTo)
+        c.Abort()
+        return
       }
 
-      c.HTML(200, "login.html", gin.H{
-        "links": []map[string]string{
-          {"href": "/public/css/credentials.css"},
-        },
-        "title": "Authenticate",
-        csrf.TemplateTag: csrf.TemplateField(c.Request),
-        "provider": config.GetString("provider.name"),
-        "provideraction": "Identify yourself to gain access",
-        "challenge": loginChallenge,
-        "email": email,
-        "errorEmail": errorEmail,
-        "errorPassword": errorPassword,
-        "loginUrl": config.GetString("idpui.public.endpoints.login"),
-        "recoverUrl": config.GetString("idpui.public.endpoints.recover"),
-        "claimUrl": config.GetString("idpui.public.endpoints.claim"),
-      })
+      showLoginForm(env, c, session, loginRequest)
       return
     }
 
@@ -155,6 +183,144 @@ func ShowLogin(env *app.Environment) gin.HandlerFunc {
   return gin.HandlerFunc(fn)
 }
 
+func showLoginForm(env *app.Environment, c *gin.Context, session sessions.Session, loginRequest *app.HydraLoginRequest) {
+  log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+
+  // Retain the values that was submittet, except passwords!
+  var email string
+  fau := session.Flashes("authenticate.email")
+  if fau != nil {
+    email = fmt.Sprintf("%s", fau[0])
+  }
+
+  errors := session.Flashes("authenticate.errors")
+  err := session.Save() // Remove flashes read, and save submit fields
+  if err != nil {
+    log.Debug(err.Error())
+  }
+
+  // Prefill who logs in, the account chosen, the human already signed in, the upstream identity being linked or the hint of the client.
+  chosen := c.Query(LOGIN_ACCOUNT_KEY)
+  linking, linkingEmail := pendingProvider(env, session, loginRequest.Challenge)
+  if email == "" {
+    if loginRequest.Skip {
+      chosen = loginRequest.Subject
+    }
+    account, exists := app.FindAccount(env, c, chosen)
+    if exists {
+      email = account.Email
+    } else if linking != nil && linkingEmail != "" {
+      email = linkingEmail
+    } else {
+      email = loginRequest.OidcContext.LoginHint
+    }
+  }
+
+  // Offer the accounts used on this device until one is chosen
+  accounts := app.ReadAccounts(env, c)
+  if email == "" && chosen == "" && len(errors) == 0 && len(accounts) > 0 {
+    showAccountChooser(env, c, loginRequest, accounts)
+    return
+  }
+
+  var errorEmail string
+  var errorPassword string
+  var errorFederation string
+
+  if len(errors) > 0 {
+    errorsMap := errors[0].(map[string][]string)
+    for k, v := range errorsMap {
+
+      if k == "email" && len(v) > 0 {
+        errorEmail = strings.Join(v, ", ")
+      }
+      if k == "password" && len(v) > 0 {
+        errorPassword = strings.Join(v, ", ")
+      }
+      if k == "federation" && len(v) > 0 {
+        errorFederation = strings.Join(v, ", ")
+      }
+
+    }
+  }
+
+  provideraction := "Identify yourself to gain access"
+  if loginRequest.Skip {
+    provideraction = "Confirm it is you to continue" // Already signed in, but credentials are required
+  }
+  var linkingName string
+  if linking != nil {
+    linkingName = linking.Name
+  }
+  var loginLink string
+  if env.LoginPolicy.Link {
+    loginLink = loginLinkUrl(env, loginRequest.Challenge)
+  }
+
+  c.HTML(200, "login.html", gin.H{
+    "links": []map[string]string{
+      {"href": "/public/css/credentials.css"},
+    },
+    "title": "Authenticate",
+    csrf.TemplateTag: csrf.TemplateField(c.Request),
+    "provider": config.GetString("provider.name"),
+    "provideraction": provideraction,
+    "challenge": loginRequest.Challenge,
+    "email": email,
+    "usernameLogin": env.LoginPolicy.Username,
+    "remember": env.LoginPolicy.Remember && loginRequest.Skip == false, // Hydra keeps the session it already has
+    "errorEmail": errorEmail,
+    "errorPassword": errorPassword,
+    "errorFederation": errorFederation,
+    "federatedLogins": federatedLogins(env, loginRequest),
+    "linkingProvider": linkingName,
+    "loginUrl": env.Endpoints.Idpui.Login.RequestURI(),
+    "loginLinkUrl": loginLink,
+    "chooseUrl": accountUrl(env, loginRequest, ""),
+    "showChooseAccount": len(accounts) > 0 && loginRequest.Skip == false && loginRequest.OidcContext.LoginHint == "", // The hint would be prefilled again
+    "recoverUrl": env.Endpoints.Idpui.Recover.RequestURI(),
+    "claimUrl": env.Endpoints.Idpui.Claim.RequestURI(),
+  })
+}
+
+// acceptLogin returns where the browser continues once the idp authenticated the human, and whether the login is accepted with Hydra. A pending login continues with the second factor or email confirmation first, see pendingLogin.
+// The idp always remembers the logins it accepts with Hydra, so they are accepted again with the choice of the human, keeping the acr the idp would use. Authenticators other than the idp leave accepting to the ui, see app.Authenticator.
+func acceptLogin(env *app.Environment, session sessions.Session, loginRequest *app.HydraLoginRequest, auth idp.CreateHumansAuthenticateResponse, pending bool, acr string) (redirectTo string, accepted bool, err error) {
+  if pending {
+    return auth.RedirectTo, false, nil
+  }
+
+  // Hydra ignores remember for skipped logins, the accept of the idp stands.
+  if loginRequest.Skip && auth.RedirectTo != "" {
+    return auth.RedirectTo, true, nil
+  }
+
+  remember := env.LoginPolicy.Remember && session.Get(LOGIN_REMEMBER_KEY) == loginRequest.Challenge
+
+  session.Delete(LOGIN_REMEMBER_KEY)
+  err = session.Save()
+  if err != nil {
+    return "", false, err
+  }
+
+  redirectTo, err = env.HydraApi.AcceptLoginRequest(loginRequest.Challenge, app.HydraLoginAccept{
+    Subject: auth.Id,
+    Remember: remember,
+    RememberFor: env.LoginPolicy.RememberFor,
+    Acr: acr,
+    Amr: app.AuthenticationMethods(acr),
+  })
+  if err != nil {
+    return "", false, err
+  }
+  return redirectTo, true, nil
+}
+
+// pendingLogin tells if the idp continues the password login with email confirmation or the second factor, as it does for humans that have not confirmed the email or require TOTP.
+func pendingLogin(auth *app.Authentication) bool {
+  return auth.Response.RedirectTo != "" && (auth.Human.EmailConfirmedAt == 0 || auth.Response.TotpRequired)
+}
+
 func SubmitLogin(env *app.Environment) gin.HandlerFunc {
   fn := func(c *gin.Context) {
 
@@ -240,80 +406,106 @@ func SubmitLogin(env *app.Environment) gin.HandlerFunc {
       return
     }
 
-    idpClient := app.IdpClientUsingClientCredentials(env, c)
-
-    identityRequest := []idp.ReadHumansRequest{ {Email: form.Email} }
-    _, humans, err := idp.ReadHumans(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.humans.collection"), identityRequest)
+    loginRequest, err := env.HydraApi.ReadLoginRequest(form.Challenge)
     if err != nil {
-      log.Debug(err.Error())
+      log.WithFields(logrus.Fields{ "challenge":form.Challenge }).Debug(err.Error())
       c.AbortWithStatus(http.StatusInternalServerError)
       return
     }
 
-    if humans == nil {
-      errors["email"] = append(errors["email"], "Not found")
+    if loginRequest == nil {
+      log.WithFields(logrus.Fields{ "challenge":form.Challenge }).Debug("Login request not found")
+      c.AbortWithStatus(http.StatusNotFound)
+      return
+    }
+
+    // Remembered until the login completes, which may be after a second factor.
+    if env.LoginPolicy.Remember && len(form.Remember) > 0 {
+      session.Set(LOGIN_REMEMBER_KEY, form.Challenge)
     } else {
+      session.Delete(LOGIN_REMEMBER_KEY)
+    }
+    err = session.Save()
+    if err != nil {
+      log.Debug(err.Error())
+    }
 
-      var resp idp.ReadHumansResponse
-      status, _ := bulky.Unmarshal(0, humans, &resp)
-      if status == 200 {
+    auth, err := env.Authenticators.Authenticate(env, c, loginRequest, form.Email, form.Password)
+    switch err {
+    case nil:
+    case app.ErrNotSignedInHuman:
+      errors["email"] = append(errors["email"], "Not the signed in user")
+    case app.ErrSecondFactorUnavailable:
+      errors["password"] = append(errors["password"], "Second factor required, log in with the password of your account")
+    default:
+      log.WithFields(logrus.Fields{ "challenge":form.Challenge }).Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    if err == nil && auth == nil {
+      errors["password"] = append(errors["password"], "Invalid") // Same for unknown humans, not telling who has an account
+    }
 
-        human := resp[0]
+    // User authenticated, redirect
+    if auth != nil {
+      human := auth.Human
 
-        // Ask idp to authenticate the user
-        authenticateRequest := []idp.CreateHumansAuthenticateRequest{{
-          Id: human.Id,
-          Password: form.Password,
-          Challenge: form.Challenge,
-        }}
-        status, authenticateResponse, err := idp.CreateHumansAuthenticate(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.humans.authenticate"), authenticateRequest)
+      // The human verified the second factor on this device before and trusts it, see login.trustedDevices
+      acr := ""
+      if auth.Response.TotpRequired && auth.Human.EmailConfirmedAt != 0 && app.TrustedDeviceAllowed(loginRequest) {
+        device, err := app.FindTrustedDevice(env, c, human.Id)
         if err != nil {
           log.WithFields(logrus.Fields{ "id":human.Id, "challenge":form.Challenge }).Debug(err.Error())
-          c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+          c.AbortWithStatus(http.StatusInternalServerError)
           return
         }
-
-        if authenticateResponse == nil {
-          log.WithFields(logrus.Fields{ "challenge":form.Challenge, "id":human.Id }).Debug("Not Found")
-          c.AbortWithStatus(http.StatusNotFound)
-          return
+        if device != nil {
+          log.WithFields(logrus.Fields{ "id":human.Id, "device":device.Id }).Debug("Trusted device, skipping second factor")
+          auth.Response.RedirectTo = ""
+          acr = "otp.device"
         }
+      }
 
-        var resp idp.CreateHumansAuthenticateResponse
-        status, _ = bulky.Unmarshal(0, authenticateResponse, &resp)
-        if status == 200 {
-
-          auth := resp
-
-          // User authenticated, redirect
-          if auth.Authenticated == true {
-
-            // Cleanup session
-            session.Delete("authenticate.email")
-            session.Delete("authenticate.errors")
+      redirectTo, accepted, err := acceptLogin(env, session, loginRequest, auth.Response, pendingLogin(auth), acr)
+      if err != nil {
+        log.WithFields(logrus.Fields{ "id":human.Id, "challenge":form.Challenge }).Debug(err.Error())
+        c.AbortWithStatus(http.StatusInternalServerError)
+        return
+      }
 
-            err = session.Save()
-            if err != nil {
-              log.Debug(err.Error())
-            }
+      err = app.RememberAccount(env, c, app.Account{ Id:human.Id, Email:human.Email, Name:human.Name })
+      if err != nil {
+        log.Debug(err.Error())
+      }
 
-            log.WithFields(logrus.Fields{ "id":auth.Id, "authenticated":auth.Authenticated, "totp_required":auth.TotpRequired, "redirect_to":auth.RedirectTo }).Debug("Redirecting")
-            c.Redirect(http.StatusFound, auth.RedirectTo)
-            c.Abort()
-            return
-          }
+      // The upstream identity is linked once the login is accepted, after the second factor when it follows
+      if accepted {
+        err = linkPendingIdentity(env, session, form.Challenge, human.Id)
+      } else {
+        err = verifyPendingIdentity(session, form.Challenge, human.Id)
+      }
+      if err != nil {
+        log.WithFields(logrus.Fields{ "id":human.Id, "challenge":form.Challenge }).Debug(err.Error())
+        c.AbortWithStatus(http.StatusInternalServerError)
+        return
+      }
 
-          // Deny by default
-          if auth.IsPasswordInvalid == true {
-            errors["password"] = append(errors["password"], "Invalid")
-          }
-        }
+      // Cleanup session
+      session.Delete("authenticate.email")
+      session.Delete("authenticate.errors")
 
-      } else {
-        errors["email"] = append(errors["email"], "Not found")
+      err = session.Save()
+      if err != nil {
+        log.Debug(err.Error())
       }
 
+      log.WithFields(logrus.Fields{ "id":human.Id, "totp_required":auth.Response.TotpRequired, "redirect_to":redirectTo }).Debug("Redirecting")
+      c.Redirect(http.StatusFound, redirectTo)
+      c.Abort()
+      return
     }
+
     session.AddFlash(errors, "authenticate.errors")
     err = session.Save()
     if err != nil {
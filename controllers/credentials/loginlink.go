@@ -0,0 +1,344 @@
+package credentials
+
+import (
+  "fmt"
+  "strings"
+  "net/url"
+  "net/http"
+  "crypto/rand"
+  "encoding/base64"
+  "github.com/sirupsen/logrus"
+  "github.com/gin-gonic/gin"
+  "github.com/gin-contrib/sessions"
+  "github.com/gorilla/csrf"
+  idp "github.com/opensentry/idp/client"
+
+  "github.com/opensentry/idpui/app"
+  "github.com/opensentry/idpui/config"
+
+  bulky "github.com/charmixer/bulky/client"
+)
+
+// # Sign-in links
+// Instead of the password the human can ask for a link by email, see login.link. The ui creates an email challenge with the idp for a random code, and the idp mails the link to the open page with the email_challenge and code.
+// The link is bound to the login challenge and the browser asking for it, through the session, and can only be opened once within login.link.ttl. Opening it verifies the challenge and returns to the login with the email_challenge, which the idp accepts as for email confirmation. The ui accepts it with acr link, no password was entered.
+
+type loginLinkForm struct {
+  Challenge string `form:"challenge" binding:"required"`
+  Email string `form:"email"` // Or the username, see login.username
+  Remember string `form:"remember"`
+}
+
+// ShowLoginLink asks who to send the link to, and tells when it was sent.
+func ShowLoginLink(env *app.Environment) gin.HandlerFunc {
+  fn := func(c *gin.Context) {
+
+    log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+    log = log.WithFields(logrus.Fields{
+      "func": "ShowLoginLink",
+    })
+
+    if env.LoginPolicy.Link == false {
+      c.AbortWithStatus(http.StatusNotFound)
+      return
+    }
+
+    loginChallenge := c.Query(LOGIN_CHALLENGE_KEY)
+    if loginChallenge == "" {
+      log.Debug("Missing " + LOGIN_CHALLENGE_KEY)
+      c.AbortWithStatus(http.StatusBadRequest)
+      return
+    }
+
+    loginRequest, err := env.HydraApi.ReadLoginRequest(loginChallenge)
+    if err != nil {
+      log.WithFields(logrus.Fields{ "challenge":loginChallenge }).Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    if loginRequest == nil {
+      log.WithFields(logrus.Fields{ "challenge":loginChallenge }).Debug("Login request not found")
+      c.AbortWithStatus(http.StatusNotFound)
+      return
+    }
+
+    session := sessions.DefaultMany(c, env.Constants.SessionStoreKey)
+
+    email := loginRequest.OidcContext.LoginHint
+    sent := session.Flashes(LOGIN_LINK_SENT)
+    if len(sent) > 0 {
+      email = fmt.Sprintf("%s", sent[0])
+    }
+
+    errors := session.Flashes(LOGIN_LINK_ERRORS)
+    err = session.Save() // Remove flashes read
+    if err != nil {
+      log.Debug(err.Error())
+    }
+
+    var errorEmail string
+    var errorLink string
+
+    if len(errors) > 0 {
+      errorsMap := errors[0].(map[string][]string)
+      for k, v := range errorsMap {
+
+        if k == "email" && len(v) > 0 {
+          errorEmail = strings.Join(v, ", ")
+        }
+        if k == "link" && len(v) > 0 {
+          errorLink = strings.Join(v, ", ")
+        }
+
+      }
+    }
+
+    showLoginLink(env, c, http.StatusOK, gin.H{
+      csrf.TemplateTag: csrf.TemplateField(c.Request),
+      "challenge": loginRequest.Challenge,
+      "email": email,
+      "usernameLogin": env.LoginPolicy.Username,
+      "remember": env.LoginPolicy.Remember && loginRequest.Skip == false,
+      "sent": len(sent) > 0,
+      "ttl": env.LoginPolicy.LinkTTL / 60,
+      "errorEmail": errorEmail,
+      "errorLink": errorLink,
+      "loginLinkUrl": env.Endpoints.Idpui.LoginLink.RequestURI(),
+      "loginUrl": env.Endpoints.Idpui.Login.RequestURI() + "?" + url.Values{ LOGIN_CHALLENGE_KEY:{loginRequest.Challenge} }.Encode(),
+    })
+  }
+  return gin.HandlerFunc(fn)
+}
+
+// SubmitLoginLink has the idp mail a link to the human. The page tells the same whether or not a link was sent, not telling who has an account.
+func SubmitLoginLink(env *app.Environment) gin.HandlerFunc {
+  fn := func(c *gin.Context) {
+
+    log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+    log = log.WithFields(logrus.Fields{
+      "func": "SubmitLoginLink",
+    })
+
+    if env.LoginPolicy.Link == false {
+      c.AbortWithStatus(http.StatusNotFound)
+      return
+    }
+
+    var form loginLinkForm
+    err := c.Bind(&form)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusBadRequest)
+      return
+    }
+
+    session := sessions.DefaultMany(c, env.Constants.SessionStoreKey)
+
+    if strings.TrimSpace(form.Email) == "" {
+      redirectToLoginLinkWithError(env, c, session, form.Challenge, "email", "Required")
+      return
+    }
+
+    loginRequest, err := env.HydraApi.ReadLoginRequest(form.Challenge)
+    if err != nil {
+      log.WithFields(logrus.Fields{ "challenge":form.Challenge }).Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    if loginRequest == nil {
+      log.WithFields(logrus.Fields{ "challenge":form.Challenge }).Debug("Login request not found")
+      c.AbortWithStatus(http.StatusNotFound)
+      return
+    }
+
+    err = sendLoginLink(env, c, session, loginRequest, form.Email)
+    if err != nil {
+      log.WithFields(logrus.Fields{ "challenge":form.Challenge }).Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    // Remembered until the link is opened
+    if env.LoginPolicy.Remember && len(form.Remember) > 0 {
+      session.Set(LOGIN_REMEMBER_KEY, form.Challenge)
+    } else {
+      session.Delete(LOGIN_REMEMBER_KEY)
+    }
+    session.AddFlash(form.Email, LOGIN_LINK_SENT)
+    err = session.Save()
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    redirectTo := loginLinkUrl(env, form.Challenge)
+    log.WithFields(logrus.Fields{"redirect_to": redirectTo}).Debug("Redirecting")
+    c.Redirect(http.StatusFound, redirectTo)
+    c.Abort()
+  }
+  return gin.HandlerFunc(fn)
+}
+
+// ShowLoginLinkOpen verifies the link and continues the login it was sent for.
+func ShowLoginLinkOpen(env *app.Environment) gin.HandlerFunc {
+  fn := func(c *gin.Context) {
+
+    log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+    log = log.WithFields(logrus.Fields{
+      "func": "ShowLoginLinkOpen",
+    })
+
+    emailChallenge := c.Query(EMAIL_CHALLENGE_KEY)
+    code := c.Query(LOGIN_LINK_CODE_KEY)
+    if emailChallenge == "" || code == "" {
+      log.Debug("Missing " + EMAIL_CHALLENGE_KEY + " or " + LOGIN_LINK_CODE_KEY)
+      c.AbortWithStatus(http.StatusBadRequest)
+      return
+    }
+    log = log.WithFields(logrus.Fields{ EMAIL_CHALLENGE_KEY:emailChallenge })
+
+    session := sessions.DefaultMany(c, env.Constants.SessionStoreKey)
+
+    linked, _ := session.Get(LOGIN_LINK_CHALLENGE_KEY).(string)
+    loginChallenge, _ := session.Get(LOGIN_LINK_LOGIN_KEY).(string)
+
+    // A link mailed to someone else, used already, or opened on another device
+    if linked == "" || linked != emailChallenge || loginChallenge == "" {
+      log.Debug("Sign-in link not requested by this browser")
+      showLoginLink(env, c, http.StatusForbidden, gin.H{
+        "errorLink": "Open the link in the browser you asked for it in, each link can only be used once",
+      })
+      return
+    }
+
+    session.Delete(LOGIN_LINK_CHALLENGE_KEY)
+    session.Delete(LOGIN_LINK_LOGIN_KEY)
+    err := session.Save()
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    idpClient := app.IdpClientUsingClientCredentials(env, c)
+
+    status, responses, err := env.IdpApi.VerifyChallenges(idpClient, env.Endpoints.Idp.ChallengesVerify.String(), []idp.UpdateChallengesVerifyRequest{ {
+      OtpChallenge: emailChallenge,
+      Code: code,
+    } })
+    if err != nil {
+      log.Debug(err.Error()) // Security Warning: Do not log the code is like logging a password!
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    var verification idp.UpdateChallengesVerifyResponse
+    if status == http.StatusOK && responses != nil {
+      status, _ = bulky.Unmarshal(0, responses, &verification)
+    }
+    if status != http.StatusOK || verification.Verified == false {
+      redirectToLoginLinkWithError(env, c, session, loginChallenge, "link", "The link has expired, ask for a new one")
+      return
+    }
+
+    // Tells the login the email challenge is a sign-in link, not email confirmation after the password
+    session.Set(LOGIN_LINK_OPENED_KEY, emailChallenge)
+    err = session.Save()
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    redirectTo := env.Endpoints.Idpui.Login.RequestURI() + "?" + url.Values{ LOGIN_CHALLENGE_KEY:{loginChallenge}, EMAIL_CHALLENGE_KEY:{emailChallenge} }.Encode()
+    log.WithFields(logrus.Fields{"redirect_to": redirectTo}).Debug("Sign-in link verified, redirecting")
+    c.Redirect(http.StatusFound, redirectTo)
+    c.Abort()
+  }
+  return gin.HandlerFunc(fn)
+}
+
+// sendLoginLink has the idp mail a link to the human of the identifier. Nothing is sent to humans that cannot log in with it: those not allowed to log in, those requiring a second factor the link would skip, or not the human Hydra already has signed in.
+func sendLoginLink(env *app.Environment, c *gin.Context, session sessions.Session, loginRequest *app.HydraLoginRequest, identifier string) error {
+  idpClient := app.IdpClientUsingClientCredentials(env, c)
+
+  human, err := app.ReadHumanByIdentifier(env, idpClient, identifier)
+  if err != nil || human == nil {
+    return err
+  }
+
+  if human.AllowLogin == false || human.TotpRequired || (loginRequest.Skip && human.Id != loginRequest.Subject) {
+    return nil
+  }
+
+  openUrl, err := app.AbsoluteUrl(env.Endpoints.Idpui.LoginLinkOpen)
+  if err != nil {
+    return err
+  }
+
+  secret := make([]byte, 32)
+  _, err = rand.Read(secret)
+  if err != nil {
+    return err
+  }
+
+  status, responses, err := env.IdpApi.CreateChallenges(idpClient, env.Endpoints.Idp.ChallengesCollection.String(), []idp.CreateChallengesRequest{ {
+    ConfirmationType: int(idp.ConfirmIdentityControlOfEmail),
+    Subject: human.Id,
+    Audience: "idp",
+    TTL: env.LoginPolicy.LinkTTL,
+    RedirectTo: openUrl,
+    CodeType: int64(idp.OTP),
+    Code: base64.RawURLEncoding.EncodeToString(secret),
+    Email: human.Email,
+  } })
+  if err != nil {
+    return err
+  }
+  if status != http.StatusOK || responses == nil {
+    return fmt.Errorf("CreateChallenges failed with status %d", status)
+  }
+
+  var challenge idp.CreateChallengesResponse
+  status, _ = bulky.Unmarshal(0, responses, &challenge)
+  if status != http.StatusOK {
+    return fmt.Errorf("CreateChallenges failed with status %d", status)
+  }
+
+  session.Set(LOGIN_LINK_CHALLENGE_KEY, challenge.OtpChallenge)
+  session.Set(LOGIN_LINK_LOGIN_KEY, loginRequest.Challenge)
+  return nil
+}
+
+func showLoginLink(env *app.Environment, c *gin.Context, status int, data gin.H) {
+  data["title"] = "Email Me a Link"
+  data["links"] = []map[string]string{
+    {"href": "/public/css/credentials.css"},
+  }
+  data["provider"] = config.GetString("provider.name")
+  data["provideraction"] = "Log in with a link sent to your email"
+  c.HTML(status, "loginlink.html", data)
+}
+
+func loginLinkUrl(env *app.Environment, loginChallenge string) string {
+  return env.Endpoints.Idpui.LoginLink.RequestURI() + "?" + url.Values{ LOGIN_CHALLENGE_KEY:{loginChallenge} }.Encode()
+}
+
+func redirectToLoginLinkWithError(env *app.Environment, c *gin.Context, session sessions.Session, loginChallenge string, field string, message string) {
+  log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+
+  errors := map[string][]string{ field:{message} }
+  session.AddFlash(errors, LOGIN_LINK_ERRORS)
+  err := session.Save()
+  if err != nil {
+    log.Debug(err.Error())
+  }
+
+  redirectTo := loginLinkUrl(env, loginChallenge)
+  log.WithFields(logrus.Fields{"redirect_to": redirectTo}).Debug("Redirecting")
+  c.Redirect(http.StatusFound, redirectTo)
+  c.Abort()
+}
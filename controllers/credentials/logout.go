@@ -36,7 +36,7 @@ func ShowLogout(env *app.Environment) gin.HandlerFunc {
 
       log = log.WithFields(logrus.Fields{ LOGOUT_CHALLENGE_KEY:logoutChallenge })
 
-      challenge, err := readLogoutChallenge(idpClient, logoutChallenge)
+      challenge, err := readLogoutChallenge(env, idpClient, logoutChallenge)
       if err != nil {
         log.Debug(err.Error())
         c.AbortWithStatus(http.StatusInternalServerError)
@@ -59,7 +59,7 @@ func ShowLogout(env *app.Environment) gin.HandlerFunc {
         "provider": config.GetString("provider.name"),
         "provideraction": "Logout of the system",
         "challenge": logoutChallenge,
-        "logoutUrl": config.GetString("idpui.public.endpoints.logout"),
+        "logoutUrl": env.Endpoints.Idpui.Logout.RequestURI(),
       })
       return
     }
@@ -80,7 +80,7 @@ func ShowLogout(env *app.Environment) gin.HandlerFunc {
     }
 
     var postLogoutRedirectUrl *url.URL
-    onLogoutRedirectTo := config.GetString("idpui.public.url") + config.GetString("idpui.public.endpoints.seeyoulater")
+    onLogoutRedirectTo := env.Endpoints.Idpui.SeeYouLater.String()
     if onLogoutRedirectTo != "" {
 
       postLogoutRedirectUrl, err = url.Parse(onLogoutRedirectTo)
@@ -93,7 +93,7 @@ func ShowLogout(env *app.Environment) gin.HandlerFunc {
     }
 
     logoutRequest := []idp.CreateHumansLogoutRequest{ { IdToken:idTokenHint, RedirectTo:postLogoutRedirectUrl.String(), State:state } }
-    status, responses, err := idp.CreateHumansLogout(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.humans.logout"), logoutRequest)
+    status, responses, err := env.IdpApi.CreateHumansLogout(idpClient, env.Endpoints.Idp.HumansLogout.String(), logoutRequest)
     if err != nil {
       log.Debug(err.Error())
       c.AbortWithStatus(http.StatusInternalServerError)
@@ -168,7 +168,7 @@ func SubmitLogout(env *app.Environment) gin.HandlerFunc {
 
     idpClient := app.IdpClientUsingClientCredentials(env, c)
 
-    challenge, err := readLogoutChallenge(idpClient, form.Challenge)
+    challenge, err := readLogoutChallenge(env, idpClient, form.Challenge)
     if err != nil {
       log.Debug(err.Error())
       c.AbortWithStatus(http.StatusInternalServerError)
@@ -179,7 +179,7 @@ func SubmitLogout(env *app.Environment) gin.HandlerFunc {
 
       // Accept the logout
       logoutRequest := []idp.UpdateHumansLogoutAcceptRequest{ { Challenge:form.Challenge } }
-      status, responses, err := idp.UpdateHumansLogoutAccept(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.humans.logout"), logoutRequest)
+      status, responses, err := env.IdpApi.UpdateHumansLogoutAccept(idpClient, env.Endpoints.Idp.HumansLogout.String(), logoutRequest)
       if err != nil {
         log.Debug(err.Error())
         c.AbortWithStatus(http.StatusInternalServerError)
@@ -201,6 +201,12 @@ func SubmitLogout(env *app.Environment) gin.HandlerFunc {
             return
           }
 
+          // The ui keeps no tokens between requests, so revoke every token it was issued for the human, ex. those left in forms.
+          err = env.HydraApi.RevokeConsentSessions(challenge.Subject, env.ClientId)
+          if err != nil {
+            log.Debug(err.Error())
+          }
+
           log.WithFields(logrus.Fields{ "redirect_to":acceptResponse.RedirectTo }).Debug("Redirecting")
           c.Redirect(http.StatusFound, acceptResponse.RedirectTo)
           c.Abort()
@@ -222,11 +228,12 @@ type LogoutChallenge struct {
   Challenge string
   State string
   RedirectTo string
+  Subject string
 }
 
-func readLogoutChallenge(idpClient *idp.IdpClient, challenge string) (lc *LogoutChallenge, err error) {
+func readLogoutChallenge(env *app.Environment, idpClient *idp.IdpClient, challenge string) (lc *LogoutChallenge, err error) {
   logoutRequest := []idp.ReadHumansLogoutRequest{ { Challenge:challenge } }
-  status, responses, err := idp.ReadHumansLogout(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.humans.logout"), logoutRequest)
+  status, responses, err := env.IdpApi.ReadHumansLogout(idpClient, env.Endpoints.Idp.HumansLogout.String(), logoutRequest)
   if err != nil {
     return nil, err
   }
@@ -250,6 +257,7 @@ func readLogoutChallenge(idpClient *idp.IdpClient, challenge string) (lc *Logout
         Challenge: challenge,
         State: state,
         RedirectTo: logoutResponse.RequestUrl,
+        Subject: logoutResponse.Id,
       }
       return lc, nil
     }
@@ -257,4 +265,4 @@ func readLogoutChallenge(idpClient *idp.IdpClient, challenge string) (lc *Logout
   }
 
   return nil, nil
-}
\ No newline at end of file
+}
@@ -28,6 +28,7 @@ type passwordForm struct {
   //RedirectTo string `form:"redirect_to" binding:"required" validate:"required,uri"`
   Password string `form:"password" binding:"required" validate:"required,notblank"`
   PasswordRetyped string `form:"password_retyped" binding:"required" validate:"required,notblank"`
+  RiskAccepted string `form:"risk_accepted"`
 }
 
 func ShowPassword(env *app.Environment) gin.HandlerFunc {
@@ -55,6 +56,7 @@ func ShowPassword(env *app.Environment) gin.HandlerFunc {
 
     var errorPassword string
     var errorPasswordRetyped string
+    var errorRiskAccepted string
 
     if len(errors) > 0 {
       errorsMap := errors[0].(map[string][]string)
@@ -68,6 +70,10 @@ func ShowPassword(env *app.Environment) gin.HandlerFunc {
           errorPasswordRetyped = strings.Join(v, ", ")
         }
 
+        if k == "risk_accepted" && len(v) > 0 {
+          errorRiskAccepted = strings.Join(v, ", ")
+        }
+
       }
     }
 
@@ -79,6 +85,7 @@ func ShowPassword(env *app.Environment) gin.HandlerFunc {
       "links": []map[string]string{
         {"href": "/public/css/credentials.css"},
       },
+      "scripts": passwordMeterScripts(env),
       csrf.TemplateTag: csrf.TemplateField(c.Request),
       "provider": config.GetString("provider.name"),
       "provideraction": "Change your password",
@@ -86,9 +93,12 @@ func ShowPassword(env *app.Environment) gin.HandlerFunc {
       "id": identity.Id,
       "name": identity.Name,
       "email": identity.Email,
-      "passwordUrl": config.GetString("idpui.public.url") + config.GetString("idpui.public.endpoints.password"),
+      "passwordUrl": env.Endpoints.Idpui.Password.String(),
+      "passwordMeter": env.PasswordMeter,
+      "passwordStrengthUrl": env.Endpoints.Idpui.PasswordStrength.RequestURI(),
       "errorPassword": errorPassword,
       "errorPasswordRetyped": errorPasswordRetyped,
+      "errorRiskAccepted": errorRiskAccepted,
     })
   }
   return gin.HandlerFunc(fn)
@@ -118,6 +128,21 @@ func SubmitPassword(env *app.Environment) gin.HandlerFunc {
       return
     }
 
+    // Changing the password requires a recent login, log in again when the page was open too long.
+    recent, err := app.VerifyRecentAuthentication(env, c, form.Id, env.StepUp.Password)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusForbidden)
+      return
+    }
+
+    if recent == false {
+      log.WithFields(logrus.Fields{"redirect_to": submitUrl}).Debug("Login too old, redirecting")
+      c.Redirect(http.StatusFound, submitUrl)
+      c.Abort()
+      return
+    }
+
     session := sessions.DefaultMany(c, env.Constants.SessionStoreKey)
 
     errors := make(map[string][]string)
@@ -167,6 +192,42 @@ func SubmitPassword(env *app.Environment) gin.HandlerFunc {
       errors["password_retyped"] = append(errors["password_retyped"], "No Match")
     }
 
+    oauth2Config := app.FetchOAuth2Config(env, c)
+    if oauth2Config == nil {
+      log.Debug("Context missing oauth2 config")
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+    idpClient := idp.NewIdpClientWithUserAccessToken(oauth2Config, &oauth2.Token{
+      AccessToken: form.AccessToken,
+    })
+
+    if form.Password != "" {
+      human, err := fetchHuman(env, idpClient, form.Id)
+      if err != nil {
+        log.Debug(err.Error())
+        c.AbortWithStatus(http.StatusInternalServerError)
+        return
+      }
+
+      if human == nil {
+        log.WithFields(logrus.Fields{ "id":form.Id }).Debug("Human not found")
+        c.AbortWithStatus(http.StatusNotFound)
+        return
+      }
+
+      for _, violation := range env.PasswordPolicy.Check(form.Password, human.Email, human.Name, human.Username) {
+        errors["password"] = append(errors["password"], violation)
+      }
+
+      err = checkBreachedPassword(env, c, form.Password, len(form.RiskAccepted) > 0, errors)
+      if err != nil {
+        log.Debug(err.Error())
+        c.AbortWithStatus(http.StatusInternalServerError)
+        return
+      }
+    }
+
     if len(errors) > 0 {
       session.AddFlash(errors, PASSWORD_ERRORS)
       err = session.Save()
@@ -191,17 +252,8 @@ func SubmitPassword(env *app.Environment) gin.HandlerFunc {
         return
       }
 
-      oauth2Config := app.FetchOAuth2Config(env, c)
-      if oauth2Config == nil {
-        log.Debug("Context missing oauth2 config")
-        c.AbortWithStatus(http.StatusInternalServerError)
-        return
-      }
-      idpClient := idp.NewIdpClientWithUserAccessToken(oauth2Config, &oauth2.Token{
-        AccessToken: form.AccessToken,
-      })
       passwordRequest := []idp.UpdateHumansPasswordRequest{ {Id: form.Id, Password: form.Password} }
-      status, responses, err := idp.UpdateHumansPassword(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.humans.password"), passwordRequest)
+      status, responses, err := env.IdpApi.UpdateHumansPassword(idpClient, env.Endpoints.Idp.HumansPassword.String(), passwordRequest)
       if err != nil {
         log.Debug(err.Error())
         c.AbortWithStatus(http.StatusInternalServerError)
@@ -241,8 +293,15 @@ func SubmitPassword(env *app.Environment) gin.HandlerFunc {
         return
       }
 
+      err = endSessionsOfPassword(env, form.Id)
+      if err != nil {
+        log.WithFields(logrus.Fields{ "id":form.Id }).Debug(err.Error())
+        c.AbortWithStatus(http.StatusInternalServerError)
+        return
+      }
+
       // Success
-      redirectTo := config.GetString("meui.public.url") + config.GetString("meui.public.endpoints.profile")
+      redirectTo := env.Endpoints.Meui.Profile.String()
       log.WithFields(logrus.Fields{"redirect_to": redirectTo}).Debug("Redirecting")
       c.Redirect(http.StatusFound, redirectTo)
       c.Abort()
@@ -256,3 +315,19 @@ func SubmitPassword(env *app.Environment) gin.HandlerFunc {
   }
   return gin.HandlerFunc(fn)
 }
+
+// endSessionsOfPassword signs out whoever knew the old password. The login sessions with Hydra end, the ui loses its tokens on every device, and the devices trusted to skip the second factor are revoked. The idp keeps no sessions of its own.
+// Apps keep the access the human gave them, Hydra only revokes the tokens of an app with its consent. The human revokes that on the sessions page.
+func endSessionsOfPassword(env *app.Environment, humanId string) error {
+  err := env.HydraApi.RevokeLoginSessions(humanId)
+  if err != nil {
+    return err
+  }
+
+  err = env.HydraApi.RevokeConsentSessions(humanId, env.ClientId)
+  if err != nil {
+    return err
+  }
+
+  return env.TrustedDevices.DeleteDevices(humanId)
+}
@@ -0,0 +1,40 @@
+package credentials
+
+import (
+  "github.com/sirupsen/logrus"
+  "github.com/gin-gonic/gin"
+
+  "github.com/opensentry/idpui/app"
+)
+
+// checkBreachedPassword applies password.breached.policy to a new password that passed the policy. A breached password is refused when the policy is block, and with warn it is accepted only once the human accepts the risk. When the sources cannot be checked, ex. the api is down, the password is refused with an error unless password.breached.failOpen accepts it unchecked.
+func checkBreachedPassword(env *app.Environment, c *gin.Context, password string, riskAccepted bool, errors map[string][]string) error {
+  if env.PasswordBreaches == nil || len(errors) > 0 {
+    return nil
+  }
+
+  breached, err := env.PasswordBreaches.Breached(password)
+  if err != nil {
+    if env.PasswordBreachFailOpen == false {
+      return err
+    }
+
+    log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+    log.WithFields(logrus.Fields{ "password.breached.failOpen":true }).Warn("Breached password check failed, accepting the password unchecked: " + err.Error())
+    return nil
+  }
+
+  if breached == false {
+    return nil
+  }
+
+  if env.PasswordBreachPolicy == "block" {
+    errors["password"] = append(errors["password"], "Found in a data breach, choose another")
+    return nil
+  }
+
+  if riskAccepted == false {
+    errors["risk_accepted"] = append(errors["risk_accepted"], "This password was found in a data breach. Choose another or accept the risk")
+  }
+  return nil
+}
@@ -0,0 +1,64 @@
+package credentials
+
+import (
+  "net/http"
+  "github.com/sirupsen/logrus"
+  "github.com/gin-gonic/gin"
+
+  "github.com/opensentry/idpui/app"
+  "github.com/opensentry/idpui/validators"
+)
+
+type passwordStrengthForm struct {
+  Password string `form:"password"`
+  Name     string `form:"display-name"`
+  Username string `form:"username"`
+}
+
+// SubmitPasswordStrength scores the password for the live strength meter. Advisory only, the policy is enforced when the password is submitted.
+func SubmitPasswordStrength(env *app.Environment) gin.HandlerFunc {
+  fn := func(c *gin.Context) {
+
+    log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+    log = log.WithFields(logrus.Fields{
+      "func": "SubmitPasswordStrength",
+    })
+
+    if env.PasswordMeter == false {
+      c.AbortWithStatus(http.StatusNotFound)
+      return
+    }
+
+    var form passwordStrengthForm
+    err := c.Bind(&form)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusBadRequest)
+      return
+    }
+
+    score := env.PasswordPolicy.Score(form.Password, form.Name, form.Username)
+    violations := env.PasswordPolicy.Check(form.Password, form.Name, form.Username)
+    if violations == nil {
+      violations = []string{}
+    }
+
+    c.Header("Cache-Control", "no-store")
+    c.JSON(http.StatusOK, gin.H{
+      "score": score,
+      "label": validators.PasswordStrengthLabels[score],
+      "violations": violations,
+    })
+  }
+  return gin.HandlerFunc(fn)
+}
+
+// passwordMeterScripts loads the strength meter on pages with a new password, when password.meter is enabled.
+func passwordMeterScripts(env *app.Environment) []map[string]string {
+  if env.PasswordMeter == false {
+    return nil
+  }
+  return []map[string]string{
+    {"src": "/public/js/passwordmeter.js"},
+  }
+}
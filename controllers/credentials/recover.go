@@ -34,7 +34,7 @@ func ShowRecover(env *app.Environment) gin.HandlerFunc {
 
     redirectTo := c.Request.Referer() // FIXME: This does not work, when force to login the refrer will be login uri. This should be a param in the /recover?redirect_uri=... param and should be forced to only be allowed to be specified redirect uris for the client.
     if redirectTo == "" {
-      redirectTo = config.GetString("meui.public.url") + config.GetString("meui.public.endpoints.profile") // FIXME should be a config default.
+      redirectTo = env.Endpoints.Meui.Profile.String() // FIXME should be a config default.
     }
 
     session := sessions.DefaultMany(c, env.Constants.SessionStoreKey)
@@ -65,8 +65,8 @@ func ShowRecover(env *app.Environment) gin.HandlerFunc {
       "provider": config.GetString("provider.name"),
       "provideraction": "Recover an identity registered in the system",
       "redirect_to": redirectTo,
-      "recoverUrl": config.GetString("idpui.public.endpoints.recover"),
-      "loginUrl": config.GetString("idpui.public.endpoints.login"),
+      "recoverUrl": env.Endpoints.Idpui.Recover.RequestURI(),
+      "loginUrl": env.Endpoints.Idpui.Login.RequestURI(),
       "errorEmail": errorEmail,
     })
   }
@@ -151,7 +151,7 @@ func SubmitRecover(env *app.Environment) gin.HandlerFunc {
     idpClient := app.IdpClientUsingClientCredentials(env, c)
 
     identityRequests := []idp.ReadHumansRequest{ {Email: form.Email} }
-    status, responses, err := idp.ReadHumans(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.humans.collection"), identityRequests)
+    status, responses, err := env.IdpApi.ReadHumans(idpClient, env.Endpoints.Idp.HumansCollection.String(), identityRequests)
     if err != nil {
       log.Debug(err.Error())
       c.AbortWithStatus(http.StatusInternalServerError)
@@ -199,7 +199,7 @@ func SubmitRecover(env *app.Environment) gin.HandlerFunc {
 
     human := humans[0]
     recoverRequests := []idp.CreateHumansRecoverRequest{ {Id: human.Id, RedirectTo: form.RedirectTo} }
-    status, responses, err = idp.RecoverHumans(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.humans.recover"), recoverRequests)
+    status, responses, err = env.IdpApi.RecoverHumans(idpClient, env.Endpoints.Idp.HumansRecover.String(), recoverRequests)
     if err != nil {
       log.Debug(err.Error())
       c.AbortWithStatus(http.StatusInternalServerError)
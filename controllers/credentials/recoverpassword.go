@@ -0,0 +1,422 @@
+package credentials
+
+import (
+  "time"
+  "net/url"
+  "net/http"
+  "strings"
+  "reflect"
+  "gopkg.in/go-playground/validator.v9"
+  "github.com/sirupsen/logrus"
+  "github.com/gin-gonic/gin"
+  "github.com/gorilla/csrf"
+  "github.com/gin-contrib/sessions"
+  "github.com/pquerna/otp/totp"
+
+  idp "github.com/opensentry/idp/client"
+
+  "github.com/opensentry/idpui/app"
+  "github.com/opensentry/idpui/config"
+  "github.com/opensentry/idpui/utils"
+  "github.com/opensentry/idpui/validators"
+
+  bulky "github.com/charmixer/bulky/client"
+)
+
+type recoverPasswordForm struct {
+  Challenge       string `form:"challenge"        binding:"required" validate:"required,notblank"`
+  Password        string `form:"password"         binding:"required" validate:"required,notblank"`
+  PasswordRetyped string `form:"password_retyped" binding:"required" validate:"required,notblank"`
+  ResetTotp       string `form:"reset_totp"`
+  RiskAccepted    string `form:"risk_accepted"`
+}
+
+func ShowRecoverPassword(env *app.Environment) gin.HandlerFunc {
+  fn := func(c *gin.Context) {
+
+    log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+    log = log.WithFields(logrus.Fields{
+      "func": "ShowRecoverPassword",
+    })
+
+    recoverChallenge := c.Query(RECOVER_CHALLENGE_KEY)
+    if recoverChallenge == "" {
+      log.Debug("Missing " + RECOVER_CHALLENGE_KEY)
+      c.AbortWithStatus(http.StatusNotFound)
+      return
+    }
+
+    q := url.Values{}
+    q.Add(RECOVER_CHALLENGE_KEY, recoverChallenge)
+
+    submitUrl, err := utils.FetchSubmitUrlFromRequest(c.Request, &q)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    session := sessions.DefaultMany(c, env.Constants.SessionStoreKey)
+
+    idpClient := app.IdpClientUsingClientCredentials(env, c)
+
+    challenge, err := fetchVerifiedRecoverChallenge(env, idpClient, session, recoverChallenge)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    if challenge == nil {
+      // Start over, the code must be confirmed again.
+      redirectTo := env.Endpoints.Idpui.Recover.String()
+      log.WithFields(logrus.Fields{ RECOVER_CHALLENGE_KEY:recoverChallenge, "redirect_to":redirectTo }).Debug("Recover challenge not verified by this browser or too old")
+      c.Redirect(http.StatusFound, redirectTo)
+      c.Abort()
+      return
+    }
+
+    human, err := fetchHuman(env, idpClient, challenge.Subject)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    if human == nil {
+      log.WithFields(logrus.Fields{ "id":challenge.Subject }).Debug("Human not found")
+      c.AbortWithStatus(http.StatusNotFound)
+      return
+    }
+
+    errors := session.Flashes(RECOVERPASSWORD_ERRORS)
+    err = session.Save() // Remove flashes read
+    if err != nil {
+      log.Debug(err.Error())
+    }
+
+    var errorPassword string
+    var errorPasswordRetyped string
+    var errorRiskAccepted string
+
+    if len(errors) > 0 {
+      errorsMap := errors[0].(map[string][]string)
+      for k, v := range errorsMap {
+
+        if k == "password" && len(v) > 0 {
+          errorPassword = strings.Join(v, ", ")
+        }
+
+        if k == "password_retyped" && len(v) > 0 {
+          errorPasswordRetyped = strings.Join(v, ", ")
+        }
+
+        if k == "risk_accepted" && len(v) > 0 {
+          errorRiskAccepted = strings.Join(v, ", ")
+        }
+
+      }
+    }
+
+    c.HTML(http.StatusOK, "recoverpassword.html", gin.H{
+      "title": "Recover Password",
+      "links": []map[string]string{
+        {"href": "/public/css/credentials.css"},
+      },
+      "scripts": passwordMeterScripts(env),
+      csrf.TemplateTag: csrf.TemplateField(c.Request),
+      "provider": config.GetString("provider.name"),
+      "provideraction": "Choose a new password",
+      "challenge": recoverChallenge,
+      "name": human.Name,
+      "email": human.Email,
+      "resetTotp": env.RecoverResetTotp && human.TotpRequired,
+      "submitUrl": submitUrl,
+      "passwordMeter": env.PasswordMeter,
+      "passwordStrengthUrl": env.Endpoints.Idpui.PasswordStrength.RequestURI(),
+      "errorPassword": errorPassword,
+      "errorPasswordRetyped": errorPasswordRetyped,
+      "errorRiskAccepted": errorRiskAccepted,
+    })
+  }
+  return gin.HandlerFunc(fn)
+}
+
+func SubmitRecoverPassword(env *app.Environment) gin.HandlerFunc {
+  fn := func(c *gin.Context) {
+
+    log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+    log = log.WithFields(logrus.Fields{
+      "func": "SubmitRecoverPassword",
+    })
+
+    var form recoverPasswordForm
+    err := c.Bind(&form)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+      return
+    }
+
+    q := url.Values{}
+    q.Add(RECOVER_CHALLENGE_KEY, form.Challenge)
+
+    submitUrl, err := utils.FetchSubmitUrlFromRequest(c.Request, &q)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    session := sessions.DefaultMany(c, env.Constants.SessionStoreKey)
+
+    errors := make(map[string][]string)
+    validate := validator.New()
+    validate.RegisterValidation("notblank", validators.NotBlank)
+    err = validate.Struct(form)
+    if err != nil {
+
+      // Validation syntax is invalid
+      if err,ok := err.(*validator.InvalidValidationError); ok{
+        log.Debug(err.Error())
+        c.AbortWithStatus(http.StatusInternalServerError)
+        return
+      }
+
+      reflected := reflect.ValueOf(form) // Use reflector to reverse engineer struct
+      for _, err := range err.(validator.ValidationErrors){
+
+        // Attempt to find field by name and get json tag name
+        field,_ := reflected.Type().FieldByName(err.StructField())
+        var name string
+
+        // If form tag doesn't exist, use lower case of name
+        if name = field.Tag.Get("form"); name == ""{
+          name = strings.ToLower(err.StructField())
+        }
+
+        switch err.Tag() {
+        case "required":
+            errors[name] = append(errors[name], "Required")
+            break
+        case "notblank":
+          errors[name] = append(errors[name], "Not Blank")
+          break
+        default:
+            errors[name] = append(errors[name], "Invalid")
+            break
+        }
+      }
+
+    }
+
+    if form.Password != form.PasswordRetyped {
+      errors["password_retyped"] = append(errors["password_retyped"], "No Match")
+    }
+
+    if len(errors) > 0 {
+      session.AddFlash(errors, RECOVERPASSWORD_ERRORS)
+      err = session.Save()
+      if err != nil {
+        log.Debug(err.Error())
+      }
+
+      log.WithFields(logrus.Fields{"errors":len(errors), "redirect_to": submitUrl}).Debug("Redirecting")
+      c.Redirect(http.StatusFound, submitUrl)
+      c.Abort()
+      return
+    }
+
+    idpClient := app.IdpClientUsingClientCredentials(env, c)
+
+    challenge, err := fetchVerifiedRecoverChallenge(env, idpClient, session, form.Challenge)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    if challenge == nil {
+      log.WithFields(logrus.Fields{ RECOVER_CHALLENGE_KEY:form.Challenge }).Debug("Recover challenge not verified by this browser or too old")
+      c.AbortWithStatus(http.StatusForbidden)
+      return
+    }
+
+    human, err := fetchHuman(env, idpClient, challenge.Subject)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    if human == nil {
+      log.WithFields(logrus.Fields{ "id":challenge.Subject }).Debug("Human not found")
+      c.AbortWithStatus(http.StatusNotFound)
+      return
+    }
+
+    violations := env.PasswordPolicy.Check(form.Password, human.Email, human.Name, human.Username)
+    if len(violations) > 0 {
+      errors["password"] = violations
+    }
+
+    err = checkBreachedPassword(env, c, form.Password, len(form.RiskAccepted) > 0, errors)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    if len(errors) > 0 {
+      session.AddFlash(errors, RECOVERPASSWORD_ERRORS)
+      err = session.Save()
+      if err != nil {
+        log.Debug(err.Error())
+      }
+
+      log.WithFields(logrus.Fields{"errors":len(errors), "redirect_to": submitUrl}).Debug("Redirecting")
+      c.Redirect(http.StatusFound, submitUrl)
+      c.Abort()
+      return
+    }
+
+    // The authenticator may be what was lost. Replace the secret, so the old authenticator is useless, and let the human set up TOTP again.
+    // Recovering only proves control of the email, so this is off unless password.recover.resetTotp allows it.
+    // Reset before the password is changed, so a failure leaves the human with the old password and authenticator instead of only half recovered.
+    if env.RecoverResetTotp && form.ResetTotp != "" && human.TotpRequired {
+      key, err := totp.Generate(totp.GenerateOpts{
+        Issuer: totpIssuer(env),
+        AccountName: human.Id,
+      })
+      if err != nil {
+        log.Debug(err.Error())
+        c.AbortWithStatus(http.StatusInternalServerError)
+        return
+      }
+
+      totpRequests := []idp.UpdateHumansTotpRequest{ {Id:human.Id, TotpRequired:false, TotpSecret:key.Secret()} }
+      status, _, err := env.IdpApi.UpdateHumansTotp(idpClient, env.Endpoints.Idp.HumansTotp.String(), totpRequests)
+      if err != nil {
+        log.Debug(err.Error())
+        c.AbortWithStatus(http.StatusInternalServerError)
+        return
+      }
+
+      if status != http.StatusOK {
+        log.WithFields(logrus.Fields{ "status":status }).Debug("Reset totp failed")
+        c.AbortWithStatus(http.StatusInternalServerError)
+        return
+      }
+    }
+
+    recoverRequests := []idp.UpdateHumansRecoverVerifyRequest{ {RecoverChallenge: challenge.OtpChallenge, NewPassword: form.Password} }
+    status, responses, err := env.IdpApi.RecoverHumansVerify(idpClient, env.Endpoints.Idp.HumansRecoverVerification.String(), recoverRequests)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    if status == http.StatusForbidden {
+      c.AbortWithStatus(http.StatusForbidden)
+      return
+    }
+
+    if status != http.StatusOK {
+      log.WithFields(logrus.Fields{ "status":status }).Debug("Recover human verify failed")
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    var verification idp.UpdateHumansRecoverVerifyResponse
+    reqStatus, reqErrors := bulky.Unmarshal(0, responses, &verification)
+
+    if reqStatus == http.StatusForbidden {
+      c.AbortWithStatus(http.StatusForbidden)
+      return
+    }
+
+    if reqStatus != http.StatusOK {
+
+      errors := []string{}
+      if len(reqErrors) > 0 {
+        for _,e := range reqErrors {
+          errors = append(errors, e.Error)
+        }
+      }
+
+      log.WithFields(logrus.Fields{ "status":reqStatus, "errors":strings.Join(errors, ", ") }).Debug("Unmarshal UpdateHumansRecoverVerifyResponse failed")
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    if verification.Verified == false || verification.RedirectTo == "" {
+      log.WithFields(logrus.Fields{ RECOVER_CHALLENGE_KEY:form.Challenge }).Debug("Recover not verified by idp")
+      c.AbortWithStatus(http.StatusForbidden)
+      return
+    }
+
+    err = endSessionsOfPassword(env, human.Id)
+    if err != nil {
+      log.WithFields(logrus.Fields{ "id":human.Id }).Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    // Destroy user session
+    session.Clear()
+    err = session.Save()
+    if err != nil {
+      log.Debug(err.Error())
+    }
+
+    // Success, call success url redirect_to
+    log.WithFields(logrus.Fields{ "redirect_to": verification.RedirectTo }).Debug("Redirecting");
+    c.Redirect(http.StatusFound, verification.RedirectTo)
+    c.Abort()
+  }
+  return gin.HandlerFunc(fn)
+}
+
+// fetchVerifiedRecoverChallenge returns the recover challenge if it was verified by this browser within RECOVER_CHALLENGE_MAX_AGE seconds, otherwise nil.
+func fetchVerifiedRecoverChallenge(env *app.Environment, idpClient *idp.IdpClient, session sessions.Session, recoverChallenge string) (*idp.Challenge, error) {
+  verifiedByBrowser := session.Get(env.Constants.SessionRecoverChallengeKey)
+  if verifiedByBrowser == nil || verifiedByBrowser.(string) != recoverChallenge {
+    return nil, nil
+  }
+
+  challenge, err := fetchChallenge(env, idpClient, recoverChallenge)
+  if err != nil {
+    return nil, err
+  }
+
+  if challenge == nil || challenge.ConfirmationType != int(idp.ConfirmIdentityRecovery) || challenge.VerifiedAt <= 0 {
+    return nil, nil
+  }
+
+  if time.Now().Unix() - challenge.VerifiedAt > RECOVER_CHALLENGE_MAX_AGE {
+    return nil, nil
+  }
+
+  return challenge, nil
+}
+
+func fetchHuman(env *app.Environment, idpClient *idp.IdpClient, id string) (*idp.Human, error) {
+
+  requests := []idp.ReadHumansRequest{ {Id: id} }
+  status, responses, err := env.IdpApi.ReadHumans(idpClient, env.Endpoints.Idp.HumansCollection.String(), requests)
+  if err != nil {
+    return nil, err
+  }
+
+  if status == http.StatusOK {
+    var resp idp.ReadHumansResponse
+    status, _ := bulky.Unmarshal(0, responses, &resp)
+    if status == http.StatusOK && len(resp) > 0 {
+      human := resp[0]
+      return &human, nil
+    }
+  }
+
+  return nil, nil
+}
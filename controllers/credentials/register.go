@@ -22,12 +22,13 @@ import (
 )
 
 type registrationForm struct {
-    Challenge       string `form:"challenge"          validate="required,uuid,notblank"`
-    State           string `form:"state"              validate="required,notblank"`
+    Challenge       string `form:"challenge"          validate:"required,uuid,notblank"`
+    State           string `form:"state"              validate:"required,notblank"`
     Name            string `form:"display-name"       validate:"required,notblank"`
     Username        string `form:"username,omitempty" validate:"omitempty,notblank"`
     Password        string `form:"password"           validate:"required,notblank"`
     PasswordRetyped string `form:"password_retyped"   validate:"required,notblank"`
+    RiskAccepted    string `form:"risk_accepted"`
 }
 
 func ShowRegistration(env *app.Environment) gin.HandlerFunc {
@@ -64,7 +65,7 @@ func ShowRegistration(env *app.Environment) gin.HandlerFunc {
 
       idpClient := app.IdpClientUsingClientCredentials(env, c)
 
-      challenge, err := fetchChallenge(idpClient, challengeId)
+      challenge, err := fetchChallenge(env, idpClient, challengeId)
       if err != nil {
         log.Debug(err.Error())
         c.AbortWithStatus(http.StatusInternalServerError)
@@ -72,7 +73,7 @@ func ShowRegistration(env *app.Environment) gin.HandlerFunc {
       }
 
       if challenge != nil {
-        invite, err := fetchInvites(idpClient, challenge.Subject)
+        invite, err := fetchInvites(env, idpClient, challenge.Subject)
         if err != nil {
           log.Debug(err.Error())
           c.AbortWithStatus(http.StatusInternalServerError)
@@ -120,6 +121,7 @@ func ShowRegistration(env *app.Environment) gin.HandlerFunc {
     var errorUsername string
     var errorPassword string
     var errorPasswordRetyped string
+    var errorRiskAccepted string
     var errorDisplayName string
 
     if len(errors) > 0 {
@@ -137,6 +139,10 @@ func ShowRegistration(env *app.Environment) gin.HandlerFunc {
           errorPasswordRetyped = strings.Join(v, ", ")
         }
 
+        if k == "risk_accepted" && len(v) > 0 {
+          errorRiskAccepted = strings.Join(v, ", ")
+        }
+
         if k == "display-name" && len(v) > 0 {
           errorDisplayName = strings.Join(v, ", ")
         }
@@ -148,18 +154,22 @@ func ShowRegistration(env *app.Environment) gin.HandlerFunc {
       "links": []map[string]string{
         {"href": "/public/css/credentials.css"},
       },
+      "scripts": passwordMeterScripts(env),
       csrf.TemplateTag: csrf.TemplateField(c.Request),
       "provider": config.GetString("provider.name"),
       "provideraction": "Register for an identity in the system",
-      "registerUrl": config.GetString("idpui.public.endpoints.register"),
-      "loginUrl": config.GetString("idpui.public.endpoints.login"),
+      "registerUrl": env.Endpoints.Idpui.Register.RequestURI(),
+      "loginUrl": env.Endpoints.Idpui.Login.RequestURI(),
       "challenge": challengeId,
       "state": state,
       "username": username,
       "displayName": displayName,
       "errorUsername": errorUsername,
+      "passwordMeter": env.PasswordMeter,
+      "passwordStrengthUrl": env.Endpoints.Idpui.PasswordStrength.RequestURI(),
       "errorPassword": errorPassword,
       "errorPasswordRetyped": errorPasswordRetyped,
+      "errorRiskAccepted": errorRiskAccepted,
       "errorDisplayName": errorDisplayName,
     })
   }
@@ -271,6 +281,32 @@ func SubmitRegistration(env *app.Environment) gin.HandlerFunc {
       errors["password_retyped"] = append(errors["password_retyped"], "No Match")
     }
 
+    idpClient := app.IdpClientUsingClientCredentials(env, c)
+
+    challenge, err := fetchChallenge(env, idpClient, form.Challenge)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    if form.Password != "" {
+      var email string
+      if challenge != nil {
+        email = challenge.Data // The email confirmed by the claim
+      }
+      for _, violation := range env.PasswordPolicy.Check(form.Password, email, form.Name, form.Username) {
+        errors["password"] = append(errors["password"], violation)
+      }
+
+      err = checkBreachedPassword(env, c, form.Password, len(form.RiskAccepted) > 0, errors)
+      if err != nil {
+        log.Debug(err.Error())
+        c.AbortWithStatus(http.StatusInternalServerError)
+        return
+      }
+    }
+
     if len(errors) > 0 {
       session.AddFlash(errors, REGISTER_ERRORS)
       err = session.Save()
@@ -286,21 +322,12 @@ func SubmitRegistration(env *app.Environment) gin.HandlerFunc {
 
     if form.Password == form.PasswordRetyped { // Just for safety is caught in the input error detection.
 
-      idpClient := app.IdpClientUsingClientCredentials(env, c)
-
-      challenge, err := fetchChallenge(idpClient, form.Challenge)
-      if err != nil {
-        log.Debug(err.Error())
-        c.AbortWithStatus(http.StatusInternalServerError)
-        return
-      }
-
-      if challenge.VerifiedAt > 0 { // FIXME: Challenge must be claim challenge or we should not accept it as a challenge to be used.
+      if challenge != nil && challenge.VerifiedAt > 0 { // FIXME: Challenge must be claim challenge or we should not accept it as a challenge to be used.
 
         var emailConfirmedAt int64 = challenge.VerifiedAt
 
         humanRequest := []idp.CreateHumansRequest{ {Id:challenge.Subject, Password:form.Password, Name:form.Name, Username:form.Username, EmailConfirmedAt:emailConfirmedAt} }
-        status, responses, err := idp.CreateHumans(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.humans.collection"), humanRequest)
+        status, responses, err := env.IdpApi.CreateHumans(idpClient, env.Endpoints.Idp.HumansCollection.String(), humanRequest)
         if err != nil {
           log.Debug(err.Error())
           c.AbortWithStatus(http.StatusInternalServerError)
@@ -339,7 +366,7 @@ func SubmitRegistration(env *app.Environment) gin.HandlerFunc {
             }
 
             // Registration successful, return to create new ones, but with success message
-            redirectTo := config.GetString("meui.public.url") + config.GetString("meui.public.endpoints.profile")
+            redirectTo := env.Endpoints.Meui.Profile.String()
             log.WithFields(logrus.Fields{"redirect_to": redirectTo}).Debug("Redirecting")
             c.Redirect(http.StatusFound, redirectTo)
             c.Abort()
@@ -380,10 +407,10 @@ func SubmitRegistration(env *app.Environment) gin.HandlerFunc {
   return gin.HandlerFunc(fn)
 }
 
-func fetchChallenge(idpClient *idp.IdpClient, challenge string) (*idp.Challenge, error) {
+func fetchChallenge(env *app.Environment, idpClient *idp.IdpClient, challenge string) (*idp.Challenge, error) {
 
   requests := []idp.ReadChallengesRequest{ {OtpChallenge: challenge} }
-  status, responses, err := idp.ReadChallenges(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.challenges.collection"), requests)
+  status, responses, err := env.IdpApi.ReadChallenges(idpClient, env.Endpoints.Idp.ChallengesCollection.String(), requests)
   if err != nil {
     return nil, err
   }
@@ -406,10 +433,10 @@ func fetchChallenge(idpClient *idp.IdpClient, challenge string) (*idp.Challenge,
   return nil, nil
 }
 
-func fetchInvites(idpClient *idp.IdpClient, id string) (*idp.Invite, error) {
+func fetchInvites(env *app.Environment, idpClient *idp.IdpClient, id string) (*idp.Invite, error) {
 
   requests := []idp.ReadInvitesRequest{ {Id: id} }
-  status, responses, err := idp.ReadInvites(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.invites.collection"), requests)
+  status, responses, err := env.IdpApi.ReadInvites(idpClient, env.Endpoints.Idp.InvitesCollection.String(), requests)
   if err != nil {
     return nil, err
   }
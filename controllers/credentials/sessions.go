@@ -0,0 +1,190 @@
+package credentials
+
+import (
+  "sort"
+  "time"
+  "strings"
+  "net/http"
+  "github.com/sirupsen/logrus"
+  "github.com/gin-gonic/gin"
+  "github.com/gorilla/csrf"
+
+  "github.com/opensentry/idpui/app"
+  "github.com/opensentry/idpui/config"
+)
+
+type sessionsRevokeForm struct {
+  Id string `form:"id" binding:"required"`
+  Client string `form:"client"` // Empty signs out everywhere
+}
+
+// connectedApp is the consent sessions of one client.
+type connectedApp struct {
+  ClientId string
+  Name string
+  Scopes []string
+  GrantedAt int64
+  LastAuthorizedAt int64 // The newest consent, Hydra does not tell when the app last used its tokens
+}
+
+// ShowSessions lists the apps the human gave access to, with the actions to revoke the access of one or to sign out everywhere. The admin api of Hydra lists consents but not login sessions, so the devices the human is signed in on cannot be listed, only all ended at once.
+func ShowSessions(env *app.Environment) gin.HandlerFunc {
+  fn := func(c *gin.Context) {
+
+    log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+    log = log.WithFields(logrus.Fields{
+      "func": "ShowSessions",
+    })
+
+    identity := app.GetIdentity(env, c)
+    if identity == nil {
+      log.Debug("Missing Identity")
+      c.AbortWithStatus(http.StatusForbidden)
+      return
+    }
+
+    consentSessions, err := env.HydraApi.ReadConsentSessions(identity.Id)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    // Every authorization is a consent session, so a client used often has many. The ui itself is not listed, revoking it is signing out.
+    byClient := make(map[string]*connectedApp)
+    for _, s := range consentSessions {
+      client := s.ConsentRequest.Client
+      if client.ClientId == env.ClientId {
+        continue
+      }
+
+      a, exists := byClient[client.ClientId]
+      if exists == false {
+        a = &connectedApp{ ClientId:client.ClientId, Name:client.ClientName, GrantedAt:s.HandledAt.Unix() }
+        byClient[client.ClientId] = a
+      }
+      if a.Name == "" {
+        a.Name = client.ClientId
+      }
+      for _, scope := range s.GrantScope {
+        if contains(a.Scopes, scope) == false {
+          a.Scopes = append(a.Scopes, scope)
+        }
+      }
+      if s.HandledAt.Unix() < a.GrantedAt {
+        a.GrantedAt = s.HandledAt.Unix()
+      }
+      if s.HandledAt.Unix() > a.LastAuthorizedAt {
+        a.LastAuthorizedAt = s.HandledAt.Unix()
+      }
+    }
+
+    var apps []*connectedApp
+    for _, a := range byClient {
+      apps = append(apps, a)
+    }
+    sort.Slice(apps, func(i, j int) bool { return apps[i].LastAuthorizedAt > apps[j].LastAuthorizedAt })
+
+    var connected []map[string]string
+    for _, a := range apps {
+      connected = append(connected, map[string]string{
+        "client": a.ClientId,
+        "name": a.Name,
+        "scopes": strings.Join(a.Scopes, " "),
+        "grantedAt": formatUnixTime(a.GrantedAt),
+        "lastAuthorizedAt": formatUnixTime(a.LastAuthorizedAt),
+      })
+    }
+
+    c.HTML(http.StatusOK, "sessions.html", gin.H{
+      "title": "Sessions",
+      "links": []map[string]string{
+        {"href": "/public/css/credentials.css"},
+      },
+      csrf.TemplateTag: csrf.TemplateField(c.Request),
+      "provider": config.GetString("provider.name"),
+      "provideraction": "Manage the apps with access to your account",
+      "id": identity.Id,
+      "name": identity.Name,
+      "email": identity.Email,
+      "apps": connected,
+      "sessionsRevokeUrl": env.Endpoints.Idpui.SessionsRevoke.String(),
+    })
+  }
+  return gin.HandlerFunc(fn)
+}
+
+// SubmitSessionsRevoke revokes the access of one app, or signs the human out everywhere. Signing out everywhere ends every session with Hydra, revokes the access of every app and ends the session with the ui.
+func SubmitSessionsRevoke(env *app.Environment) gin.HandlerFunc {
+  fn := func(c *gin.Context) {
+
+    log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+    log = log.WithFields(logrus.Fields{
+      "func": "SubmitSessionsRevoke",
+    })
+
+    var form sessionsRevokeForm
+    err := c.Bind(&form)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusBadRequest)
+      return
+    }
+
+    redirectTo := env.Endpoints.Idpui.Sessions.String()
+
+    recent, err := app.VerifyRecentAuthentication(env, c, form.Id, env.StepUp.Sessions)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusForbidden)
+      return
+    }
+
+    // The page was open too long, log in again
+    if recent == false {
+      log.WithFields(logrus.Fields{"redirect_to": redirectTo}).Debug("Login too old, redirecting")
+      c.Redirect(http.StatusFound, redirectTo)
+      c.Abort()
+      return
+    }
+
+    if form.Client != "" {
+      err = env.HydraApi.RevokeConsentSessions(form.Id, form.Client)
+      if err != nil {
+        log.Debug(err.Error())
+        c.AbortWithStatus(http.StatusInternalServerError)
+        return
+      }
+
+      log.WithFields(logrus.Fields{ "client":form.Client, "redirect_to":redirectTo }).Debug("Access revoked, redirecting")
+      c.Redirect(http.StatusFound, redirectTo)
+      c.Abort()
+      return
+    }
+
+    err = env.HydraApi.RevokeLoginSessions(form.Id)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    err = env.HydraApi.RevokeConsentSessions(form.Id, "")
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    // The tokens of the ui are revoked as well, clear its session.
+    redirectTo = env.Endpoints.Idpui.SeeYouLater.String()
+    log.WithFields(logrus.Fields{ "redirect_to":redirectTo }).Debug("Signed out everywhere, redirecting")
+    c.Redirect(http.StatusFound, redirectTo)
+    c.Abort()
+  }
+  return gin.HandlerFunc(fn)
+}
+
+func formatUnixTime(t int64) string {
+  return time.Unix(t, 0).UTC().Format("2006-01-02 15:04 UTC")
+}
@@ -86,7 +86,7 @@ func ShowTotp(env *app.Environment) gin.HandlerFunc {
     } else {
 
       totpOpts := totp.GenerateOpts{
-        Issuer: config.GetString("idpui.public.url"),
+        Issuer: totpIssuer(env),
         AccountName: identity.Id,
       }
       key, err = totp.Generate(totpOpts)
@@ -183,6 +183,21 @@ func SubmitTotp(env *app.Environment) gin.HandlerFunc {
       return
     }
 
+    // Changing TOTP requires a recent login, log in again when the page was open too long.
+    recent, err := app.VerifyRecentAuthentication(env, c, form.Id, env.StepUp.Totp)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusForbidden)
+      return
+    }
+
+    if recent == false {
+      log.WithFields(logrus.Fields{"redirect_to": submitUrl}).Debug("Login too old, redirecting")
+      c.Redirect(http.StatusFound, submitUrl)
+      c.Abort()
+      return
+    }
+
     session := sessions.DefaultMany(c, env.Constants.SessionStoreKey)
 
     errors := make(map[string][]string)
@@ -270,7 +285,7 @@ func SubmitTotp(env *app.Environment) gin.HandlerFunc {
         AccessToken: form.AccessToken,
       })
       totpRequest := []idp.UpdateHumansTotpRequest{ {Id:form.Id, TotpRequired:true, TotpSecret:form.Secret} }
-      status, responses, err := idp.UpdateHumansTotp(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.humans.totp"), totpRequest);
+      status, responses, err := env.IdpApi.UpdateHumansTotp(idpClient, env.Endpoints.Idp.HumansTotp.String(), totpRequest);
       if err != nil {
         log.Debug(err.Error())
         c.AbortWithStatus(http.StatusInternalServerError)
@@ -311,8 +326,14 @@ func SubmitTotp(env *app.Environment) gin.HandlerFunc {
         return
       }
 
+      // The access token was only for this change
+      err = app.RevokeToken(env, form.AccessToken)
+      if err != nil {
+        log.Debug(err.Error())
+      }
+
       // Success
-      redirectTo := config.GetString("meui.public.url") + config.GetString("meui.public.endpoints.profile")
+      redirectTo := env.Endpoints.Meui.Profile.String()
       log.WithFields(logrus.Fields{"redirect_to": redirectTo}).Debug("Redirecting")
       c.Redirect(http.StatusFound, redirectTo)
       c.Abort()
@@ -326,3 +347,11 @@ func SubmitTotp(env *app.Environment) gin.HandlerFunc {
   }
   return gin.HandlerFunc(fn)
 }
+
+// totpIssuer names the ui in the authenticator app, the same for every secret so a reset replaces the entry.
+func totpIssuer(env *app.Environment) string {
+  if env.Endpoints.Idpui.Public == nil {
+    return ""
+  }
+  return env.Endpoints.Idpui.Public.String()
+}
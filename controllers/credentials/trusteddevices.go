@@ -0,0 +1,138 @@
+package credentials
+
+import (
+  "time"
+  "net/http"
+  "github.com/sirupsen/logrus"
+  "github.com/gin-gonic/gin"
+  "github.com/gorilla/csrf"
+
+  "github.com/opensentry/idpui/app"
+  "github.com/opensentry/idpui/config"
+)
+
+type trustedDevicesRevokeForm struct {
+  Id string `form:"id" binding:"required"`
+  Device string `form:"device"` // Empty revokes every device of the human
+}
+
+// ShowTrustedDevices lists the devices the human trusts to skip the second factor.
+func ShowTrustedDevices(env *app.Environment) gin.HandlerFunc {
+  fn := func(c *gin.Context) {
+
+    log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+    log = log.WithFields(logrus.Fields{
+      "func": "ShowTrustedDevices",
+    })
+
+    identity := app.GetIdentity(env, c)
+    if identity == nil {
+      log.Debug("Missing Identity")
+      c.AbortWithStatus(http.StatusForbidden)
+      return
+    }
+
+    devices, err := env.TrustedDevices.ReadDevices(identity.Id)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    current, err := app.FindTrustedDevice(env, c, identity.Id)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    now := time.Now().Unix()
+    var trusted []map[string]string
+    for _, d := range devices {
+      if d.ExpiresAt <= now {
+        continue
+      }
+      var this string
+      if current != nil && current.Id == d.Id {
+        this = "true"
+      }
+      trusted = append(trusted, map[string]string{
+        "device": d.Id,
+        "userAgent": d.UserAgent,
+        "ip": d.Ip,
+        "createdAt": time.Unix(d.CreatedAt, 0).UTC().Format("2006-01-02"),
+        "expiresAt": time.Unix(d.ExpiresAt, 0).UTC().Format("2006-01-02"),
+        "current": this,
+      })
+    }
+
+    c.HTML(http.StatusOK, "trusteddevices.html", gin.H{
+      "title": "Trusted Devices",
+      "links": []map[string]string{
+        {"href": "/public/css/credentials.css"},
+      },
+      csrf.TemplateTag: csrf.TemplateField(c.Request),
+      "provider": config.GetString("provider.name"),
+      "provideraction": "Manage the devices that skip the second factor",
+      "id": identity.Id,
+      "name": identity.Name,
+      "email": identity.Email,
+      "devices": trusted,
+      "trustedDevicesRevokeUrl": env.Endpoints.Idpui.TrustedDevicesRevoke.String(),
+    })
+  }
+  return gin.HandlerFunc(fn)
+}
+
+// SubmitTrustedDevicesRevoke revokes one or every device of the human, their next login on it asks for the second factor again.
+func SubmitTrustedDevicesRevoke(env *app.Environment) gin.HandlerFunc {
+  fn := func(c *gin.Context) {
+
+    log := c.MustGet(env.Constants.LogKey).(*logrus.Entry)
+    log = log.WithFields(logrus.Fields{
+      "func": "SubmitTrustedDevicesRevoke",
+    })
+
+    var form trustedDevicesRevokeForm
+    err := c.Bind(&form)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusBadRequest)
+      return
+    }
+
+    redirectTo := env.Endpoints.Idpui.TrustedDevices.String()
+
+    recent, err := app.VerifyRecentAuthentication(env, c, form.Id, env.StepUp.Devices)
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusForbidden)
+      return
+    }
+
+    // The page was open too long, log in again
+    if recent == false {
+      log.WithFields(logrus.Fields{"redirect_to": redirectTo}).Debug("Login too old, redirecting")
+      c.Redirect(http.StatusFound, redirectTo)
+      c.Abort()
+      return
+    }
+
+    // Only the devices of the human itself
+    if form.Device == "" {
+      err = env.TrustedDevices.DeleteDevices(form.Id)
+    } else {
+      err = env.TrustedDevices.DeleteDevice(form.Id, form.Device)
+    }
+    if err != nil {
+      log.Debug(err.Error())
+      c.AbortWithStatus(http.StatusInternalServerError)
+      return
+    }
+
+    log.WithFields(logrus.Fields{ "device":form.Device, "redirect_to":redirectTo }).Debug("Revoked, redirecting")
+    c.Redirect(http.StatusFound, redirectTo)
+    c.Abort()
+  }
+  return gin.HandlerFunc(fn)
+}
@@ -7,7 +7,6 @@ import (
   idp "github.com/opensentry/idp/client"
 
   "github.com/opensentry/idpui/app"
-  "github.com/opensentry/idpui/config"
 
   bulky "github.com/charmixer/bulky/client"
 )
@@ -36,7 +35,7 @@ func ShowPublicProfile(env *app.Environment) gin.HandlerFunc {
 
     // Look up profile information for user.
     humanRequests := []idp.ReadHumansRequest{ {Id: request.Id } }
-    status, responses, err := idp.ReadHumans(idpClient, config.GetString("idp.public.url") + config.GetString("idp.public.endpoints.humans.collection"), humanRequests)
+    status, responses, err := env.IdpApi.ReadHumans(idpClient, env.Endpoints.Idp.HumansCollection.String(), humanRequests)
     if err != nil {
       log.Debug(err.Error())
       c.AbortWithStatus(http.StatusInternalServerError)
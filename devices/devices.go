@@ -0,0 +1,195 @@
+package devices
+
+import (
+  "os"
+  "sort"
+  "sync"
+  "time"
+  "io/ioutil"
+  "path/filepath"
+  "encoding/json"
+  "github.com/opensentry/idpui/utils"
+)
+
+// # Trusted devices
+// A human that verified the second factor can trust the device, so logins on it skip the second factor until the trust expires or is revoked. The device holds the id in a signed cookie, the record here is what makes it revocable.
+
+// Device is a browser a human trusts to skip the second factor.
+type Device struct {
+  Id string `json:"id"`
+  HumanId string `json:"human_id"`
+  UserAgent string `json:"user_agent"` // As the device identified itself when trusted, for display
+  Ip string `json:"ip"`
+  CreatedAt int64 `json:"created_at"`
+  ExpiresAt int64 `json:"expires_at"`
+}
+
+// Devices stores the trusted devices. The idp has no notion of devices, so the ui keeps them.
+type Devices interface {
+  // FindDevice returns the device with the id, nil when it is not trusted.
+  FindDevice(id string) (*Device, error)
+
+  // CreateDevice trusts the device. Expired devices are dropped, so they do not pile up.
+  CreateDevice(device Device) error
+
+  // ReadDevices returns the devices the human trusts, newest first.
+  ReadDevices(humanId string) ([]Device, error)
+
+  // DeleteDevice revokes the device of the human. Revoking what is not trusted is not an error.
+  DeleteDevice(humanId string, id string) error
+
+  // DeleteDevices revokes every device of the human.
+  DeleteDevices(humanId string) error
+}
+
+// FileDevices keeps the devices in a JSON file, see login.trustedDevices.path. Every ui instance points at the same file on a shared volume, each change holds a lock on it for the whole read and write.
+type FileDevices struct {
+  Path string
+
+  mu sync.Mutex
+}
+
+func (f *FileDevices) FindDevice(id string) (*Device, error) {
+  unlock, err := f.lock()
+  if err != nil {
+    return nil, err
+  }
+  defer unlock()
+
+  devices, err := f.read()
+  if err != nil {
+    return nil, err
+  }
+  for _, d := range devices {
+    if d.Id == id {
+      return &d, nil
+    }
+  }
+  return nil, nil
+}
+
+func (f *FileDevices) CreateDevice(device Device) error {
+  unlock, err := f.lock()
+  if err != nil {
+    return err
+  }
+  defer unlock()
+
+  devices, err := f.read()
+  if err != nil {
+    return err
+  }
+
+  now := time.Now().Unix()
+  kept := []Device{ device }
+  for _, d := range devices {
+    if d.ExpiresAt > now {
+      kept = append(kept, d)
+    }
+  }
+  return f.write(kept)
+}
+
+func (f *FileDevices) ReadDevices(humanId string) ([]Device, error) {
+  unlock, err := f.lock()
+  if err != nil {
+    return nil, err
+  }
+  defer unlock()
+
+  devices, err := f.read()
+  if err != nil {
+    return nil, err
+  }
+
+  var found []Device
+  for _, d := range devices {
+    if d.HumanId == humanId {
+      found = append(found, d)
+    }
+  }
+  sort.Slice(found, func(i, j int) bool { return found[i].CreatedAt > found[j].CreatedAt })
+  return found, nil
+}
+
+func (f *FileDevices) DeleteDevice(humanId string, id string) error {
+  return f.delete(func(d Device) bool { return d.HumanId == humanId && d.Id == id })
+}
+
+func (f *FileDevices) DeleteDevices(humanId string) error {
+  return f.delete(func(d Device) bool { return d.HumanId == humanId })
+}
+
+func (f *FileDevices) delete(match func(Device) bool) error {
+  unlock, err := f.lock()
+  if err != nil {
+    return err
+  }
+  defer unlock()
+
+  devices, err := f.read()
+  if err != nil {
+    return err
+  }
+
+  var kept []Device
+  for _, d := range devices {
+    if match(d) == false {
+      kept = append(kept, d)
+    }
+  }
+  return f.write(kept)
+}
+
+// lock keeps out the other goroutines and the other ui instances until unlocked.
+func (f *FileDevices) lock() (func(), error) {
+  f.mu.Lock()
+  unlock, err := utils.LockFile(f.Path)
+  if err != nil {
+    f.mu.Unlock()
+    return nil, err
+  }
+  return func() { unlock(); f.mu.Unlock() }, nil
+}
+
+func (f *FileDevices) read() ([]Device, error) {
+  data, err := ioutil.ReadFile(f.Path)
+  if os.IsNotExist(err) {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  var devices []Device
+  err = json.Unmarshal(data, &devices)
+  if err != nil {
+    return nil, err
+  }
+  return devices, nil
+}
+
+// write replaces the file in one rename, so a crash never leaves half the devices.
+func (f *FileDevices) write(devices []Device) error {
+  data, err := json.MarshalIndent(devices, "", "  ")
+  if err != nil {
+    return err
+  }
+
+  tmp, err := ioutil.TempFile(filepath.Dir(f.Path), filepath.Base(f.Path) + ".*")
+  if err != nil {
+    return err
+  }
+  defer os.Remove(tmp.Name())
+
+  _, err = tmp.Write(data)
+  if err != nil {
+    tmp.Close()
+    return err
+  }
+  err = tmp.Close()
+  if err != nil {
+    return err
+  }
+  return os.Rename(tmp.Name(), f.Path)
+}
@@ -0,0 +1,139 @@
+package directory
+
+import (
+  "fmt"
+  "net"
+  "time"
+  "strings"
+  "net/url"
+  "crypto/tls"
+  "github.com/go-ldap/ldap/v3"
+)
+
+// # Directory
+// Humans of on-prem deployments log in with the password of their directory account. The ui searches the directory for the entry of the identifier entered on the login form, and verifies the password with a bind as that entry. The password is never compared by the ui.
+// The search is done with a service account, or anonymously when none is configured. Each login uses its own connection, so a directory restart never leaves the ui with a broken one.
+
+// Entry is the directory account the password was verified for.
+type Entry struct {
+  Dn string
+  Username string
+  Email string
+  Name string
+}
+
+// Attributes names the attributes of the entry used for the human, ex. uid, mail and cn.
+type Attributes struct {
+  Username string
+  Email string
+  Name string
+}
+
+type Ldap struct {
+  Url string // ldap:// or ldaps://
+  StartTls bool // Upgrade an ldap:// connection before sending credentials
+  TlsConfig *tls.Config // Nil to verify with the system roots
+
+  BindDn string // Service account used to search, empty to search anonymously
+  BindPassword string
+
+  SearchBase string
+  UserFilter string // Ex. (&(objectClass=person)(uid=%s)), %s is the escaped identifier
+  Attributes Attributes
+
+  Timeout time.Duration
+}
+
+// Authenticate returns the entry of the identifier when the password binds as it, nil when the identifier matches no single entry or the password is wrong.
+func (l *Ldap) Authenticate(identifier string, password string) (*Entry, error) {
+
+  // An empty password is an unauthenticated bind, which most directories accept for any dn
+  if identifier == "" || password == "" {
+    return nil, nil
+  }
+
+  conn, err := l.dial()
+  if err != nil {
+    return nil, err
+  }
+  defer conn.Close()
+
+  if l.BindDn != "" {
+    err = conn.Bind(l.BindDn, l.BindPassword)
+    if err != nil {
+      return nil, fmt.Errorf("Bind as %s failed: %s", l.BindDn, err.Error())
+    }
+  }
+
+  var attributes []string
+  for _, a := range []string{ l.Attributes.Username, l.Attributes.Email, l.Attributes.Name } {
+    if a != "" {
+      attributes = append(attributes, a)
+    }
+  }
+
+  filter := strings.Replace(l.UserFilter, "%s", ldap.EscapeFilter(identifier), -1)
+  search := ldap.NewSearchRequest(l.SearchBase, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(l.Timeout.Seconds()), false, filter, attributes, nil)
+  result, err := conn.Search(search)
+  if err != nil && ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) == false {
+    return nil, err
+  }
+
+  // Ambiguous identifiers log in as no one
+  if result == nil || len(result.Entries) != 1 {
+    return nil, nil
+  }
+  found := result.Entries[0]
+
+  err = conn.Bind(found.DN, password)
+  if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  return &Entry{
+    Dn: found.DN,
+    Username: attribute(found, l.Attributes.Username),
+    Email: attribute(found, l.Attributes.Email),
+    Name: attribute(found, l.Attributes.Name),
+  }, nil
+}
+
+func (l *Ldap) dial() (*ldap.Conn, error) {
+  u, err := url.Parse(l.Url)
+  if err != nil {
+    return nil, err
+  }
+
+  tlsConfig := &tls.Config{}
+  if l.TlsConfig != nil {
+    tlsConfig = l.TlsConfig.Clone()
+  }
+  if tlsConfig.ServerName == "" {
+    tlsConfig.ServerName = u.Hostname() // Not derived by StartTLS
+  }
+
+  conn, err := ldap.DialURL(l.Url, ldap.DialWithDialer(&net.Dialer{ Timeout:l.Timeout }), ldap.DialWithTLSConfig(tlsConfig))
+  if err != nil {
+    return nil, err
+  }
+  conn.SetTimeout(l.Timeout)
+
+  if l.StartTls {
+    err = conn.StartTLS(tlsConfig)
+    if err != nil {
+      conn.Close()
+      return nil, err
+    }
+  }
+  return conn, nil
+}
+
+func attribute(e *ldap.Entry, name string) string {
+  if name == "" {
+    return ""
+  }
+  return e.GetAttributeValue(name)
+}
@@ -0,0 +1,158 @@
+package federation
+
+import (
+  "fmt"
+  "sync"
+  "context"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/base64"
+  "github.com/coreos/go-oidc"
+  "golang.org/x/oauth2"
+)
+
+// # Federated login
+// Humans log in with an upstream OpenID Connect provider, ex. the corporate identity of a partner. The ui runs the authorization code flow with PKCE against the upstream, verifies its id token and accepts the Hydra login for the human the upstream identity is linked to, see Links.
+// Upstreams are discovered on first use, so one being down does not stop the ui from starting.
+
+type Provider struct {
+  Id string // Used in urls and links, never change it once humans have linked
+  Name string // Shown on the button
+  Issuer string
+  ClientId string
+  ClientSecret string
+  Scopes []string
+  TrustEmail bool // The upstream only asserts emails its users own, so a verified email links to the human with that email
+  TrustMfa bool // The upstream verifies a second factor as strong as TOTP, so its amr mfa counts as the second factor
+
+  mu sync.Mutex
+  provider *oidc.Provider
+}
+
+// Identity is who the upstream says logged in.
+type Identity struct {
+  Provider string
+  Subject string
+  Email string
+  EmailVerified bool
+  Name string
+  Amr []string
+}
+
+type Providers []*Provider
+
+// Find returns the provider with the id, nil when it is not configured.
+func (ps Providers) Find(id string) *Provider {
+  for _, p := range ps {
+    if p.Id == id {
+      return p
+    }
+  }
+  return nil
+}
+
+// discover fetches the discovery document once. Not bound to a request, as the provider keeps using the context for its keys.
+func (p *Provider) discover() (*oidc.Provider, error) {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+
+  if p.provider == nil {
+    provider, err := oidc.NewProvider(context.Background(), p.Issuer)
+    if err != nil {
+      return nil, fmt.Errorf("Discovery of %s failed: %s", p.Issuer, err.Error())
+    }
+    p.provider = provider
+  }
+  return p.provider, nil
+}
+
+func (p *Provider) config(provider *oidc.Provider, redirectUrl string) *oauth2.Config {
+  scopes := p.Scopes
+  if len(scopes) == 0 {
+    scopes = []string{ oidc.ScopeOpenID, "email", "profile" }
+  }
+  return &oauth2.Config{
+    ClientID: p.ClientId,
+    ClientSecret: p.ClientSecret,
+    Endpoint: provider.Endpoint(),
+    RedirectURL: redirectUrl,
+    Scopes: scopes,
+  }
+}
+
+// AuthCodeURL returns where the browser logs in with the upstream. The verifier is the PKCE code verifier, only its S256 challenge is sent.
+func (p *Provider) AuthCodeURL(redirectUrl string, state string, nonce string, verifier string) (string, error) {
+  provider, err := p.discover()
+  if err != nil {
+    return "", err
+  }
+
+  return p.config(provider, redirectUrl).AuthCodeURL(state,
+    oidc.Nonce(nonce),
+    oauth2.SetAuthURLParam("code_challenge", CodeChallenge(verifier)),
+    oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+  ), nil
+}
+
+// Exchange redeems the code the upstream returned with and verifies the id token issued for it, including the nonce of the authorization request.
+func (p *Provider) Exchange(ctx context.Context, redirectUrl string, code string, verifier string, nonce string) (*Identity, error) {
+  provider, err := p.discover()
+  if err != nil {
+    return nil, err
+  }
+
+  token, err := p.config(provider, redirectUrl).Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", verifier))
+  if err != nil {
+    return nil, err
+  }
+
+  rawIdToken, ok := token.Extra("id_token").(string)
+  if ok == false {
+    return nil, fmt.Errorf("No id_token from %s", p.Issuer)
+  }
+
+  idToken, err := provider.Verifier(&oidc.Config{ ClientID:p.ClientId }).Verify(ctx, rawIdToken)
+  if err != nil {
+    return nil, err
+  }
+
+  if idToken.Nonce != nonce {
+    return nil, fmt.Errorf("Nonce mismatch in id_token from %s", p.Issuer)
+  }
+
+  var claims struct {
+    Email string `json:"email"`
+    EmailVerified bool `json:"email_verified"`
+    Name string `json:"name"`
+    Amr []string `json:"amr"`
+  }
+  err = idToken.Claims(&claims)
+  if err != nil {
+    return nil, err
+  }
+
+  return &Identity{
+    Provider: p.Id,
+    Subject: idToken.Subject,
+    Email: claims.Email,
+    EmailVerified: claims.EmailVerified,
+    Name: claims.Name,
+    Amr: claims.Amr,
+  }, nil
+}
+
+// NewCodeVerifier returns a random PKCE code verifier, RFC 7636.
+func NewCodeVerifier() (string, error) {
+  b := make([]byte, 32)
+  _, err := rand.Read(b)
+  if err != nil {
+    return "", err
+  }
+  return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CodeChallenge is the S256 code challenge of the verifier.
+func CodeChallenge(verifier string) string {
+  sum := sha256.Sum256([]byte(verifier))
+  return base64.RawURLEncoding.EncodeToString(sum[:])
+}
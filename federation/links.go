@@ -0,0 +1,177 @@
+package federation
+
+import (
+  "os"
+  "sort"
+  "sync"
+  "io/ioutil"
+  "path/filepath"
+  "encoding/json"
+  "github.com/opensentry/idpui/utils"
+)
+
+// Link says the upstream identity logs in as the human.
+type Link struct {
+  Provider string `json:"provider"`
+  Subject string `json:"subject"`
+  HumanId string `json:"human_id"`
+  Email string `json:"email"` // As the upstream asserted it when linking, for display
+  LinkedAt int64 `json:"linked_at"`
+}
+
+// Links stores which upstream identities log in as which humans. The idp has no notion of upstream identities, so the ui keeps them.
+type Links interface {
+  // FindLink returns the link of the upstream identity, nil when it is not linked.
+  FindLink(provider string, subject string) (*Link, error)
+
+  // CreateLink links the upstream identity, replacing any link it had.
+  CreateLink(link Link) error
+
+  // ReadLinks returns every upstream identity linked to the human, oldest first.
+  ReadLinks(humanId string) ([]Link, error)
+
+  // DeleteLink unlinks the upstream identity. Unlinking what is not linked is not an error.
+  DeleteLink(provider string, subject string) error
+}
+
+// FileLinks keeps the links in a JSON file, see federation.links.path. Instances of the ui share it through a lock file next to it, so a link made by one is found by all.
+type FileLinks struct {
+  Path string
+
+  mu sync.Mutex
+}
+
+func (f *FileLinks) FindLink(provider string, subject string) (*Link, error) {
+  unlock, err := f.lock()
+  if err != nil {
+    return nil, err
+  }
+  defer unlock()
+
+  links, err := f.read()
+  if err != nil {
+    return nil, err
+  }
+  for _, l := range links {
+    if l.Provider == provider && l.Subject == subject {
+      return &l, nil
+    }
+  }
+  return nil, nil
+}
+
+func (f *FileLinks) CreateLink(link Link) error {
+  unlock, err := f.lock()
+  if err != nil {
+    return err
+  }
+  defer unlock()
+
+  links, err := f.read()
+  if err != nil {
+    return err
+  }
+
+  kept := []Link{ link }
+  for _, l := range links {
+    if l.Provider != link.Provider || l.Subject != link.Subject {
+      kept = append(kept, l)
+    }
+  }
+  return f.write(kept)
+}
+
+func (f *FileLinks) ReadLinks(humanId string) ([]Link, error) {
+  unlock, err := f.lock()
+  if err != nil {
+    return nil, err
+  }
+  defer unlock()
+
+  links, err := f.read()
+  if err != nil {
+    return nil, err
+  }
+
+  var found []Link
+  for _, l := range links {
+    if l.HumanId == humanId {
+      found = append(found, l)
+    }
+  }
+  sort.Slice(found, func(i, j int) bool { return found[i].LinkedAt < found[j].LinkedAt })
+  return found, nil
+}
+
+func (f *FileLinks) DeleteLink(provider string, subject string) error {
+  unlock, err := f.lock()
+  if err != nil {
+    return err
+  }
+  defer unlock()
+
+  links, err := f.read()
+  if err != nil {
+    return err
+  }
+
+  var kept []Link
+  for _, l := range links {
+    if l.Provider != provider || l.Subject != subject {
+      kept = append(kept, l)
+    }
+  }
+  return f.write(kept)
+}
+
+func (f *FileLinks) lock() (func(), error) {
+  f.mu.Lock()
+  unlock, err := utils.LockFile(f.Path)
+  if err != nil {
+    f.mu.Unlock()
+    return nil, err
+  }
+  return func() { unlock(); f.mu.Unlock() }, nil
+}
+
+func (f *FileLinks) read() ([]Link, error) {
+  data, err := ioutil.ReadFile(f.Path)
+  if os.IsNotExist(err) {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  var links []Link
+  err = json.Unmarshal(data, &links)
+  if err != nil {
+    return nil, err
+  }
+  return links, nil
+}
+
+// write replaces the file in one rename, so a crash never leaves half the links.
+func (f *FileLinks) write(links []Link) error {
+  data, err := json.MarshalIndent(links, "", "  ")
+  if err != nil {
+    return err
+  }
+
+  tmp, err := ioutil.TempFile(filepath.Dir(f.Path), filepath.Base(f.Path) + ".*")
+  if err != nil {
+    return err
+  }
+  defer os.Remove(tmp.Name())
+
+  _, err = tmp.Write(data)
+  if err != nil {
+    tmp.Close()
+    return err
+  }
+  err = tmp.Close()
+  if err != nil {
+    return err
+  }
+  return os.Rename(tmp.Name(), f.Path)
+}
@@ -7,9 +7,12 @@ require (
 	github.com/coreos/go-oidc v2.2.1+incompatible
 	github.com/gin-contrib/sessions v0.0.3
 	github.com/gin-gonic/gin v1.6.3
+	github.com/go-asn1-ber/asn1-ber v1.5.1
+	github.com/go-ldap/ldap/v3 v3.4.1
 	github.com/gofrs/uuid v4.0.0+incompatible
 	github.com/gorilla/csrf v1.7.0
 	github.com/gwatts/gin-adapter v0.0.0-20170508204228-c44433c485ad
+	github.com/nbutton23/zxcvbn-go v0.0.0-20210217022336-fa2cb2858354
 	github.com/opensentry/idp v0.0.0-20210207221934-b1172a6c522a
 	github.com/pborman/getopt v1.1.0
 	github.com/pquerna/otp v1.3.0
@@ -18,4 +21,5 @@ require (
 	golang.org/x/net v0.0.0-20210119194325-5f4716e94777
 	golang.org/x/oauth2 v0.0.0-20210201163806-010130855d6c
 	gopkg.in/go-playground/validator.v9 v9.31.0
+	gopkg.in/square/go-jose.v2 v2.5.1
 )
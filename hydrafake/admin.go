@@ -0,0 +1,295 @@
+package hydrafake
+
+import (
+  "time"
+  "net/http"
+  "encoding/json"
+)
+
+// The admin api is served on the same server as the public api. Only what the ui uses is implemented.
+
+// revokeLoginSessions ends every session of the subject, the next authorization request must log in again.
+func (h *Hydra) revokeLoginSessions(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodDelete {
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+
+  subject := r.URL.Query().Get("subject")
+  if subject == "" {
+    writeOauth2Error(w, http.StatusBadRequest, "invalid_request")
+    return
+  }
+
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  for id, s := range h.sessions {
+    if s.Subject == subject {
+      delete(h.sessions, id)
+    }
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
+
+// consentSessions lists or revokes the consent sessions of the subject.
+func (h *Hydra) consentSessions(w http.ResponseWriter, r *http.Request) {
+  switch r.Method {
+  case http.MethodGet:
+    h.listConsentSessions(w, r)
+  case http.MethodDelete:
+    h.revokeConsentSessions(w, r)
+  default:
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+  }
+}
+
+// listConsentSessions lists the consents the subject granted, oldest first, as Hydra does.
+func (h *Hydra) listConsentSessions(w http.ResponseWriter, r *http.Request) {
+  subject := r.URL.Query().Get("subject")
+  if subject == "" {
+    writeOauth2Error(w, http.StatusBadRequest, "invalid_request")
+    return
+  }
+
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  sessions := []map[string]interface{}{}
+  for _, c := range h.consents {
+    if c.Subject != subject {
+      continue
+    }
+    sessions = append(sessions, map[string]interface{}{
+      "grant_scope": c.Scopes,
+      "handled_at": c.HandledAt,
+      "consent_request": map[string]interface{}{
+        "subject": c.Subject,
+        "client": map[string]string{ "client_id":c.ClientId, "client_name":h.clientName(c.ClientId) },
+      },
+    })
+  }
+  writeJson(w, http.StatusOK, sessions)
+}
+
+// revokeConsentSessions revokes the consents, every token and unused code issued to the subject for the client, or for all clients with all=true.
+func (h *Hydra) revokeConsentSessions(w http.ResponseWriter, r *http.Request) {
+  q := r.URL.Query()
+  subject := q.Get("subject")
+  clientId := q.Get("client")
+  all := q.Get("all") == "true"
+  if subject == "" || (clientId == "" && all == false) {
+    writeOauth2Error(w, http.StatusBadRequest, "invalid_request")
+    return
+  }
+
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  revoked := func(s string, c string) bool {
+    return s == subject && (all || c == clientId)
+  }
+  for token, g := range h.tokens {
+    if revoked(g.Subject, g.ClientId) {
+      delete(h.tokens, token)
+    }
+  }
+  for code, g := range h.codes {
+    if revoked(g.Subject, g.ClientId) {
+      delete(h.codes, code)
+    }
+  }
+  var kept []*consent
+  for _, c := range h.consents {
+    if revoked(c.Subject, c.ClientId) == false {
+      kept = append(kept, c)
+    }
+  }
+  h.consents = kept
+  w.WriteHeader(http.StatusNoContent)
+}
+
+// loginRequest tells what Hydra knows about the login_challenge, as Hydra does for the ui and the idp.
+func (h *Hydra) loginRequest(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodGet {
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  lr, exists := h.loginRequests[r.URL.Query().Get("login_challenge")]
+  if exists == false {
+    writeOauth2Error(w, http.StatusNotFound, "not_found")
+    return
+  }
+
+  writeJson(w, http.StatusOK, map[string]interface{}{
+    "challenge": lr.Challenge,
+    "skip": lr.Skip,
+    "subject": lr.Subject,
+    "requested_scope": lr.Scopes,
+    "request_url": lr.RequestUrl,
+    "session_id": lr.SessionId,
+    "client": map[string]string{ "client_id":lr.ClientId, "client_name":h.clientName(lr.ClientId) },
+    "oidc_context": map[string]interface{}{ "login_hint":lr.LoginHint, "acr_values":lr.AcrValues },
+  })
+}
+
+// acceptLoginRequest accepts the login_challenge with the remember choice, acr and amr of the body.
+func (h *Hydra) acceptLoginRequest(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPut {
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+
+  var accept struct {
+    Subject string `json:"subject"`
+    Remember bool `json:"remember"`
+    RememberFor int `json:"remember_for"`
+    Acr string `json:"acr"`
+    Amr []string `json:"amr"`
+  }
+  err := json.NewDecoder(r.Body).Decode(&accept)
+  if err != nil || accept.Subject == "" {
+    writeOauth2Error(w, http.StatusBadRequest, "invalid_request")
+    return
+  }
+
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  challenge := r.URL.Query().Get("login_challenge")
+  lr, exists := h.loginRequests[challenge]
+  if exists == false {
+    writeOauth2Error(w, http.StatusNotFound, "not_found")
+    return
+  }
+  if lr.Skip && lr.Subject != accept.Subject {
+    writeOauth2Error(w, http.StatusBadRequest, "invalid_request") // Subject does not match the previous authentication
+    return
+  }
+
+  writeJson(w, http.StatusOK, map[string]string{
+    "redirect_to": h.acceptLogin(challenge, accept.Subject, accept.Remember, accept.RememberFor, accept.Acr, accept.Amr),
+  })
+}
+
+// rejectLoginRequest denies the login_challenge with the error of the body. The client is sent the error, a device waiting for the login is denied and polls access_denied.
+func (h *Hydra) rejectLoginRequest(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPut {
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+
+  var reject struct {
+    Error string `json:"error"`
+    ErrorDescription string `json:"error_description"`
+  }
+  err := json.NewDecoder(r.Body).Decode(&reject)
+  if err != nil || reject.Error == "" {
+    writeOauth2Error(w, http.StatusBadRequest, "invalid_request")
+    return
+  }
+
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  challenge := r.URL.Query().Get("login_challenge")
+  lr, exists := h.loginRequests[challenge]
+  if exists == false {
+    writeOauth2Error(w, http.StatusNotFound, "not_found")
+    return
+  }
+  delete(h.loginRequests, challenge)
+
+  params := map[string]string{ "error":reject.Error, "error_description":reject.ErrorDescription }
+  redirectTo := h.DeviceDoneUrl
+  if lr.DeviceCode != "" {
+    if dr, exists := h.deviceRequests[lr.DeviceCode]; exists {
+      dr.Denied = true
+    }
+  } else {
+    redirectTo = lr.RedirectUri
+    params["state"] = lr.State
+  }
+
+  writeJson(w, http.StatusOK, map[string]string{
+    "redirect_to": withQuery(redirectTo, params),
+  })
+}
+
+// Sessions returns the number of authenticated sessions of the subject.
+func (h *Hydra) Sessions(subject string) int {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  n := 0
+  for _, s := range h.sessions {
+    if s.Subject == subject {
+      n++
+    }
+  }
+  return n
+}
+
+// AgeSessions moves the authentication time of every session of the subject back by d, as if the human logged in that much earlier.
+func (h *Hydra) AgeSessions(subject string, d time.Duration) {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  for _, s := range h.sessions {
+    if s.Subject == subject {
+      s.AuthTime -= int64(d / time.Second)
+    }
+  }
+}
+
+// Tokens returns the number of active access tokens of the subject.
+func (h *Hydra) Tokens(subject string) int {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  n := 0
+  for _, g := range h.tokens {
+    if g.Subject == subject {
+      n++
+    }
+  }
+  return n
+}
+
+// acceptDeviceRequest takes the user code of the body for the device_challenge, the browser continues with the login for the device. Unknown, expired and used codes are not found, as with Hydra.
+func (h *Hydra) acceptDeviceRequest(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPut {
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+
+  var accept struct {
+    UserCode string `json:"user_code"`
+  }
+  err := json.NewDecoder(r.Body).Decode(&accept)
+  if err != nil || accept.UserCode == "" {
+    writeOauth2Error(w, http.StatusBadRequest, "invalid_request")
+    return
+  }
+
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  dc, exists := h.deviceChallenges[r.URL.Query().Get("device_challenge")]
+  dr := h.pendingDeviceRequest(accept.UserCode)
+  if exists == false || dc.DeviceCode != "" || dr == nil {
+    writeOauth2Error(w, http.StatusNotFound, "not_found")
+    return
+  }
+
+  dr.Confirmed = true
+  dc.DeviceCode = dr.DeviceCode
+  dc.Verifier = randomString(16)
+  writeJson(w, http.StatusOK, map[string]string{
+    "redirect_to": h.Issuer + "oauth2/device/verify?device_verifier=" + dc.Verifier,
+  })
+}
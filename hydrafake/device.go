@@ -0,0 +1,162 @@
+package hydrafake
+
+import (
+  "time"
+  "strings"
+  "net/http"
+  "crypto/rand"
+)
+
+// The device authorization grant, RFC 8628. The device gets a user code to show, the human enters it on the device page of the ui and logs in, and the device polls the token endpoint until then.
+
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// deviceAuth starts a device authorization request for a client, public clients only send their client_id.
+func (h *Hydra) deviceAuth(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+
+  err := r.ParseForm()
+  if err != nil {
+    writeOauth2Error(w, http.StatusBadRequest, "invalid_request")
+    return
+  }
+
+  clientId, clientSecret := clientCredentials(r)
+
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  if secret, exists := h.Clients[clientId]; exists == false || secret != clientSecret {
+    writeOauth2Error(w, http.StatusUnauthorized, "invalid_client")
+    return
+  }
+
+  dr := &deviceRequest{
+    DeviceCode: randomString(24),
+    UserCode: h.newUserCode(),
+    ClientId: clientId,
+    Scopes: strings.Fields(r.PostForm.Get("scope")),
+    ExpiresAt: time.Now().Add(h.DeviceCodeTTL).Unix(),
+  }
+  h.deviceRequests[dr.DeviceCode] = dr
+
+  verificationUri := h.Issuer + "oauth2/device/verify"
+  writeJson(w, http.StatusOK, map[string]interface{}{
+    "device_code": dr.DeviceCode,
+    "user_code": dr.UserCode,
+    "verification_uri": verificationUri,
+    "verification_uri_complete": withQuery(verificationUri, map[string]string{ "user_code":dr.UserCode }),
+    "expires_in": int64(h.DeviceCodeTTL.Seconds()),
+    "interval": 5,
+  })
+}
+
+// deviceVerify sends the browser to the device url with a device_challenge, passing on the user code of a verification_uri_complete. When the user code is accepted the browser returns with the device_verifier and is sent to log in for the device.
+func (h *Hydra) deviceVerify(w http.ResponseWriter, r *http.Request) {
+  q := r.URL.Query()
+
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  if _, continues := q["device_verifier"]; continues {
+    verifier := q.Get("device_verifier")
+    var dc *deviceChallenge
+    for _, d := range h.deviceChallenges {
+      if d.Verifier == verifier && d.DeviceCode != "" {
+        dc = d
+        break
+      }
+    }
+    if dc == nil {
+      http.Error(w, "invalid_request: device verifier not found or user code not accepted", http.StatusBadRequest)
+      return
+    }
+    delete(h.deviceChallenges, dc.Challenge)
+
+    dr, exists := h.deviceRequests[dc.DeviceCode]
+    if exists == false {
+      http.Error(w, "invalid_request: device request expired", http.StatusBadRequest)
+      return
+    }
+
+    lr := &loginRequest{
+      Challenge: randomString(16),
+      Verifier: randomString(16),
+      ClientId: dr.ClientId,
+      Scopes: dr.Scopes,
+      RequestUrl: h.Issuer + strings.TrimPrefix(r.URL.RequestURI(), "/"),
+      DeviceCode: dr.DeviceCode,
+    }
+    if s := h.session(r); s != nil {
+      lr.Skip = true
+      lr.Subject = s.Subject
+      lr.SessionId = s.Id
+    }
+    h.loginRequests[lr.Challenge] = lr
+
+    http.Redirect(w, r, withQuery(h.LoginUrl, map[string]string{ "login_challenge":lr.Challenge }), http.StatusFound)
+    return
+  }
+
+  dc := &deviceChallenge{ Challenge:randomString(16) }
+  h.deviceChallenges[dc.Challenge] = dc
+
+  http.Redirect(w, r, withQuery(h.DeviceUrl, map[string]string{
+    "device_challenge": dc.Challenge,
+    "user_code": q.Get("user_code"),
+  }), http.StatusFound)
+}
+
+// deviceGrant returns the grant of the device code once the human logged in, otherwise the error the polling device is told, RFC 8628 section 3.5. Must be called with the lock held.
+func (h *Hydra) deviceGrant(clientId string, deviceCode string) (*grant, string) {
+  dr, exists := h.deviceRequests[deviceCode]
+  if exists == false || dr.ClientId != clientId {
+    return nil, "invalid_grant"
+  }
+
+  switch {
+  case dr.Denied:
+    delete(h.deviceRequests, deviceCode)
+    return nil, "access_denied"
+  case dr.Grant != nil:
+    delete(h.deviceRequests, deviceCode) // Device codes can only be used once
+    return dr.Grant, ""
+  case time.Now().Unix() >= dr.ExpiresAt:
+    delete(h.deviceRequests, deviceCode)
+    return nil, "expired_token"
+  }
+  return nil, "authorization_pending"
+}
+
+// pendingDeviceRequest finds the device request of the user code still waiting for it to be entered. Must be called with the lock held.
+func (h *Hydra) pendingDeviceRequest(userCode string) *deviceRequest {
+  for _, dr := range h.deviceRequests {
+    if dr.UserCode == userCode && dr.Confirmed == false && time.Now().Unix() < dr.ExpiresAt {
+      return dr
+    }
+  }
+  return nil
+}
+
+// clientName must be called with the lock held.
+func (h *Hydra) clientName(clientId string) string {
+  if name, exists := h.ClientNames[clientId]; exists {
+    return name
+  }
+  return clientId
+}
+
+func (h *Hydra) newUserCode() string {
+  b := make([]byte, h.UserCodeLength)
+  _, err := rand.Read(b)
+  if err != nil {
+    panic(err)
+  }
+  for i := range b {
+    b[i] = h.UserCodeAlphabet[int(b[i]) % len(h.UserCodeAlphabet)]
+  }
+  return string(b)
+}
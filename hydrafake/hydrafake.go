@@ -0,0 +1,290 @@
+package hydrafake
+
+import (
+  "sync"
+  "time"
+  "net/http"
+  "net/http/httptest"
+  "crypto/rand"
+  "crypto/rsa"
+  "encoding/base64"
+  "gopkg.in/square/go-jose.v2"
+)
+
+// # Local Hydra
+// Hydra is a minimal OpenID Connect provider behaving like ORY Hydra towards the ui: discovery, JWKS, authorization code flow with login challenges and PKCE, client credentials, token revocation, the device authorization grant with device challenges, logout with logout challenges, and reading and accepting login requests, and listing and revoking sessions with the admin api. Consent is always granted, as for first party clients.
+// It is served on a plain http httptest server, so the ui can reach it with the default http client.
+// Login and logout requests are accepted through AcceptLogin and AcceptLogout, which is what the idp does on behalf of the ui, see ConnectIdp.
+// A second instance serves as the upstream provider of federated logins, with Claims adding what the upstream asserts about its users.
+
+type Hydra struct {
+  *httptest.Server
+
+  Issuer string // Server url with a trailing slash, as Hydra
+
+  LoginUrl string // urls.login, where the browser is sent with a login_challenge
+  LogoutUrl string // urls.logout, where the browser is sent with a logout_challenge
+  PostLogoutUrl string // urls.post_logout_redirect, used when the logout request has none
+  DeviceUrl string // urls.device.verification, where the browser is sent with a device_challenge to enter the user code
+  DeviceDoneUrl string // urls.device.success, where the browser ends once the device is authorized or denied
+
+  Clients map[string]string // Client secret by client id, empty for public clients such as devices
+  ClientNames map[string]string // Shown to humans, ex. on the device and sessions pages. The client id when not set
+
+  AccessTokenTTL time.Duration
+  DeviceCodeTTL time.Duration // How long a device waits for its user code to be entered
+  UserCodeAlphabet string // No vowels by default, so user codes never spell words, as Hydra
+  UserCodeLength int
+
+  SessionCookieName string // Cookies are not separated by port, so instances on the same host need their own
+
+  Claims func(subject string) map[string]interface{} // Extra id token claims, ex. email, when used as an upstream provider
+
+  mu sync.Mutex
+  key *rsa.PrivateKey
+  keyId string
+  loginRequests map[string]*loginRequest
+  logoutRequests map[string]*logoutRequest
+  deviceRequests map[string]*deviceRequest // By device code
+  deviceChallenges map[string]*deviceChallenge
+  codes map[string]*grant
+  tokens map[string]*grant
+  sessions map[string]*session
+  consents []*consent
+}
+
+type session struct {
+  Id string
+  Subject string
+  AuthTime int64
+}
+
+// consent is a consent session, one for every authorization granted to a client.
+type consent struct {
+  Subject string
+  ClientId string
+  Scopes []string
+  HandledAt time.Time
+}
+
+type loginRequest struct {
+  Challenge string
+  Verifier string
+  ClientId string
+  RedirectUri string
+  State string
+  Nonce string
+  Scopes []string
+  RequestUrl string
+  LoginHint string
+  AcrValues []string
+  CodeChallenge string
+  CodeChallengeMethod string
+  Skip bool
+  Subject string
+  SessionId string
+  Accepted bool
+  Remember bool
+  RememberFor int
+  Acr string
+  Amr []string
+  DeviceCode string // The login authorizes a device instead of issuing a code to RedirectUri
+}
+
+type deviceRequest struct {
+  DeviceCode string
+  UserCode string
+  ClientId string
+  Scopes []string
+  ExpiresAt int64
+  Confirmed bool // The user code was entered and accepted, the human logs in next
+  Denied bool // The login that followed was rejected
+  Grant *grant // Set once the human logged in, the device exchanges DeviceCode for it
+}
+
+// deviceChallenge is a browser entering a user code. Accepting it with the user code of a device request continues with the login.
+type deviceChallenge struct {
+  Challenge string
+  Verifier string
+  DeviceCode string
+}
+
+type logoutRequest struct {
+  Challenge string
+  Verifier string
+  Subject string
+  SessionId string
+  RequestUrl string
+  PostLogoutRedirectUri string
+  State string
+  RpInitiated bool
+  Accepted bool
+}
+
+type grant struct {
+  ClientId string
+  Subject string
+  RedirectUri string
+  Nonce string
+  SessionId string
+  Scopes []string
+  AuthTime int64
+  Acr string
+  Amr []string
+  CodeChallenge string
+  CodeChallengeMethod string
+  ExpiresAt int64
+}
+
+// LogoutRequest is what Hydra tells the idp about a logout_challenge.
+type LogoutRequest struct {
+  Challenge string
+  Subject string
+  SessionId string
+  RequestUrl string
+  RpInitiated bool
+}
+
+// NewServer starts Hydra on a local port. Set LoginUrl, LogoutUrl, DeviceUrl, DeviceDoneUrl and Clients before sending a browser to it. Close it when done.
+func NewServer() *Hydra {
+  key, err := rsa.GenerateKey(rand.Reader, 2048)
+  if err != nil {
+    panic(err)
+  }
+
+  h := &Hydra{
+    Clients: make(map[string]string),
+    ClientNames: make(map[string]string),
+    AccessTokenTTL: time.Hour,
+    DeviceCodeTTL: 10 * time.Minute,
+    UserCodeAlphabet: "BCDFGHJKLMNPQRSTVWXZ",
+    UserCodeLength: 8,
+    SessionCookieName: "oauth2_authentication_session",
+    key: key,
+    keyId: randomString(8),
+    loginRequests: make(map[string]*loginRequest),
+    logoutRequests: make(map[string]*logoutRequest),
+    deviceRequests: make(map[string]*deviceRequest),
+    deviceChallenges: make(map[string]*deviceChallenge),
+    codes: make(map[string]*grant),
+    tokens: make(map[string]*grant),
+    sessions: make(map[string]*session),
+  }
+
+  mux := http.NewServeMux()
+  mux.HandleFunc("/.well-known/openid-configuration", h.discovery)
+  mux.HandleFunc("/.well-known/jwks.json", h.jwks)
+  mux.HandleFunc("/oauth2/auth", h.auth)
+  mux.HandleFunc("/oauth2/token", h.token)
+  mux.HandleFunc("/oauth2/revoke", h.revoke)
+  mux.HandleFunc("/oauth2/device/auth", h.deviceAuth)
+  mux.HandleFunc("/oauth2/device/verify", h.deviceVerify)
+  mux.HandleFunc("/oauth2/sessions/logout", h.logout)
+  mux.HandleFunc("/admin/oauth2/auth/sessions/login", h.revokeLoginSessions)
+  mux.HandleFunc("/admin/oauth2/auth/sessions/consent", h.consentSessions)
+  mux.HandleFunc("/admin/oauth2/auth/requests/login", h.loginRequest)
+  mux.HandleFunc("/admin/oauth2/auth/requests/login/accept", h.acceptLoginRequest)
+  mux.HandleFunc("/admin/oauth2/auth/requests/login/reject", h.rejectLoginRequest)
+  mux.HandleFunc("/admin/oauth2/auth/requests/device/accept", h.acceptDeviceRequest)
+
+  h.Server = httptest.NewServer(mux)
+  h.Issuer = h.Server.URL + "/"
+  h.PostLogoutUrl = h.Issuer
+  return h
+}
+
+// AcceptLogin accepts the login request for the subject and returns where the browser continues. Hydra then issues the authorization code to the client. The login is remembered, as the idp does, and the acr ends up in the id token.
+func (h *Hydra) AcceptLogin(challenge string, subject string, acr string) (redirectTo string) {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  return h.acceptLogin(challenge, subject, true, 0, acr, nil)
+}
+
+// acceptLogin must be called with the lock held. Accepting again replaces the previous accept.
+func (h *Hydra) acceptLogin(challenge string, subject string, remember bool, rememberFor int, acr string, amr []string) (redirectTo string) {
+  lr, exists := h.loginRequests[challenge]
+  if exists == false || (lr.Skip && lr.Subject != subject) {
+    return h.Issuer + "oauth2/auth?login_verifier="
+  }
+  lr.Subject = subject
+  lr.Accepted = true
+  lr.Remember = remember
+  lr.RememberFor = rememberFor
+  lr.Acr = acr
+  lr.Amr = amr
+  return h.Issuer + "oauth2/auth?login_verifier=" + lr.Verifier
+}
+
+// SkipLogin reports if the browser already has an authenticated session with Hydra, in which case the login must be accepted without asking for credentials.
+func (h *Hydra) SkipLogin(challenge string) (subject string, skip bool) {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  lr, exists := h.loginRequests[challenge]
+  if exists == false || lr.Skip == false {
+    return "", false
+  }
+  return lr.Subject, true
+}
+
+// EndSessionUrl is the url a relying party sends the browser to for logging out.
+func (h *Hydra) EndSessionUrl(idTokenHint string, state string, postLogoutRedirectUri string) string {
+  return withQuery(h.Issuer + "oauth2/sessions/logout", map[string]string{
+    "id_token_hint": idTokenHint,
+    "state": state,
+    "post_logout_redirect_uri": postLogoutRedirectUri,
+  })
+}
+
+func (h *Hydra) LogoutRequest(challenge string) (LogoutRequest, bool) {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  lr, exists := h.logoutRequests[challenge]
+  if exists == false {
+    return LogoutRequest{}, false
+  }
+  return LogoutRequest{
+    Challenge: lr.Challenge,
+    Subject: lr.Subject,
+    SessionId: lr.SessionId,
+    RequestUrl: lr.RequestUrl,
+    RpInitiated: lr.RpInitiated,
+  }, true
+}
+
+// AcceptLogout accepts the logout request and returns where the browser continues. Hydra then ends the session and redirects to the post logout url.
+func (h *Hydra) AcceptLogout(challenge string) (redirectTo string) {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  lr, exists := h.logoutRequests[challenge]
+  if exists == false {
+    return h.Issuer + "oauth2/sessions/logout?logout_verifier="
+  }
+  lr.Accepted = true
+  return h.Issuer + "oauth2/sessions/logout?logout_verifier=" + lr.Verifier
+}
+
+// session must be called with the lock held.
+func (h *Hydra) session(r *http.Request) *session {
+  cookie, err := r.Cookie(h.SessionCookieName)
+  if err != nil {
+    return nil
+  }
+  return h.sessions[cookie.Value]
+}
+
+func randomString(numberOfBytes int) string {
+  b := make([]byte, numberOfBytes)
+  _, err := rand.Read(b)
+  if err != nil {
+    panic(err)
+  }
+  return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (h *Hydra) publicKey() jose.JSONWebKey {
+  return jose.JSONWebKey{ Key:&h.key.PublicKey, KeyID:h.keyId, Algorithm:string(jose.RS256), Use:"sig" }
+}
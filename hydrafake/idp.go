@@ -0,0 +1,31 @@
+package hydrafake
+
+import (
+  idp "github.com/opensentry/idp/client"
+
+  "github.com/opensentry/idpui/idpfake"
+)
+
+// ConnectIdp makes the in-memory idp accept login and logout requests with this Hydra, as the idp does with the Hydra admin api.
+func (h *Hydra) ConnectIdp(f *idpfake.Idp) {
+  f.AcceptLogin = h.AcceptLogin
+  f.SkipLogin = h.SkipLogin
+  f.InitiateLogout = func(idToken string, state string, redirectTo string) string {
+    return h.EndSessionUrl(idToken, state, redirectTo)
+  }
+  f.ReadLogout = func(challenge string) (idp.HumanLogout, bool) {
+    lr, exists := h.LogoutRequest(challenge)
+    if exists == false {
+      return idp.HumanLogout{}, false
+    }
+    return idp.HumanLogout{
+      SessionId: lr.SessionId,
+      InitiatedByRelayingParty: lr.RpInitiated,
+      Id: lr.Subject,
+      RequestUrl: lr.RequestUrl,
+    }, true
+  }
+  f.AcceptLogout = func(challenge string, logout idp.HumanLogout) string {
+    return h.AcceptLogout(challenge)
+  }
+}
@@ -0,0 +1,460 @@
+package hydrafake
+
+import (
+  "time"
+  "strings"
+  "strconv"
+  "net/url"
+  "net/http"
+  "crypto/sha256"
+  "encoding/json"
+  "encoding/base64"
+  "gopkg.in/square/go-jose.v2"
+)
+
+func (h *Hydra) discovery(w http.ResponseWriter, r *http.Request) {
+  writeJson(w, http.StatusOK, map[string]interface{}{
+    "issuer": h.Issuer,
+    "authorization_endpoint": h.Issuer + "oauth2/auth",
+    "token_endpoint": h.Issuer + "oauth2/token",
+    "jwks_uri": h.Issuer + ".well-known/jwks.json",
+    "end_session_endpoint": h.Issuer + "oauth2/sessions/logout",
+    "revocation_endpoint": h.Issuer + "oauth2/revoke",
+    "device_authorization_endpoint": h.Issuer + "oauth2/device/auth",
+    "response_types_supported": []string{"code"},
+    "subject_types_supported": []string{"public"},
+    "id_token_signing_alg_values_supported": []string{"RS256"},
+    "grant_types_supported": []string{"authorization_code", "client_credentials", deviceCodeGrantType},
+    "token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+    "code_challenge_methods_supported": []string{"plain", "S256"},
+  })
+}
+
+func (h *Hydra) jwks(w http.ResponseWriter, r *http.Request) {
+  writeJson(w, http.StatusOK, jose.JSONWebKeySet{ Keys:[]jose.JSONWebKey{ h.publicKey() } })
+}
+
+// auth starts the authorization code flow by sending the browser to the login url with a login_challenge. When the login is accepted the browser returns with the login_verifier and is sent back to the client with a code.
+func (h *Hydra) auth(w http.ResponseWriter, r *http.Request) {
+  q := r.URL.Query()
+
+  if _, continues := q["login_verifier"]; continues {
+    h.authContinue(w, r, q.Get("login_verifier"))
+    return
+  }
+
+  clientId := q.Get("client_id")
+  if _, exists := h.Clients[clientId]; exists == false {
+    http.Error(w, "invalid_client", http.StatusBadRequest)
+    return
+  }
+  if q.Get("response_type") != "code" {
+    http.Error(w, "unsupported_response_type", http.StatusBadRequest)
+    return
+  }
+  redirectUri := q.Get("redirect_uri")
+  if redirectUri == "" {
+    http.Error(w, "invalid_request: missing redirect_uri", http.StatusBadRequest)
+    return
+  }
+
+  h.mu.Lock()
+  lr := &loginRequest{
+    Challenge: randomString(16),
+    Verifier: randomString(16),
+    ClientId: clientId,
+    RedirectUri: redirectUri,
+    State: q.Get("state"),
+    Nonce: q.Get("nonce"),
+    Scopes: strings.Fields(q.Get("scope")),
+    RequestUrl: h.Issuer + strings.TrimPrefix(r.URL.RequestURI(), "/"),
+    LoginHint: q.Get("login_hint"),
+    AcrValues: strings.Fields(q.Get("acr_values")),
+    CodeChallenge: q.Get("code_challenge"),
+    CodeChallengeMethod: q.Get("code_challenge_method"),
+  }
+  if s := h.session(r); s != nil && q.Get("prompt") != "login" && withinMaxAge(s, q.Get("max_age")) {
+    lr.Skip = true
+    lr.Subject = s.Subject
+    lr.SessionId = s.Id
+  }
+  h.loginRequests[lr.Challenge] = lr
+  h.mu.Unlock()
+
+  http.Redirect(w, r, withQuery(h.LoginUrl, map[string]string{ "login_challenge":lr.Challenge }), http.StatusFound)
+}
+
+// pkceVerified reports whether the code verifier matches the code challenge of the authorization request, RFC 7636. Codes issued without a challenge need no verifier.
+func pkceVerified(g *grant, verifier string) bool {
+  switch g.CodeChallengeMethod {
+  case "", "plain": // Without a challenge the verifier must be empty too
+    return verifier == g.CodeChallenge
+  case "S256":
+    sum := sha256.Sum256([]byte(verifier))
+    return base64.RawURLEncoding.EncodeToString(sum[:]) == g.CodeChallenge
+  }
+  return false
+}
+
+// withinMaxAge reports whether the session authenticated recently enough for the max_age of the authorization request.
+func withinMaxAge(s *session, maxAge string) bool {
+  if maxAge == "" {
+    return true
+  }
+  seconds, err := strconv.Atoi(maxAge)
+  if err != nil {
+    return true
+  }
+  return time.Now().Unix() - s.AuthTime < int64(seconds)
+}
+
+func (h *Hydra) authContinue(w http.ResponseWriter, r *http.Request, verifier string) {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  var lr *loginRequest
+  for _, l := range h.loginRequests {
+    if l.Verifier == verifier {
+      lr = l
+      break
+    }
+  }
+  if lr == nil || lr.Accepted == false {
+    http.Error(w, "invalid_request: login verifier not found or login not accepted", http.StatusBadRequest)
+    return
+  }
+  delete(h.loginRequests, lr.Challenge)
+
+  // A skipped login continues the session, otherwise the human authenticated again. Only remembered sessions are kept in the browser.
+  s := h.session(r)
+  if lr.Skip == false || s == nil || s.Subject != lr.Subject {
+    s = &session{ Id:randomString(16), Subject:lr.Subject, AuthTime:time.Now().Unix() }
+    h.sessions[s.Id] = s
+
+    cookie := &http.Cookie{ Name:h.SessionCookieName, Value:s.Id, Path:"/", HttpOnly:true, MaxAge:lr.RememberFor }
+    if lr.Remember == false {
+      cookie.Value = ""
+      cookie.MaxAge = -1
+    }
+    http.SetCookie(w, cookie)
+  }
+
+  // Consent is always granted.
+  h.consents = append(h.consents, &consent{ Subject:lr.Subject, ClientId:lr.ClientId, Scopes:lr.Scopes, HandledAt:time.Now().UTC() })
+
+  // The device polling for tokens gets them now.
+  if lr.DeviceCode != "" {
+    if dr, exists := h.deviceRequests[lr.DeviceCode]; exists {
+      dr.Grant = &grant{
+        ClientId: lr.ClientId,
+        Subject: lr.Subject,
+        SessionId: s.Id,
+        Scopes: lr.Scopes,
+        AuthTime: s.AuthTime,
+        Acr: lr.Acr,
+        Amr: lr.Amr,
+      }
+    }
+    http.Redirect(w, r, h.DeviceDoneUrl, http.StatusFound)
+    return
+  }
+
+  code := randomString(24)
+  h.codes[code] = &grant{
+    ClientId: lr.ClientId,
+    Subject: lr.Subject,
+    RedirectUri: lr.RedirectUri,
+    Nonce: lr.Nonce,
+    SessionId: s.Id,
+    Scopes: lr.Scopes,
+    AuthTime: s.AuthTime,
+    Acr: lr.Acr,
+    Amr: lr.Amr,
+    CodeChallenge: lr.CodeChallenge,
+    CodeChallengeMethod: lr.CodeChallengeMethod,
+  }
+
+  http.Redirect(w, r, withQuery(lr.RedirectUri, map[string]string{
+    "code": code,
+    "scope": strings.Join(lr.Scopes, " "),
+    "state": lr.State,
+  }), http.StatusFound)
+}
+
+func (h *Hydra) token(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+
+  err := r.ParseForm()
+  if err != nil {
+    writeOauth2Error(w, http.StatusBadRequest, "invalid_request")
+    return
+  }
+
+  clientId, clientSecret := clientCredentials(r)
+
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  if secret, exists := h.Clients[clientId]; exists == false || secret != clientSecret {
+    writeOauth2Error(w, http.StatusUnauthorized, "invalid_client")
+    return
+  }
+
+  var g *grant
+  switch r.PostForm.Get("grant_type") {
+  case "authorization_code":
+    code := r.PostForm.Get("code")
+    g = h.codes[code]
+    delete(h.codes, code) // Codes can only be used once
+    if g == nil || g.ClientId != clientId || g.RedirectUri != r.PostForm.Get("redirect_uri") || pkceVerified(g, r.PostForm.Get("code_verifier")) == false {
+      writeOauth2Error(w, http.StatusBadRequest, "invalid_grant")
+      return
+    }
+  case "client_credentials":
+    g = &grant{ ClientId:clientId, Subject:clientId, Scopes:strings.Fields(r.PostForm.Get("scope")) }
+  case deviceCodeGrantType:
+    var e string
+    g, e = h.deviceGrant(clientId, r.PostForm.Get("device_code"))
+    if g == nil {
+      writeOauth2Error(w, http.StatusBadRequest, e)
+      return
+    }
+  default:
+    writeOauth2Error(w, http.StatusBadRequest, "unsupported_grant_type")
+    return
+  }
+
+  now := time.Now()
+  g.ExpiresAt = now.Add(h.AccessTokenTTL).Unix()
+
+  accessToken := randomString(32)
+  h.tokens[accessToken] = g
+
+  response := map[string]interface{}{
+    "access_token": accessToken,
+    "token_type": "bearer",
+    "expires_in": int64(h.AccessTokenTTL.Seconds()),
+    "scope": strings.Join(g.Scopes, " "),
+  }
+
+  if hasScope(g.Scopes, "openid") {
+    claims := map[string]interface{}{
+      "iss": h.Issuer,
+      "sub": g.Subject,
+      "aud": []string{ g.ClientId },
+      "iat": now.Unix(),
+      "exp": g.ExpiresAt,
+      "auth_time": g.AuthTime,
+      "nonce": g.Nonce,
+      "sid": g.SessionId,
+    }
+    if g.Acr != "" {
+      claims["acr"] = g.Acr
+    }
+    if len(g.Amr) > 0 {
+      claims["amr"] = g.Amr
+    }
+    if h.Claims != nil {
+      for k, v := range h.Claims(g.Subject) {
+        claims[k] = v
+      }
+    }
+
+    idToken, err := h.sign(claims)
+    if err != nil {
+      writeOauth2Error(w, http.StatusInternalServerError, "server_error")
+      return
+    }
+    response["id_token"] = idToken
+  }
+
+  writeJson(w, http.StatusOK, response)
+}
+
+// revoke revokes an access token of the authenticated client, RFC 7009. Unknown tokens and tokens of other clients are ignored, as the client must not learn about them.
+func (h *Hydra) revoke(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+
+  err := r.ParseForm()
+  if err != nil || r.PostForm.Get("token") == "" {
+    writeOauth2Error(w, http.StatusBadRequest, "invalid_request")
+    return
+  }
+
+  clientId, clientSecret := clientCredentials(r)
+
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  if secret, exists := h.Clients[clientId]; exists == false || secret != clientSecret {
+    writeOauth2Error(w, http.StatusUnauthorized, "invalid_client")
+    return
+  }
+
+  token := r.PostForm.Get("token")
+  if g, exists := h.tokens[token]; exists && g.ClientId == clientId {
+    delete(h.tokens, token)
+  }
+  w.WriteHeader(http.StatusOK)
+}
+
+// logout starts a logout by sending the browser to the logout url with a logout_challenge. When the logout is accepted the browser returns with the logout_verifier, the session is ended and the browser is sent to the post logout redirect.
+func (h *Hydra) logout(w http.ResponseWriter, r *http.Request) {
+  q := r.URL.Query()
+
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  if _, continues := q["logout_verifier"]; continues {
+    verifier := q.Get("logout_verifier")
+    var lr *logoutRequest
+    for _, l := range h.logoutRequests {
+      if l.Verifier == verifier {
+        lr = l
+        break
+      }
+    }
+    if lr == nil || lr.Accepted == false {
+      http.Error(w, "invalid_request: logout verifier not found or logout not accepted", http.StatusBadRequest)
+      return
+    }
+    delete(h.logoutRequests, lr.Challenge)
+    delete(h.sessions, lr.SessionId)
+    http.SetCookie(w, &http.Cookie{ Name:h.SessionCookieName, Value:"", Path:"/", MaxAge:-1 })
+
+    redirectTo := lr.PostLogoutRedirectUri
+    if redirectTo == "" {
+      redirectTo = h.PostLogoutUrl
+    }
+    if lr.State != "" {
+      redirectTo = withQuery(redirectTo, map[string]string{ "state":lr.State })
+    }
+    http.Redirect(w, r, redirectTo, http.StatusFound)
+    return
+  }
+
+  lr := &logoutRequest{
+    Challenge: randomString(16),
+    Verifier: randomString(16),
+    RequestUrl: h.Issuer + strings.TrimPrefix(r.URL.RequestURI(), "/"),
+    PostLogoutRedirectUri: q.Get("post_logout_redirect_uri"),
+    State: q.Get("state"),
+  }
+
+  if idTokenHint := q.Get("id_token_hint"); idTokenHint != "" {
+    subject, sessionId, err := h.verify(idTokenHint)
+    if err != nil {
+      http.Error(w, "invalid_request: " + err.Error(), http.StatusBadRequest)
+      return
+    }
+    lr.Subject = subject
+    lr.SessionId = sessionId
+    lr.RpInitiated = true
+  }
+
+  if s := h.session(r); s != nil && (lr.Subject == "" || lr.Subject == s.Subject) {
+    lr.Subject = s.Subject
+    lr.SessionId = s.Id
+  }
+
+  if lr.Subject == "" {
+    // Nothing to log out of.
+    redirectTo := lr.PostLogoutRedirectUri
+    if redirectTo == "" {
+      redirectTo = h.PostLogoutUrl
+    }
+    http.Redirect(w, r, redirectTo, http.StatusFound)
+    return
+  }
+
+  h.logoutRequests[lr.Challenge] = lr
+  http.Redirect(w, r, withQuery(h.LogoutUrl, map[string]string{ "logout_challenge":lr.Challenge }), http.StatusFound)
+}
+
+func (h *Hydra) sign(claims map[string]interface{}) (string, error) {
+  signer, err := jose.NewSigner(jose.SigningKey{ Algorithm:jose.RS256, Key:jose.JSONWebKey{ Key:h.key, KeyID:h.keyId } }, (&jose.SignerOptions{}).WithType("JWT"))
+  if err != nil {
+    return "", err
+  }
+  payload, err := json.Marshal(claims)
+  if err != nil {
+    return "", err
+  }
+  jws, err := signer.Sign(payload)
+  if err != nil {
+    return "", err
+  }
+  return jws.CompactSerialize()
+}
+
+// verify checks an id token issued by us, expired tokens are accepted as hints.
+func (h *Hydra) verify(idToken string) (subject string, sessionId string, err error) {
+  jws, err := jose.ParseSigned(idToken)
+  if err != nil {
+    return "", "", err
+  }
+  payload, err := jws.Verify(&h.key.PublicKey)
+  if err != nil {
+    return "", "", err
+  }
+  var claims struct {
+    Subject string `json:"sub"`
+    SessionId string `json:"sid"`
+  }
+  err = json.Unmarshal(payload, &claims)
+  if err != nil {
+    return "", "", err
+  }
+  return claims.Subject, claims.SessionId, nil
+}
+
+// clientCredentials reads the client authentication of the request, with basic auth or in the form. The form must be parsed.
+func clientCredentials(r *http.Request) (clientId string, clientSecret string) {
+  clientId, clientSecret, ok := r.BasicAuth()
+  if ok {
+    clientId, _ = url.QueryUnescape(clientId)
+    clientSecret, _ = url.QueryUnescape(clientSecret)
+    return clientId, clientSecret
+  }
+  return r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+}
+
+func hasScope(scopes []string, scope string) bool {
+  for _, s := range scopes {
+    if s == scope {
+      return true
+    }
+  }
+  return false
+}
+
+func withQuery(u string, params map[string]string) string {
+  parsed, err := url.Parse(u)
+  if err != nil {
+    return u
+  }
+  q := parsed.Query()
+  for k, v := range params {
+    if v != "" {
+      q.Set(k, v)
+    }
+  }
+  parsed.RawQuery = q.Encode()
+  return parsed.String()
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(status)
+  json.NewEncoder(w).Encode(v)
+}
+
+func writeOauth2Error(w http.ResponseWriter, status int, e string) {
+  writeJson(w, status, map[string]string{ "error":e })
+}
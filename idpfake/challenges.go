@@ -0,0 +1,124 @@
+package idpfake
+
+import (
+  "time"
+  "net/http"
+  "github.com/pquerna/otp/totp"
+
+  idp "github.com/opensentry/idp/client"
+
+  bulky "github.com/charmixer/bulky/client"
+)
+
+// createChallenge must be called with the lock held. OTP challenges get a generated code, TOTP challenges are verified against the secret of the subject.
+func (f *Idp) createChallenge(confirmationType idp.ConfirmationType, subject string, redirectTo string, codeType idp.OTPType, data string) idp.Challenge {
+  now := time.Now().Unix()
+
+  challenge := idp.Challenge{
+    OtpChallenge: newId(),
+    ConfirmationType: int(confirmationType),
+    Subject: subject,
+    Audience: "idp",
+    IssuedAt: now,
+    ExpiresAt: now + f.ChallengeTTL,
+    TTL: f.ChallengeTTL,
+    RedirectTo: redirectTo,
+    CodeType: int64(codeType),
+    Data: data,
+  }
+  if codeType == idp.OTP {
+    challenge.Code = newCode()
+  }
+
+  f.Challenges[challenge.OtpChallenge] = challenge
+  return challenge
+}
+
+// verifiedChallenge must be called with the lock held. Returns the challenge if it exists, is verified and of the expected type.
+func (f *Idp) verifiedChallenge(id string, confirmationType idp.ConfirmationType) (idp.Challenge, bool) {
+  challenge, exists := f.Challenges[id]
+  if exists == false || challenge.VerifiedAt == 0 || challenge.ConfirmationType != int(confirmationType) {
+    return idp.Challenge{}, false
+  }
+  return challenge, true
+}
+
+// CreateChallenges creates challenges with the code of the request. Challenges with an email are mailed as a link to their redirect_to with the email_challenge and code, see Mailed.
+func (f *Idp) CreateChallenges(client *idp.IdpClient, url string, requests []idp.CreateChallengesRequest) (int, bulky.Responses, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  var responses bulky.Responses
+  for i, r := range requests {
+    if _, exists := f.Humans[r.Subject]; exists == false || r.Code == "" || r.TTL <= 0 {
+      responses = append(responses, errorResponse(i, http.StatusBadRequest, "Invalid challenge"))
+      continue
+    }
+
+    challenge := f.createChallenge(idp.ConfirmationType(r.ConfirmationType), r.Subject, r.RedirectTo, idp.OTPType(r.CodeType), r.Email)
+    challenge.Code = r.Code
+    challenge.TTL = r.TTL
+    challenge.ExpiresAt = challenge.IssuedAt + r.TTL
+    f.Challenges[challenge.OtpChallenge] = challenge
+
+    if r.Email != "" {
+      f.Mailed[r.Email] = withQuery(withQuery(r.RedirectTo, "email_challenge", challenge.OtpChallenge), "code", r.Code)
+    }
+
+    challenge.Code = "" // Only mailed
+    responses = append(responses, response(i, http.StatusOK, idp.CreateChallengesResponse(challenge)))
+  }
+  return http.StatusOK, responses, nil
+}
+
+func (f *Idp) ReadChallenges(client *idp.IdpClient, url string, requests []idp.ReadChallengesRequest) (int, bulky.Responses, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  var responses bulky.Responses
+  for i, r := range requests {
+    challenge, exists := f.Challenges[r.OtpChallenge]
+    if exists == false {
+      responses = append(responses, errorResponse(i, http.StatusNotFound, "Not found"))
+      continue
+    }
+    challenge.Code = "" // Never handed out by the idp
+    responses = append(responses, response(i, http.StatusOK, idp.ReadChallengesResponse{ challenge }))
+  }
+  return http.StatusOK, responses, nil
+}
+
+func (f *Idp) VerifyChallenges(client *idp.IdpClient, url string, requests []idp.UpdateChallengesVerifyRequest) (int, bulky.Responses, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  var responses bulky.Responses
+  for i, r := range requests {
+    challenge, exists := f.Challenges[r.OtpChallenge]
+    if exists == false {
+      responses = append(responses, errorResponse(i, http.StatusNotFound, "Not found"))
+      continue
+    }
+
+    verified := false
+    if time.Now().Unix() <= challenge.ExpiresAt {
+      if challenge.CodeType == int64(idp.TOTP) {
+        verified = totp.Validate(r.Code, f.Humans[challenge.Subject].TotpSecret)
+      } else {
+        verified = challenge.Code != "" && r.Code == challenge.Code
+      }
+    }
+
+    if verified {
+      challenge.VerifiedAt = time.Now().Unix()
+      f.Challenges[challenge.OtpChallenge] = challenge
+    }
+
+    responses = append(responses, response(i, http.StatusOK, idp.UpdateChallengesVerifyResponse{
+      OtpChallenge: challenge.OtpChallenge,
+      Verified: verified,
+      RedirectTo: challenge.RedirectTo,
+    }))
+  }
+  return http.StatusOK, responses, nil
+}
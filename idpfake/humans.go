@@ -0,0 +1,376 @@
+package idpfake
+
+import (
+  "net/http"
+
+  idp "github.com/opensentry/idp/client"
+
+  bulky "github.com/charmixer/bulky/client"
+)
+
+// The hooks AcceptLogin, SkipLogin, InitiateLogout, ReadLogout and AcceptLogout are called with the lock held, they must not call back into the fake.
+
+// withoutSecrets strips what the idp never hands out.
+func withoutSecrets(human idp.Human) idp.Human {
+  human.Password = ""
+  human.TotpSecret = ""
+  return human
+}
+
+func (f *Idp) CreateHumans(client *idp.IdpClient, url string, requests []idp.CreateHumansRequest) (int, bulky.Responses, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  var responses bulky.Responses
+  for i, r := range requests {
+    if _, exists := f.Humans[r.Id]; exists || r.Id == "" {
+      responses = append(responses, errorResponse(i, http.StatusConflict, "Human exists"))
+      continue
+    }
+
+    human := idp.Human{
+      Id: r.Id,
+      Username: r.Username,
+      Password: r.Password,
+      Name: r.Name,
+      Email: r.Email,
+      EmailConfirmedAt: r.EmailConfirmedAt,
+      AllowLogin: true, // Only disallowed by administration
+    }
+
+    // Humans are registered from a claimed invite with the same id, the email is the one that was confirmed.
+    if invite, exists := f.Invites[r.Id]; exists {
+      if human.Email == "" {
+        human.Email = invite.Email
+      }
+      if human.Username == "" {
+        human.Username = invite.Username
+      }
+    }
+
+    f.Humans[human.Id] = human
+    responses = append(responses, response(i, http.StatusOK, idp.CreateHumansResponse(withoutSecrets(human))))
+  }
+  return http.StatusOK, responses, nil
+}
+
+// ReadHumans matches on every field set in the request. An empty request returns all humans.
+func (f *Idp) ReadHumans(client *idp.IdpClient, url string, requests []idp.ReadHumansRequest) (int, bulky.Responses, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  var responses bulky.Responses
+  for i, r := range requests {
+    var found idp.ReadHumansResponse
+    for _, human := range f.Humans {
+      if (r.Id == "" || human.Id == r.Id) && (r.Email == "" || human.Email == r.Email) && (r.Username == "" || human.Username == r.Username) {
+        found = append(found, withoutSecrets(human))
+      }
+    }
+    if len(found) == 0 {
+      responses = append(responses, errorResponse(i, http.StatusNotFound, "Not found"))
+      continue
+    }
+    responses = append(responses, response(i, http.StatusOK, found))
+  }
+  return http.StatusOK, responses, nil
+}
+
+// DeleteHumans only starts the deletion, the human is deleted when the challenge is confirmed, see DeleteHumansVerify.
+func (f *Idp) DeleteHumans(client *idp.IdpClient, url string, requests []idp.DeleteHumansRequest) (int, bulky.Responses, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  var responses bulky.Responses
+  for i, r := range requests {
+    if _, exists := f.Humans[r.Id]; exists == false {
+      responses = append(responses, errorResponse(i, http.StatusNotFound, "Not found"))
+      continue
+    }
+
+    challenge := f.createChallenge(idp.ConfirmIdentityDeletion, r.Id, r.RedirectTo, idp.OTP, "")
+    responses = append(responses, response(i, http.StatusOK, idp.DeleteHumansResponse{
+      Id: r.Id,
+      RedirectTo: withQuery(f.DeleteConfirmUrl, "delete_challenge", challenge.OtpChallenge),
+    }))
+  }
+  return http.StatusOK, responses, nil
+}
+
+func (f *Idp) DeleteHumansVerify(client *idp.IdpClient, url string, requests []idp.UpdateHumansDeleteVerifyRequest) (int, bulky.Responses, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  var responses bulky.Responses
+  for i, r := range requests {
+    challenge, verified := f.verifiedChallenge(r.DeleteChallenge, idp.ConfirmIdentityDeletion)
+    if verified == false {
+      responses = append(responses, errorResponse(i, http.StatusBadRequest, "Challenge not verified"))
+      continue
+    }
+
+    delete(f.Humans, challenge.Subject)
+    responses = append(responses, response(i, http.StatusOK, idp.UpdateHumansDeleteVerifyResponse{
+      Id: challenge.Subject,
+      RedirectTo: challenge.RedirectTo,
+      Verified: true,
+    }))
+  }
+  return http.StatusOK, responses, nil
+}
+
+func (f *Idp) UpdateHumansPassword(client *idp.IdpClient, url string, requests []idp.UpdateHumansPasswordRequest) (int, bulky.Responses, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  var responses bulky.Responses
+  for i, r := range requests {
+    human, exists := f.Humans[r.Id]
+    if exists == false {
+      responses = append(responses, errorResponse(i, http.StatusNotFound, "Not found"))
+      continue
+    }
+
+    human.Password = r.Password
+    f.Humans[human.Id] = human
+    responses = append(responses, response(i, http.StatusOK, idp.UpdateHumansPasswordResponse(withoutSecrets(human))))
+  }
+  return http.StatusOK, responses, nil
+}
+
+func (f *Idp) UpdateHumansTotp(client *idp.IdpClient, url string, requests []idp.UpdateHumansTotpRequest) (int, bulky.Responses, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  var responses bulky.Responses
+  for i, r := range requests {
+    human, exists := f.Humans[r.Id]
+    if exists == false {
+      responses = append(responses, errorResponse(i, http.StatusNotFound, "Not found"))
+      continue
+    }
+
+    human.TotpRequired = r.TotpRequired
+    human.TotpSecret = r.TotpSecret
+    f.Humans[human.Id] = human
+    responses = append(responses, response(i, http.StatusOK, idp.UpdateHumansTotpResponse(withoutSecrets(human))))
+  }
+  return http.StatusOK, responses, nil
+}
+
+// CreateHumansAuthenticate authenticates a login challenge by password, by a verified otp challenge (TOTP) or a verified email challenge, or by Hydra skipping the login.
+// A correct password for a human that requires TOTP or has not confirmed the email is authenticated with a redirect to the page confirming it, which returns to the login with the challenge.
+func (f *Idp) CreateHumansAuthenticate(client *idp.IdpClient, url string, requests []idp.CreateHumansAuthenticateRequest) (int, bulky.Responses, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  var responses bulky.Responses
+  for i, r := range requests {
+    var auth idp.CreateHumansAuthenticateResponse
+    loginUrl := withQuery(f.LoginUrl, "login_challenge", r.Challenge)
+
+    if r.OtpChallenge != "" {
+
+      if challenge, verified := f.verifiedChallenge(r.OtpChallenge, idp.ConfirmIdentity); verified {
+        auth = f.authenticated(r.Challenge, challenge.Subject, "otp")
+      }
+
+    } else if r.EmailChallenge != "" {
+
+      if challenge, verified := f.verifiedChallenge(r.EmailChallenge, idp.ConfirmIdentityControlOfEmail); verified {
+        if human, exists := f.Humans[challenge.Subject]; exists {
+          human.EmailConfirmedAt = challenge.VerifiedAt
+          f.Humans[human.Id] = human
+          auth = f.authenticated(r.Challenge, human.Id, "otp.email")
+        }
+      }
+
+    } else if r.Id == "" {
+
+      if subject, skip := f.SkipLogin(r.Challenge); skip {
+        auth = f.authenticated(r.Challenge, subject, "skip")
+      }
+
+    } else {
+
+      human, exists := f.Humans[r.Id]
+      auth.Id = r.Id
+      auth.IdentityExists = exists
+
+      if exists && human.Password != r.Password {
+        auth.IsPasswordInvalid = true
+      } else if exists && human.AllowLogin {
+
+        if human.EmailConfirmedAt == 0 {
+          challenge := f.createChallenge(idp.ConfirmIdentityControlOfEmail, human.Id, loginUrl, idp.OTP, human.Email)
+          auth.Authenticated = true
+          auth.RedirectTo = withQuery(f.EmailConfirmUrl, "email_challenge", challenge.OtpChallenge)
+        } else if human.TotpRequired {
+          challenge := f.createChallenge(idp.ConfirmIdentity, human.Id, loginUrl, idp.TOTP, "")
+          auth.Authenticated = true
+          auth.TotpRequired = true
+          auth.RedirectTo = withQuery(f.VerifyUrl, "otp_challenge", challenge.OtpChallenge)
+        } else {
+          auth = f.authenticated(r.Challenge, human.Id, "")
+        }
+
+      }
+
+    }
+
+    responses = append(responses, response(i, http.StatusOK, auth))
+  }
+  return http.StatusOK, responses, nil
+}
+
+func (f *Idp) authenticated(challenge string, subject string, acr string) idp.CreateHumansAuthenticateResponse {
+  return idp.CreateHumansAuthenticateResponse{
+    Id: subject,
+    Authenticated: true,
+    IdentityExists: true,
+    RedirectTo: f.AcceptLogin(challenge, subject, acr),
+  }
+}
+
+// RecoverHumans sends a code to the email of the human, see RecoverHumansVerify.
+func (f *Idp) RecoverHumans(client *idp.IdpClient, url string, requests []idp.CreateHumansRecoverRequest) (int, bulky.Responses, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  var responses bulky.Responses
+  for i, r := range requests {
+    if _, exists := f.Humans[r.Id]; exists == false {
+      responses = append(responses, errorResponse(i, http.StatusNotFound, "Not found"))
+      continue
+    }
+
+    challenge := f.createChallenge(idp.ConfirmIdentityRecovery, r.Id, r.RedirectTo, idp.OTP, "")
+    responses = append(responses, response(i, http.StatusOK, idp.CreateHumansRecoverResponse{
+      Id: r.Id,
+      RedirectTo: withQuery(f.RecoverConfirmUrl, "recover_challenge", challenge.OtpChallenge),
+    }))
+  }
+  return http.StatusOK, responses, nil
+}
+
+func (f *Idp) RecoverHumansVerify(client *idp.IdpClient, url string, requests []idp.UpdateHumansRecoverVerifyRequest) (int, bulky.Responses, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  var responses bulky.Responses
+  for i, r := range requests {
+    challenge, verified := f.verifiedChallenge(r.RecoverChallenge, idp.ConfirmIdentityRecovery)
+    if verified == false {
+      responses = append(responses, errorResponse(i, http.StatusBadRequest, "Challenge not verified"))
+      continue
+    }
+
+    human := f.Humans[challenge.Subject]
+    human.Password = r.NewPassword
+    f.Humans[human.Id] = human
+
+    delete(f.Challenges, challenge.OtpChallenge) // A recover challenge can only be used once
+    responses = append(responses, response(i, http.StatusOK, idp.UpdateHumansRecoverVerifyResponse{
+      Id: human.Id,
+      RedirectTo: challenge.RedirectTo,
+      Verified: true,
+    }))
+  }
+  return http.StatusOK, responses, nil
+}
+
+// CreateHumansEmailChange sends a code to the new email, the email is changed when it is confirmed, see UpdateHumansEmailConfirm.
+func (f *Idp) CreateHumansEmailChange(client *idp.IdpClient, url string, requests []idp.CreateHumansEmailChangeRequest) (int, bulky.Responses, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  var responses bulky.Responses
+  for i, r := range requests {
+    if _, exists := f.Humans[r.Id]; exists == false {
+      responses = append(responses, errorResponse(i, http.StatusNotFound, "Not found"))
+      continue
+    }
+
+    challenge := f.createChallenge(idp.ConfirmIdentityControlOfEmailDuringChange, r.Id, r.RedirectTo, idp.OTP, r.Email)
+    responses = append(responses, response(i, http.StatusOK, idp.CreateHumansEmailChangeResponse{
+      Id: r.Id,
+      RedirectTo: withQuery(f.EmailChangeConfirmUrl, "email_challenge", challenge.OtpChallenge),
+    }))
+  }
+  return http.StatusOK, responses, nil
+}
+
+func (f *Idp) UpdateHumansEmailConfirm(client *idp.IdpClient, url string, requests []idp.UpdateHumansEmailConfirmRequest) (int, bulky.Responses, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  var responses bulky.Responses
+  for i, r := range requests {
+    challenge, verified := f.verifiedChallenge(r.EmailChallenge, idp.ConfirmIdentityControlOfEmailDuringChange)
+    if verified == false || challenge.Data != r.Email {
+      responses = append(responses, errorResponse(i, http.StatusBadRequest, "Challenge not verified"))
+      continue
+    }
+
+    human := f.Humans[challenge.Subject]
+    human.Email = r.Email
+    human.EmailConfirmedAt = challenge.VerifiedAt
+    f.Humans[human.Id] = human
+
+    responses = append(responses, response(i, http.StatusOK, idp.UpdateHumansEmailConfirmResponse{
+      Id: human.Id,
+      RedirectTo: challenge.RedirectTo,
+      Verified: true,
+    }))
+  }
+  return http.StatusOK, responses, nil
+}
+
+func (f *Idp) CreateHumansLogout(client *idp.IdpClient, url string, requests []idp.CreateHumansLogoutRequest) (int, bulky.Responses, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  var responses bulky.Responses
+  for i, r := range requests {
+    responses = append(responses, response(i, http.StatusOK, idp.CreateHumansLogoutResponse{
+      RedirectTo: f.InitiateLogout(r.IdToken, r.State, r.RedirectTo),
+    }))
+  }
+  return http.StatusOK, responses, nil
+}
+
+func (f *Idp) ReadHumansLogout(client *idp.IdpClient, url string, requests []idp.ReadHumansLogoutRequest) (int, bulky.Responses, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  var responses bulky.Responses
+  for i, r := range requests {
+    logout, exists := f.ReadLogout(r.Challenge)
+    if exists == false {
+      responses = append(responses, errorResponse(i, http.StatusNotFound, "Not found"))
+      continue
+    }
+    responses = append(responses, response(i, http.StatusOK, idp.ReadHumansLogoutResponse(logout)))
+  }
+  return http.StatusOK, responses, nil
+}
+
+func (f *Idp) UpdateHumansLogoutAccept(client *idp.IdpClient, url string, requests []idp.UpdateHumansLogoutAcceptRequest) (int, bulky.Responses, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  var responses bulky.Responses
+  for i, r := range requests {
+    logout, exists := f.ReadLogout(r.Challenge)
+    if exists == false {
+      responses = append(responses, errorResponse(i, http.StatusNotFound, "Not found"))
+      continue
+    }
+
+    responses = append(responses, response(i, http.StatusOK, idp.UpdateHumansLogoutAcceptResponse{
+      Id: logout.Id,
+      RedirectTo: f.AcceptLogout(r.Challenge, logout),
+    }))
+  }
+  return http.StatusOK, responses, nil
+}
@@ -0,0 +1,163 @@
+package idpfake
+
+import (
+  "sync"
+  "fmt"
+  "math/big"
+  "net/url"
+  "crypto/rand"
+  "encoding/json"
+  "github.com/gofrs/uuid"
+
+  idp "github.com/opensentry/idp/client"
+
+  "github.com/opensentry/idpui/app"
+
+  bulky "github.com/charmixer/bulky/client"
+)
+
+// # In-memory idp
+// Idp implements app.IdpApi without a running idp, so handlers can be tested under go test. It models humans, challenges and the links mailed for them, invites, logout, recover, delete and email change the way the idp does, including the redirects the idp answers with.
+// The parts the real idp delegates to Hydra (login and logout requests) are hooks, so a test can plug in its own Hydra or keep the defaults.
+// The client and url arguments are ignored, use any client.
+
+var _ app.IdpApi = (*Idp)(nil)
+
+type Idp struct {
+  mu sync.Mutex
+
+  Humans map[string]idp.Human
+  Challenges map[string]idp.Challenge
+  Invites map[string]idp.Invite
+  Mailed map[string]string // The last link mailed for a challenge created with an email, by email
+
+  // Pages of the ui the idp sends the browser to. Set by New.
+  LoginUrl string
+  VerifyUrl string
+  EmailConfirmUrl string
+  RecoverConfirmUrl string
+  DeleteConfirmUrl string
+  EmailChangeConfirmUrl string
+
+  ChallengeTTL int64 // seconds
+
+  // AcceptLogin is called when a login challenge is authenticated and returns where the browser continues, normally Hydra. The acr is how, as the idp tells Hydra: empty for password, otp, otp.email or skip. Defaults to the ui root.
+  AcceptLogin func(challenge string, subject string, acr string) (redirectTo string)
+
+  // SkipLogin reports if Hydra would skip the login for the challenge. Defaults to never.
+  SkipLogin func(challenge string) (subject string, skip bool)
+
+  // InitiateLogout returns the url of the Hydra logout flow. Defaults to redirecting straight to redirectTo with the state.
+  InitiateLogout func(idToken string, state string, redirectTo string) (logoutUrl string)
+
+  // ReadLogout returns the logout request for the logout_challenge. Defaults to none.
+  ReadLogout func(challenge string) (logout idp.HumanLogout, exists bool)
+
+  // AcceptLogout returns where the browser continues after an accepted logout. Defaults to the request url of the logout.
+  AcceptLogout func(challenge string, logout idp.HumanLogout) (redirectTo string)
+}
+
+// New creates an empty idp sending the browser to the ui at idpui, ex. https://id.localhost
+func New(idpui string) *Idp {
+  f := &Idp{
+    Humans: make(map[string]idp.Human),
+    Challenges: make(map[string]idp.Challenge),
+    Invites: make(map[string]idp.Invite),
+    Mailed: make(map[string]string),
+
+    LoginUrl: idpui + "/login",
+    VerifyUrl: idpui + "/verify",
+    EmailConfirmUrl: idpui + "/emailconfirm",
+    RecoverConfirmUrl: idpui + "/recoverconfirm",
+    DeleteConfirmUrl: idpui + "/deleteconfirm",
+    EmailChangeConfirmUrl: idpui + "/emailchangeconfirm",
+
+    ChallengeTTL: 600,
+  }
+
+  f.AcceptLogin = func(challenge string, subject string, acr string) string {
+    return idpui + "/"
+  }
+  f.SkipLogin = func(challenge string) (string, bool) {
+    return "", false
+  }
+  f.InitiateLogout = func(idToken string, state string, redirectTo string) string {
+    return withQuery(redirectTo, "state", state)
+  }
+  f.ReadLogout = func(challenge string) (idp.HumanLogout, bool) {
+    return idp.HumanLogout{}, false
+  }
+  f.AcceptLogout = func(challenge string, logout idp.HumanLogout) string {
+    return logout.RequestUrl
+  }
+
+  return f
+}
+
+// AddHuman stores the human as given, ex. with Password, AllowLogin and EmailConfirmedAt set to be able to log in. Returns the human with id set.
+func (f *Idp) AddHuman(human idp.Human) idp.Human {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  if human.Id == "" {
+    human.Id = newId()
+  }
+  f.Humans[human.Id] = human
+  return human
+}
+
+// Code returns the code sent to the human for the challenge, what a test would read from the email or sms.
+func (f *Idp) Code(challenge string) string {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  return f.Challenges[challenge].Code
+}
+
+// response builds the bulky response the idp would send. The ok value is marshalled through json like on the wire, so bulky.Unmarshal decodes it exactly as in production.
+func response(index int, status int, ok interface{}) bulky.Response {
+  r := bulky.Response{ Index:index, Status:status }
+  if ok != nil {
+    data, err := json.Marshal(ok)
+    if err != nil {
+      panic(err)
+    }
+    var v interface{}
+    err = json.Unmarshal(data, &v)
+    if err != nil {
+      panic(err)
+    }
+    r.Ok = v
+  }
+  return r
+}
+
+func errorResponse(index int, status int, message string) bulky.Response {
+  return bulky.Response{ Index:index, Status:status, Errors:[]bulky.ErrorResponse{ {Code:status, Error:message} } }
+}
+
+func newId() string {
+  id, err := uuid.NewV4()
+  if err != nil {
+    panic(err)
+  }
+  return id.String()
+}
+
+func newCode() string {
+  n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+  if err != nil {
+    panic(err)
+  }
+  return fmt.Sprintf("%06d", n.Int64())
+}
+
+func withQuery(u string, key string, value string) string {
+  parsed, err := url.Parse(u)
+  if err != nil {
+    return u
+  }
+  q := parsed.Query()
+  q.Set(key, value)
+  parsed.RawQuery = q.Encode()
+  return parsed.String()
+}
@@ -0,0 +1,81 @@
+package idpfake
+
+import (
+  "time"
+  "net/http"
+
+  idp "github.com/opensentry/idp/client"
+
+  bulky "github.com/charmixer/bulky/client"
+)
+
+func (f *Idp) CreateInvites(client *idp.IdpClient, url string, requests []idp.CreateInvitesRequest) (int, bulky.Responses, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  var responses bulky.Responses
+  for i, r := range requests {
+    now := time.Now().Unix()
+    invite := idp.Invite{
+      Id: newId(),
+      IssuedAt: now,
+      ExpiresAt: r.ExpiresAt,
+      Email: r.Email,
+      Username: r.Username,
+    }
+    if invite.ExpiresAt == 0 {
+      invite.ExpiresAt = now + 86400
+    }
+    f.Invites[invite.Id] = invite
+    responses = append(responses, response(i, http.StatusOK, idp.CreateInvitesResponse(invite)))
+  }
+  return http.StatusOK, responses, nil
+}
+
+func (f *Idp) ReadInvites(client *idp.IdpClient, url string, requests []idp.ReadInvitesRequest) (int, bulky.Responses, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  var responses bulky.Responses
+  for i, r := range requests {
+    var found idp.ReadInvitesResponse
+    for _, invite := range f.Invites {
+      if (r.Id == "" || invite.Id == r.Id) && (r.Email == "" || invite.Email == r.Email) {
+        found = append(found, invite)
+      }
+    }
+    if len(found) == 0 {
+      responses = append(responses, errorResponse(i, http.StatusNotFound, "Not found"))
+      continue
+    }
+    responses = append(responses, response(i, http.StatusOK, found))
+  }
+  return http.StatusOK, responses, nil
+}
+
+// CreateInvitesClaim sends a code to the email of the invite. Confirming it proves control of the email and continues to RedirectTo, normally registration.
+func (f *Idp) CreateInvitesClaim(client *idp.IdpClient, url string, requests []idp.CreateInvitesClaimRequest) (int, bulky.Responses, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  var responses bulky.Responses
+  for i, r := range requests {
+    invite, exists := f.Invites[r.Id]
+    if exists == false {
+      responses = append(responses, errorResponse(i, http.StatusNotFound, "Not found"))
+      continue
+    }
+
+    challenge := f.createChallenge(idp.ConfirmIdentityControlOfEmail, invite.Id, r.RedirectTo, idp.OTP, invite.Email)
+    if r.TTL > 0 {
+      challenge.TTL = r.TTL
+      challenge.ExpiresAt = challenge.IssuedAt + r.TTL
+      f.Challenges[challenge.OtpChallenge] = challenge
+    }
+
+    responses = append(responses, response(i, http.StatusOK, idp.CreateInvitesClaimResponse{
+      RedirectTo: withQuery(f.EmailConfirmUrl, "email_challenge", challenge.OtpChallenge),
+    }))
+  }
+  return http.StatusOK, responses, nil
+}
@@ -0,0 +1,263 @@
+package ldapfake
+
+import (
+  "net"
+  "sync"
+  "strings"
+  ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// # Local LDAP directory
+// Ldap is a minimal LDAP v3 server behaving like a directory towards the ui: simple binds, subtree searches with and, or, not, equality and presence filters, and unbind. Attribute names and values match case-insensitively, as with the default matching rules of most directories.
+// Like most directories, a bind with a dn and an empty password is an unauthenticated bind and succeeds, so the ui must never bind with an empty password.
+// Only the entries are kept, not the containers above them, so any search base is valid. It is served on a plain ldap:// listener on a local port. StartTLS is not supported.
+
+const (
+  applicationBindRequest = 0
+  applicationBindResponse = 1
+  applicationUnbindRequest = 2
+  applicationSearchRequest = 3
+  applicationSearchResultEntry = 4
+  applicationSearchResultDone = 5
+
+  filterAnd = 0
+  filterOr = 1
+  filterNot = 2
+  filterEqualityMatch = 3
+  filterPresent = 7
+
+  resultSuccess = 0
+  resultSizeLimitExceeded = 4
+  resultInvalidCredentials = 49
+  resultUnwillingToPerform = 53
+)
+
+// Entry is an account in the directory. Binding as its dn with the password succeeds.
+type Entry struct {
+  Dn string
+  Password string
+  Attributes map[string][]string
+}
+
+type Ldap struct {
+  Url string // ldap://127.0.0.1:port
+
+  mu sync.Mutex
+  entries map[string]Entry // By lower case dn
+  listener net.Listener
+}
+
+// NewServer starts the directory on a local port. Close it when done.
+func NewServer() *Ldap {
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    panic(err)
+  }
+
+  l := &Ldap{
+    Url: "ldap://" + listener.Addr().String(),
+    entries: make(map[string]Entry),
+    listener: listener,
+  }
+  go l.serve()
+  return l
+}
+
+func (l *Ldap) Close() {
+  l.listener.Close()
+}
+
+// AddEntry adds the entry, replacing any with the same dn.
+func (l *Ldap) AddEntry(e Entry) {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+
+  l.entries[strings.ToLower(e.Dn)] = e
+}
+
+func (l *Ldap) serve() {
+  for {
+    conn, err := l.listener.Accept()
+    if err != nil {
+      return // Closed
+    }
+    go l.handle(conn)
+  }
+}
+
+func (l *Ldap) handle(conn net.Conn) {
+  defer conn.Close()
+
+  for {
+    packet, err := ber.ReadPacket(conn)
+    if err != nil || len(packet.Children) < 2 {
+      return
+    }
+    messageId := packet.Children[0].Value
+    request := packet.Children[1]
+
+    var responses []*ber.Packet
+    switch request.Tag {
+    case applicationBindRequest:
+      responses = []*ber.Packet{ result(applicationBindResponse, l.bind(request)) }
+    case applicationSearchRequest:
+      responses = l.search(request)
+    case applicationUnbindRequest:
+      return
+    default:
+      return // Closing is how directories answer what they cannot parse
+    }
+
+    for _, response := range responses {
+      message := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+      message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageId, "MessageID"))
+      message.AppendChild(response)
+      _, err = conn.Write(message.Bytes())
+      if err != nil {
+        return
+      }
+    }
+  }
+}
+
+func (l *Ldap) bind(request *ber.Packet) int {
+  if len(request.Children) < 3 {
+    return resultUnwillingToPerform
+  }
+  dn := stringValue(request.Children[1])
+  password := string(request.Children[2].Data.Bytes()) // Simple authentication, [0] OCTET STRING
+
+  if dn == "" || password == "" {
+    return resultSuccess // Anonymous or unauthenticated bind
+  }
+
+  l.mu.Lock()
+  defer l.mu.Unlock()
+
+  entry, exists := l.entries[strings.ToLower(dn)]
+  if exists == false || entry.Password != password {
+    return resultInvalidCredentials
+  }
+  return resultSuccess
+}
+
+func (l *Ldap) search(request *ber.Packet) []*ber.Packet {
+  if len(request.Children) < 8 {
+    return []*ber.Packet{ result(applicationSearchResultDone, resultUnwillingToPerform) }
+  }
+  base := strings.ToLower(stringValue(request.Children[0]))
+  sizeLimit, _ := request.Children[3].Value.(int64)
+  filter := request.Children[6]
+
+  var wanted []string
+  for _, a := range request.Children[7].Children {
+    wanted = append(wanted, stringValue(a))
+  }
+
+  l.mu.Lock()
+  defer l.mu.Unlock()
+
+  var responses []*ber.Packet
+  for dn, entry := range l.entries {
+    if dn != base && strings.HasSuffix(dn, "," + base) == false && base != "" {
+      continue
+    }
+    if matches(entry, filter) == false {
+      continue
+    }
+    if sizeLimit > 0 && int64(len(responses)) == sizeLimit {
+      return append(responses, result(applicationSearchResultDone, resultSizeLimitExceeded))
+    }
+    responses = append(responses, searchResultEntry(entry, wanted))
+  }
+  return append(responses, result(applicationSearchResultDone, resultSuccess))
+}
+
+func matches(entry Entry, filter *ber.Packet) bool {
+  switch filter.Tag {
+  case filterAnd:
+    for _, f := range filter.Children {
+      if matches(entry, f) == false {
+        return false
+      }
+    }
+    return true
+  case filterOr:
+    for _, f := range filter.Children {
+      if matches(entry, f) {
+        return true
+      }
+    }
+    return false
+  case filterNot:
+    return len(filter.Children) == 1 && matches(entry, filter.Children[0]) == false
+  case filterEqualityMatch:
+    if len(filter.Children) != 2 {
+      return false
+    }
+    for _, v := range values(entry, stringValue(filter.Children[0])) {
+      if strings.EqualFold(v, stringValue(filter.Children[1])) {
+        return true
+      }
+    }
+    return false
+  case filterPresent:
+    return len(values(entry, string(filter.Data.Bytes()))) > 0
+  }
+  return false // Substrings, ordering and approximate matches are not supported
+}
+
+func values(entry Entry, attribute string) []string {
+  for name, vs := range entry.Attributes {
+    if strings.EqualFold(name, attribute) {
+      return vs
+    }
+  }
+  return nil
+}
+
+func searchResultEntry(entry Entry, wanted []string) *ber.Packet {
+  response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, applicationSearchResultEntry, nil, "Search Result Entry")
+  response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.Dn, "Object Name"))
+
+  attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+  for name, vs := range entry.Attributes {
+    if len(wanted) > 0 && contains(wanted, name) == false {
+      continue
+    }
+    attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+    attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+    set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+    for _, v := range vs {
+      set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+    }
+    attribute.AppendChild(set)
+    attributes.AppendChild(attribute)
+  }
+  response.AppendChild(attributes)
+  return response
+}
+
+func result(application ber.Tag, code int) *ber.Packet {
+  response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, application, nil, "Result")
+  response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+  response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+  response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+  return response
+}
+
+func stringValue(p *ber.Packet) string {
+  if s, ok := p.Value.(string); ok {
+    return s
+  }
+  return string(p.Data.Bytes())
+}
+
+func contains(values []string, value string) bool {
+  for _, v := range values {
+    if strings.EqualFold(v, value) {
+      return true
+    }
+  }
+  return false
+}
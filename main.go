@@ -2,8 +2,13 @@ package main
 
 import (
   "net/url"
+  "net/http"
+  "crypto/tls"
+  "time"
   "encoding/gob"
   "os"
+  "os/signal"
+  "syscall"
   "runtime"
   "path"
   "fmt"
@@ -19,10 +24,16 @@ import (
   "github.com/pborman/getopt"
 
   "github.com/opensentry/idpui/app"
+  "github.com/opensentry/idpui/breach"
   "github.com/opensentry/idpui/config"
+  "github.com/opensentry/idpui/directory"
+  "github.com/opensentry/idpui/devices"
+  "github.com/opensentry/idpui/federation"
   "github.com/opensentry/idpui/controllers/challenges"
   "github.com/opensentry/idpui/controllers/credentials"
   "github.com/opensentry/idpui/controllers/profiles"
+  "github.com/opensentry/idpui/utils"
+  "github.com/opensentry/idpui/validators"
 )
 
 const appName = "idpui"
@@ -39,6 +50,13 @@ var (
 func init() {
   log = logrus.New();
 
+  gob.Register(make(map[string][]string))
+  gob.Register([]app.Account{})
+  gob.Register(make(map[string]string))
+}
+
+// initConfigurations loads the configuration and sets up logging from it. Not done in init, so tests can point the configuration at their own files first.
+func initConfigurations() {
   err := config.InitConfigurations()
   if err != nil {
     log.Panic(err.Error())
@@ -71,33 +89,98 @@ func init() {
     "log.debug": logDebug,
     "log.format": logFormat,
   }
-
-  gob.Register(make(map[string][]string))
 }
 
 func main() {
 
-  provider, err := oidc.NewProvider(context.Background(), config.GetString("hydra.public.url") + "/")
+  optServe := getopt.BoolLong("serve", 0, "Serve application")
+  optDev := getopt.BoolLong("dev", 0, "Development mode. Reload templates on every request, show detailed error pages, allow insecure cookies and generate a self-signed certificate if none is configured. Never use in production")
+  optCheckConfig := getopt.BoolLong("check-config", 0, "Validate the configuration and print the effective configuration with secrets redacted")
+  optBuildBreachFilter := getopt.BoolLong("build-breach-filter", 0, "Build a breached password filter for password.breached.filter. Usage: --build-breach-filter [--min-count=N] <corpus> <filter>, where corpus is the HIBP SHA-1 hashes ordered by hash")
+  optMinCount := getopt.IntLong("min-count", 0, 1, "Skip hashes seen fewer times than this when building a breach filter, to make it smaller", "N")
+  optHelp := getopt.BoolLong("help", 0, "Help")
+  getopt.Parse()
+
+  if *optHelp {
+    getopt.Usage()
+    os.Exit(0)
+  }
+
+  // Needs no configuration, the filter is built before deploying it.
+  if *optBuildBreachFilter {
+    args := getopt.Args()
+    if len(args) != 2 {
+      getopt.Usage()
+      os.Exit(1)
+    }
+
+    err := buildBreachFilter(args[0], args[1], *optMinCount)
+    if err != nil {
+      fmt.Fprintln(os.Stderr, err.Error())
+      os.Exit(1)
+    }
+    os.Exit(0)
+  }
+
+  initConfigurations()
+
+  // Fail on boot instead of at request time.
+  cfg, err := config.LoadAndValidate(*optDev)
+
+  if *optCheckConfig {
+    fmt.Println("# Sources, in order of precedence from lowest to highest")
+    for _, source := range config.Sources() {
+      fmt.Println("# " + source)
+    }
+    config.WriteEffective(os.Stdout)
+    if err != nil {
+      fmt.Fprintln(os.Stderr, err.Error())
+      os.Exit(1)
+    }
+    fmt.Println("Configuration OK")
+    os.Exit(0)
+  }
+
   if err != nil {
-    logrus.WithFields(appFields).Panic("oidc.NewProvider" + err.Error())
+    log.WithFields(appFields).Panic(err.Error())
     return
   }
 
-  endpoint := provider.Endpoint()
-  endpoint.AuthStyle = 2 // Force basic secret, so token exchange does not auto to post which we did not allow.
+  if *optServe == false {
+    getopt.Usage()
+    os.Exit(0)
+  }
 
-  clientId := config.GetString("oauth2.client.id")
-  if clientId == "" {
-    log.Panic("Missing config oauth2.client.id")
+  env, err := newEnvironment(cfg, *optDev)
+  if err != nil {
+    log.WithFields(appFields).Panic(err.Error())
     return
   }
 
-  clientSecret := config.GetString("oauth2.client.secret")
-  if clientSecret == "" {
-    log.Panic("Missing config oauth2.client.secret")
-    return
+  serve(env)
+}
+
+// newEnvironment builds the application state from a validated configuration. Discovers the OpenID Connect provider, so Hydra must be reachable.
+func newEnvironment(cfg *config.Configuration, development bool) (*app.Environment, error) {
+  endpoints, err := app.NewEndpoints(cfg)
+  if err != nil {
+    return nil, err
+  }
+
+  // Every call to Hydra gives up after hydra.timeout, a hanging Hydra must not hang the requests of the ui
+  hydraClient := &http.Client{ Timeout:time.Duration(cfg.Hydra.Timeout) * time.Second }
+
+  provider, err := oidc.NewProvider(oidc.ClientContext(context.Background(), hydraClient), endpoints.Hydra.Public.String() + "/")
+  if err != nil {
+    return nil, fmt.Errorf("oidc.NewProvider: %s", err.Error())
   }
 
+  endpoint := provider.Endpoint()
+  endpoint.AuthStyle = 2 // Force basic secret, so token exchange does not auto to post which we did not allow.
+
+  clientId := cfg.Oauth2.Client.Id
+  clientSecret := cfg.Oauth2.Client.Secret
+
   // IdpUI needs to be able as an App using client_id to access idp endpoints. Using client credentials flow
   idpConfig := &clientcredentials.Config{
     ClientID:  clientId,
@@ -117,6 +200,16 @@ func main() {
     AuthStyle: 2, // https://godoc.org/golang.org/x/oauth2#AuthStyle
   }
 
+  breaches, err := newBreachChecker(cfg)
+  if err != nil {
+    return nil, fmt.Errorf("Invalid config password.breached: %s", err.Error())
+  }
+
+  trustedProxies, err := utils.ParseTrustedProxies(config.GetStringSlice("serve.proxy.trusted"))
+  if err != nil {
+    return nil, fmt.Errorf("Invalid config serve.proxy.trusted: %s", err.Error())
+  }
+
   // Setup app state variables. Can be used in handler functions by doing closures see exchangeAuthorizationCodeCallback
   env := &app.Environment{
     Constants: &app.EnvironmentConstants{
@@ -128,7 +221,13 @@ func main() {
       SessionStoreKey: appName,
       SessionRedirectCsrfStoreKey: appName + ".redirectcsrf",
       SessionChallengeStoreKey: appName + ".challenges",
+      SessionAccountsStoreKey: appName + ".accounts",
+      SessionDevicesStoreKey: appName + ".devices",
       SessionLogoutStateKey: "logout.state",
+      SessionRecoverChallengeKey: "recover.challenge",
+      SessionStepUpStateKey: "stepup.state",
+      SessionEmailOtpChallengeKey: "emailotp.challenge",
+      SessionAuthenticationKey: "stepup.authentication",
 
       ContextAccessTokenKey: "access_token",
       ContextIdTokenKey: "id_token",
@@ -136,6 +235,7 @@ func main() {
       ContextIdentityKey: "id",
       ContextOAuth2ConfigKey: "oauth2_config",
       ContextRequiredScopesKey: "required_scopes",
+      ContextAuthenticationRequirementKey: "authentication_requirement",
       ContextPrecalculatedStateKey: "precalculated_state",
     },
     Provider: provider,
@@ -143,30 +243,204 @@ func main() {
     ClientSecret: clientSecret,
     IdpConfig: idpConfig,
     AapConfig: aapConfig,
+    TrustedProxies: trustedProxies,
+    LoginPolicy: &app.LoginPolicy{
+      Username: cfg.Login.Username,
+      Remember: cfg.Login.Remember.Enabled,
+      RememberFor: cfg.Login.Remember.For,
+      Skip: cfg.Login.Skip,
+      ReauthenticateScopes: cfg.Login.Reauthenticate.Scopes,
+      Link: cfg.Login.Link.Enabled,
+      LinkTTL: int64(cfg.Login.Link.Ttl),
+      EmailOtp: cfg.Login.EmailOtp.Enabled,
+      EmailOtpTTL: int64(cfg.Login.EmailOtp.Ttl),
+      TrustDevices: cfg.Login.TrustedDevices.Enabled,
+      TrustDevicesFor: cfg.Login.TrustedDevices.For,
+    },
+    Authenticators: newAuthenticators(cfg),
+    AccountChooser: &app.AccountChooser{
+      Enabled: cfg.Login.Accounts.Enabled,
+      Max: cfg.Login.Accounts.Max,
+      For: cfg.Login.Accounts.For,
+    },
+    StepUp: app.StepUpRequirements{
+      Password: authenticationRequirement(cfg.StepUp.Password),
+      Totp: authenticationRequirement(cfg.StepUp.Totp),
+      Delete: authenticationRequirement(cfg.StepUp.Delete),
+      EmailChange: authenticationRequirement(cfg.StepUp.Emailchange),
+      Identities: authenticationRequirement(cfg.StepUp.Identities),
+      Devices: authenticationRequirement(cfg.StepUp.Devices),
+      Sessions: authenticationRequirement(cfg.StepUp.Sessions),
+    },
+    PasswordPolicy: &validators.PasswordPolicy{
+      MinLength: cfg.Password.Policy.MinLength,
+      MaxLength: cfg.Password.Policy.MaxLength,
+      Lowercase: cfg.Password.Policy.Lowercase,
+      Uppercase: cfg.Password.Policy.Uppercase,
+      Digits: cfg.Password.Policy.Digits,
+      Symbols: cfg.Password.Policy.Symbols,
+      MinScore: cfg.Password.Policy.MinScore,
+    },
+    PasswordMeter: cfg.Password.Meter,
+    RecoverResetTotp: cfg.Password.Recover.ResetTotp,
+    PasswordBreaches: breaches,
+    FederationProviders: newFederationProviders(cfg),
+    FederationLinks: &federation.FileLinks{ Path:cfg.Federation.Links.Path },
+    TrustedDevices: &devices.FileDevices{ Path:cfg.Login.TrustedDevices.Path },
+    DeviceUserCodeAlphabet: cfg.Hydra.Device.UserCode.Alphabet,
+    DeviceUserCodeLength: cfg.Hydra.Device.UserCode.Length,
+    PasswordBreachPolicy: cfg.Password.Breached.Policy,
+    PasswordBreachFailOpen: cfg.Password.Breached.FailOpen,
+    Endpoints: endpoints,
+    IdpApi: app.IdpClientApi{},
+    HydraApi: app.HydraAdminApi{ Url:endpoints.Hydra.Admin, Client:hydraClient },
+    HydraClient: hydraClient,
     Logger: log,
+    Development: development,
   }
+  return env, nil
+}
 
-  optServe := getopt.BoolLong("serve", 0, "Serve application")
-  optHelp := getopt.BoolLong("help", 0, "Help")
-  getopt.Parse()
+func authenticationRequirement(cfg config.AuthenticationRequirementConfiguration) *app.AuthenticationRequirement {
+  return &app.AuthenticationRequirement{
+    MaxAge: cfg.MaxAge,
+    Acr: cfg.Acr,
+    Amr: cfg.Amr,
+    SecondFactor: cfg.SecondFactor,
+    EmailOtp: cfg.EmailOtp,
+    TrustedDevice: cfg.TrustedDevice,
+  }
+}
 
-  if *optHelp {
-    getopt.Usage()
-    os.Exit(0)
+// newAuthenticators returns the authenticators of login.authenticators in the order they verify credentials.
+func newAuthenticators(cfg *config.Configuration) (authenticators app.Authenticators) {
+  for _, a := range cfg.Login.Authenticators {
+    switch a {
+    case "idp":
+      authenticators = append(authenticators, app.IdpAuthenticator{})
+    case "ldap":
+      authenticators = append(authenticators, app.LdapAuthenticator{
+        Directory: &directory.Ldap{
+          Url: cfg.Ldap.Url,
+          StartTls: cfg.Ldap.StartTls,
+          BindDn: cfg.Ldap.Bind.Dn,
+          BindPassword: cfg.Ldap.Bind.Password,
+          SearchBase: cfg.Ldap.Search.Base,
+          UserFilter: cfg.Ldap.Search.Filter,
+          Attributes: directory.Attributes{
+            Username: cfg.Ldap.Attributes.Username,
+            Email: cfg.Ldap.Attributes.Email,
+            Name: cfg.Ldap.Attributes.Name,
+          },
+          Timeout: time.Duration(cfg.Ldap.Timeout) * time.Second,
+        },
+        Provision: cfg.Ldap.Provision,
+        MatchEmail: cfg.Ldap.MatchEmail,
+      })
+    }
   }
+  return authenticators
+}
 
-  if *optServe {
-    serve(env)
-  } else {
-    getopt.Usage()
-    os.Exit(0)
+// newFederationProviders returns the upstream providers in the order their buttons are shown.
+func newFederationProviders(cfg *config.Configuration) (providers federation.Providers) {
+  for _, p := range cfg.Federation.Providers {
+    providers = append(providers, &federation.Provider{
+      Id: p.Id,
+      Name: p.Name,
+      Issuer: p.Issuer,
+      ClientId: p.Client.Id,
+      ClientSecret: p.Client.Secret,
+      Scopes: p.Scopes,
+      TrustEmail: p.TrustEmail,
+      TrustMfa: p.TrustMfa,
+    })
+  }
+  return providers
+}
+
+// newBreachChecker opens the breached password sources in the order they are checked, the offline sources first. Nil when password.breached.policy is off.
+func newBreachChecker(cfg *config.Configuration) (breach.Checker, error) {
+  breached := cfg.Password.Breached
+  if breached.Policy == "off" {
+    return nil, nil
+  }
+
+  var checkers breach.Checkers
+
+  if breached.Filter != "" {
+    filter, err := breach.OpenFilter(breached.Filter) // Kept open for the lifetime of the application
+    if err != nil {
+      return nil, err
+    }
+    checkers = append(checkers, filter)
   }
 
+  if breached.Ranges != "" {
+    info, err := os.Stat(breached.Ranges)
+    if err != nil {
+      return nil, err
+    }
+    if info.IsDir() == false {
+      return nil, fmt.Errorf("%s: Not a directory", breached.Ranges)
+    }
+    checkers = append(checkers, breach.RangeDir{ Path:breached.Ranges })
+  }
+
+  if breached.Api != "" {
+    u, err := url.Parse(breached.Api)
+    if err != nil {
+      return nil, err
+    }
+    checkers = append(checkers, breach.RangeApi{ Url:u, Client:&http.Client{ Timeout:5 * time.Second } })
+  }
+
+  return checkers, nil
+}
+
+// buildBreachFilter writes a filter of the breached password corpus with a false positive rate of 0.1%.
+func buildBreachFilter(corpusPath string, filterPath string, minCount int) error {
+  corpus, err := os.Open(corpusPath)
+  if err != nil {
+    return err
+  }
+  defer corpus.Close()
+
+  out, err := os.Create(filterPath)
+  if err != nil {
+    return err
+  }
+
+  hashes, err := breach.BuildFilter(corpus, out, 0.001, minCount)
+  if err != nil {
+    out.Close()
+    os.Remove(filterPath)
+    return fmt.Errorf("%s: %s", corpusPath, err.Error())
+  }
+
+  err = out.Close()
+  if err != nil {
+    return err
+  }
+
+  fmt.Printf("Wrote %d hashes to %s\n", hashes, filterPath)
+  return nil
 }
 
 func serve(env *app.Environment) {
+  listenAndServe(env, router(env))
+}
+
+// router sets up the middlewares and routes of the application.
+func router(env *app.Environment) *gin.Engine {
   r := gin.New() // Clean gin to take control with logging.
-  r.Use(gin.Recovery())
+
+  if env.Development {
+    log.WithFields(appFields).Warn("Development mode enabled. Do not use in production")
+    r.Use(app.DevelopmentErrorPages(env))
+  } else {
+    r.Use(gin.Recovery())
+  }
 
   r.Use(app.RequestId())
   r.Use(app.RequestLogger(env, appFields))
@@ -176,17 +450,25 @@ func serve(env *app.Environment) {
   store.Options(sessions.Options{
     MaxAge: 86400,
     Path: "/",
-    Secure: true,
+    Secure: !env.Development, // Allow plain http on localhost while developing
     HttpOnly: true,
   })
-  r.Use(sessions.SessionsMany([]string{env.Constants.SessionRedirectCsrfStoreKey, env.Constants.SessionStoreKey, env.Constants.SessionChallengeStoreKey}, store))
+  r.Use(sessions.SessionsMany([]string{env.Constants.SessionRedirectCsrfStoreKey, env.Constants.SessionStoreKey, env.Constants.SessionChallengeStoreKey, env.Constants.SessionAccountsStoreKey, env.Constants.SessionDevicesStoreKey}, store))
 
   // Use CSRF on all idpui forms.
-  adapterCSRF := adapter.Wrap(csrf.Protect([]byte(config.GetString("csrf.authKey")), csrf.Secure(true)))
+  adapterCSRF := adapter.Wrap(csrf.Protect([]byte(config.GetString("csrf.authKey")), csrf.Secure(!env.Development)))
   // r.Use(adapterCSRF) // Do not use this as it will make csrf tokens for public files aswell which is just extra data going over the wire, no need for that.
 
   r.Static("/public", "public")
-  r.LoadHTMLGlob("views/*")
+  if env.Development {
+    r.HTMLRender = app.DevelopmentHTMLRender{ Glob:"views/*" } // Parsed on every request
+  } else {
+    r.LoadHTMLGlob("views/*")
+  }
+
+  // Routes are served where idpui.public.endpoints.* point. The challenge pages the idp sends humans to and the public profile are configured with the idp and meui instead, so their paths are fixed.
+  idpui := env.Endpoints.Idpui
+  route := idpui.RoutePath
 
   // Public endpoints
   ep := r.Group("/")
@@ -196,99 +478,174 @@ func serve(env *app.Environment) {
     ep.GET("/profile", profiles.ShowPublicProfile(env) )
 
     // Signup
-    ep.GET(  "/claim", credentials.ShowClaimEmail(env) )
-    ep.POST( "/claim", credentials.SubmitClaimEmail(env) )
+    ep.GET(  route(idpui.Claim), credentials.ShowClaimEmail(env) )
+    ep.POST( route(idpui.Claim), credentials.SubmitClaimEmail(env) )
 
-    ep.GET(  "/register", credentials.ShowRegistration(env) )
-    ep.POST( "/register", credentials.SubmitRegistration(env) )
+    ep.GET(  route(idpui.Register), credentials.ShowRegistration(env) )
+    ep.POST( route(idpui.Register), credentials.SubmitRegistration(env) )
 
     // Signin
-    ep.GET(  "/login", credentials.ShowLogin(env) )
-    ep.POST( "/login", credentials.SubmitLogin(env) )
+    ep.GET(  route(idpui.Login), credentials.ShowLogin(env) )
+    ep.POST( route(idpui.Login), credentials.SubmitLogin(env) )
+    ep.POST( route(idpui.AccountsForget), credentials.SubmitAccountsForget(env) )
+
+    // Login with a link sent by email, see login.link
+    ep.GET(  route(idpui.LoginLink), credentials.ShowLoginLink(env) )
+    ep.POST( route(idpui.LoginLink), credentials.SubmitLoginLink(env) )
+    ep.GET(  route(idpui.LoginLinkOpen), credentials.ShowLoginLinkOpen(env) )
+
+    // Login with an upstream OpenID Connect provider, see federation.providers
+    ep.GET( route(idpui.FederatedLogin), credentials.ShowFederatedLogin(env) )
+    ep.GET( route(idpui.FederatedCallback), credentials.ShowFederatedCallback(env) )
+
+    // Enter the user code of a device, see the device authorization grant of Hydra
+    ep.GET(  route(idpui.Device), credentials.ShowDevice(env) )
+    ep.POST( route(idpui.Device), credentials.SubmitDevice(env) )
+    ep.GET(  route(idpui.DeviceConfirm), credentials.ShowDeviceConfirm(env) )
+    ep.POST( route(idpui.DeviceConfirm), credentials.SubmitDeviceConfirm(env) )
+    ep.GET(  route(idpui.DeviceDone), credentials.ShowDeviceDone(env) )
 
     // Verify OTP code
     ep.GET(  "/verify", challenges.ShowVerify(env) )
     ep.POST( "/verify", challenges.SubmitVerify(env) )
 
+    // Verify with a code sent by email instead of TOTP, see login.emailOtp
+    ep.POST( route(idpui.VerifyEmailSend), challenges.SubmitVerifyEmailSend(env) )
+    ep.GET(  route(idpui.VerifyEmail), challenges.ShowVerifyEmail(env) )
+    ep.POST( route(idpui.VerifyEmail), challenges.SubmitVerifyEmail(env) )
+
     // Verify email using OTP code
     ep.GET( "/emailconfirm", challenges.ShowEmailConfirm(env) )
     ep.POST( "/emailconfirm", challenges.SubmitEmailConfirm(env) )
 
     // Logout
-    ep.GET( "/logout", credentials.ShowLogout(env))
-    ep.POST( "/logout", credentials.SubmitLogout(env) )
+    ep.GET( route(idpui.Logout), credentials.ShowLogout(env))
+    ep.POST( route(idpui.Logout), credentials.SubmitLogout(env) )
 
     // Clear cookies shortcut - FIXME: This should not be needed once logout works correctly.
-    ep.GET( "/seeyoulater", credentials.ShowSeeYouLater(env))
+    ep.GET( route(idpui.SeeYouLater), credentials.ShowSeeYouLater(env))
 
     // Verify delete using OTP code
     ep.GET( "/deleteconfirm", challenges.ShowDeleteConfirm(env) )
     ep.POST( "/deleteconfirm", challenges.SubmitDeleteConfirm(env) )
 
     // Recover
-    ep.GET(  "/recover", credentials.ShowRecover(env) )
-    ep.POST( "/recover", credentials.SubmitRecover(env) )
+    ep.GET(  route(idpui.Recover), credentials.ShowRecover(env) )
+    ep.POST( route(idpui.Recover), credentials.SubmitRecover(env) )
 
     // Verify recover using OTP code
     ep.GET( "/recoverconfirm", challenges.ShowRecoverConfirm(env) )
     ep.POST( "/recoverconfirm", challenges.SubmitRecoverConfirm(env) )
 
+    // Live strength meter for password inputs, see password.meter
+    ep.POST( route(idpui.PasswordStrength), credentials.SubmitPasswordStrength(env) )
+
+    // Choose a new password using the verified recover challenge
+    ep.GET( route(idpui.RecoverPassword), credentials.ShowRecoverPassword(env) )
+    ep.POST( route(idpui.RecoverPassword), credentials.SubmitRecoverPassword(env) )
+
     // # Endpoints that require authentication
     ep := r.Group("/")
     ep.Use(adapterCSRF)
     ep.Use(app.RequireScopes(env, "openid", "idp:read:humans"))
     {
       // Password change
-      ep.GET(  "/password",
+      ep.GET(  route(idpui.Password),
         app.RequireScopes(env, "idp:update:humans:password"),
+        app.RequireAuthentication(env, env.StepUp.Password),
         app.ConfigureOauth2(env),
         app.RequestTokenUsingAuthorizationCode(env),
         app.RequireIdentity(env),
         credentials.ShowPassword(env),
       )
-      ep.POST( "/password", // Renders the access token obtained in the GET request in a hidden input field for posting. (maybe it should just render into bearer token header?)
+      ep.POST( route(idpui.Password), // Renders the access token obtained in the GET request in a hidden input field for posting. (maybe it should just render into bearer token header?)
         app.RequireScopes(env, "idp:update:humans:password"),
         app.ConfigureOauth2(env),
         credentials.SubmitPassword(env),
       )
 
       // TOTP setup
-      ep.GET(  "/totp",
+      ep.GET(  route(idpui.Totp),
         app.RequireScopes(env, "idp:update:humans:totp"),
+        app.RequireAuthentication(env, env.StepUp.Totp),
         app.ConfigureOauth2(env),
         app.RequestTokenUsingAuthorizationCode(env),
         app.RequireIdentity(env),
         credentials.ShowTotp(env),
       )
-      ep.POST( "/totp",
+      ep.POST( route(idpui.Totp),
         app.RequireScopes(env, "idp:update:humans:totp"),
         app.ConfigureOauth2(env),
         credentials.SubmitTotp(env),
       )
 
       // Delete identity
-      ep.GET(  "/delete",
+      ep.GET(  route(idpui.Delete),
         app.RequireScopes(env, "idp:delete:humans"),
+        app.RequireAuthentication(env, env.StepUp.Delete),
         app.ConfigureOauth2(env),
         app.RequestTokenUsingAuthorizationCode(env),
         app.RequireIdentity(env),
         credentials.ShowProfileDelete(env),
       )
-      ep.POST( "/delete",
+      ep.POST( route(idpui.Delete),
         app.RequireScopes(env, "idp:delete:humans"),
         app.ConfigureOauth2(env),
         credentials.SubmitProfileDelete(env),
       )
 
+      // Linked identities, see federation.providers
+      ep.GET(  route(idpui.Identities),
+        app.RequireAuthentication(env, env.StepUp.Identities),
+        app.ConfigureOauth2(env),
+        app.RevokeAccessToken(env),
+        app.RequestTokenUsingAuthorizationCode(env),
+        app.RequireIdentity(env),
+        credentials.ShowIdentities(env),
+      )
+      ep.POST( route(idpui.IdentitiesLink),
+        credentials.SubmitIdentitiesLink(env),
+      )
+      ep.POST( route(idpui.IdentitiesUnlink),
+        credentials.SubmitIdentitiesUnlink(env),
+      )
+
+      // Trusted devices, see login.trustedDevices
+      ep.GET(  route(idpui.TrustedDevices),
+        app.RequireAuthentication(env, env.StepUp.Devices),
+        app.ConfigureOauth2(env),
+        app.RevokeAccessToken(env),
+        app.RequestTokenUsingAuthorizationCode(env),
+        app.RequireIdentity(env),
+        credentials.ShowTrustedDevices(env),
+      )
+      ep.POST( route(idpui.TrustedDevicesRevoke),
+        credentials.SubmitTrustedDevicesRevoke(env),
+      )
+
+      // Signed in sessions and the apps given access
+      ep.GET(  route(idpui.Sessions),
+        app.RequireAuthentication(env, env.StepUp.Sessions),
+        app.ConfigureOauth2(env),
+        app.RevokeAccessToken(env),
+        app.RequestTokenUsingAuthorizationCode(env),
+        app.RequireIdentity(env),
+        credentials.ShowSessions(env),
+      )
+      ep.POST( route(idpui.SessionsRevoke),
+        credentials.SubmitSessionsRevoke(env),
+      )
+
       // Change email (change recovery email)
-      ep.GET(  "/emailchange",
+      ep.GET(  route(idpui.EmailChange),
         app.RequireScopes(env, "idp:create:humans:emailchange"),
+        app.RequireAuthentication(env, env.StepUp.EmailChange),
         app.ConfigureOauth2(env),
         app.RequestTokenUsingAuthorizationCode(env),
         app.RequireIdentity(env),
         credentials.ShowEmailChange(env),
       )
-      ep.POST( "/emailchange",
+      ep.POST( route(idpui.EmailChange),
         app.RequireScopes(env, "idp:create:humans:emailchange"),
         app.ConfigureOauth2(env),
         credentials.SubmitEmailChange(env),
@@ -319,15 +676,16 @@ WARNING: Using data on the challenge will effectivly split the transaction into
 */
 
       // Confirmation of the challenge required to change email
-      ep.GET(  "/emailchangeconfirm",
+      ep.GET(  route(idpui.EmailChangeConfirm),
         app.RequireScopes(env, "idp:update:humans:emailchange"),
+        app.RequireAuthentication(env, env.StepUp.EmailChange),
         app.UsePrecalculatedStateFromQuery(env, "email_challenge"),
         app.ConfigureOauth2(env),
         app.RequestTokenUsingAuthorizationCode(env),
         app.RequireIdentity(env),
         challenges.ShowEmailChangeConfirm(env),
       )
-      ep.POST( "/emailchangeconfirm",
+      ep.POST( route(idpui.EmailChangeConfirm),
         app.RequireScopes(env, "idp:update:humans:emailchange"),
         app.ConfigureOauth2(env),
         challenges.SubmitEmailChangeConfirm(env),
@@ -338,5 +696,122 @@ WARNING: Using data on the challenge will effectivly split the transaction into
 
   }
 
-  r.RunTLS(":" + config.GetString("serve.public.port"), config.GetString("serve.tls.cert.path"), config.GetString("serve.tls.key.path"))
+  return r
+}
+
+// listenAndServe runs the server until SIGINT or SIGTERM, then stops accepting connections and waits up to serve.shutdown.timeout seconds for in-flight requests to finish. SIGHUP reloads the TLS certificate.
+func listenAndServe(env *app.Environment, handler http.Handler) {
+  srv := &http.Server{
+    Addr: ":" + config.GetString("serve.public.port"),
+    Handler: handler,
+  }
+
+  var reloader *utils.CertificateReloader
+
+  listener := config.GetString("serve.listener")
+  switch listener {
+  case "http":
+    // TLS is terminated by a proxy in front of us. Forwarded headers are only honored from serve.proxy.trusted
+    if len(env.TrustedProxies) <= 0 {
+      log.WithFields(appFields).Warn("Serving plain http without serve.proxy.trusted. Forwarded headers will be ignored")
+    }
+  case "tls":
+    certPath := config.GetString("serve.tls.cert.path")
+    keyPath := config.GetString("serve.tls.key.path")
+
+    if env.Development && !fileExists(certPath) {
+      cert, err := generateDevelopmentCertificate()
+      if err != nil {
+        log.WithFields(appFields).Panic(err.Error())
+        return
+      }
+      log.WithFields(appFields).WithFields(logrus.Fields{"serve.tls.cert.path": certPath}).Warn("Certificate not found, serving with a generated self-signed certificate")
+      srv.TLSConfig = &tls.Config{ Certificates: []tls.Certificate{cert} }
+      break
+    }
+
+    var err error
+    reloader, err = utils.NewCertificateReloader(certPath, keyPath, time.Duration(config.GetInt("serve.tls.reload.interval")) * time.Second)
+    if err != nil {
+      log.WithFields(appFields).Panic(err.Error())
+      return
+    }
+    reloader.ReloadFailed = func(err error) {
+      log.WithFields(appFields).Error("Certificate reload failed, keeping current certificate: " + err.Error())
+    }
+    srv.TLSConfig = &tls.Config{ GetCertificate: reloader.GetCertificate }
+  default:
+    log.WithFields(appFields).Panic("Unknown serve.listener " + listener + ", expected tls or http")
+    return
+  }
+
+  serveErrors := make(chan error, 1)
+  go func() {
+    var err error
+    if srv.TLSConfig != nil {
+      err = srv.ListenAndServeTLS("", "") // Certificates are provided by the TLSConfig
+    } else {
+      err = srv.ListenAndServe()
+    }
+    serveErrors <- err
+  }()
+
+  signals := make(chan os.Signal, 1)
+  signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+  for {
+    select {
+    case err := <-serveErrors:
+      if err != nil && err != http.ErrServerClosed {
+        log.WithFields(appFields).Panic(err.Error())
+      }
+      return
+
+    case sig := <-signals:
+      if sig == syscall.SIGHUP {
+        if reloader == nil {
+          continue
+        }
+        err := reloader.Reload()
+        if err != nil {
+          log.WithFields(appFields).Error("Certificate reload failed, keeping current certificate: " + err.Error())
+          continue
+        }
+        log.WithFields(appFields).Info("Certificate reloaded")
+        continue
+      }
+
+      timeout := time.Duration(config.GetInt("serve.shutdown.timeout")) * time.Second
+      log.WithFields(appFields).WithFields(logrus.Fields{"signal": sig.String(), "serve.shutdown.timeout": timeout.String()}).Info("Shutting down, draining in-flight requests")
+
+      ctx, cancel := context.WithTimeout(context.Background(), timeout)
+      err := srv.Shutdown(ctx)
+      cancel()
+      if err != nil {
+        log.WithFields(appFields).Error("Graceful shutdown failed: " + err.Error())
+        return
+      }
+      log.WithFields(appFields).Info("Shutdown complete")
+      return
+    }
+  }
+}
+
+func fileExists(path string) bool {
+  if path == "" {
+    return false
+  }
+  _, err := os.Stat(path)
+  return err == nil
+}
+
+func generateDevelopmentCertificate() (tls.Certificate, error) {
+  hosts := []string{"localhost", "127.0.0.1", "::1"}
+
+  publicUrl, err := url.Parse(config.GetString("idpui.public.url"))
+  if err == nil && publicUrl.Hostname() != "" && publicUrl.Hostname() != "localhost" {
+    hosts = append(hosts, publicUrl.Hostname())
+  }
+
+  return utils.GenerateSelfSignedCertificate(appName + " development", hosts, 24 * time.Hour)
 }
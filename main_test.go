@@ -0,0 +1,2189 @@
+package main
+
+import (
+  "os"
+  "fmt"
+  "time"
+  "errors"
+  "html"
+  "encoding/json"
+  "regexp"
+  "strings"
+  "testing"
+  "io/ioutil"
+  "net/url"
+  "net/http"
+  "net/http/httptest"
+  "net/http/cookiejar"
+  "path/filepath"
+  "github.com/sirupsen/logrus"
+  "github.com/gin-gonic/gin"
+  "github.com/pquerna/otp/totp"
+
+  idp "github.com/opensentry/idp/client"
+  bulky "github.com/charmixer/bulky/client"
+
+  "github.com/opensentry/idpui/app"
+  "github.com/opensentry/idpui/breach"
+  "github.com/opensentry/idpui/config"
+  "github.com/opensentry/idpui/devices"
+  "github.com/opensentry/idpui/federation"
+  "github.com/opensentry/idpui/hydrafake"
+  "github.com/opensentry/idpui/idpfake"
+  "github.com/opensentry/idpui/ldapfake"
+)
+
+// # End-to-end tests
+// The application is served by router(env) on a TLS httptest server, so secure cookies and CSRF behave as in production. Hydra is the local fake in hydrafake and the idp is the in-memory fake in idpfake, connected so the idp accepts login and logout requests with Hydra.
+// Another hydrafake is the upstream provider of federated logins. Its login page logs in upstreamSubject without asking.
+// The ldapfake directory is the second authenticator of the login form, after the idp. The ui searches it with the service account testLdapBindDn.
+// Each test drives a browser with its own cookie jar through a full flow. Codes and links sent by email are read from the fake idp.
+
+const testMeuiUrl = "https://me.localhost"
+const testClientUrl = "https://client.localhost" // Another client of Hydra
+
+const testLdapBindDn = "cn=idpui,ou=services,dc=example,dc=com"
+const testLdapBindPassword = "idpui-directory"
+
+// testBreachedPassword is in the breached password filter of the tests, but passes the password policy.
+const testBreachedPassword = "purple monkey dishwasher"
+
+var (
+  hydra *hydrafake.Hydra
+  ui *httptest.Server
+  fakeIdp *idpfake.Idp
+  uiEnv *app.Environment
+
+  upstream *hydrafake.Hydra
+  upstreamLogin *httptest.Server
+  upstreamSubject string // Who logs in at the upstream next
+  upstreamClaims = make(map[string]map[string]interface{}) // What the upstream asserts about its users, by subject
+
+  ldapDirectory *ldapfake.Ldap
+)
+
+func TestMain(m *testing.M) {
+  gin.SetMode(gin.TestMode)
+
+  code, err := runTests(m)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err.Error())
+    os.Exit(1)
+  }
+  os.Exit(code)
+}
+
+func runTests(m *testing.M) (int, error) {
+  hydra = hydrafake.NewServer()
+  defer hydra.Close()
+
+  upstream = hydrafake.NewServer()
+  defer upstream.Close()
+  upstream.SessionCookieName = "upstream_authentication_session"
+  upstreamLogin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    http.Redirect(w, r, upstream.AcceptLogin(r.URL.Query().Get("login_challenge"), upstreamSubject, ""), http.StatusFound)
+  }))
+  defer upstreamLogin.Close()
+  upstream.LoginUrl = upstreamLogin.URL
+  upstream.Clients["idpui-corp"] = "corp-secret"
+  upstream.Clients["idpui-partner"] = "partner-secret"
+  upstream.Claims = func(subject string) map[string]interface{} {
+    return upstreamClaims[subject]
+  }
+
+  ldapDirectory = ldapfake.NewServer()
+  defer ldapDirectory.Close()
+  ldapDirectory.AddEntry(ldapfake.Entry{ Dn:testLdapBindDn, Password:testLdapBindPassword })
+
+  // The handler needs the environment, which needs the url of the ui for its configuration.
+  var handler http.Handler
+  ui = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    handler.ServeHTTP(w, r)
+  }))
+  defer ui.Close()
+
+  dir, err := ioutil.TempDir("", "idpui")
+  if err != nil {
+    return 0, err
+  }
+  defer os.RemoveAll(dir)
+
+  err = writeTestConfigurations(dir)
+  if err != nil {
+    return 0, err
+  }
+
+  corpus := strings.Join([]string{ breach.Hash("123456") + ":24230577", breach.Hash(testBreachedPassword) + ":3" }, "\n")
+  err = ioutil.WriteFile(filepath.Join(dir, "breached.txt"), []byte(corpus), 0600)
+  if err != nil {
+    return 0, err
+  }
+  err = buildBreachFilter(filepath.Join(dir, "breached.txt"), filepath.Join(dir, "breached.filter"), 1)
+  if err != nil {
+    return 0, err
+  }
+
+  initConfigurations()
+  log.SetOutput(ioutil.Discard)
+  logrus.SetOutput(ioutil.Discard) // Requests are logged with the standard logger
+
+  cfg, err := config.LoadAndValidate(false)
+  if err != nil {
+    return 0, err
+  }
+
+  env, err := newEnvironment(cfg, false)
+  if err != nil {
+    return 0, err
+  }
+  uiEnv = env
+
+  fakeIdp = idpfake.New(ui.URL)
+  env.IdpApi = fakeIdp
+
+  hydra.Clients[cfg.Oauth2.Client.Id] = cfg.Oauth2.Client.Secret
+  hydra.LoginUrl = ui.URL + "/login"
+  hydra.LogoutUrl = ui.URL + "/logout"
+  hydra.PostLogoutUrl = ui.URL + "/seeyoulater"
+  hydra.DeviceUrl = ui.URL + "/device"
+  hydra.DeviceDoneUrl = ui.URL + "/device/done"
+  hydra.ConnectIdp(fakeIdp)
+
+  handler = router(env)
+
+  return m.Run(), nil
+}
+
+func writeTestConfigurations(dir string) error {
+  discovery := `
+hydra:
+  public:
+    url: ` + hydra.URL + `
+  admin:
+    url: ` + hydra.URL + `
+idp:
+  public:
+    url: https://idp.localhost
+    endpoints:
+      humans:
+        collection: /humans
+        authenticate: /humans/authenticate
+        password: /humans/password
+        totp: /humans/totp
+        emailchange: /humans/emailchange
+        logout: /humans/logout
+        recover: /humans/recover
+        recoververification: /humans/recoververification
+        deleteverification: /humans/deleteverification
+      challenges:
+        collection: /challenges
+        verify: /challenges/verify
+      invites:
+        collection: /invites
+        claim: /invites/claim
+idpui:
+  public:
+    url: ` + ui.URL + `
+    endpoints:
+      root: /
+      login: /login
+      logout: /logout
+      claim: /claim
+      register: /register
+      recover: /recover
+      password: /password
+      totp: /totp
+      delete: /delete
+      emailchange: /emailchange
+      emailchangeconfirm: /emailchangeconfirm
+      seeyoulater: /seeyoulater
+meui:
+  public:
+    url: ` + testMeuiUrl + `
+    endpoints:
+      profile: /profile
+`
+
+  app := `
+provider:
+  name: Test
+serve:
+  listener: http
+  public:
+    port: 443
+session:
+  authKey: 0123456789abcdef0123456789abcdef
+csrf:
+  authKey: fedcba9876543210fedcba9876543210
+oauth2:
+  client:
+    id: idpui
+    secret: idpui-secret
+  scopes:
+    required:
+      - openid
+password:
+  breached:
+    policy: warn
+    filter: ` + filepath.Join(dir, "breached.filter") + `
+login:
+  authenticators:
+    - idp
+    - ldap
+  link:
+    enabled: true
+  emailOtp:
+    enabled: true
+  trustedDevices:
+    enabled: true
+    path: ` + filepath.Join(dir, "devices.json") + `
+ldap:
+  url: ` + ldapDirectory.Url + `
+  bind:
+    dn: ` + testLdapBindDn + `
+    password: ` + testLdapBindPassword + `
+  search:
+    base: ou=people,dc=example,dc=com
+federation:
+  links:
+    path: ` + filepath.Join(dir, "links.json") + `
+  providers:
+    - id: corp
+      name: Corp
+      issuer: ` + upstream.Issuer + `
+      client:
+        id: idpui-corp
+        secret: corp-secret
+      trustEmail: true
+      trustMfa: true
+    - id: partner
+      name: Partner
+      issuer: ` + upstream.Issuer + `
+      client:
+        id: idpui-partner
+        secret: partner-secret
+`
+
+  discoveryPath := filepath.Join(dir, "discovery.yml")
+  appPath := filepath.Join(dir, "app.yml")
+
+  err := ioutil.WriteFile(discoveryPath, []byte(discovery), 0600)
+  if err != nil {
+    return err
+  }
+  err = ioutil.WriteFile(appPath, []byte(app), 0600)
+  if err != nil {
+    return err
+  }
+
+  os.Setenv("CONFIG_DISCOVERY_PATH", discoveryPath)
+  os.Setenv("CONFIG_APP_PATH", appPath)
+  return nil
+}
+
+// browser follows redirects between the ui and Hydra and keeps cookies like a browser would. Redirects to other hosts, ex. meui, are not followed.
+type browser struct {
+  t *testing.T
+  client *http.Client
+}
+
+// page is the last response of a request after following redirects.
+type page struct {
+  Url *url.URL
+  Status int
+  Location string // Set when stopped at a redirect to another host
+  Body string
+}
+
+func newBrowser(t *testing.T) *browser {
+  jar, err := cookiejar.New(nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  client := *ui.Client() // Trusts the certificate of the ui
+  client.Jar = jar
+  client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+    for _, followed := range []string{ ui.URL, hydra.URL, upstream.URL, upstreamLogin.URL } {
+      if strings.HasPrefix(req.URL.String(), followed) {
+        return nil
+      }
+    }
+    return http.ErrUseLastResponse
+  }
+  return &browser{ t:t, client:&client }
+}
+
+func (b *browser) do(req *http.Request) *page {
+  b.t.Helper()
+
+  res, err := b.client.Do(req)
+  if err != nil {
+    b.t.Fatal(err)
+  }
+  defer res.Body.Close()
+
+  body, err := ioutil.ReadAll(res.Body)
+  if err != nil {
+    b.t.Fatal(err)
+  }
+
+  return &page{
+    Url: res.Request.URL,
+    Status: res.StatusCode,
+    Location: res.Header.Get("Location"),
+    Body: string(body),
+  }
+}
+
+func (b *browser) get(u string) *page {
+  b.t.Helper()
+
+  req, err := http.NewRequest("GET", u, nil)
+  if err != nil {
+    b.t.Fatal(err)
+  }
+  return b.do(req)
+}
+
+var (
+  formRegexp = regexp.MustCompile(`(?s)<form[^>]*action="([^"]*)"[^>]*>(.*?)</form>`)
+  inputRegexp = regexp.MustCompile(`<input[^>]*>`)
+  nameRegexp = regexp.MustCompile(`name="([^"]*)"`)
+  valueRegexp = regexp.MustCompile(`value="([^"]*)"`)
+)
+
+// submit posts the first form of the page with its hidden fields, including the CSRF token, and the fields given.
+func (b *browser) submit(p *page, fields map[string]string) *page {
+  b.t.Helper()
+  return b.submitForm(p, "", fields)
+}
+
+// submitForm posts the first form on the page that contains the text, ex. the value of its button.
+func (b *browser) submitForm(p *page, contains string, fields map[string]string) *page {
+  b.t.Helper()
+
+  if p.Status != http.StatusOK {
+    b.t.Fatalf("Expected a form on %s, got status %d", p.Url, p.Status)
+  }
+
+  var form []string
+  for _, f := range formRegexp.FindAllStringSubmatch(p.Body, -1) {
+    if strings.Contains(f[0], contains) {
+      form = f
+      break
+    }
+  }
+  if form == nil {
+    b.t.Fatalf("No form with %q on %s", contains, p.Url)
+  }
+
+  action, err := p.Url.Parse(html.UnescapeString(form[1]))
+  if err != nil {
+    b.t.Fatal(err)
+  }
+
+  values := url.Values{}
+  for _, input := range inputRegexp.FindAllString(form[2], -1) {
+    if strings.Contains(input, `type="hidden"`) == false {
+      continue
+    }
+    name := nameRegexp.FindStringSubmatch(input)
+    value := valueRegexp.FindStringSubmatch(input)
+    if name != nil && value != nil {
+      values.Set(html.UnescapeString(name[1]), html.UnescapeString(value[1]))
+    }
+  }
+  for k, v := range fields {
+    values.Set(k, v)
+  }
+
+  req, err := http.NewRequest("POST", action.String(), strings.NewReader(values.Encode()))
+  if err != nil {
+    b.t.Fatal(err)
+  }
+  req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+  req.Header.Set("Referer", p.Url.String())
+  return b.do(req)
+}
+
+// login signs in at the login page the browser was sent to by Hydra, and stays signed in with Hydra.
+func (b *browser) login(p *page, email string, password string) *page {
+  b.t.Helper()
+
+  expectPath(b.t, p, "/login")
+  if strings.Contains(p.Body, "<title>Choose an account</title>") {
+    p = b.chooseAccount(p, email)
+  }
+  return b.submit(p, map[string]string{ "email":email, "password":password, "remember":"on" })
+}
+
+var accountRegexp = regexp.MustCompile(`(?s)<a class="item" href="([^"]*)">(.*?)</a>`)
+
+// chooseAccount follows the account with the email in the account chooser, or uses another account when it is not listed.
+func (b *browser) chooseAccount(p *page, email string) *page {
+  b.t.Helper()
+
+  var other string
+  for _, item := range accountRegexp.FindAllStringSubmatch(p.Body, -1) {
+    u, err := p.Url.Parse(html.UnescapeString(item[1]))
+    if err != nil {
+      b.t.Fatal(err)
+    }
+    if strings.Contains(item[2], html.EscapeString(email)) {
+      return b.get(u.String())
+    }
+    if u.Query().Get("account") == "other" {
+      other = u.String()
+    }
+  }
+  if other == "" {
+    b.t.Fatalf("No account to choose on %s", p.Url)
+  }
+  return b.get(other)
+}
+
+func expectPath(t *testing.T, p *page, path string) {
+  t.Helper()
+
+  if p.Status != http.StatusOK || p.Url.Path != path {
+    t.Fatalf("Expected %s, got status %d on %s\n%s", path, p.Status, p.Url, p.Body)
+  }
+}
+
+func expectRedirectTo(t *testing.T, p *page, u string) {
+  t.Helper()
+
+  if p.Location != u {
+    t.Fatalf("Expected redirect to %s, got status %d on %s with location %q", u, p.Status, p.Url, p.Location)
+  }
+}
+
+var testHumans = 0
+
+// addHuman creates a human that can log in with a unique email.
+func addHuman(t *testing.T, password string) idp.Human {
+  testHumans = testHumans + 1
+  return fakeIdp.AddHuman(idp.Human{
+    Name: t.Name(),
+    Email: fmt.Sprintf("human%d@example.com", testHumans),
+    Password: password,
+    EmailConfirmedAt: 1,
+    AllowLogin: true,
+  })
+}
+
+// human reads the human as stored by the idp, secrets included.
+func human(t *testing.T, id string) (idp.Human, bool) {
+  h, exists := fakeIdp.Humans[id]
+  return h, exists
+}
+
+func TestRoutesFollowEndpoints(t *testing.T) {
+  sessionsUrl, err := url.Parse(ui.URL + "/account/sessions")
+  if err != nil {
+    t.Fatal(err)
+  }
+  endpoints := *uiEnv.Endpoints
+  endpoints.Idpui.Sessions = sessionsUrl
+  env := *uiEnv
+  env.Endpoints = &endpoints
+  r := router(&env)
+
+  for path, found := range map[string]bool{ "/account/sessions":true, "/sessions":false } {
+    w := httptest.NewRecorder()
+    r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+    if (w.Code != http.StatusNotFound) != found {
+      t.Fatalf("Expected %s to be served %v, got status %d", path, found, w.Code)
+    }
+  }
+}
+
+func TestLogin(t *testing.T) {
+  h := addHuman(t, "secret")
+  b := newBrowser(t)
+
+  p := b.login(b.get(ui.URL + "/password"), h.Email, "wrong")
+  expectPath(t, p, "/login")
+  if strings.Contains(p.Body, "Invalid") == false {
+    t.Fatal("Expected the password to be invalid")
+  }
+
+  p = b.login(p, h.Email, "secret")
+  expectPath(t, p, "/password")
+  if strings.Contains(p.Body, h.Id) == false {
+    t.Fatal("Expected the form for the logged in human")
+  }
+
+  // Hydra remembers the login
+  p = b.get(ui.URL + "/totp")
+  expectPath(t, p, "/totp")
+}
+
+func TestRememberMe(t *testing.T) {
+  h := addHuman(t, "secret")
+
+  // Not remembered, every login asks for credentials
+  b := newBrowser(t)
+  p := b.get(ui.URL + "/password")
+  expectPath(t, p, "/login")
+  if strings.Contains(p.Body, `name="remember"`) == false {
+    t.Fatal("Expected keep me signed in")
+  }
+  p = b.submit(p, map[string]string{ "email":h.Email, "password":"secret" })
+  expectPath(t, p, "/password")
+
+  p = b.get(ui.URL + "/password")
+  expectPath(t, p, "/login")
+
+  // Remembered, Hydra skips the login
+  p = b.login(p, h.Email, "secret")
+  expectPath(t, p, "/password")
+
+  p = b.get(ui.URL + "/password")
+  expectPath(t, p, "/password")
+}
+
+func TestLoginSkip(t *testing.T) {
+  h := addHuman(t, "secret")
+  other := addHuman(t, "secret")
+  b := newBrowser(t)
+
+  p := b.login(b.get(ui.URL + "/password"), h.Email, "secret")
+  expectPath(t, p, "/password")
+
+  // authorize starts a login for another client. Skipped logins end at the client with a code.
+  hydra.Clients["client"] = "client-secret"
+  authorize := func(params map[string]string) *page {
+    q := url.Values{}
+    q.Set("client_id", "client")
+    q.Set("response_type", "code")
+    q.Set("redirect_uri", testClientUrl + "/callback")
+    q.Set("scope", "openid")
+    for k, v := range params {
+      q.Set(k, v)
+    }
+    return b.get(hydra.URL + "/oauth2/auth?" + q.Encode())
+  }
+
+  p = authorize(nil)
+  if strings.HasPrefix(p.Location, testClientUrl + "/callback?code=") == false {
+    t.Fatalf("Expected the login to be skipped, got status %d on %s", p.Status, p.Url)
+  }
+
+  // The client forces credentials
+  for _, params := range []map[string]string{ {"prompt":"login"}, {"max_age":"0"} } {
+    p = authorize(params)
+    expectPath(t, p, "/login")
+  }
+
+  // Sensitive scopes always ask for credentials, and only the signed in human may give them
+  uiEnv.LoginPolicy.ReauthenticateScopes = []string{"openid"}
+  defer func() { uiEnv.LoginPolicy.ReauthenticateScopes = nil }()
+
+  p = authorize(nil)
+  expectPath(t, p, "/login")
+  if strings.Contains(p.Body, `name="remember"`) {
+    t.Fatal("Expected no keep me signed in, Hydra keeps the session it has")
+  }
+
+  // A wrong password does not tell whether the account exists
+  p = b.submit(p, map[string]string{ "email":other.Email, "password":"wrong" })
+  expectPath(t, p, "/login")
+  if strings.Contains(p.Body, "Not the signed in user") || strings.Contains(p.Body, "Invalid") == false {
+    t.Fatalf("Expected a wrong password to be refused as invalid\n%s", p.Body)
+  }
+
+  p = b.submit(p, map[string]string{ "email":other.Email, "password":"secret" })
+  expectPath(t, p, "/login")
+  if strings.Contains(p.Body, "Not the signed in user") == false {
+    t.Fatalf("Expected another human to be refused\n%s", p.Body)
+  }
+
+  p = b.submit(p, map[string]string{ "email":h.Email, "password":"secret" })
+  if strings.HasPrefix(p.Location, testClientUrl + "/callback?code=") == false {
+    t.Fatalf("Expected the login to be accepted, got status %d on %s", p.Status, p.Url)
+  }
+}
+
+func TestLoginWithUsername(t *testing.T) {
+  h := addHuman(t, "secret")
+  h.Username = fmt.Sprintf("human%d", testHumans)
+  fakeIdp.AddHuman(h)
+
+  // Only the email unless the deployment enables usernames
+  b := newBrowser(t)
+  p := b.login(b.get(ui.URL + "/password"), h.Username, "secret")
+  expectPath(t, p, "/login")
+  if strings.Contains(p.Body, "Invalid") == false {
+    t.Fatal("Expected the username to be refused")
+  }
+
+  uiEnv.LoginPolicy.Username = true
+  defer func() { uiEnv.LoginPolicy.Username = false }()
+
+  // Unknown humans get the same error as a wrong password
+  for _, identifier := range []string{ "nobody", "nobody@example.com" } {
+    b = newBrowser(t)
+    p = b.login(b.get(ui.URL + "/password"), identifier, "secret")
+    expectPath(t, p, "/login")
+    if strings.Contains(p.Body, "Invalid") == false || strings.Contains(p.Body, "Not found") {
+      t.Fatalf("Expected %s to be refused as a wrong password\n%s", identifier, p.Body)
+    }
+  }
+
+  b = newBrowser(t)
+  p = b.get(ui.URL + "/password")
+  if strings.Contains(p.Body, "E-mail or username") == false {
+    t.Fatal("Expected the username to be asked for")
+  }
+  p = b.login(p, h.Username, "secret")
+  expectPath(t, p, "/password")
+}
+
+func TestAccountChooser(t *testing.T) {
+  h := addHuman(t, "secret")
+  other := addHuman(t, "secret")
+  b := newBrowser(t)
+
+  // Nothing to choose on a new device. Not remembered with Hydra, so every visit logs in.
+  p := b.get(ui.URL + "/password")
+  expectPath(t, p, "/login")
+  if strings.Contains(p.Body, "<title>Authenticate</title>") == false {
+    t.Fatal("Expected the login form")
+  }
+  p = b.submit(p, map[string]string{ "email":h.Email, "password":"secret" })
+  expectPath(t, p, "/password")
+
+  p = b.get(ui.URL + "/password")
+  expectPath(t, p, "/login")
+  if strings.Contains(p.Body, h.Email) == false || strings.Contains(p.Body, "Use another account") == false {
+    t.Fatalf("Expected the account chooser\n%s", p.Body)
+  }
+
+  p = b.chooseAccount(p, other.Email)
+  if strings.Contains(p.Body, `value=""`) == false {
+    t.Fatal("Expected no email for another account")
+  }
+  p = b.submit(p, map[string]string{ "email":other.Email, "password":"secret" })
+  expectPath(t, p, "/password")
+
+  // Most recently used first, the chosen account is prefilled
+  p = b.get(ui.URL + "/password")
+  if strings.Index(p.Body, other.Email) > strings.Index(p.Body, h.Email) {
+    t.Fatal("Expected the most recent account first")
+  }
+  p = b.chooseAccount(p, h.Email)
+  if strings.Contains(p.Body, `value="` + h.Email + `"`) == false {
+    t.Fatal("Expected the chosen email")
+  }
+
+  // The login_hint of the client goes straight to the form
+  hydra.Clients["client"] = "client-secret"
+  q := url.Values{}
+  q.Set("client_id", "client")
+  q.Set("response_type", "code")
+  q.Set("redirect_uri", testClientUrl + "/callback")
+  q.Set("scope", "openid")
+  q.Set("login_hint", other.Email)
+  p = b.get(hydra.URL + "/oauth2/auth?" + q.Encode())
+  expectPath(t, p, "/login")
+  if strings.Contains(p.Body, `value="` + other.Email + `"`) == false {
+    t.Fatal("Expected the email of the login_hint")
+  }
+
+  // Forgetting the accounts shows the form again
+  p = b.get(ui.URL + "/password")
+  p = b.submit(p, nil)
+  expectPath(t, p, "/login")
+  if strings.Contains(p.Body, "<title>Authenticate</title>") == false || strings.Contains(p.Body, h.Email) {
+    t.Fatalf("Expected the accounts to be forgotten\n%s", p.Body)
+  }
+}
+
+var federatedRegexp = regexp.MustCompile(`<a class="[^"]*federated" href="([^"]*)">Sign in with ([^<]*)</a>`)
+
+// federatedLogin follows the sign in button of the upstream provider on the login page.
+func (b *browser) federatedLogin(p *page, name string) *page {
+  b.t.Helper()
+
+  expectPath(b.t, p, "/login")
+  for _, button := range federatedRegexp.FindAllStringSubmatch(p.Body, -1) {
+    if button[2] == name {
+      u, err := p.Url.Parse(html.UnescapeString(button[1]))
+      if err != nil {
+        b.t.Fatal(err)
+      }
+      return b.get(u.String())
+    }
+  }
+  b.t.Fatalf("No sign in with %s on %s", name, p.Url)
+  return nil
+}
+
+// expectLinked fails unless the upstream identity logs in as the human.
+func expectLinked(t *testing.T, provider string, subject string, humanId string) {
+  t.Helper()
+
+  link, err := uiEnv.FederationLinks.FindLink(provider, subject)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if link == nil || link.HumanId != humanId {
+    t.Fatalf("Expected %s at %s to be linked to %s, got %v", subject, provider, humanId, link)
+  }
+}
+
+func TestFederatedLogin(t *testing.T) {
+  h := addHuman(t, "secret")
+
+  // Corp is trusted for emails, the verified email links on first use
+  upstreamSubject = "corp-" + h.Id
+  upstreamClaims[upstreamSubject] = map[string]interface{}{ "email":h.Email, "email_verified":true, "name":h.Name }
+
+  b := newBrowser(t)
+  p := b.federatedLogin(b.get(ui.URL + "/password"), "Corp")
+  expectPath(t, p, "/password")
+  expectLinked(t, "corp", upstreamSubject, h.Id)
+
+  // An unverified email is not enough
+  other := addHuman(t, "secret")
+  upstreamSubject = "corp-" + other.Id
+  upstreamClaims[upstreamSubject] = map[string]interface{}{ "email":other.Email, "email_verified":false }
+
+  b = newBrowser(t)
+  p = b.federatedLogin(b.get(ui.URL + "/password"), "Corp")
+  expectPath(t, p, "/login")
+  if strings.Contains(p.Body, "Log in once to link your Corp account") == false {
+    t.Fatalf("Expected to log in to link\n%s", p.Body)
+  }
+}
+
+func TestFederatedLoginUnconfirmedEmail(t *testing.T) {
+  // Anyone can register the email of someone else, it stays unconfirmed
+  h := addHuman(t, "secret")
+  h.EmailConfirmedAt = 0
+  fakeIdp.AddHuman(h)
+
+  upstreamSubject = "corp-" + h.Id
+  upstreamClaims[upstreamSubject] = map[string]interface{}{ "email":h.Email, "email_verified":true }
+
+  b := newBrowser(t)
+  p := b.federatedLogin(b.get(ui.URL + "/password"), "Corp")
+  expectPath(t, p, "/login")
+  if strings.Contains(p.Body, "Log in once to link your Corp account") == false {
+    t.Fatalf("Expected to log in to link\n%s", p.Body)
+  }
+  if link, _ := uiEnv.FederationLinks.FindLink("corp", upstreamSubject); link != nil {
+    t.Fatal("Expected no link to a human with an unconfirmed email")
+  }
+}
+
+func TestFederatedLoginLinking(t *testing.T) {
+  h := addHuman(t, "secret")
+
+  // Partner is not trusted for emails, the human logs in once to link
+  upstreamSubject = "partner-" + h.Id
+  upstreamClaims[upstreamSubject] = map[string]interface{}{ "email":h.Email, "email_verified":true }
+
+  b := newBrowser(t)
+  p := b.federatedLogin(b.get(ui.URL + "/password"), "Partner")
+  expectPath(t, p, "/login")
+  if strings.Contains(p.Body, "Log in once to link your Partner account") == false || strings.Contains(p.Body, `value="` + h.Email + `"`) == false {
+    t.Fatalf("Expected to log in to link with the upstream email\n%s", p.Body)
+  }
+  if link, _ := uiEnv.FederationLinks.FindLink("partner", upstreamSubject); link != nil {
+    t.Fatal("Expected no link before logging in")
+  }
+
+  p = b.submit(p, map[string]string{ "email":h.Email, "password":"secret" })
+  expectPath(t, p, "/password")
+  expectLinked(t, "partner", upstreamSubject, h.Id)
+
+  // Linked, no password asked on another device
+  b = newBrowser(t)
+  p = b.federatedLogin(b.get(ui.URL + "/password"), "Partner")
+  expectPath(t, p, "/password")
+}
+
+func TestFederatedLoginSecondFactor(t *testing.T) {
+  key, err := totp.Generate(totp.GenerateOpts{ Issuer:"idpui", AccountName:"test" })
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  h := addHuman(t, "secret")
+  h.TotpRequired = true
+  h.TotpSecret = key.Secret()
+  fakeIdp.AddHuman(h)
+
+  // The ui cannot ask for the TOTP code, the upstream must have verified a second factor
+  upstreamSubject = "corp-" + h.Id
+  upstreamClaims[upstreamSubject] = map[string]interface{}{ "email":h.Email, "email_verified":true }
+
+  b := newBrowser(t)
+  p := b.federatedLogin(b.get(ui.URL + "/password"), "Corp")
+  expectPath(t, p, "/login")
+  if strings.Contains(p.Body, "Corp did not verify a second factor") == false {
+    t.Fatalf("Expected the login to be refused\n%s", p.Body)
+  }
+
+  upstreamClaims[upstreamSubject]["amr"] = []string{"pwd", "otp", "mfa"}
+  p = b.federatedLogin(p, "Corp")
+  expectPath(t, p, "/password")
+}
+
+func TestFederatedLoginLinkingSecondFactor(t *testing.T) {
+  key, err := totp.Generate(totp.GenerateOpts{ Issuer:"idpui", AccountName:"test" })
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  h := addHuman(t, "secret")
+  h.TotpRequired = true
+  h.TotpSecret = key.Secret()
+  fakeIdp.AddHuman(h)
+
+  upstreamSubject = "partner-" + h.Id
+  upstreamClaims[upstreamSubject] = map[string]interface{}{ "email":h.Email, "email_verified":true }
+
+  b := newBrowser(t)
+  p := b.federatedLogin(b.get(ui.URL + "/password"), "Partner")
+  expectPath(t, p, "/login")
+
+  // The password alone does not link, the second factor is still to come
+  p = b.submit(p, map[string]string{ "email":h.Email, "password":"secret" })
+  expectPath(t, p, "/verify")
+  if link, _ := uiEnv.FederationLinks.FindLink("partner", upstreamSubject); link != nil {
+    t.Fatal("Expected no link before the second factor")
+  }
+
+  code, err := totp.GenerateCode(key.Secret(), time.Now())
+  if err != nil {
+    t.Fatal(err)
+  }
+  p = b.submit(p, map[string]string{ "code":code })
+  expectPath(t, p, "/password")
+  expectLinked(t, "partner", upstreamSubject, h.Id)
+
+  // Partner is not trusted to verify the second factor, its mfa does not replace TOTP
+  upstreamClaims[upstreamSubject]["amr"] = []string{"pwd", "otp", "mfa"}
+  b = newBrowser(t)
+  p = b.federatedLogin(b.get(ui.URL + "/password"), "Partner")
+  expectPath(t, p, "/login")
+  if strings.Contains(p.Body, "Partner is not trusted to verify a second factor") == false {
+    t.Fatalf("Expected the login to be refused\n%s", p.Body)
+  }
+}
+
+func TestLinkedIdentities(t *testing.T) {
+  h := addHuman(t, "secret")
+
+  upstreamSubject = "partner-" + h.Id
+  upstreamClaims[upstreamSubject] = map[string]interface{}{ "email":"someone@partner.example", "email_verified":true }
+
+  b := newBrowser(t)
+  p := b.login(b.get(ui.URL + "/identities"), h.Email, "secret")
+  expectPath(t, p, "/identities")
+  if strings.Contains(p.Body, "No linked accounts") == false {
+    t.Fatalf("Expected no linked accounts\n%s", p.Body)
+  }
+
+  p = b.submitForm(p, "Link Partner", nil)
+  expectPath(t, p, "/identities")
+  expectLinked(t, "partner", upstreamSubject, h.Id)
+  if strings.Contains(p.Body, "someone@partner.example") == false || strings.Contains(p.Body, "Link Partner") {
+    t.Fatalf("Expected Partner to be listed as linked\n%s", p.Body)
+  }
+
+  // Logs in with the link
+  other := newBrowser(t)
+  p = other.federatedLogin(other.get(ui.URL + "/password"), "Partner")
+  expectPath(t, p, "/password")
+
+  p = b.submitForm(b.get(ui.URL + "/identities"), "Unlink Partner", nil)
+  expectPath(t, p, "/identities")
+  if link, _ := uiEnv.FederationLinks.FindLink("partner", upstreamSubject); link != nil {
+    t.Fatalf("Expected Partner to be unlinked, got %v", link)
+  }
+  if strings.Contains(p.Body, "No linked accounts") == false {
+    t.Fatalf("Expected no linked accounts\n%s", p.Body)
+  }
+}
+
+func TestUnlinkLastWayToLogIn(t *testing.T) {
+  h := addHuman(t, "secret")
+
+  upstreamSubject = "partner-" + h.Id
+  upstreamClaims[upstreamSubject] = map[string]interface{}{}
+
+  b := newBrowser(t)
+  p := b.login(b.get(ui.URL + "/identities"), h.Email, "secret")
+  p = b.submitForm(p, "Link Partner", nil)
+  expectLinked(t, "partner", upstreamSubject, h.Id)
+
+  // A human provisioned with a random password cannot recover it without a confirmed email
+  h.EmailConfirmedAt = 0
+  fakeIdp.AddHuman(h)
+
+  p = b.submitForm(b.get(ui.URL + "/identities"), "Unlink Partner", nil)
+  expectPath(t, p, "/identities")
+  if strings.Contains(p.Body, "Unlinking would leave no way to log in") == false {
+    t.Fatalf("Expected the last way to log in to stay linked\n%s", p.Body)
+  }
+  expectLinked(t, "partner", upstreamSubject, h.Id)
+
+  h.EmailConfirmedAt = 1
+  fakeIdp.AddHuman(h)
+
+  p = b.submitForm(b.get(ui.URL + "/identities"), "Unlink Partner", nil)
+  if link, _ := uiEnv.FederationLinks.FindLink("partner", upstreamSubject); link != nil {
+    t.Fatalf("Expected Partner to be unlinked, got %v", link)
+  }
+}
+
+func TestLinkedIdentityOfAnotherHuman(t *testing.T) {
+  h := addHuman(t, "secret")
+  other := addHuman(t, "secret")
+
+  upstreamSubject = "partner-" + other.Id
+  upstreamClaims[upstreamSubject] = map[string]interface{}{}
+  err := uiEnv.FederationLinks.CreateLink(federation.Link{ Provider:"partner", Subject:upstreamSubject, HumanId:other.Id })
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  b := newBrowser(t)
+  p := b.login(b.get(ui.URL + "/identities"), h.Email, "secret")
+  p = b.submitForm(p, "Link Partner", nil)
+  expectPath(t, p, "/identities")
+  if strings.Contains(p.Body, "This Partner account is linked to another account") == false {
+    t.Fatalf("Expected the link to be refused\n%s", p.Body)
+  }
+  expectLinked(t, "partner", upstreamSubject, other.Id)
+}
+
+// addDirectoryEntry adds an account with the uid to the directory, the email is optional.
+func addDirectoryEntry(uid string, email string, password string) {
+  attributes := map[string][]string{ "objectClass":{"person", "inetOrgPerson"}, "uid":{uid}, "cn":{"Directory " + uid} }
+  if email != "" {
+    attributes["mail"] = []string{email}
+  }
+  ldapDirectory.AddEntry(ldapfake.Entry{ Dn:"uid=" + uid + ",ou=people,dc=example,dc=com", Password:password, Attributes:attributes })
+}
+
+// humanWithUsername reads the human as stored by the idp, ex. after provisioning.
+func humanWithUsername(t *testing.T, username string) (found idp.Human, exists bool) {
+  for _, h := range fakeIdp.Humans {
+    if h.Username == username {
+      if exists {
+        t.Fatalf("Expected one human with username %s", username)
+      }
+      found, exists = h, true
+    }
+  }
+  return found, exists
+}
+
+func TestLdapLogin(t *testing.T) {
+  uid := "ldap-" + strings.ToLower(t.Name())
+  addDirectoryEntry(uid, uid + "@corp.example", "directory secret")
+
+  b := newBrowser(t)
+  p := b.login(b.get(ui.URL + "/password"), uid, "wrong")
+  expectPath(t, p, "/login")
+  if strings.Contains(p.Body, "Invalid") == false {
+    t.Fatal("Expected the password to be invalid")
+  }
+  if _, exists := humanWithUsername(t, uid); exists {
+    t.Fatal("Expected no human provisioned for a wrong password")
+  }
+
+  // Provisioned on first login, with the email the directory vouches for
+  p = b.login(p, uid, "directory secret")
+  expectPath(t, p, "/password")
+  h, exists := humanWithUsername(t, uid)
+  if exists == false || h.Email != uid + "@corp.example" || h.Name != "Directory " + uid || h.EmailConfirmedAt == 0 {
+    t.Fatalf("Expected the human to be provisioned from the directory, got %v", h)
+  }
+  if strings.Contains(p.Body, h.Id) == false {
+    t.Fatal("Expected the form for the provisioned human")
+  }
+
+  // Matched on later logins
+  b = newBrowser(t)
+  p = b.login(b.get(ui.URL + "/password"), uid, "directory secret")
+  expectPath(t, p, "/password")
+  humanWithUsername(t, uid)
+}
+
+// matchDirectoryEmails lets directory entries log in as the human with the same confirmed email, see ldap.matchEmail. Call the returned func to stop.
+func matchDirectoryEmails() func() {
+  authenticators := uiEnv.Authenticators
+  var matching app.Authenticators
+  for _, a := range authenticators {
+    if l, ok := a.(app.LdapAuthenticator); ok {
+      l.MatchEmail = true
+      a = l
+    }
+    matching = append(matching, a)
+  }
+  uiEnv.Authenticators = matching
+  return func() { uiEnv.Authenticators = authenticators }
+}
+
+func TestLdapLoginMatchesHumanByEmail(t *testing.T) {
+  h := addHuman(t, "secret")
+  addDirectoryEntry("ldap-" + h.Id, h.Email, "directory secret")
+
+  // Not by default, nor is a second human provisioned with the email
+  b := newBrowser(t)
+  p := b.login(b.get(ui.URL + "/password"), "ldap-" + h.Id, "directory secret")
+  expectPath(t, p, "/login")
+  if strings.Contains(p.Body, "Invalid") == false {
+    t.Fatalf("Expected the directory login to be refused\n%s", p.Body)
+  }
+  if _, exists := humanWithUsername(t, "ldap-" + h.Id); exists {
+    t.Fatal("Expected no human provisioned with the email of another")
+  }
+
+  defer matchDirectoryEmails()()
+
+  p = b.login(p, "ldap-" + h.Id, "directory secret")
+  expectPath(t, p, "/password")
+  if strings.Contains(p.Body, h.Id) == false {
+    t.Fatal("Expected the form for the human with the email of the entry")
+  }
+
+  // The password of the idp still works, it is checked first
+  b = newBrowser(t)
+  p = b.login(b.get(ui.URL + "/password"), h.Email, "secret")
+  expectPath(t, p, "/password")
+
+  // Only a confirmed email matches
+  h.EmailConfirmedAt = 0
+  fakeIdp.AddHuman(h)
+
+  b = newBrowser(t)
+  p = b.login(b.get(ui.URL + "/password"), "ldap-" + h.Id, "directory secret")
+  expectPath(t, p, "/login")
+  if strings.Contains(p.Body, "Invalid") == false {
+    t.Fatalf("Expected the directory login to be refused\n%s", p.Body)
+  }
+}
+
+func TestLdapLoginSecondFactor(t *testing.T) {
+  key, err := totp.Generate(totp.GenerateOpts{ Issuer:"idpui", AccountName:"test" })
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  h := addHuman(t, "secret")
+  h.TotpRequired = true
+  h.TotpSecret = key.Secret()
+  fakeIdp.AddHuman(h)
+  addDirectoryEntry("ldap-" + h.Id, h.Email, "directory secret")
+  defer matchDirectoryEmails()()
+
+  // The idp only asks for the code after its own password check
+  b := newBrowser(t)
+  p := b.login(b.get(ui.URL + "/password"), "ldap-" + h.Id, "directory secret")
+  expectPath(t, p, "/login")
+  if strings.Contains(p.Body, "Second factor required") == false {
+    t.Fatalf("Expected the directory login to be refused\n%s", p.Body)
+  }
+
+  p = b.login(p, h.Email, "secret")
+  expectPath(t, p, "/verify")
+}
+
+var loginLinkRegexp = regexp.MustCompile(`href="([^"]*)">Email me a sign-in link</a>`)
+
+// requestLoginLink asks for a sign-in link from the login page.
+func (b *browser) requestLoginLink(p *page, email string) *page {
+  b.t.Helper()
+
+  expectPath(b.t, p, "/login")
+  m := loginLinkRegexp.FindStringSubmatch(p.Body)
+  if m == nil {
+    b.t.Fatalf("No sign-in link on %s\n%s", p.Url, p.Body)
+  }
+  u, err := p.Url.Parse(html.UnescapeString(m[1]))
+  if err != nil {
+    b.t.Fatal(err)
+  }
+
+  p = b.get(u.String())
+  expectPath(b.t, p, "/login/link")
+  p = b.submit(p, map[string]string{ "email":email })
+  expectPath(b.t, p, "/login/link")
+  if strings.Contains(p.Body, "a sign-in link was sent") == false {
+    b.t.Fatalf("Expected the link to be sent\n%s", p.Body)
+  }
+  return p
+}
+
+func TestLoginLink(t *testing.T) {
+  h := addHuman(t, "secret")
+  b := newBrowser(t)
+
+  b.requestLoginLink(b.get(ui.URL + "/password"), h.Email)
+  link := fakeIdp.Mailed[h.Email]
+  if strings.HasPrefix(link, ui.URL + "/login/link/open?") == false {
+    t.Fatalf("Expected a link to the ui, got %q", link)
+  }
+
+  // Only the browser that asked for it
+  p := newBrowser(t).get(link)
+  if p.Status != http.StatusForbidden || strings.Contains(p.Body, "Open the link in the browser you asked for it in") == false {
+    t.Fatalf("Expected another browser to be refused, got status %d\n%s", p.Status, p.Body)
+  }
+
+  p = b.get(link)
+  expectPath(t, p, "/password")
+
+  // Once
+  p = b.get(link)
+  if p.Status != http.StatusForbidden {
+    t.Fatalf("Expected the link to be used, got status %d on %s", p.Status, p.Url)
+  }
+
+  // The link is not a password, pages that require one ask for it
+  amr := uiEnv.StepUp.Password.Amr
+  uiEnv.StepUp.Password.Amr = []string{"pwd"}
+  defer func() { uiEnv.StepUp.Password.Amr = amr }()
+
+  b = newBrowser(t)
+  b.requestLoginLink(b.get(ui.URL + "/password"), h.Email)
+  p = b.get(fakeIdp.Mailed[h.Email])
+  expectPath(t, p, "/login")
+
+  p = b.login(p, h.Email, "secret")
+  expectPath(t, p, "/password")
+}
+
+func TestLoginLinkExpired(t *testing.T) {
+  h := addHuman(t, "secret")
+  b := newBrowser(t)
+
+  b.requestLoginLink(b.get(ui.URL + "/password"), h.Email)
+  link, err := url.Parse(fakeIdp.Mailed[h.Email])
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  id := link.Query().Get("email_challenge")
+  challenge := fakeIdp.Challenges[id]
+  if challenge.TTL != 300 {
+    t.Fatalf("Expected the link to expire after login.link.ttl, got %d", challenge.TTL)
+  }
+  challenge.ExpiresAt = time.Now().Unix() - 1
+  fakeIdp.Challenges[id] = challenge
+
+  p := b.get(link.String())
+  expectPath(t, p, "/login/link")
+  if strings.Contains(p.Body, "The link has expired") == false {
+    t.Fatalf("Expected the link to be expired\n%s", p.Body)
+  }
+}
+
+func TestLoginLinkNotSent(t *testing.T) {
+  h := addHuman(t, "secret")
+  h.TotpRequired = true // The link would skip the second factor
+  fakeIdp.AddHuman(h)
+
+  for _, email := range []string{ h.Email, "nobody@example.com" } {
+    b := newBrowser(t)
+    b.requestLoginLink(b.get(ui.URL + "/password"), email)
+    if _, sent := fakeIdp.Mailed[email]; sent {
+      t.Fatalf("Expected no link for %s", email)
+    }
+  }
+}
+
+// deviceAuthorization starts a device authorization request with Hydra, as a device does, and returns the device code it polls with and the user code it shows.
+func deviceAuthorization(t *testing.T, clientId string, scope string) (deviceCode string, userCode string) {
+  t.Helper()
+
+  res, err := http.PostForm(hydra.URL + "/oauth2/device/auth", url.Values{ "client_id":{clientId}, "scope":{scope} })
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer res.Body.Close()
+
+  var authorization struct {
+    DeviceCode string `json:"device_code"`
+    UserCode string `json:"user_code"`
+  }
+  err = json.NewDecoder(res.Body).Decode(&authorization)
+  if err != nil || res.StatusCode != http.StatusOK {
+    t.Fatalf("Device authorization failed with status %d: %v", res.StatusCode, err)
+  }
+  return authorization.DeviceCode, authorization.UserCode
+}
+
+// pollDevice asks Hydra for the tokens of the device code and returns the error, empty when tokens were issued.
+func pollDevice(t *testing.T, clientId string, deviceCode string) string {
+  t.Helper()
+
+  res, err := http.PostForm(hydra.URL + "/oauth2/token", url.Values{
+    "grant_type": {"urn:ietf:params:oauth:grant-type:device_code"},
+    "client_id": {clientId},
+    "device_code": {deviceCode},
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer res.Body.Close()
+
+  var token struct {
+    AccessToken string `json:"access_token"`
+    Error string `json:"error"`
+  }
+  err = json.NewDecoder(res.Body).Decode(&token)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if token.Error == "" && token.AccessToken == "" {
+    t.Fatalf("Expected an access token or an error, got status %d", res.StatusCode)
+  }
+  return token.Error
+}
+
+func TestDeviceAuthorization(t *testing.T) {
+  h := addHuman(t, "secret")
+  hydra.Clients["tv"] = "" // Public client
+  hydra.ClientNames["tv"] = "Living Room TV"
+  defer delete(hydra.ClientNames, "tv")
+
+  deviceCode, userCode := deviceAuthorization(t, "tv", "openid offline")
+  if e := pollDevice(t, "tv", deviceCode); e != "authorization_pending" {
+    t.Fatalf("Expected authorization_pending, got %q", e)
+  }
+
+  b := newBrowser(t)
+
+  // Hydra issues the device challenge of the page
+  p := b.get(ui.URL + "/device")
+  expectPath(t, p, "/device")
+  if p.Url.Query().Get("device_challenge") == "" {
+    t.Fatalf("Expected a device challenge, got %s", p.Url)
+  }
+
+  for code, message := range map[string]string{ "BCDF": "Invalid code", "AAAA-AAAA": "Invalid code", "BBBB-BBBB": "Unknown or expired code" } {
+    p = b.submit(p, map[string]string{ "user_code":code })
+    expectPath(t, p, "/device")
+    if strings.Contains(p.Body, message) == false {
+      t.Fatalf("Expected %q for %s\n%s", message, code, p.Body)
+    }
+  }
+
+  // Codes are typed as humans read them
+  p = b.submit(p, map[string]string{ "user_code":strings.ToLower(userCode[:4] + " - " + userCode[4:]) })
+
+  // The human sees who asks for access before logging in
+  expectPath(t, p, "/device/confirm")
+  for _, expected := range []string{ "Living Room TV", "offline", userCode[:4] + "-" + userCode[4:] } {
+    if strings.Contains(p.Body, expected) == false {
+      t.Fatalf("Expected %q on the confirmation\n%s", expected, p.Body)
+    }
+  }
+
+  p = b.submitForm(p, `value="Confirm"`, nil)
+  p = b.login(p, h.Email, "secret")
+  expectPath(t, p, "/device/done")
+  if strings.Contains(p.Body, "Your device is connected") == false {
+    t.Fatalf("Expected the device to be connected\n%s", p.Body)
+  }
+
+  if e := pollDevice(t, "tv", deviceCode); e != "" {
+    t.Fatalf("Expected tokens for the device, got %q", e)
+  }
+  if e := pollDevice(t, "tv", deviceCode); e != "invalid_grant" {
+    t.Fatalf("Expected the device code to be used, got %q", e)
+  }
+}
+
+func TestDeviceAuthorizationCodeUsedOnce(t *testing.T) {
+  h := addHuman(t, "secret")
+  hydra.Clients["tv"] = ""
+
+  deviceCode, userCode := deviceAuthorization(t, "tv", "openid")
+
+  // The verification_uri_complete of the device fills in the code
+  b := newBrowser(t)
+  p := b.get(ui.URL + "/device?user_code=" + userCode)
+  expectPath(t, p, "/device")
+  if strings.Contains(p.Body, `value="` + userCode + `"`) == false {
+    t.Fatalf("Expected the code to be filled in\n%s", p.Body)
+  }
+
+  p = b.submit(p, map[string]string{ "user_code":userCode })
+  p = b.submitForm(p, `value="Confirm"`, nil)
+  expectPath(t, p, "/login")
+
+  // Hydra accepts a code once, another browser cannot take over the device
+  other := newBrowser(t)
+  q := other.get(ui.URL + "/device")
+  q = other.submit(q, map[string]string{ "user_code":userCode })
+  expectPath(t, q, "/device")
+  if strings.Contains(q.Body, "Unknown or expired code") == false {
+    t.Fatalf("Expected the code to be used\n%s", q.Body)
+  }
+
+  p = b.login(p, h.Email, "secret")
+  expectPath(t, p, "/device/done")
+  if e := pollDevice(t, "tv", deviceCode); e != "" {
+    t.Fatalf("Expected tokens for the device, got %q", e)
+  }
+}
+
+func TestDeviceAuthorizationUserCodeFormat(t *testing.T) {
+  h := addHuman(t, "secret")
+  hydra.Clients["tv"] = ""
+
+  // Hydra configured with shorter codes of digits
+  hydra.UserCodeAlphabet, uiEnv.DeviceUserCodeAlphabet = "0123456789", "0123456789"
+  hydra.UserCodeLength, uiEnv.DeviceUserCodeLength = 6, 6
+  defer func() {
+    hydra.UserCodeAlphabet, uiEnv.DeviceUserCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ", "BCDFGHJKLMNPQRSTVWXZ"
+    hydra.UserCodeLength, uiEnv.DeviceUserCodeLength = 8, 8
+  }()
+
+  deviceCode, userCode := deviceAuthorization(t, "tv", "openid")
+
+  b := newBrowser(t)
+  p := b.get(ui.URL + "/device")
+  p = b.submit(p, map[string]string{ "user_code":"BCDF-GHJK" })
+  expectPath(t, p, "/device")
+  if strings.Contains(p.Body, "Invalid code") == false {
+    t.Fatalf("Expected codes of the default alphabet to be invalid\n%s", p.Body)
+  }
+
+  p = b.submit(p, map[string]string{ "user_code":userCode[:3] + " " + userCode[3:] })
+  expectPath(t, p, "/device/confirm")
+  p = b.submitForm(p, `value="Confirm"`, nil)
+  p = b.login(p, h.Email, "secret")
+  expectPath(t, p, "/device/done")
+  if e := pollDevice(t, "tv", deviceCode); e != "" {
+    t.Fatalf("Expected tokens for the device, got %q", e)
+  }
+}
+
+func TestDeviceAuthorizationDenied(t *testing.T) {
+  hydra.Clients["tv"] = ""
+
+  deviceCode, userCode := deviceAuthorization(t, "tv", "openid")
+
+  b := newBrowser(t)
+  p := b.get(ui.URL + "/device")
+  p = b.submit(p, map[string]string{ "user_code":userCode })
+  expectPath(t, p, "/device/confirm")
+
+  p = b.submitForm(p, `value="Deny"`, nil)
+  expectPath(t, p, "/device/done")
+  if strings.Contains(p.Body, "denied access") == false {
+    t.Fatalf("Expected the device to be denied\n%s", p.Body)
+  }
+
+  if e := pollDevice(t, "tv", deviceCode); e != "access_denied" {
+    t.Fatalf("Expected access_denied, got %q", e)
+  }
+
+  // Logging in later is not taken for the denied device
+  p = b.get(ui.URL + "/sessions")
+  expectPath(t, p, "/login")
+}
+
+func TestLoginWithTotp(t *testing.T) {
+  key, err := totp.Generate(totp.GenerateOpts{ Issuer:"idpui", AccountName:"test" })
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  h := addHuman(t, "secret")
+  h.TotpRequired = true
+  h.TotpSecret = key.Secret()
+  fakeIdp.AddHuman(h)
+
+  b := newBrowser(t)
+
+  p := b.login(b.get(ui.URL + "/password"), h.Email, "secret")
+  expectPath(t, p, "/verify")
+
+  code, err := totp.GenerateCode(key.Secret(), time.Now())
+  if err != nil {
+    t.Fatal(err)
+  }
+  p = b.submit(p, map[string]string{ "code":code })
+  expectPath(t, p, "/password")
+}
+
+// loginWithEmailOtp logs the human with TOTP in at the login page, entering the code sent by email instead of TOTP.
+func (b *browser) loginWithEmailOtp(p *page, email string, password string) *page {
+  b.t.Helper()
+
+  p = b.login(p, email, password)
+  expectPath(b.t, p, "/verify")
+  p = b.submitForm(p, "Send me a code by email", nil)
+  expectPath(b.t, p, "/verify/email")
+
+  link, err := url.Parse(fakeIdp.Mailed[email])
+  if err != nil {
+    b.t.Fatal(err)
+  }
+  if link.Path != "/verify/email" || link.Query().Get("email_challenge") != p.Url.Query().Get("email_challenge") {
+    b.t.Fatalf("Expected the code for %s, got %q", p.Url, link)
+  }
+
+  return b.submit(p, map[string]string{ "code":link.Query().Get("code") })
+}
+
+func TestLoginWithEmailOtp(t *testing.T) {
+  emailOtp := uiEnv.StepUp.Password.EmailOtp
+  uiEnv.StepUp.Password.EmailOtp = true
+  defer func() { uiEnv.StepUp.Password.EmailOtp = emailOtp }()
+
+  h := addHuman(t, "secret")
+  h.TotpRequired = true
+  h.TotpSecret = "lost"
+  fakeIdp.AddHuman(h)
+
+  b := newBrowser(t)
+
+  p := b.login(b.get(ui.URL + "/password"), h.Email, "secret")
+  expectPath(t, p, "/verify")
+  p = b.submitForm(p, "Send me a code by email", nil)
+  expectPath(t, p, "/verify/email")
+
+  link := fakeIdp.Mailed[h.Email]
+
+  // Only the browser that asked for it
+  other := newBrowser(t).get(link)
+  if other.Status != http.StatusForbidden || strings.Contains(other.Body, "Enter the code in the browser you asked for it in") == false {
+    t.Fatalf("Expected another browser to be refused, got status %d\n%s", other.Status, other.Body)
+  }
+
+  p = b.submit(p, map[string]string{ "code":"000000x" })
+  expectPath(t, p, "/verify/email")
+  if strings.Contains(p.Body, "Invalid") == false {
+    t.Fatalf("Expected the code to be invalid\n%s", p.Body)
+  }
+
+  // The mailed link carries the code
+  p = b.get(link)
+  expectPath(t, p, "/password")
+}
+
+func TestStepUpEmailOtp(t *testing.T) {
+  h := addHuman(t, "secret")
+  h.TotpRequired = true
+  h.TotpSecret = "lost"
+  fakeIdp.AddHuman(h)
+
+  // By default a code sent by email is not a second factor for the sensitive pages.
+  b := newBrowser(t)
+  p := b.loginWithEmailOtp(b.get(ui.URL + "/password"), h.Email, "secret")
+  expectPath(t, p, "/login")
+
+  uiEnv.StepUp.Password.EmailOtp = true
+  defer func() { uiEnv.StepUp.Password.EmailOtp = false }()
+
+  b = newBrowser(t)
+  p = b.loginWithEmailOtp(b.get(ui.URL + "/password"), h.Email, "secret")
+  expectPath(t, p, "/password")
+}
+
+func TestEmailOtpNotSentWithoutConfirmedEmail(t *testing.T) {
+  h := addHuman(t, "secret")
+  h.TotpRequired = true
+  h.TotpSecret = "lost"
+  fakeIdp.AddHuman(h)
+
+  b := newBrowser(t)
+  p := b.login(b.get(ui.URL + "/password"), h.Email, "secret")
+  expectPath(t, p, "/verify")
+
+  h.EmailConfirmedAt = 0
+  fakeIdp.AddHuman(h)
+
+  p = b.submitForm(p, "Send me a code by email", nil)
+  expectPath(t, p, "/verify")
+  if strings.Contains(p.Body, "No confirmed email to send a code to") == false {
+    t.Fatalf("Expected no code to be sent\n%s", p.Body)
+  }
+  if _, sent := fakeIdp.Mailed[h.Email]; sent {
+    t.Fatal("Expected no code to be mailed")
+  }
+}
+
+func TestTrustedDevice(t *testing.T) {
+  key, err := totp.Generate(totp.GenerateOpts{ Issuer:"idpui", AccountName:"test" })
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  h := addHuman(t, "secret")
+  h.TotpRequired = true
+  h.TotpSecret = key.Secret()
+  fakeIdp.AddHuman(h)
+
+  b := newBrowser(t)
+
+  p := b.login(b.get(ui.URL + "/password"), h.Email, "secret")
+  expectPath(t, p, "/verify")
+  if strings.Contains(p.Body, "Trust this device for 30 days") == false {
+    t.Fatalf("Expected to be offered to trust the device\n%s", p.Body)
+  }
+
+  code, err := totp.GenerateCode(key.Secret(), time.Now())
+  if err != nil {
+    t.Fatal(err)
+  }
+  p = b.submit(p, map[string]string{ "code":code, "trust_device":"on" })
+  expectPath(t, p, "/password")
+
+  // By default a sensitive page asks for the second factor on a trusted device too
+  p = b.get(ui.URL + "/totp")
+  p = b.login(p, h.Email, "secret")
+  expectPath(t, p, "/verify")
+
+  uiEnv.StepUp.Totp.TrustedDevice = true
+  defer func() { uiEnv.StepUp.Totp.TrustedDevice = false }()
+
+  // The skipped login proves no second factor, logging in again on the trusted device does.
+  p = b.get(ui.URL + "/totp")
+  p = b.login(p, h.Email, "secret")
+  expectPath(t, p, "/totp")
+
+  // Other devices are not trusted
+  other := newBrowser(t)
+  p = other.login(other.get(ui.URL + "/password"), h.Email, "secret")
+  expectPath(t, p, "/verify")
+
+  p = b.login(b.get(ui.URL + "/devices/trusted"), h.Email, "secret")
+  expectPath(t, p, "/verify")
+
+  code, err = totp.GenerateCode(key.Secret(), time.Now())
+  if err != nil {
+    t.Fatal(err)
+  }
+  p = b.submit(p, map[string]string{ "code":code })
+  expectPath(t, p, "/devices/trusted")
+  if strings.Contains(p.Body, "This device") == false {
+    t.Fatalf("Expected the device to be listed\n%s", p.Body)
+  }
+
+  // The page is shown again after a login, which asks for the second factor once the device is revoked.
+  p = b.submitForm(p, "Revoke all devices", nil)
+  p = b.login(p, h.Email, "secret")
+  expectPath(t, p, "/verify")
+
+  code, err = totp.GenerateCode(key.Secret(), time.Now())
+  if err != nil {
+    t.Fatal(err)
+  }
+  p = b.submit(p, map[string]string{ "code":code })
+  expectPath(t, p, "/devices/trusted")
+  if strings.Contains(p.Body, "No trusted devices") == false {
+    t.Fatalf("Expected the device to be revoked\n%s", p.Body)
+  }
+}
+
+// authorizeClient authorizes another client with the remembered login of the browser.
+func (b *browser) authorizeClient(clientId string) {
+  b.t.Helper()
+
+  q := url.Values{}
+  q.Set("client_id", clientId)
+  q.Set("response_type", "code")
+  q.Set("redirect_uri", testClientUrl + "/callback")
+  q.Set("scope", "openid")
+  p := b.get(hydra.URL + "/oauth2/auth?" + q.Encode())
+  if strings.HasPrefix(p.Location, testClientUrl + "/callback?code=") == false {
+    b.t.Fatalf("Expected %s to be authorized, got status %d on %s", clientId, p.Status, p.Url)
+  }
+}
+
+func TestSessions(t *testing.T) {
+  h := addHuman(t, "secret")
+  b := newBrowser(t)
+
+  p := b.login(b.get(ui.URL + "/sessions"), h.Email, "secret")
+  expectPath(t, p, "/sessions")
+  if strings.Contains(p.Body, "No apps have access") == false {
+    t.Fatalf("Expected the ui itself not to be listed\n%s", p.Body)
+  }
+  if hydra.Tokens(h.Id) != 0 {
+    t.Fatal("Expected the access token of the page to be revoked once rendered")
+  }
+
+  // Both apps skip the login with the session of the ui
+  hydra.Clients["printer"] = "printer-secret"
+  hydra.ClientNames["printer"] = "Photo Printer"
+  hydra.Clients["notes"] = "notes-secret"
+  hydra.ClientNames["notes"] = "Notes"
+  b.authorizeClient("printer")
+  b.authorizeClient("notes")
+
+  p = b.get(ui.URL + "/sessions")
+  expectPath(t, p, "/sessions")
+  if strings.Contains(p.Body, "Photo Printer") == false || strings.Contains(p.Body, "Notes") == false {
+    t.Fatalf("Expected both apps to be listed\n%s", p.Body)
+  }
+
+  p = b.submitForm(p, `value="notes"`, nil)
+  expectPath(t, p, "/sessions")
+  if strings.Contains(p.Body, "Notes") || strings.Contains(p.Body, "Photo Printer") == false {
+    t.Fatalf("Expected only the access of Notes to be revoked\n%s", p.Body)
+  }
+
+  p = b.submitForm(p, "Sign out everywhere", nil)
+  expectPath(t, p, "/seeyoulater")
+  if hydra.Sessions(h.Id) != 0 || hydra.Tokens(h.Id) != 0 {
+    t.Fatal("Expected every session and token to be revoked")
+  }
+
+  p = b.get(ui.URL + "/sessions")
+  expectPath(t, p, "/login")
+}
+
+// withHydraSession gives a new browser the Hydra cookies of b, a second visit with the remembered login but without a session in the ui.
+func (b *browser) withHydraSession(t *testing.T) *browser {
+  u, err := url.Parse(hydra.URL)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  other := newBrowser(t)
+  other.client.Jar.SetCookies(u, b.client.Jar.Cookies(u))
+  return other
+}
+
+func TestStepUpMaxAge(t *testing.T) {
+  h := addHuman(t, "secret")
+  b := newBrowser(t)
+
+  p := b.login(b.get(ui.URL + "/password"), h.Email, "secret")
+  expectPath(t, p, "/password")
+
+  // A remembered login older than the max age of the page is not skipped by Hydra.
+  hydra.AgeSessions(h.Id, time.Hour)
+  p = b.withHydraSession(t).get(ui.URL + "/password")
+  expectPath(t, p, "/login")
+}
+
+func TestStepUpSecondFactor(t *testing.T) {
+  key, err := totp.Generate(totp.GenerateOpts{ Issuer:"idpui", AccountName:"test" })
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  h := addHuman(t, "secret")
+  h.TotpRequired = true
+  h.TotpSecret = key.Secret()
+  fakeIdp.AddHuman(h)
+
+  b := newBrowser(t)
+
+  p := b.login(b.get(ui.URL + "/password"), h.Email, "secret")
+  expectPath(t, p, "/verify")
+
+  code, err := totp.GenerateCode(key.Secret(), time.Now())
+  if err != nil {
+    t.Fatal(err)
+  }
+  p = b.submit(p, map[string]string{ "code":code })
+  expectPath(t, p, "/password")
+
+  // The skipped login proves no second factor, so the human must log in again.
+  other := b.withHydraSession(t)
+  p = other.get(ui.URL + "/totp")
+  expectPath(t, p, "/login")
+
+  p = other.login(p, h.Email, "secret")
+  expectPath(t, p, "/verify")
+}
+
+func TestStepUpDelete(t *testing.T) {
+  maxAge := uiEnv.StepUp.Delete.MaxAge
+  uiEnv.StepUp.Delete.MaxAge = 1
+  defer func() { uiEnv.StepUp.Delete.MaxAge = maxAge }()
+
+  h := addHuman(t, "secret")
+  b := newBrowser(t)
+
+  p := b.login(b.get(ui.URL + "/delete"), h.Email, "secret")
+  expectPath(t, p, "/delete")
+
+  // The form was shown for a login that is too old by the time it is submitted.
+  time.Sleep(2100 * time.Millisecond)
+  p = b.submit(p, map[string]string{ "risk_accepted":"on" })
+  expectPath(t, p, "/login")
+
+  p = b.login(p, h.Email, "secret")
+  expectPath(t, p, "/delete")
+
+  if _, exists := human(t, h.Id); exists == false {
+    t.Fatal("Expected the human to exist")
+  }
+}
+
+func TestStepUpSubmit(t *testing.T) {
+  requirements := []*app.AuthenticationRequirement{ uiEnv.StepUp.Password, uiEnv.StepUp.Totp, uiEnv.StepUp.EmailChange }
+  for _, r := range requirements {
+    defer func(r *app.AuthenticationRequirement, maxAge int) { r.MaxAge = maxAge }(r, r.MaxAge)
+    r.MaxAge = 2
+  }
+
+  h := addHuman(t, "secret")
+  b := newBrowser(t)
+
+  password := b.login(b.get(ui.URL + "/password"), h.Email, "secret")
+  expectPath(t, password, "/password")
+  totp := b.get(ui.URL + "/totp")
+  expectPath(t, totp, "/totp")
+  emailChange := b.get(ui.URL + "/emailchange")
+  expectPath(t, emailChange, "/emailchange")
+  p := b.submit(b.get(ui.URL + "/emailchange"), map[string]string{ "email":"changed." + h.Email })
+  expectPath(t, p, "/emailchangeconfirm")
+  emailChangeConfirm := p
+
+  // The forms were shown for a login that is too old by the time they are submitted, posting them does not skip the step-up.
+  time.Sleep(3100 * time.Millisecond)
+  for _, test := range []struct{ page *page; fields map[string]string }{
+    { password, map[string]string{ "password":"velvet lantern orbit", "password_retyped":"velvet lantern orbit" } },
+    { totp, map[string]string{ "totp":"000000" } },
+    { emailChange, map[string]string{ "email":"other." + h.Email } },
+    { emailChangeConfirm, map[string]string{ "code":fakeIdp.Code(emailChangeConfirm.Url.Query().Get("state")) } },
+  } {
+    p := b.submit(test.page, test.fields)
+    if p.Location != "" || p.Url.Path != "/login" {
+      t.Errorf("Expected %s to send a stale login to log in again, got status %d on %s", test.page.Url.Path, p.Status, p.Url)
+    }
+  }
+
+  unchanged, _ := human(t, h.Id)
+  if unchanged.Password != "secret" || unchanged.TotpRequired || unchanged.Email != h.Email {
+    t.Fatal("Expected the human to be unchanged")
+  }
+}
+
+func TestStepUpForm(t *testing.T) {
+  acr := uiEnv.StepUp.Sessions.Acr
+  defer func() { uiEnv.StepUp.Sessions.Acr = acr }()
+
+  h := addHuman(t, "secret")
+  b := newBrowser(t)
+
+  p := b.login(b.get(ui.URL + "/sessions"), h.Email, "secret")
+  expectPath(t, p, "/sessions")
+  if strings.Contains(p.Body, `name="id_token"`) {
+    t.Fatal("Expected no id token in the forms")
+  }
+
+  // The login remembered by the page is checked against the whole requirement when the form is submitted
+  uiEnv.StepUp.Sessions.Acr = []string{"otp"}
+  p = b.submitForm(p, "Sign out everywhere", nil)
+  if p.Url.Path == "/seeyoulater" || hydra.Sessions(h.Id) == 0 {
+    t.Fatal("Expected the form to be refused for a login that no longer meets the requirement")
+  }
+}
+
+func TestPasswordChange(t *testing.T) {
+  h := addHuman(t, "secret")
+  b := newBrowser(t)
+
+  p := b.login(b.get(ui.URL + "/password"), h.Email, "secret")
+  expectPath(t, p, "/password")
+
+  hydra.Clients["notes"] = "notes-secret"
+  b.authorizeClient("notes")
+
+  err := uiEnv.TrustedDevices.CreateDevice(devices.Device{ Id:"device-" + h.Id, HumanId:h.Id, ExpiresAt:time.Now().Add(time.Hour).Unix() })
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  p = b.submit(p, map[string]string{ "password":"velvet lantern orbit", "password_retyped":"velvet lantern orbit" })
+  expectRedirectTo(t, p, testMeuiUrl + "/profile")
+
+  if changed, _ := human(t, h.Id); changed.Password != "velvet lantern orbit" {
+    t.Fatal("Expected the password to be changed")
+  }
+  if hydra.Sessions(h.Id) != 0 || hydra.Tokens(h.Id) != 0 {
+    t.Fatal("Expected every session and token to be revoked")
+  }
+  if trusted, _ := uiEnv.TrustedDevices.ReadDevices(h.Id); len(trusted) != 0 {
+    t.Fatal("Expected the trusted devices to be revoked")
+  }
+
+  // The apps the human gave access keep it
+  consents, err := uiEnv.HydraApi.ReadConsentSessions(h.Id)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(consents) != 1 || consents[0].ConsentRequest.Client.ClientId != "notes" {
+    t.Fatalf("Expected only the consent of notes to be kept, got %d consents", len(consents))
+  }
+}
+
+func TestPasswordPolicy(t *testing.T) {
+  h := addHuman(t, "secret")
+  b := newBrowser(t)
+
+  p := b.login(b.get(ui.URL + "/password"), h.Email, "secret")
+  expectPath(t, p, "/password")
+  if strings.Contains(p.Body, "password-meter") == false {
+    t.Fatal("Expected the password strength meter")
+  }
+
+  for _, weak := range []string{ "short", "password1", "human" + strings.TrimPrefix(strings.Split(h.Email, "@")[0], "human") + " is me" } {
+    p = b.submit(p, map[string]string{ "password":weak, "password_retyped":weak })
+    expectPath(t, p, "/password")
+  }
+  if changed, _ := human(t, h.Id); changed.Password != "secret" {
+    t.Fatal("Expected a weak password to be rejected")
+  }
+  if strings.Contains(p.Body, "Must not contain your email, name or username") == false {
+    t.Fatalf("Expected the policy violation to be shown\n%s", p.Body)
+  }
+
+  token := regexp.MustCompile(`name="gorilla.csrf.Token" value="([^"]*)"`).FindStringSubmatch(p.Body)
+  if token == nil {
+    t.Fatal("No CSRF token on the password page")
+  }
+  req, err := http.NewRequest("POST", ui.URL + "/password/strength", strings.NewReader(url.Values{ "password":{"velvet lantern orbit"} }.Encode()))
+  if err != nil {
+    t.Fatal(err)
+  }
+  req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+  req.Header.Set("Referer", p.Url.String())
+  req.Header.Set("X-CSRF-Token", html.UnescapeString(token[1]))
+  strength := b.do(req)
+  if strength.Status != http.StatusOK || strings.Contains(strength.Body, `"violations":[]`) == false {
+    t.Fatalf("Expected a strong password, got status %d: %s", strength.Status, strength.Body)
+  }
+}
+
+func TestBreachedPassword(t *testing.T) {
+  h := addHuman(t, "secret")
+  b := newBrowser(t)
+
+  p := b.login(b.get(ui.URL + "/password"), h.Email, "secret")
+  expectPath(t, p, "/password")
+
+  // Warned, the risk must be accepted
+  p = b.submit(p, map[string]string{ "password":testBreachedPassword, "password_retyped":testBreachedPassword })
+  expectPath(t, p, "/password")
+  if strings.Contains(p.Body, "found in a data breach") == false || strings.Contains(p.Body, `name="risk_accepted"`) == false {
+    t.Fatalf("Expected the breach warning\n%s", p.Body)
+  }
+
+  // Blocked, accepting the risk is not enough
+  uiEnv.PasswordBreachPolicy = "block"
+  p = b.submit(p, map[string]string{ "password":testBreachedPassword, "password_retyped":testBreachedPassword, "risk_accepted":"on" })
+  uiEnv.PasswordBreachPolicy = "warn"
+  expectPath(t, p, "/password")
+  if strings.Contains(p.Body, "Found in a data breach, choose another") == false {
+    t.Fatalf("Expected the breached password to be refused\n%s", p.Body)
+  }
+  if changed, _ := human(t, h.Id); changed.Password != "secret" {
+    t.Fatal("Expected the breached password to be refused")
+  }
+
+  p = b.submit(p, map[string]string{ "password":testBreachedPassword, "password_retyped":testBreachedPassword, "risk_accepted":"on" })
+  expectRedirectTo(t, p, testMeuiUrl + "/profile")
+  if changed, _ := human(t, h.Id); changed.Password != testBreachedPassword {
+    t.Fatal("Expected the password to be changed once the risk was accepted")
+  }
+}
+
+// unavailableBreaches fails every check, as a range api that cannot be reached.
+type unavailableBreaches struct{}
+
+func (unavailableBreaches) Breached(password string) (bool, error) {
+  return false, errors.New("range api unreachable")
+}
+
+func TestBreachedPasswordCheckFails(t *testing.T) {
+  breaches := uiEnv.PasswordBreaches
+  uiEnv.PasswordBreaches = unavailableBreaches{}
+  defer func() { uiEnv.PasswordBreaches = breaches }()
+
+  h := addHuman(t, "secret")
+  b := newBrowser(t)
+
+  p := b.login(b.get(ui.URL + "/password"), h.Email, "secret")
+  expectPath(t, p, "/password")
+
+  // Refused by default, the password could be breached
+  q := b.submit(p, map[string]string{ "password":"velvet lantern orbit", "password_retyped":"velvet lantern orbit" })
+  if q.Status != http.StatusInternalServerError {
+    t.Fatalf("Expected the password to be refused, got status %d on %s", q.Status, q.Url)
+  }
+  if changed, _ := human(t, h.Id); changed.Password != "secret" {
+    t.Fatal("Expected the password to be unchanged")
+  }
+
+  uiEnv.PasswordBreachFailOpen = true
+  defer func() { uiEnv.PasswordBreachFailOpen = false }()
+
+  q = b.submit(p, map[string]string{ "password":"velvet lantern orbit", "password_retyped":"velvet lantern orbit" })
+  expectRedirectTo(t, q, testMeuiUrl + "/profile")
+  if changed, _ := human(t, h.Id); changed.Password != "velvet lantern orbit" {
+    t.Fatal("Expected the password to be changed unchecked")
+  }
+}
+
+func TestEmailChange(t *testing.T) {
+  h := addHuman(t, "secret")
+  b := newBrowser(t)
+
+  p := b.login(b.get(ui.URL + "/emailchange"), h.Email, "secret")
+  expectPath(t, p, "/emailchange")
+
+  email := "changed." + h.Email
+  p = b.submit(p, map[string]string{ "email":email })
+  expectPath(t, p, "/emailchangeconfirm")
+  if hydra.Tokens(h.Id) != 1 {
+    t.Fatalf("Expected only the access token of the confirmation, got %d", hydra.Tokens(h.Id))
+  }
+
+  p = b.submit(p, map[string]string{ "code":fakeIdp.Code(p.Url.Query().Get("state")) })
+  expectRedirectTo(t, p, testMeuiUrl + "/profile")
+  if hydra.Tokens(h.Id) != 0 {
+    t.Fatal("Expected the access token to be revoked")
+  }
+
+  if changed, _ := human(t, h.Id); changed.Email != email {
+    t.Fatalf("Expected email %s, got %s", email, changed.Email)
+  }
+}
+
+func TestRecover(t *testing.T) {
+  h := addHuman(t, "forgotten")
+
+  // Someone knowing the old password is logged in
+  other := newBrowser(t)
+  p := other.login(other.get(ui.URL + "/password"), h.Email, "forgotten")
+  expectPath(t, p, "/password")
+
+  b := newBrowser(t)
+
+  p = b.get(ui.URL + "/recover")
+  expectPath(t, p, "/recover")
+
+  p = b.submit(p, map[string]string{ "email":h.Email })
+  expectPath(t, p, "/recoverconfirm")
+
+  p = b.submit(p, map[string]string{ "code":fakeIdp.Code(p.Url.Query().Get("recover_challenge")) })
+  expectPath(t, p, "/recover/password")
+
+  // Only the browser that confirmed the code may choose the password
+  if q := other.get(p.Url.String()); q.Url.Path != "/recover" {
+    t.Fatalf("Expected another browser to start over, got %s", q.Url)
+  }
+
+  p = b.submit(p, map[string]string{ "password":"quiet harbor compass", "password_retyped":"mistyped" })
+  expectPath(t, p, "/recover/password")
+
+  p = b.submit(p, map[string]string{ "password":"quiet harbor compass", "password_retyped":"quiet harbor compass" })
+  expectRedirectTo(t, p, testMeuiUrl + "/profile")
+
+  if hydra.Sessions(h.Id) != 0 || hydra.Tokens(h.Id) != 0 {
+    t.Fatal("Expected sessions and tokens to be revoked")
+  }
+
+  p = other.get(ui.URL + "/password")
+  expectPath(t, p, "/login")
+
+  p = b.login(b.get(ui.URL + "/password"), h.Email, "quiet harbor compass")
+  expectPath(t, p, "/password")
+}
+
+func TestRecoverWithTotpReset(t *testing.T) {
+  h := addHuman(t, "forgotten")
+  h.TotpRequired = true
+  h.TotpSecret = "lost"
+  fakeIdp.AddHuman(h)
+
+  b := newBrowser(t)
+
+  p := b.submit(b.get(ui.URL + "/recover"), map[string]string{ "email":h.Email })
+  p = b.submit(p, map[string]string{ "code":fakeIdp.Code(p.Url.Query().Get("recover_challenge")) })
+  expectPath(t, p, "/recover/password")
+
+  if strings.Contains(p.Body, `name="reset_totp"`) {
+    t.Fatal("Expected no TOTP reset unless password.recover.resetTotp allows it")
+  }
+
+  // Control of the email alone does not remove the second factor
+  p = b.submit(p, map[string]string{ "password":"quiet harbor compass", "password_retyped":"quiet harbor compass", "reset_totp":"on" })
+  expectRedirectTo(t, p, testMeuiUrl + "/profile")
+
+  if recovered, _ := human(t, h.Id); recovered.TotpRequired == false || recovered.TotpSecret != "lost" {
+    t.Fatal("Expected TOTP to be kept")
+  }
+
+  uiEnv.RecoverResetTotp = true
+  defer func() { uiEnv.RecoverResetTotp = false }()
+
+  p = b.submit(b.get(ui.URL + "/recover"), map[string]string{ "email":h.Email })
+  p = b.submit(p, map[string]string{ "code":fakeIdp.Code(p.Url.Query().Get("recover_challenge")) })
+  expectPath(t, p, "/recover/password")
+  if strings.Contains(p.Body, `name="reset_totp"`) == false {
+    t.Fatal("Expected to be offered the TOTP reset")
+  }
+
+  p = b.submit(p, map[string]string{ "password":"quiet harbor compass", "password_retyped":"quiet harbor compass", "reset_totp":"on" })
+  expectRedirectTo(t, p, testMeuiUrl + "/profile")
+
+  if recovered, _ := human(t, h.Id); recovered.TotpRequired || recovered.TotpSecret == "lost" {
+    t.Fatal("Expected TOTP to be reset")
+  }
+}
+
+// unavailableTotp is the fake idp failing to update TOTP.
+type unavailableTotp struct {
+  app.IdpApi
+}
+
+func (unavailableTotp) UpdateHumansTotp(client *idp.IdpClient, url string, requests []idp.UpdateHumansTotpRequest) (int, bulky.Responses, error) {
+  return http.StatusServiceUnavailable, nil, nil
+}
+
+func TestRecoverWithTotpResetFailed(t *testing.T) {
+  h := addHuman(t, "forgotten")
+  h.TotpRequired = true
+  h.TotpSecret = "lost"
+  fakeIdp.AddHuman(h)
+
+  uiEnv.RecoverResetTotp = true
+  uiEnv.IdpApi = unavailableTotp{ fakeIdp }
+  defer func() {
+    uiEnv.RecoverResetTotp = false
+    uiEnv.IdpApi = fakeIdp
+  }()
+
+  b := newBrowser(t)
+  p := b.submit(b.get(ui.URL + "/recover"), map[string]string{ "email":h.Email })
+  p = b.submit(p, map[string]string{ "code":fakeIdp.Code(p.Url.Query().Get("recover_challenge")) })
+  p = b.submit(p, map[string]string{ "password":"quiet harbor compass", "password_retyped":"quiet harbor compass", "reset_totp":"on" })
+  if p.Status != http.StatusInternalServerError {
+    t.Fatalf("Expected the recover to fail, got status %d on %s", p.Status, p.Url)
+  }
+
+  // Nothing is half recovered, the password is only changed once TOTP was reset
+  uiEnv.IdpApi = fakeIdp
+  if recovered, _ := human(t, h.Id); recovered.TotpRequired == false || recovered.TotpSecret != "lost" {
+    t.Fatal("Expected TOTP to be kept")
+  }
+
+  q := newBrowser(t)
+  p = q.login(q.get(ui.URL + "/password"), h.Email, "forgotten")
+  expectPath(t, p, "/verify")
+}
+
+func TestClaimAndRegister(t *testing.T) {
+  email := "invited@example.com"
+  _, _, err := fakeIdp.CreateInvites(nil, "", []idp.CreateInvitesRequest{ {Email:email} })
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  b := newBrowser(t)
+
+  p := b.get(ui.URL + "/claim")
+  expectPath(t, p, "/claim")
+
+  p = b.submit(p, map[string]string{ "email":email })
+  expectPath(t, p, "/emailconfirm")
+
+  p = b.submit(p, map[string]string{ "code":fakeIdp.Code(p.Url.Query().Get("email_challenge")) })
+  expectPath(t, p, "/register")
+
+  p = b.submit(p, map[string]string{ "display-name":"Invited", "username":"invited", "password":"maple thunder ribbon", "password_retyped":"maple thunder ribbon" })
+  expectRedirectTo(t, p, testMeuiUrl + "/profile")
+
+  p = b.login(b.get(ui.URL + "/password"), email, "maple thunder ribbon")
+  expectPath(t, p, "/password")
+}
+
+func TestRegisterChallengeIsUuid(t *testing.T) {
+  email := "malformed@example.com"
+  _, _, err := fakeIdp.CreateInvites(nil, "", []idp.CreateInvitesRequest{ {Email:email} })
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  b := newBrowser(t)
+  p := b.submit(b.get(ui.URL + "/claim"), map[string]string{ "email":email })
+  p = b.submit(p, map[string]string{ "code":fakeIdp.Code(p.Url.Query().Get("email_challenge")) })
+  expectPath(t, p, "/register")
+
+  // The idp knows the confirmed claim by another id, the form only accepts uuids
+  m := regexp.MustCompile(`name="challenge" value="([^"]+)"`).FindStringSubmatch(p.Body)
+  if m == nil {
+    t.Fatalf("Expected the claim challenge on the form\n%s", p.Body)
+  }
+  challenge, exists := fakeIdp.Challenges[m[1]]
+  if exists == false || challenge.Subject == "" {
+    t.Fatalf("Expected the idp to know the challenge %s", m[1])
+  }
+  challenge.OtpChallenge = "claim-" + challenge.OtpChallenge
+  fakeIdp.Challenges[challenge.OtpChallenge] = challenge
+
+  p = b.submit(p, map[string]string{ "challenge":challenge.OtpChallenge, "display-name":"Malformed", "password":"maple thunder ribbon", "password_retyped":"maple thunder ribbon" })
+  expectPath(t, p, "/register")
+  if _, exists := human(t, challenge.Subject); exists {
+    t.Fatal("Expected a challenge that is not a uuid to be refused")
+  }
+}
+
+func TestDelete(t *testing.T) {
+  h := addHuman(t, "secret")
+  b := newBrowser(t)
+
+  p := b.login(b.get(ui.URL + "/delete"), h.Email, "secret")
+  expectPath(t, p, "/delete")
+
+  p = b.submit(p, map[string]string{ "risk_accepted":"on" })
+  expectPath(t, p, "/deleteconfirm")
+
+  p = b.submit(p, map[string]string{ "code":fakeIdp.Code(p.Url.Query().Get("delete_challenge")) })
+  expectPath(t, p, "/seeyoulater")
+
+  if _, exists := human(t, h.Id); exists {
+    t.Fatal("Expected the human to be deleted")
+  }
+  if hydra.Sessions(h.Id) != 0 || hydra.Tokens(h.Id) != 0 {
+    t.Fatal("Expected every session and token to be revoked")
+  }
+}
+
+func TestLogout(t *testing.T) {
+  h := addHuman(t, "secret")
+  b := newBrowser(t)
+
+  p := b.login(b.get(ui.URL + "/password"), h.Email, "secret")
+  expectPath(t, p, "/password")
+
+  // The access token rendered into the form stays valid until logout
+  if hydra.Tokens(h.Id) != 1 {
+    t.Fatalf("Expected the access token of the form, got %d", hydra.Tokens(h.Id))
+  }
+
+  p = b.get(hydra.EndSessionUrl("", "", ""))
+  expectPath(t, p, "/logout")
+
+  p = b.submit(p, nil)
+  expectPath(t, p, "/seeyoulater")
+  if hydra.Tokens(h.Id) != 0 {
+    t.Fatal("Expected the access token to be revoked")
+  }
+
+  // Hydra forgot the login
+  p = b.get(ui.URL + "/password")
+  expectPath(t, p, "/login")
+}
@@ -0,0 +1,39 @@
+// Live password strength meter. Scores are computed by the server with the same policy that is enforced on submit, see /password/strength
+$(function() {
+  $('.password-meter').each(function() {
+    var meter = $(this);
+    var form = meter.closest('form');
+    var input = form.find('input[name="password"]');
+    var timer = null;
+
+    meter.progress({ total: 4, value: 0, showActivity: false });
+
+    input.on('input', function() {
+      clearTimeout(timer);
+      timer = setTimeout(function() {
+        var password = input.val();
+        if (password === '') {
+          meter.progress('set progress', 0);
+          meter.progress('set label', '');
+          return;
+        }
+
+        $.ajax({
+          url: meter.data('url'),
+          method: 'POST',
+          headers: { 'X-CSRF-Token': form.find('input[name="gorilla.csrf.Token"]').val() },
+          data: {
+            password: password,
+            'display-name': form.find('input[name="display-name"]').val() || '',
+            username: form.find('input[name="username"]').val() || ''
+          }
+        }).done(function(strength) {
+          var colors = ['red', 'orange', 'yellow', 'olive', 'green'];
+          meter.removeClass(colors.join(' ')).addClass(colors[strength.score]);
+          meter.progress('set progress', strength.score);
+          meter.progress('set label', strength.violations.length > 0 ? strength.label + ': ' + strength.violations.join(', ') : strength.label);
+        });
+      }, 250);
+    });
+  });
+});
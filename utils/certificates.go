@@ -0,0 +1,155 @@
+package utils
+
+import (
+  "os"
+  "sync"
+  "time"
+  "math/big"
+  "net"
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/tls"
+  "crypto/x509"
+  "crypto/x509/pkix"
+)
+
+// GenerateSelfSignedCertificate creates an in memory certificate valid for the given hosts (names or ip addresses). Only meant for local development.
+func GenerateSelfSignedCertificate(organization string, hosts []string, validFor time.Duration) (tls.Certificate, error) {
+  privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    return tls.Certificate{}, err
+  }
+
+  serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+  if err != nil {
+    return tls.Certificate{}, err
+  }
+
+  notBefore := time.Now()
+  template := x509.Certificate{
+    SerialNumber: serialNumber,
+    Subject: pkix.Name{
+      Organization: []string{organization},
+    },
+    NotBefore: notBefore,
+    NotAfter: notBefore.Add(validFor),
+    KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+    ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+    BasicConstraintsValid: true,
+  }
+
+  for _, h := range hosts {
+    if ip := net.ParseIP(h); ip != nil {
+      template.IPAddresses = append(template.IPAddresses, ip)
+    } else {
+      template.DNSNames = append(template.DNSNames, h)
+    }
+  }
+
+  der, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+  if err != nil {
+    return tls.Certificate{}, err
+  }
+
+  leaf, err := x509.ParseCertificate(der)
+  if err != nil {
+    return tls.Certificate{}, err
+  }
+
+  return tls.Certificate{
+    Certificate: [][]byte{der},
+    PrivateKey: privateKey,
+    Leaf: leaf,
+  }, nil
+}
+
+// CertificateReloader serves a certificate loaded from disk and reloads it when the files change, so renewed certificates take effect without a restart. Use GetCertificate in tls.Config.
+type CertificateReloader struct {
+  CertPath string
+  KeyPath string
+  CheckInterval time.Duration // How often the files are checked for changes during handshakes
+  ReloadFailed func(err error) // Told when changed files fail to load during a handshake, ex. to log it. Nil ignores it
+
+  mu sync.RWMutex
+  certificate *tls.Certificate
+  certModTime time.Time
+  keyModTime time.Time
+  lastCheck time.Time
+}
+
+func NewCertificateReloader(certPath string, keyPath string, checkInterval time.Duration) (*CertificateReloader, error) {
+  reloader := &CertificateReloader{
+    CertPath: certPath,
+    KeyPath: keyPath,
+    CheckInterval: checkInterval,
+  }
+  err := reloader.Reload()
+  if err != nil {
+    return nil, err
+  }
+  return reloader, nil
+}
+
+// Reload reads the certificate and key from disk. On error the current certificate is kept.
+func (r *CertificateReloader) Reload() error {
+  certInfo, err := os.Stat(r.CertPath)
+  if err != nil {
+    return err
+  }
+  keyInfo, err := os.Stat(r.KeyPath)
+  if err != nil {
+    return err
+  }
+
+  certificate, err := tls.LoadX509KeyPair(r.CertPath, r.KeyPath)
+  if err != nil {
+    return err
+  }
+
+  r.mu.Lock()
+  r.certificate = &certificate
+  r.certModTime = certInfo.ModTime()
+  r.keyModTime = keyInfo.ModTime()
+  r.lastCheck = time.Now()
+  r.mu.Unlock()
+  return nil
+}
+
+// Changed reports if the certificate or key file has been modified since last load.
+func (r *CertificateReloader) Changed() bool {
+  certInfo, err := os.Stat(r.CertPath)
+  if err != nil {
+    return false
+  }
+  keyInfo, err := os.Stat(r.KeyPath)
+  if err != nil {
+    return false
+  }
+
+  r.mu.RLock()
+  defer r.mu.RUnlock()
+  return !certInfo.ModTime().Equal(r.certModTime) || !keyInfo.ModTime().Equal(r.keyModTime)
+}
+
+func (r *CertificateReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+  r.mu.RLock()
+  check := time.Since(r.lastCheck) > r.CheckInterval
+  r.mu.RUnlock()
+
+  if check {
+    if r.Changed() {
+      err := r.Reload() // Keep serving the old certificate if the new one is broken, ex. while only one of the files has been written.
+      if err != nil && r.ReloadFailed != nil {
+        r.ReloadFailed(err)
+      }
+    }
+    r.mu.Lock()
+    r.lastCheck = time.Now()
+    r.mu.Unlock()
+  }
+
+  r.mu.RLock()
+  defer r.mu.RUnlock()
+  return r.certificate, nil
+}
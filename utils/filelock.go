@@ -0,0 +1,26 @@
+package utils
+
+import (
+  "os"
+  "syscall"
+)
+
+// LockFile takes an exclusive lock on path.lock, waiting while another process holds it. Processes that hold it around each read and write of the file at path can share that file without losing each other's writes. Call the returned func to release the lock.
+func LockFile(path string) (func(), error) {
+  f, err := os.OpenFile(path + ".lock", os.O_CREATE|os.O_RDWR, 0600)
+  if err != nil {
+    return nil, err
+  }
+
+  err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+  if err != nil {
+    f.Close()
+    return nil, err
+  }
+
+  unlock := func() {
+    syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+    f.Close()
+  }
+  return unlock, nil
+}
@@ -1,7 +1,7 @@
 package utils
 
 import (
-  "bytes"
+  "fmt"
   "strings"
   "net"
   "net/http"
@@ -25,8 +25,8 @@ func GetRequestIpData(r *http.Request) (IpData, error) {
   return ret, nil
 }
 
-func GetForwardedForIpData(r *http.Request) (IpData, error) {
-  ip, port := detectForwardedForIpAndPort(r)
+func GetForwardedForIpData(r *http.Request, trusted TrustedProxies) (IpData, error) {
+  ip, port := detectForwardedForIpAndPort(r, trusted)
 
   ret := IpData{
     Ip: ip,
@@ -35,79 +35,108 @@ func GetForwardedForIpData(r *http.Request) (IpData, error) {
   return ret, nil
 }
 
-type ipRange struct {
-    start net.IP
-    end net.IP
-}
+// TrustedProxies is the list of networks that are allowed to set X-Forwarded-* and X-Real-Ip headers. Requests from any other address have these headers ignored.
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies accepts CIDRs (10.0.0.0/8, fd00::/8) and single addresses (127.0.0.1, ::1) for both IPv4 and IPv6.
+func ParseTrustedProxies(proxies []string) (TrustedProxies, error) {
+  var trusted TrustedProxies
+  for _, p := range proxies {
+    p = strings.TrimSpace(p)
+    if p == "" {
+      continue
+    }
 
-// inRange - check to see if a given ip address is within a range given
-func inRange(r ipRange, ipAddress net.IP) bool {
-    // strcmp type byte comparison
-    if bytes.Compare(ipAddress, r.start) >= 0 && bytes.Compare(ipAddress, r.end) < 0 {
-        return true
+    if !strings.Contains(p, "/") {
+      ip := net.ParseIP(p)
+      if ip == nil {
+        return nil, fmt.Errorf("Invalid trusted proxy address %s", p)
+      }
+      if ip.To4() != nil {
+        p = p + "/32"
+      } else {
+        p = p + "/128"
+      }
     }
+
+    _, ipNet, err := net.ParseCIDR(p)
+    if err != nil {
+      return nil, err
+    }
+    trusted = append(trusted, ipNet)
+  }
+  return trusted, nil
+}
+
+func (t TrustedProxies) Contains(ip net.IP) bool {
+  if ip == nil {
     return false
+  }
+  for _, n := range t {
+    if n.Contains(ip) {
+      return true
+    }
+  }
+  return false
 }
 
-var privateRanges = []ipRange{
-    ipRange{
-        start: net.ParseIP("10.0.0.0"),
-        end:   net.ParseIP("10.255.255.255"),
-    },
-    ipRange{
-        start: net.ParseIP("100.64.0.0"),
-        end:   net.ParseIP("100.127.255.255"),
-    },
-    ipRange{
-        start: net.ParseIP("172.16.0.0"),
-        end:   net.ParseIP("172.31.255.255"),
-    },
-    ipRange{
-        start: net.ParseIP("192.0.0.0"),
-        end:   net.ParseIP("192.0.0.255"),
-    },
-    ipRange{
-        start: net.ParseIP("192.168.0.0"),
-        end:   net.ParseIP("192.168.255.255"),
-    },
-    ipRange{
-        start: net.ParseIP("198.18.0.0"),
-        end:   net.ParseIP("198.19.255.255"),
-    },
+// IsTrustedRequest reports if the direct peer of the request is a trusted proxy.
+func (t TrustedProxies) IsTrustedRequest(r *http.Request) bool {
+  if len(t) <= 0 {
+    return false
+  }
+  ip, _, err := net.SplitHostPort(r.RemoteAddr)
+  if err != nil {
+    ip = r.RemoteAddr
+  }
+  return t.Contains(net.ParseIP(ip))
 }
 
-// isPrivateSubnet - check to see if this ip is in a private subnet
-func isPrivateSubnet(ipAddress net.IP) bool {
-    // my use case is only concerned with ipv4 atm
-    if ipCheck := ipAddress.To4(); ipCheck != nil {
-        // iterate over all our ranges
-        for _, r := range privateRanges {
-            // check if this ip is in a private range
-            if inRange(r, ipAddress){
-                return true
-            }
-        }
+func detectForwardedForIpAndPort(r *http.Request, trusted TrustedProxies) (string, string) {
+  if trusted.IsTrustedRequest(r) == false {
+    return "", ""
+  }
+
+  for _, h := range []string{"X-Forwarded-For", "X-Real-Ip"} {
+    addresses := strings.Split(r.Header.Get(h), ",")
+    // march from right to left until we get an address that is not one of our proxies.
+    // that will be the address right before our proxy chain.
+    for i := len(addresses) -1 ; i >= 0; i-- {
+      // header can contain spaces too, strip those out.
+      ip := strings.TrimSpace(addresses[i])
+      realIP := net.ParseIP(ip)
+      if realIP == nil || trusted.Contains(realIP) {
+        continue
+      }
+      return ip, ""
     }
-    return false
+  }
+  return "", ""
 }
 
-func detectForwardedForIpAndPort(r *http.Request) (string, string) {
-    for _, h := range []string{"X-Forwarded-For", "X-Real-Ip"} {
-        addresses := strings.Split(r.Header.Get(h), ",")
-        // march from right to left until we get a public address
-        // that will be the address right before our proxy.
-        for i := len(addresses) -1 ; i >= 0; i-- {
-            ip := strings.TrimSpace(addresses[i])
-            // header can contain spaces too, strip those out.
-            realIP := net.ParseIP(ip)
-            if !realIP.IsGlobalUnicast() || isPrivateSubnet(realIP) {
-                // bad address, go to next
-                continue
-            }
-            return ip, ""
-        }
+// GetRequestBaseUrl returns scheme and host the client used to reach us. X-Forwarded-Proto and X-Forwarded-Host are only honored when the request comes from a trusted proxy.
+func GetRequestBaseUrl(r *http.Request, trusted TrustedProxies) *url.URL {
+  scheme := "http"
+  if r.TLS != nil {
+    scheme = "https"
+  }
+  host := r.Host
+
+  if trusted.IsTrustedRequest(r) {
+    if proto := firstHeaderValue(r, "X-Forwarded-Proto"); proto == "http" || proto == "https" {
+      scheme = proto
     }
-    return "", ""
+    if fhost := firstHeaderValue(r, "X-Forwarded-Host"); fhost != "" {
+      host = fhost
+    }
+  }
+
+  return &url.URL{ Scheme:scheme, Host:host }
+}
+
+func firstHeaderValue(r *http.Request, header string) string {
+  values := strings.Split(r.Header.Get(header), ",")
+  return strings.ToLower(strings.TrimSpace(values[0]))
 }
 
 func FetchSubmitUrlFromRequest(req *http.Request, q *url.Values) (string, error) {
@@ -0,0 +1,107 @@
+package utils
+
+import (
+  "testing"
+  "crypto/tls"
+  "net/http/httptest"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+  for _, test := range []struct{
+    proxies []string
+    networks []string
+    fails bool
+  }{
+    { []string{"10.0.0.0/8", "fd00::/8"}, []string{"10.0.0.0/8", "fd00::/8"}, false },
+    { []string{"127.0.0.1", "::1"}, []string{"127.0.0.1/32", "::1/128"}, false },
+    { []string{" 192.168.1.1 ", ""}, []string{"192.168.1.1/32"}, false },
+    { nil, nil, false },
+    { []string{"proxy.example"}, nil, true },
+    { []string{"10.0.0.0/33"}, nil, true },
+  } {
+    trusted, err := ParseTrustedProxies(test.proxies)
+    if (err != nil) != test.fails {
+      t.Errorf("%v: expected failing %v, got %v", test.proxies, test.fails, err)
+      continue
+    }
+
+    var networks []string
+    for _, n := range trusted {
+      networks = append(networks, n.String())
+    }
+    if len(networks) != len(test.networks) {
+      t.Errorf("%v: expected %v, got %v", test.proxies, test.networks, networks)
+      continue
+    }
+    for i := range networks {
+      if networks[i] != test.networks[i] {
+        t.Errorf("%v: expected %v, got %v", test.proxies, test.networks, networks)
+      }
+    }
+  }
+}
+
+func TestIsTrustedRequest(t *testing.T) {
+  trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8", "::1"})
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  for _, test := range []struct{
+    trusted TrustedProxies
+    remoteAddr string
+    expected bool
+  }{
+    { trusted, "10.1.2.3:4567", true },
+    { trusted, "[::1]:4567", true },
+    { trusted, "10.1.2.3", true }, // Without a port
+    { trusted, "192.168.1.1:4567", false },
+    { trusted, "[::2]:4567", false },
+    { trusted, "not an address", false },
+    { nil, "10.1.2.3:4567", false }, // No proxies trusted
+  } {
+    r := httptest.NewRequest("GET", "/", nil)
+    r.RemoteAddr = test.remoteAddr
+    if test.trusted.IsTrustedRequest(r) != test.expected {
+      t.Errorf("%s: expected trusted %v with %v", test.remoteAddr, test.expected, test.trusted)
+    }
+  }
+}
+
+func TestGetRequestBaseUrl(t *testing.T) {
+  trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8"})
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  for _, test := range []struct{
+    name string
+    remoteAddr string
+    tls bool
+    headers map[string]string
+    expected string
+  }{
+    { "plain", "10.1.2.3:4567", false, nil, "http://ui.internal" },
+    { "tls", "10.1.2.3:4567", true, nil, "https://ui.internal" },
+    { "forwarded by a proxy", "10.1.2.3:4567", false, map[string]string{ "X-Forwarded-Proto":"https", "X-Forwarded-Host":"ui.example" }, "https://ui.example" },
+    { "forwarded by a chain of proxies", "10.1.2.3:4567", false, map[string]string{ "X-Forwarded-Proto":"HTTPS, http", "X-Forwarded-Host":"ui.example, proxy.internal" }, "https://ui.example" },
+    { "forwarded unknown scheme", "10.1.2.3:4567", false, map[string]string{ "X-Forwarded-Proto":"ftp" }, "http://ui.internal" },
+    { "forwarded by anyone", "192.168.1.1:4567", false, map[string]string{ "X-Forwarded-Proto":"https", "X-Forwarded-Host":"evil.example" }, "http://ui.internal" },
+  } {
+    r := httptest.NewRequest("GET", "/login", nil)
+    r.Host = "ui.internal"
+    r.RemoteAddr = test.remoteAddr
+    if test.tls {
+      r.TLS = &tls.ConnectionState{}
+    } else {
+      r.TLS = nil
+    }
+    for k, v := range test.headers {
+      r.Header.Set(k, v)
+    }
+
+    if u := GetRequestBaseUrl(r, trusted); u.String() != test.expected {
+      t.Errorf("%s: expected %s, got %s", test.name, test.expected, u)
+    }
+  }
+}
@@ -0,0 +1,113 @@
+package validators
+
+import (
+  "fmt"
+  "strings"
+  "unicode"
+  "github.com/nbutton23/zxcvbn-go"
+)
+
+// # Password policy
+// Enforced on every page that sets a password: registration, password change and recovery. Built from password.policy in the configuration.
+// Strength is scored like zxcvbn from 0 (guessable) to 4 (very unguessable), taking the personal information of the human into account.
+
+type PasswordPolicy struct {
+  MinLength int
+  MaxLength int // The idp does not accept more than 55 characters
+
+  Lowercase bool // Require at least one of each class
+  Uppercase bool
+  Digits bool
+  Symbols bool
+
+  MinScore int // 0-4
+}
+
+// PasswordStrengthLabels describes the scores 0-4.
+var PasswordStrengthLabels = []string{"Very weak", "Weak", "Fair", "Strong", "Very strong"}
+
+// Score rates the password from 0 to 4. The personal information (email, name, username) makes passwords built from it score lower.
+func (p *PasswordPolicy) Score(password string, personal ...string) int {
+  if password == "" {
+    return 0
+  }
+  return zxcvbn.PasswordStrength(password, personalInputs(personal)).Score
+}
+
+// Check returns every rule of the policy the password breaks, worded for the human. Empty when the password is accepted.
+func (p *PasswordPolicy) Check(password string, personal ...string) (violations []string) {
+  length := len([]rune(password))
+  if length < p.MinLength {
+    violations = append(violations, fmt.Sprintf("At least %d characters", p.MinLength))
+  }
+  if p.MaxLength > 0 && length > p.MaxLength {
+    violations = append(violations, fmt.Sprintf("At most %d characters", p.MaxLength))
+  }
+
+  var lower, upper, digit, symbol bool
+  for _, r := range password {
+    switch {
+    case unicode.IsLower(r):
+      lower = true
+    case unicode.IsUpper(r):
+      upper = true
+    case unicode.IsDigit(r):
+      digit = true
+    default:
+      symbol = true
+    }
+  }
+  if p.Lowercase && lower == false {
+    violations = append(violations, "A lowercase letter")
+  }
+  if p.Uppercase && upper == false {
+    violations = append(violations, "An uppercase letter")
+  }
+  if p.Digits && digit == false {
+    violations = append(violations, "A digit")
+  }
+  if p.Symbols && symbol == false {
+    violations = append(violations, "A symbol")
+  }
+
+  lowered := strings.ToLower(password)
+  for _, input := range personalInputs(personal) {
+    if strings.Contains(lowered, input) {
+      violations = append(violations, "Must not contain your email, name or username")
+      break
+    }
+  }
+
+  if len(violations) == 0 {
+    score := p.Score(password, personal...)
+    if score < p.MinScore {
+      violations = append(violations, fmt.Sprintf("Too easy to guess (%s)", PasswordStrengthLabels[score]))
+    }
+  }
+
+  return violations
+}
+
+// personalInputs splits email, name and username into the lowercased parts a password could be built from. Parts shorter than 3 characters are ignored, they are too common to forbid.
+func personalInputs(personal []string) (inputs []string) {
+  for _, p := range personal {
+    p = strings.ToLower(strings.TrimSpace(p))
+    if p == "" {
+      continue
+    }
+
+    if at := strings.Index(p, "@"); at > 0 {
+      p = p[:at] // The domain is shared by many
+    }
+
+    parts := strings.FieldsFunc(p, func(r rune) bool {
+      return unicode.IsLetter(r) == false && unicode.IsDigit(r) == false
+    })
+    for _, part := range parts {
+      if len(part) >= 3 {
+        inputs = append(inputs, part)
+      }
+    }
+  }
+  return inputs
+}